@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RestoreResult records what RestoreAll did for one volume of the registry.
+type RestoreResult struct {
+	ID          string   `json:"id"`
+	Activated   bool     `json:"activated"`
+	MountPoints []string `json:"mount_points"`
+	// Err is the reason the volume could not be fully restored, nil on success.
+	Err error `json:"-"`
+}
+
+// ActivateVolume is used to attach an existing LUKS sparse file to a loop device and open it as a
+// dm-crypt volume, e.g. after a reboot. Unlike CreateVolume it never creates nor formats anything.
+//
+// Input Parameters:
+//
+// 	sparseFilePath – Absolute path of the sparse file holding the LUKS volume.
+//
+// 	deviceMapperLocation – Absolute path of the dm-crypt volume.
+//
+// 	key – The key used to open the dm-crypt volume.
+//
+// A volume already active on the sparse file is left as is. The loop device and the mapping are
+// removed again when a step fails. The registry record of the volume is refreshed with its new
+// loop device, a volume that cannot be recorded is kept open and the error is ErrNotRecorded.
+func ActivateVolume(sparseFilePath string, deviceMapperLocation string, key []byte) error {
+	return DefaultManager.ActivateVolume(sparseFilePath, deviceMapperLocation, key)
+}
+
+// ActivateVolumeContext is used to activate the volume like ActivateVolume, stopping when ctx is
+// done like CreateVolumeContext.
+func ActivateVolumeContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, key []byte) error {
+	return DefaultManager.ActivateVolumeContext(ctx, sparseFilePath, deviceMapperLocation, key)
+}
+
+// ActivateVolume activates the volume like the package level ActivateVolume.
+func (m *Manager) ActivateVolume(sparseFilePath string, deviceMapperLocation string, key []byte) error {
+	return m.ActivateVolumeContext(context.Background(), sparseFilePath, deviceMapperLocation, key)
+}
+
+// ActivateVolumeContext activates the volume like the package level ActivateVolumeContext.
+func (m *Manager) ActivateVolumeContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, key []byte) (err error) {
+	// input validation
+	if len(strings.TrimSpace(sparseFilePath)) <= 0 {
+		return errors.New("sparse file path not given")
+	}
+
+	if len(strings.TrimSpace(deviceMapperLocation)) <= 0 {
+		return errors.New("device mapper location not given")
+	}
+
+	if len(key) == 0 {
+		return errors.New("key not given")
+	}
+
+	unlock, err := m.lockVolume(ctx, sparseFilePath, deviceMapperLocation, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fileInfo, err := os.Stat(sparseFilePath)
+	if os.IsNotExist(err) {
+		return &VolumeError{Op: "activate", Path: sparseFilePath, Kind: ErrNotFound}
+	} else if err != nil {
+		return &VolumeError{Op: "activate", Path: sparseFilePath, Err: err}
+	}
+
+	status, err := m.volumeStatus(ctx, deviceMapperLocation)
+	if err != nil {
+		return err
+	}
+	if status.Active && !isSameFile(fileInfo, status.SparseFilePath) {
+		return &VolumeError{Op: "activate", Path: deviceMapperLocation, Kind: ErrAlreadyExists,
+			Err: fmt.Errorf("volume is active on %s", status.SparseFilePath)}
+	}
+
+	undo := &rollback{}
+	defer func() {
+		if err != nil {
+			err = undo.run(err)
+		}
+	}()
+
+	deviceLoop, err := m.attachLoop(ctx, sparseFilePath, undo)
+	if err != nil {
+		return err
+	}
+	if err = m.openVolume(ctx, deviceLoop, deviceMapperLocation, key, undo); err != nil {
+		return err
+	}
+
+	// the loop device usually changes across reboots, refresh the record of the volume, keeping
+	// the instance and image it was created for. The open volume is kept if that fails.
+	undo.commit()
+	if err = m.recordVolume(ctx, sparseFilePath, deviceMapperLocation, deviceLoop, nil); err != nil {
+		return &VolumeError{Op: "activate", Path: deviceMapperLocation, Kind: ErrNotRecorded, Err: err}
+	}
+	return nil
+}
+
+// RestoreAll is used to reactivate every volume of the registry and mount it again on the mount
+// points it had, e.g. after a reboot. Manager.StateDir must be set.
+//
+// Input Parameter:
+//
+// 	keyLookup – Returns the key of a volume from its registry ID.
+//
+// A volume that cannot be restored does not stop the others, its result holds the reason. The
+// error is only set when the registry cannot be read.
+func RestoreAll(keyLookup func(volumeID string) ([]byte, error)) ([]RestoreResult, error) {
+	return DefaultManager.RestoreAll(keyLookup)
+}
+
+// RestoreAllContext is used to restore the volumes like RestoreAll. The volumes not restored yet
+// when ctx is done are reported with an error wrapping ctx.Err().
+func RestoreAllContext(ctx context.Context, keyLookup func(volumeID string) ([]byte, error)) ([]RestoreResult, error) {
+	return DefaultManager.RestoreAllContext(ctx, keyLookup)
+}
+
+// RestoreAll restores the volumes like the package level RestoreAll.
+func (m *Manager) RestoreAll(keyLookup func(volumeID string) ([]byte, error)) ([]RestoreResult, error) {
+	return m.RestoreAllContext(context.Background(), keyLookup)
+}
+
+// RestoreAllContext restores the volumes like the package level RestoreAllContext.
+func (m *Manager) RestoreAllContext(ctx context.Context, keyLookup func(volumeID string) ([]byte, error)) ([]RestoreResult, error) {
+	if keyLookup == nil {
+		return nil, errors.New("key lookup not given")
+	}
+	records, err := m.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RestoreResult, 0, len(records))
+	for _, record := range records {
+		result := RestoreResult{ID: record.ID, MountPoints: []string{}}
+		result.Err = m.restoreVolume(ctx, record, keyLookup, &result)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// restoreVolume activates the recorded volume and mounts it on the recorded mount points it is
+// not mounted on yet.
+func (m *Manager) restoreVolume(ctx context.Context, record VolumeRecord, keyLookup func(volumeID string) ([]byte, error), result *RestoreResult) error {
+	if err := ctx.Err(); err != nil {
+		return &VolumeError{Op: "restore", Path: record.DeviceMapperLocation, Err: err}
+	}
+	// the volume was being deleted, it is left for Scan and Collect
+	if record.Deleting {
+		return &VolumeError{Op: "restore", Path: record.DeviceMapperLocation, Err: errors.New("volume deletion did not complete")}
+	}
+
+	key, err := keyLookup(record.ID)
+	if err != nil {
+		return &VolumeError{Op: "restore", Path: record.DeviceMapperLocation, Err: fmt.Errorf("error getting the key of volume %s: %w", record.ID, err)}
+	}
+	if err = m.ActivateVolumeContext(ctx, record.SparseFilePath, record.DeviceMapperLocation, key); err != nil {
+		return err
+	}
+	result.Activated = true
+
+	status, err := m.volumeStatus(ctx, record.DeviceMapperLocation)
+	if err != nil {
+		return err
+	}
+	mounted := map[string]bool{}
+	for _, point := range status.MountPoints {
+		mounted[point] = true
+	}
+	for _, point := range record.MountPoints {
+		if !mounted[point] {
+			if err = m.MountContext(ctx, record.DeviceMapperLocation, point); err != nil {
+				return err
+			}
+		}
+		result.MountPoints = append(result.MountPoints, point)
+	}
+	return nil
+}
+
+// isSameFile reports whether path is the file described by fileInfo.
+func isSameFile(fileInfo os.FileInfo, path string) bool {
+	if path == "" {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	return err == nil && os.SameFile(fileInfo, pathInfo)
+}
@@ -0,0 +1,261 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// wrongKey is refused by the scripted luksOpen of the activation tests
+var wrongKey = []byte("wrong key")
+
+// scriptActivation adds the status responses of a volume opened by ActivateVolume: the volume
+// is reported inactive until it is opened, unless active is set.
+func scriptActivation(r *ScriptedRunner, mapper, sparseFile string, active bool) {
+	if !active {
+		// checked before the loop device is attached and again before luksOpen
+		r.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status", mapper}, Times: 2, Result: cryptsetupStatus(mapper, false, "", "")})
+	}
+	r.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status", mapper}, Result: cryptsetupStatus(mapper, true, "/dev/loop9", sparseFile)})
+}
+
+// keyRunner refuses the wrong key in luksOpen and leaves the other commands to the
+// ScriptedRunner
+type keyRunner struct {
+	*ScriptedRunner
+}
+
+func (r keyRunner) RunContext(ctx context.Context, c Command) (CommandResult, error) {
+	result, err := r.ScriptedRunner.RunContext(ctx, c)
+	if err == nil && commandVerb(c) == "cryptsetup luksOpen" && bytes.Equal(c.Stdin, wrongKey) {
+		return CommandResult{ExitCode: cryptsetupExitWrongKey, Stderr: "No key available with this passphrase."}, nil
+	}
+	return result, err
+}
+
+func (r keyRunner) Run(c Command) (CommandResult, error) {
+	return r.RunContext(context.Background(), c)
+}
+
+func TestActivateVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          []byte
+		active       bool
+		otherFile    bool
+		noFile       bool
+		wantErr      error
+		wantOpened   bool
+		wantDetached bool
+	}{
+		{name: "inactive volume", key: []byte("key"), wantOpened: true},
+		{name: "already active", key: []byte("key"), active: true},
+		{name: "active on another file", key: []byte("key"), active: true, otherFile: true, wantErr: ErrAlreadyExists},
+		{name: "wrong key", key: wrongKey, wantErr: ErrWrongKey, wantDetached: true},
+		{name: "sparse file missing", key: []byte("key"), noFile: true, wantErr: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sparseFile := filepath.Join(dir, "vol.img")
+			if !tt.noFile {
+				if err := ioutil.WriteFile(sparseFile, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mapper := filepath.Join(dir, "mapper", "vol")
+			statusFile := sparseFile
+			if tt.otherFile {
+				statusFile = filepath.Join(dir, "other.img")
+				if err := ioutil.WriteFile(statusFile, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			scripted := &ScriptedRunner{}
+			scriptActivation(scripted, mapper, statusFile, tt.active)
+			loops := newFakeLoop()
+			m := &Manager{Runner: keyRunner{scripted}, Loop: loops, LockDir: filepath.Join(dir, "locks"), StateDir: filepath.Join(dir, "state")}
+
+			// the volume was created for an instance before a reboot
+			if err := m.recordVolume(context.Background(), sparseFile, mapper, "/dev/loop3", &VolumeOptions{InstanceID: "vm-1", ImageID: "image-1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.recordMount(context.Background(), mapper, "/mnt/vol"); err != nil {
+				t.Fatal(err)
+			}
+			before, err := m.LookupVolume("vol")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = m.ActivateVolume(sparseFile, mapper, tt.key)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("ActivateVolume failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			opened := false
+			for _, c := range scripted.Commands() {
+				if commandVerb(c) == "cryptsetup luksOpen" {
+					opened = !bytes.Equal(c.Stdin, wrongKey)
+				}
+			}
+			if opened != tt.wantOpened {
+				t.Errorf("opened the volume: %v, want %v", opened, tt.wantOpened)
+			}
+			if detached := len(loops.detached) > 0; detached != tt.wantDetached {
+				t.Errorf("detached %q, want a detach: %v", loops.detached, tt.wantDetached)
+			}
+
+			// the record gets the new loop device and keeps what it was created with
+			record, err := m.LookupVolume("vol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLoop := before.LoopDevice
+			if tt.wantErr == nil {
+				wantLoop = "/dev/loop0"
+			}
+			if record.LoopDevice != wantLoop || record.InstanceID != "vm-1" || record.ImageID != "image-1" ||
+				!reflect.DeepEqual(record.MountPoints, []string{"/mnt/vol"}) || !record.Created.Equal(before.Created) {
+				t.Errorf("record %+v, want the loop device %s and the fields of %+v", record, wantLoop, before)
+			}
+		})
+	}
+}
+
+func TestRestoreAll(t *testing.T) {
+	dir := t.TempDir()
+	mapper := func(id string) string { return filepath.Join(dir, "mapper", id) }
+	sparseFile := func(id string) string { return filepath.Join(dir, id+".img") }
+	// a is restored, b has no key, c has a wrong key, d is active and mounted already, the
+	// sparse file of e is gone
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := ioutil.WriteFile(sparseFile(id), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fakeSysBlock(t, nil, "98 22 253:3 / /mnt/d rw,relatime - ext4 "+mapper("d")+" rw")
+
+	scripted := &ScriptedRunner{}
+	for _, id := range []string{"a", "b", "c", "e"} {
+		scriptActivation(scripted, mapper(id), sparseFile(id), false)
+	}
+	scriptActivation(scripted, mapper("d"), sparseFile("d"), true)
+	loops := newFakeLoop()
+	m := &Manager{Runner: keyRunner{scripted}, Loop: loops, LockDir: filepath.Join(dir, "locks"), StateDir: filepath.Join(dir, "state")}
+
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := m.recordVolume(ctx, sparseFile(id), mapper(id), "/dev/loop8", &VolumeOptions{InstanceID: "vm-" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.recordMount(ctx, mapper("d"), "/mnt/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	keyLookup := func(id string) ([]byte, error) {
+		switch id {
+		case "b":
+			return nil, errors.New("no key in the keyring")
+		case "c":
+			return wrongKey, nil
+		}
+		return []byte("key of " + id), nil
+	}
+	results, err := m.RestoreAll(keyLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		id          string
+		activated   bool
+		mountPoints []string
+		wantErr     error
+	}{
+		{id: "a", activated: true, mountPoints: []string{}},
+		{id: "b", mountPoints: []string{}},
+		{id: "c", mountPoints: []string{}, wantErr: ErrWrongKey},
+		{id: "d", activated: true, mountPoints: []string{"/mnt/d"}},
+		{id: "e", mountPoints: []string{}, wantErr: ErrNotFound},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		result := results[i]
+		if result.ID != w.id || result.Activated != w.activated || !reflect.DeepEqual(result.MountPoints, w.mountPoints) {
+			t.Errorf("result %+v, want %+v", result, w)
+		}
+		if (result.Err == nil) != w.activated {
+			t.Errorf("result of %s error = %v", w.id, result.Err)
+		}
+		if w.wantErr != nil && !errors.Is(result.Err, w.wantErr) {
+			t.Errorf("result of %s error = %v, want %v", w.id, result.Err, w.wantErr)
+		}
+	}
+
+	// the loop device of the failed activation is detached again, the others stay attached
+	if !reflect.DeepEqual(loops.detached, []string{"/dev/loop1"}) {
+		t.Errorf("detached %q, want the loop device of c", loops.detached)
+	}
+	for _, id := range []string{"a", "d"} {
+		record, err := m.LookupVolume(id)
+		if err != nil || record.InstanceID != "vm-"+id {
+			t.Errorf("record of %s after RestoreAll = %+v, %v", id, record, err)
+		}
+	}
+}
+
+func TestRestoreAllCanceled(t *testing.T) {
+	dir := t.TempDir()
+	scripted := &ScriptedRunner{}
+	m := &Manager{Runner: scripted, Loop: newFakeLoop(), LockDir: filepath.Join(dir, "locks"), StateDir: filepath.Join(dir, "state")}
+	for _, id := range []string{"a", "b"} {
+		if err := m.recordVolume(context.Background(), filepath.Join(dir, id+".img"), filepath.Join(dir, "mapper", id), "/dev/loop0", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded := len(scripted.Commands())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := m.RestoreAllContext(ctx, func(string) ([]byte, error) { return []byte("key"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.Activated || !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("result %+v, want an error wrapping %v", result, context.Canceled)
+		}
+	}
+	if got := scripted.Commands(); len(got) != recorded {
+		t.Errorf("ran %v after ctx was canceled", got[recorded:])
+	}
+}
+
+func TestRestoreAllWithoutKeyLookup(t *testing.T) {
+	m := &Manager{StateDir: t.TempDir()}
+	if _, err := m.RestoreAll(nil); err == nil {
+		t.Error("RestoreAll(nil) succeeded")
+	}
+}
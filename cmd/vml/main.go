@@ -5,14 +5,17 @@
 package main
 
 import (
+	"bufio"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"intel/isecl/lib/common/v4/crypt"
 	"intel/isecl/lib/common/v4/pkg/instance"
 	"intel/isecl/lib/common/v4/validation"
 	"intel/isecl/lib/vml/v4"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -21,6 +24,16 @@ type instanceManifest struct {
 	Manifest instance.Manifest `json:"instance_manifest"`
 }
 
+type vmManifest struct {
+	Manifest vml.VMManifest `json:"instance_manifest"`
+}
+
+// environment variable holding the state directory of the volume registry
+const stateDirEnv = "VML_STATE_DIR"
+
+// environment variable selecting the crypt backend, cryptsetup or native
+const cryptBackendEnv = "VML_CRYPT_BACKEND"
+
 func main() {
 
 	if len(os.Args[0:]) < 2 {
@@ -37,15 +50,31 @@ func main() {
 	var methodName = os.Args[1]
 	var err error
 
+	// volumes are recorded in the registry when a state directory is configured
+	vml.DefaultManager.StateDir = os.Getenv(stateDirEnv)
+	vml.DefaultManager.CryptBackend = vml.CryptBackend(os.Getenv(cryptBackendEnv))
+
 	switch methodName {
 	case "CreateVolume":
 		fmt.Println("Creating dm-crypt volume...")
 		if len(os.Args[1:]) < 5 {
 			fmt.Println("Invalid arguments")
-			fmt.Printf("Usage : %s CreateVolume sparseFilePath deviceMapperLocation key diskSize\n", os.Args[0])
+			fmt.Printf("Usage : %s CreateVolume sparseFilePath deviceMapperLocation key diskSize [--integrity algorithm]\n", os.Args[0])
 			os.Exit(1)
 		}
 
+		// the integrity algorithm, hmac-sha256, hmac-sha512 or aead, formats the volume with
+		// authenticated encryption, other extra arguments are ignored as they always were
+		var opts vml.VolumeOptions
+		if len(os.Args) > 6 && os.Args[6] == "--integrity" {
+			if len(os.Args) < 8 {
+				fmt.Println("Invalid arguments")
+				fmt.Printf("Usage : %s CreateVolume sparseFilePath deviceMapperLocation key diskSize [--integrity algorithm]\n", os.Args[0])
+				os.Exit(1)
+			}
+			opts.Integrity = os.Args[7]
+		}
+
 		inputArr := []string{os.Args[2], os.Args[3], os.Args[5]}
 		if validateInputErr := validation.ValidateStrings(inputArr); validateInputErr != nil {
 			fmt.Println("Invalid string format")
@@ -64,7 +93,7 @@ func main() {
 		}
 
 		size, _ := strconv.Atoi(os.Args[5])
-		if err = vml.CreateVolume(os.Args[2], os.Args[3], key, size); err != nil {
+		if err = vml.CreateVolumeWithOptions(os.Args[2], os.Args[3], key, size, opts); err != nil {
 			fmt.Printf("Error creating the dm-crypt volume: %s\n", err.Error())
 			os.Exit(1)
 		} else {
@@ -136,6 +165,276 @@ func main() {
 		fmt.Printf("Unmounted %s successfully\n", os.Args[2])
 		os.Exit(0)
 
+	case "Status":
+		if len(os.Args[1:]) < 2 {
+			fmt.Println("Invalid arguments")
+			fmt.Printf("Usage : %s Status deviceMapperLocation\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		inputArr := []string{os.Args[2]}
+		if validateInputErr := validation.ValidateStrings(inputArr); validateInputErr != nil {
+			fmt.Println("Invalid string format")
+			os.Exit(1)
+		}
+
+		status, err := vml.GetVolumeStatus(os.Args[2])
+		if err != nil {
+			fmt.Printf("Error getting the status of the dm-crypt volume: %s\n", err.Error())
+			os.Exit(1)
+		}
+		statusOutput, err := json.Marshal(status)
+		if err != nil {
+			fmt.Println("Error serializing the volume status")
+			os.Exit(1)
+		}
+		fmt.Println(string(statusOutput))
+		os.Exit(0)
+
+	case "List":
+		volumes, err := vml.ListVolumes()
+		if err == vml.ErrRegistryDisabled {
+			fmt.Printf("Error listing the volumes: %s, set %s to the state directory\n", err.Error(), stateDirEnv)
+			os.Exit(1)
+		} else if err != nil {
+			fmt.Printf("Error listing the volumes: %s\n", err.Error())
+			os.Exit(1)
+		}
+		listOutput, err := json.Marshal(volumes)
+		if err != nil {
+			fmt.Println("Error serializing the volume list")
+			os.Exit(1)
+		}
+		fmt.Println(string(listOutput))
+		os.Exit(0)
+
+	case "Scan":
+		report, err := vml.Scan()
+		if err != nil {
+			fmt.Printf("Error scanning for orphaned resources: %s\n", err.Error())
+			os.Exit(1)
+		}
+		scanOutput, err := json.Marshal(report)
+		if err != nil {
+			fmt.Println("Error serializing the scan report")
+			os.Exit(1)
+		}
+		fmt.Println(string(scanOutput))
+		os.Exit(0)
+
+	case "GC":
+		// dry run unless --apply is given, mappings, loop devices and sparse files are only
+		// cleaned up on request
+		policy := vml.CollectPolicy{ForgetStaleRecords: true}
+		for _, arg := range os.Args[2:] {
+			switch arg {
+			case "--apply":
+				policy.Apply = true
+			case "--close-mappers":
+				policy.CloseMappers = true
+			case "--detach-loops":
+				policy.DetachLoops = true
+			case "--remove-sparse-files":
+				policy.RemoveSparseFiles = true
+			default:
+				fmt.Println("Invalid arguments")
+				fmt.Printf("Usage : %s GC [--apply] [--close-mappers] [--detach-loops] [--remove-sparse-files]\n", os.Args[0])
+				os.Exit(1)
+			}
+		}
+
+		report, err := vml.Scan()
+		if err != nil {
+			fmt.Printf("Error scanning for orphaned resources: %s\n", err.Error())
+			os.Exit(1)
+		}
+		actions, err := vml.Collect(report, policy)
+		if err != nil {
+			fmt.Printf("Error cleaning up orphaned resources: %s\n", err.Error())
+			os.Exit(1)
+		}
+		gcOutput, err := json.Marshal(actions)
+		if err != nil {
+			fmt.Println("Error serializing the clean up actions")
+			os.Exit(1)
+		}
+		fmt.Println(string(gcOutput))
+		failed := false
+		for _, action := range actions {
+			if action.Err != nil {
+				fmt.Printf("Error during %s of %s: %s\n", action.Action, action.Target, action.Err.Error())
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+
+	case "BackupHeader", "RestoreHeader", "VerifyHeader":
+		if len(os.Args[1:]) < 3 {
+			fmt.Println("Invalid arguments")
+			fmt.Printf("Usage : %s %s sparseFilePath headerBackupPath\n", os.Args[0], methodName)
+			os.Exit(1)
+		}
+
+		inputArr := []string{os.Args[2], os.Args[3]}
+		if validateInputErr := validation.ValidateStrings(inputArr); validateInputErr != nil {
+			fmt.Println("Invalid string format")
+			os.Exit(1)
+		}
+
+		switch methodName {
+		case "BackupHeader":
+			fmt.Println("Backing up the LUKS header...")
+			if err = vml.BackupHeader(os.Args[2], os.Args[3]); err != nil {
+				fmt.Printf("Error backing up the LUKS header: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("LUKS header backed up successfully in %s\n", os.Args[3])
+		case "RestoreHeader":
+			fmt.Println("Restoring the LUKS header...")
+			if err = vml.RestoreHeader(os.Args[2], os.Args[3]); err != nil {
+				fmt.Printf("Error restoring the LUKS header: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("LUKS header of %s restored successfully\n", os.Args[2])
+		case "VerifyHeader":
+			info, err := vml.VerifyHeader(os.Args[2], os.Args[3])
+			if err != nil {
+				fmt.Printf("Error verifying the LUKS header backup: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("LUKS header backup %s matches volume %s (sha256 %s)\n", os.Args[3], info.LUKSUUID, info.SHA256)
+		}
+		os.Exit(0)
+
+	case "CreateVerityVolume":
+		fmt.Println("Building the dm-verity hash tree...")
+		if len(os.Args[1:]) < 3 {
+			fmt.Println("Invalid arguments")
+			fmt.Printf("Usage : %s CreateVerityVolume dataFile hashFile\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		inputArr := []string{os.Args[2], os.Args[3]}
+		if validateInputErr := validation.ValidateStrings(inputArr); validateInputErr != nil {
+			fmt.Println("Invalid string format")
+			os.Exit(1)
+		}
+
+		verityVolume, err := vml.CreateVerityVolume(os.Args[2], os.Args[3])
+		if err != nil {
+			fmt.Printf("Error building the dm-verity hash tree: %s\n", err.Error())
+			os.Exit(1)
+		}
+		verityOutput, err := json.Marshal(verityVolume)
+		if err != nil {
+			fmt.Println("Error serializing the dm-verity volume")
+			os.Exit(1)
+		}
+		fmt.Println(string(verityOutput))
+		os.Exit(0)
+
+	case "OpenVerityVolume":
+		fmt.Println("Opening the dm-verity volume...")
+		if len(os.Args[1:]) != 5 && len(os.Args[1:]) != 7 {
+			fmt.Println("Invalid arguments")
+			fmt.Printf("Usage : %s OpenVerityVolume dataFile hashFile rootHash mapperName [signatureFile certificateFile]\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		inputArr := []string{os.Args[2], os.Args[3], os.Args[5]}
+		if validateInputErr := validation.ValidateStrings(inputArr); validateInputErr != nil {
+			fmt.Println("Invalid string format")
+			os.Exit(1)
+		}
+
+		if validateHexStringErr := validation.ValidateHexString(os.Args[4]); validateHexStringErr != nil {
+			fmt.Println("Invalid hex format for the root hash")
+			os.Exit(1)
+		}
+
+		// the signature of the root hash is verified with the certificate, in PEM
+		var opts vml.VerityOptions
+		if len(os.Args[1:]) == 7 {
+			opts.RootHashSignature, err = ioutil.ReadFile(os.Args[6])
+			if err != nil {
+				fmt.Printf("Error reading the root hash signature: %s\n", err.Error())
+				os.Exit(1)
+			}
+			opts.Certificate, err = crypt.GetCertFromPemFile(os.Args[7])
+			if err != nil {
+				fmt.Printf("Error reading the certificate: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+
+		location, err := vml.OpenVerityVolumeWithOptions(os.Args[2], os.Args[3], os.Args[4], os.Args[5], opts)
+		if err != nil {
+			fmt.Printf("Error opening the dm-verity volume: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("dm-verity volume opened successfully in %s\n", location)
+		os.Exit(0)
+
+	case "CloseVerityVolume":
+		fmt.Println("Closing the dm-verity volume...")
+		if len(os.Args[1:]) < 2 {
+			fmt.Println("Invalid arguments")
+			fmt.Printf("Usage : %s CloseVerityVolume mapperName\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		if validateInputErr := validation.ValidateStrings([]string{os.Args[2]}); validateInputErr != nil {
+			fmt.Println("Invalid string format")
+			os.Exit(1)
+		}
+
+		if err = vml.CloseVerityVolume(os.Args[2]); err != nil {
+			fmt.Printf("Error closing the dm-verity volume: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Successfully closed dm-verity volume: %s\n", os.Args[2])
+		os.Exit(0)
+
+	case "Encrypt":
+		fmt.Println("Encrypting the image file...")
+		if len(os.Args[1:]) != 4 && !(len(os.Args[1:]) == 5 && os.Args[5] == "--stream") {
+			fmt.Println("Invalid arguments")
+			fmt.Printf("Usage : %s Encrypt <imagePath> <encryptionOutputFilePath> <key> [--stream]\n", os.Args[0])
+			os.Exit(1)
+		}
+		imagePath := os.Args[2]
+		encPath := os.Args[3]
+
+		inputArr := []string{imagePath, encPath}
+		if validateInputErr := validation.ValidateStrings(inputArr); validateInputErr != nil {
+			fmt.Println("Invalid string format")
+			os.Exit(1)
+		}
+
+		if validateHexStringErr := validation.ValidateHexString(os.Args[4]); validateHexStringErr != nil {
+			fmt.Println("Invalid hex format for the key")
+			os.Exit(1)
+		}
+
+		key, err := hex.DecodeString(os.Args[4])
+		if err != nil {
+			fmt.Println("Error while decoding hex string")
+			os.Exit(1)
+		}
+
+		// the V1 format read by Decrypt is written by default, --stream writes the chunked V2
+		// format read by DecryptStream without holding the image in memory
+		if err = encryptFile(imagePath, encPath, key, len(os.Args[1:]) == 5); err != nil {
+			fmt.Printf("Error encrypting the image: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Image file encrypted successfully")
+		fmt.Printf("Encrypted image will be found in: %s\n", encPath)
+		os.Exit(0)
+
 	case "Decrypt":
 		fmt.Println("Decrypting the image file...")
 		if len(os.Args[1:]) < 4 {
@@ -182,24 +481,13 @@ func main() {
 			os.Exit(1)
 		}
 
-		// read the encrypted file
-		encryptedData, err := ioutil.ReadFile(encImagePath)
-		if err != nil {
-			fmt.Println("Error while reading the image file")
-			os.Exit(1)
-		}
-
-		decryptedData, err := vml.Decrypt(encryptedData, key)
-		if err != nil {
+		// the image is decrypted a chunk at a time, the output file only appears once the whole
+		// image is decrypted and authenticated
+		if err = decryptFile(encImagePath, decPath, key); err != nil {
 			fmt.Printf("Error decrypting the image: %s\n", err.Error())
 			os.Exit(1)
 		}
 		fmt.Println("Image file decrypted successfully")
-		//Save to file
-		if err = ioutil.WriteFile(decPath, decryptedData, 0600); err != nil {
-			fmt.Printf("Error during writing to file: %s\n", err.Error())
-			os.Exit(1)
-		}
 		fmt.Printf("Decrypted image will be found in: %s\n", decPath)
 		os.Exit(0)
 
@@ -207,7 +495,7 @@ func main() {
 		fmt.Println("Creating VM manifest...")
 		if len(os.Args[1:]) < 5 {
 			fmt.Println("Invalid arguments")
-			fmt.Printf("Usage : %s CreateVMManifest vmID hostHardwareUUID imageID imageEncrypted\n", os.Args[0])
+			fmt.Printf("Usage : %s CreateVMManifest vmID hostHardwareUUID imageID imageEncrypted [verityRootHash]\n", os.Args[0])
 			os.Exit(1)
 		}
 
@@ -232,11 +520,20 @@ func main() {
 			os.Exit(1)
 		}
 
-		createdManifest, err := vml.CreateVMManifest(os.Args[2], os.Args[3], os.Args[4], isEncryptionRequiredValue)
-		var manifest instanceManifest
-		manifest.Manifest = createdManifest
-		if err != nil {
-			fmt.Println(err)
+		// the manifest serializes like instance.Manifest, with image_verity only when the dm-verity
+		// root hash of a read-only image is given
+		var manifest vmManifest
+		if len(os.Args[1:]) > 5 {
+			manifest.Manifest, err = vml.CreateVMManifestWithVerity(os.Args[2], os.Args[3], os.Args[4], isEncryptionRequiredValue, vml.ImageVerity{RootHash: os.Args[6]})
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else {
+			manifest.Manifest.Manifest, err = vml.CreateVMManifest(os.Args[2], os.Args[3], os.Args[4], isEncryptionRequiredValue)
+			if err != nil {
+				fmt.Println(err)
+			}
 		}
 		manifestOutput, err := serialize(manifest)
 		if err != nil {
@@ -284,11 +581,76 @@ func main() {
 		}
 
 	default:
-		fmt.Println("Invalid method name \nExpected values: CreateVolume, DeleteVolume, Mount, Unmount, CreateVMManifest, Decrypt, CreateContainerManifest")
+		fmt.Println("Invalid method name \nExpected values: CreateVolume, DeleteVolume, Mount, Unmount, Status, List, Scan, GC, BackupHeader, RestoreHeader, VerifyHeader, CreateVerityVolume, OpenVerityVolume, CloseVerityVolume, CreateVMManifest, Encrypt, Decrypt, CreateContainerManifest")
+	}
+}
+
+// encryptFile encrypts the image to a temporary file renamed to encPath on success, in the V2
+// format when stream is set and in the V1 format otherwise.
+func encryptFile(imagePath, encPath string, key []byte, stream bool) error {
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	encFile, err := ioutil.TempFile(filepath.Dir(encPath), "."+filepath.Base(encPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(encFile.Name())
+
+	if stream {
+		err = vml.EncryptStream(bufio.NewReader(image), encFile, key)
+	} else {
+		var plaintext, encrypted []byte
+		if plaintext, err = ioutil.ReadAll(image); err == nil {
+			if encrypted, err = vml.Encrypt(plaintext, key); err == nil {
+				_, err = encFile.Write(encrypted)
+			}
+		}
+	}
+	if err == nil {
+		err = encFile.Sync()
+	}
+	if closeErr := encFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(encFile.Name(), encPath)
+}
+
+// decryptFile decrypts the encrypted file to a temporary file renamed to decPath on success, so
+// that a partially decrypted image is never left at decPath.
+func decryptFile(encPath, decPath string, key []byte) error {
+	encFile, err := os.Open(encPath)
+	if err != nil {
+		return err
+	}
+	defer encFile.Close()
+
+	decFile, err := ioutil.TempFile(filepath.Dir(decPath), "."+filepath.Base(decPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(decFile.Name())
+
+	err = vml.DecryptStream(bufio.NewReader(encFile), decFile, key)
+	if err == nil {
+		err = decFile.Sync()
+	}
+	if closeErr := decFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
 	}
+	return os.Rename(decFile.Name(), decPath)
 }
 
-func serialize(manifest instanceManifest) (string, error) {
+func serialize(manifest interface{}) (string, error) {
 	bytes, err := json.Marshal(manifest)
 	if err != nil {
 		return "", err
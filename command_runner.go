@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Command describes a single invocation of an external program such as cryptsetup or mkfs.ext4.
+type Command struct {
+	Name string
+	Args []string
+	// Stdin, when set, is fed to the standard input of the command. It is used to hand
+	// the volume keys to cryptsetup without writing them to a file.
+	Stdin []byte
+	// ExtraFiles are fed to the command through pipes, the i'th one readable by the command
+	// at ExtraFilePath(i). They carry additional keys, e.g. the new key of luksAddKey.
+	ExtraFiles [][]byte
+}
+
+// ExtraFilePath returns the path at which a command reads its i'th extra file.
+func ExtraFilePath(i int) string {
+	// descriptors 0, 1 and 2 are stdin, stdout and stderr
+	return "/dev/fd/" + strconv.Itoa(3+i)
+}
+
+// String returns the command line of the command.
+func (c Command) String() string {
+	return strings.TrimSpace(c.Name + " " + strings.Join(c.Args, " "))
+}
+
+// CommandResult holds the output and the exit code of a command that was started.
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// CommandRunner is used to execute the external programs the volume operations depend on.
+//
+// Run returns an error only when the command could not be started. A command that ran and
+// failed is reported through a non zero CommandResult.ExitCode.
+type CommandRunner interface {
+	Run(cmd Command) (CommandResult, error)
+}
+
+// ContextCommandRunner is a CommandRunner that can stop a command when its context is done.
+//
+// RunContext returns ctx.Err() when ctx is done before the command is started, or when the
+// command failed after ctx was done. A command that completed successfully is reported as such
+// even if ctx was done meanwhile, so that the caller can undo what it did.
+type ContextCommandRunner interface {
+	CommandRunner
+	RunContext(ctx context.Context, cmd Command) (CommandResult, error)
+}
+
+// runContext runs the command with the runner, passing ctx on when the runner is a
+// ContextCommandRunner. Other runners are only checked against ctx before the command starts.
+func runContext(ctx context.Context, r CommandRunner, c Command) (CommandResult, error) {
+	if cr, ok := r.(ContextCommandRunner); ok {
+		return cr.RunContext(ctx, c)
+	}
+	if err := ctx.Err(); err != nil {
+		return CommandResult{}, err
+	}
+	return r.Run(c)
+}
+
+// ExecRunner runs the commands on the host using os/exec. It is the default CommandRunner.
+type ExecRunner struct{}
+
+// Run executes the command and waits for it to complete.
+func (r ExecRunner) Run(c Command) (CommandResult, error) {
+	return r.RunContext(context.Background(), c)
+}
+
+// RunContext executes the command like Run. When ctx is done first, the command and every
+// process it started are killed.
+func (ExecRunner) RunContext(ctx context.Context, c Command) (CommandResult, error) {
+	if err := ctx.Err(); err != nil {
+		return CommandResult{}, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	// the command runs in its own process group, so that helpers it spawns, e.g. udev
+	// waiters of cryptsetup, are killed along with it
+	setProcessGroup(cmd)
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	var writers []*os.File
+	for range c.ExtraFiles {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeFiles(cmd.ExtraFiles)
+			closeFiles(writers)
+			return CommandResult{}, err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		writers = append(writers, w)
+	}
+
+	err := cmd.Start()
+	// the child holds its own copies of the read ends
+	closeFiles(cmd.ExtraFiles)
+	if err != nil {
+		closeFiles(writers)
+		return CommandResult{}, err
+	}
+	for i, w := range writers {
+		go func(w *os.File, data []byte) {
+			w.Write(data)
+			w.Close()
+		}(w, c.ExtraFiles[i])
+	}
+
+	// exec.CommandContext only kills the command itself
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+
+	result := CommandResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	// a command that succeeded is reported even when ctx was done meanwhile, its effects must
+	// be undone by the caller
+	if err != nil && ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	}
+	return result, err
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// RecordingRunner records every command it is asked to run. When Runner is set the command is
+// passed on to it, otherwise the command is reported as successful with no output.
+type RecordingRunner struct {
+	Runner CommandRunner
+
+	mu       sync.Mutex
+	commands []Command
+}
+
+// Run records the command and runs it with the wrapped runner, if any.
+func (r *RecordingRunner) Run(c Command) (CommandResult, error) {
+	return r.RunContext(context.Background(), c)
+}
+
+// RunContext records the command like Run, passing ctx on to the wrapped runner.
+func (r *RecordingRunner) RunContext(ctx context.Context, c Command) (CommandResult, error) {
+	r.mu.Lock()
+	r.commands = append(r.commands, Command{
+		Name:  c.Name,
+		Args:  append([]string(nil), c.Args...),
+		Stdin: append([]byte(nil), c.Stdin...),
+	})
+	for _, data := range c.ExtraFiles {
+		recorded := &r.commands[len(r.commands)-1]
+		recorded.ExtraFiles = append(recorded.ExtraFiles, append([]byte(nil), data...))
+	}
+	r.mu.Unlock()
+
+	if r.Runner == nil {
+		return CommandResult{}, ctx.Err()
+	}
+	return runContext(ctx, r.Runner, c)
+}
+
+// Commands returns the commands recorded so far, in the order they were run.
+func (r *RecordingRunner) Commands() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Command(nil), r.commands...)
+}
+
+// ScriptedResponse is a canned result returned by ScriptedRunner.
+type ScriptedResponse struct {
+	// Name is the program the response applies to, e.g. "cryptsetup" or "losetup".
+	Name string
+	// Args must all be present in the command arguments for the response to apply.
+	// An empty Args matches every invocation of Name.
+	Args []string
+	// Result is returned to the caller when the response applies.
+	Result CommandResult
+	// Err, when set, is returned as if the command could not be started.
+	Err error
+	// Times limits how many times the response is used. Zero means no limit.
+	Times int
+
+	used int
+}
+
+func (s *ScriptedResponse) matches(c Command) bool {
+	if s.Name != c.Name {
+		return false
+	}
+	for _, want := range s.Args {
+		found := false
+		for _, arg := range c.Args {
+			if arg == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ScriptedRunner returns canned stdout, stderr and exit codes for the commands it is asked to run,
+// and records every command like RecordingRunner does.
+//
+// Responses are matched in the order they were added; the first matching response that has not
+// been used up is returned. Commands with no matching response succeed with no output, unless
+// Strict is set, in which case they fail to start.
+type ScriptedRunner struct {
+	Strict bool
+
+	recorder  RecordingRunner
+	mu        sync.Mutex
+	responses []*ScriptedResponse
+}
+
+// Add appends a canned response to the script.
+func (r *ScriptedRunner) Add(resp ScriptedResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = append(r.responses, &resp)
+}
+
+// Run records the command and returns the first matching canned response.
+func (r *ScriptedRunner) Run(c Command) (CommandResult, error) {
+	return r.RunContext(context.Background(), c)
+}
+
+// RunContext returns the response like Run. When ctx is done ctx.Err() is returned instead, as
+// ExecRunner does.
+func (r *ScriptedRunner) RunContext(ctx context.Context, c Command) (CommandResult, error) {
+	r.recorder.RunContext(ctx, c)
+	if err := ctx.Err(); err != nil {
+		return CommandResult{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, resp := range r.responses {
+		if (resp.Times > 0 && resp.used >= resp.Times) || !resp.matches(c) {
+			continue
+		}
+		resp.used++
+		return resp.Result, resp.Err
+	}
+
+	if r.Strict {
+		return CommandResult{}, fmt.Errorf("no scripted response for %q", c.String())
+	}
+	return CommandResult{}, nil
+}
+
+// Commands returns the commands run so far, in the order they were run.
+func (r *ScriptedRunner) Commands() []Command {
+	return r.recorder.Commands()
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecRunner(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		want CommandResult
+	}{
+		{
+			name: "output",
+			cmd:  Command{Name: "sh", Args: []string{"-c", "echo out; echo err >&2"}},
+			want: CommandResult{Stdout: "out\n", Stderr: "err\n"},
+		},
+		{
+			name: "exit code",
+			cmd:  Command{Name: "sh", Args: []string{"-c", "exit 3"}},
+			want: CommandResult{ExitCode: 3},
+		},
+		{
+			name: "stdin",
+			cmd:  Command{Name: "cat", Stdin: []byte("key")},
+			want: CommandResult{Stdout: "key"},
+		},
+		{
+			name: "extra files",
+			cmd:  Command{Name: "cat", Args: []string{ExtraFilePath(1), ExtraFilePath(0)}, ExtraFiles: [][]byte{[]byte("old"), []byte("new")}},
+			want: CommandResult{Stdout: "newold"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ExecRunner{}.Run(tt.cmd)
+			if err != nil || result != tt.want {
+				t.Fatalf("got %+v, %v, want %+v", result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecRunnerNotFound(t *testing.T) {
+	if _, err := (ExecRunner{}).Run(Command{Name: "vml-no-such-command"}); err == nil {
+		t.Fatal("command that cannot be started succeeded")
+	}
+}
+
+func TestExecRunnerContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (ExecRunner{}).RunContext(canceled, Command{Name: "true"}); err != context.Canceled {
+		t.Fatalf("canceled before the start: got error %v, want %v", err, context.Canceled)
+	}
+
+	// the command and the processes it started are killed once the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ExecRunner{}.RunContext(ctx, Command{Name: "sh", Args: []string{"-c", "sleep 10 & sleep 10; wait"}})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command ran for %v after the deadline", elapsed)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestScriptedRunner(t *testing.T) {
+	startErr := errors.New("cannot start")
+	tests := []struct {
+		name      string
+		strict    bool
+		responses []ScriptedResponse
+		commands  []Command
+		want      []CommandResult
+		wantErr   []error
+	}{
+		{
+			name:     "unscripted commands succeed",
+			commands: []Command{{Name: "losetup", Args: []string{"-f"}}},
+			want:     []CommandResult{{}},
+			wantErr:  []error{nil},
+		},
+		{
+			name: "first matching response is used",
+			responses: []ScriptedResponse{
+				{Name: "cryptsetup", Args: []string{"luksOpen"}, Result: CommandResult{ExitCode: 2, Stderr: "No key available"}},
+				{Name: "cryptsetup", Result: CommandResult{Stdout: "any"}},
+			},
+			commands: []Command{
+				{Name: "cryptsetup", Args: []string{"-v", "luksOpen", "/dev/loop0", "vol"}},
+				{Name: "cryptsetup", Args: []string{"status", "/dev/mapper/vol"}},
+			},
+			want:    []CommandResult{{ExitCode: 2, Stderr: "No key available"}, {Stdout: "any"}},
+			wantErr: []error{nil, nil},
+		},
+		{
+			name: "all the arguments must be present",
+			responses: []ScriptedResponse{
+				{Name: "cryptsetup", Args: []string{"status", "/dev/mapper/other"}, Result: CommandResult{ExitCode: 4}},
+			},
+			commands: []Command{{Name: "cryptsetup", Args: []string{"status", "/dev/mapper/vol"}}},
+			want:     []CommandResult{{}},
+			wantErr:  []error{nil},
+		},
+		{
+			name: "used up responses are skipped",
+			responses: []ScriptedResponse{
+				{Name: "cryptsetup", Times: 1, Result: CommandResult{Stdout: "first"}},
+				{Name: "cryptsetup", Result: CommandResult{Stdout: "then"}},
+			},
+			commands: []Command{{Name: "cryptsetup"}, {Name: "cryptsetup"}, {Name: "cryptsetup"}},
+			want:     []CommandResult{{Stdout: "first"}, {Stdout: "then"}, {Stdout: "then"}},
+			wantErr:  []error{nil, nil, nil},
+		},
+		{
+			name:      "start errors are returned",
+			responses: []ScriptedResponse{{Name: "mkfs.ext4", Err: startErr}},
+			commands:  []Command{{Name: "mkfs.ext4", Args: []string{"/dev/mapper/vol"}}},
+			want:      []CommandResult{{}},
+			wantErr:   []error{startErr},
+		},
+		{
+			name:     "strict runner fails unscripted commands",
+			strict:   true,
+			commands: []Command{{Name: "truncate"}},
+			want:     []CommandResult{{}},
+			wantErr:  []error{errors.New(`no scripted response for "truncate"`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ScriptedRunner{Strict: tt.strict}
+			for _, resp := range tt.responses {
+				r.Add(resp)
+			}
+			for i, c := range tt.commands {
+				result, err := r.Run(c)
+				if result != tt.want[i] {
+					t.Errorf("command %d: got result %+v, want %+v", i, result, tt.want[i])
+				}
+				if (err == nil) != (tt.wantErr[i] == nil) || (err != nil && err.Error() != tt.wantErr[i].Error()) {
+					t.Errorf("command %d: got error %v, want %v", i, err, tt.wantErr[i])
+				}
+			}
+			if got := r.Commands(); !reflect.DeepEqual(got, recorded(tt.commands)) {
+				t.Errorf("recorded %v, want %v", got, tt.commands)
+			}
+		})
+	}
+}
+
+func TestScriptedRunnerCanceled(t *testing.T) {
+	r := &ScriptedRunner{}
+	r.Add(ScriptedResponse{Name: "cryptsetup", Result: CommandResult{Stdout: "ok"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.RunContext(ctx, Command{Name: "cryptsetup"}); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	// the canceled command is still recorded
+	if got := len(r.Commands()); got != 1 {
+		t.Fatalf("recorded %d commands, want 1", got)
+	}
+}
+
+func TestRecordingRunner(t *testing.T) {
+	scripted := &ScriptedRunner{}
+	scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksUUID"}, Result: CommandResult{Stdout: "uuid\n"}})
+
+	tests := []struct {
+		name   string
+		runner CommandRunner
+		want   CommandResult
+	}{
+		{name: "without a runner", want: CommandResult{}},
+		{name: "with a runner", runner: scripted, want: CommandResult{Stdout: "uuid\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RecordingRunner{Runner: tt.runner}
+			c := Command{
+				Name:       "cryptsetup",
+				Args:       []string{"luksUUID", "/dev/loop0"},
+				Stdin:      []byte("key"),
+				ExtraFiles: [][]byte{[]byte("new key")},
+			}
+			result, err := r.Run(c)
+			if err != nil || result != tt.want {
+				t.Fatalf("got %+v, %v, want %+v", result, err, tt.want)
+			}
+
+			// the recorded command does not share memory with the caller's
+			c.Args[1] = "/dev/loop1"
+			c.Stdin[0] = 'K'
+			c.ExtraFiles[0][0] = 'N'
+			want := []Command{{
+				Name:       "cryptsetup",
+				Args:       []string{"luksUUID", "/dev/loop0"},
+				Stdin:      []byte("key"),
+				ExtraFiles: [][]byte{[]byte("new key")},
+			}}
+			if got := r.Commands(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("recorded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		runner  CommandRunner
+		wantErr error
+		wantRun int
+	}{
+		{name: "plain runner", ctx: context.Background(), runner: &plainRunner{}, wantRun: 1},
+		{name: "plain runner canceled", ctx: canceled, runner: &plainRunner{}, wantErr: context.Canceled},
+		{name: "context runner canceled", ctx: canceled, runner: &ScriptedRunner{}, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runContext(tt.ctx, tt.runner, Command{Name: "true"})
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if plain, ok := tt.runner.(*plainRunner); ok && plain.runs != tt.wantRun {
+				t.Fatalf("command run %d times, want %d", plain.runs, tt.wantRun)
+			}
+		})
+	}
+}
+
+// plainRunner is a CommandRunner that does not take a context
+type plainRunner struct {
+	runs int
+}
+
+func (r *plainRunner) Run(c Command) (CommandResult, error) {
+	r.runs++
+	return CommandResult{}, nil
+}
+
+// recorded returns the commands as RecordingRunner records them
+func recorded(commands []Command) []Command {
+	var want []Command
+	for _, c := range commands {
+		want = append(want, Command{Name: c.Name, Args: append([]string(nil), c.Args...), Stdin: append([]byte(nil), c.Stdin...)})
+	}
+	return want
+}
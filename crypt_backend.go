@@ -0,0 +1,303 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/vml/v4/dm"
+	"intel/isecl/lib/vml/v4/luks"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CryptBackend selects how the dm-crypt mappings of the volumes are opened, closed and inspected.
+// Formatting, resizing and the keyslot operations always use cryptsetup.
+type CryptBackend string
+
+// Crypt backends
+const (
+	// CryptBackendCryptsetup runs the cryptsetup binary.
+	CryptBackendCryptsetup CryptBackend = "cryptsetup"
+	// CryptBackendNative unlocks the LUKS header with the luks package and creates the mapping
+	// with the device-mapper ioctls of the dm package, without cryptsetup.
+	CryptBackendNative CryptBackend = "native"
+)
+
+// prefix of the device-mapper UUID of the dm-crypt mappings, followed by the LUKS version, the
+// LUKS UUID without dashes and the mapping name, like cryptsetup
+const cryptUUIDPrefix = "CRYPT-"
+
+func (m *Manager) cryptBackend() (CryptBackend, error) {
+	switch m.CryptBackend {
+	case "", CryptBackendCryptsetup:
+		return CryptBackendCryptsetup, nil
+	case CryptBackendNative:
+		return CryptBackendNative, nil
+	}
+	return "", fmt.Errorf("unknown crypt backend %q", m.CryptBackend)
+}
+
+// luksOpen opens the LUKS volume on the device as the dm-crypt mapping at the device mapper
+// location.
+func (m *Manager) luksOpen(ctx context.Context, device, deviceMapperLocation string, key []byte) error {
+	backend, err := m.cryptBackend()
+	if err != nil {
+		return err
+	}
+	if backend == CryptBackendNative {
+		if err = ctx.Err(); err != nil {
+			return &VolumeError{Op: "luksOpen", Path: device, Err: err}
+		}
+		return nativeOpen(device, deviceMapperLocation, key)
+	}
+
+	// the key is passed on stdin so that it never touches the disk
+	args := []string{"-v", "luksOpen", device, volumeID(deviceMapperLocation), "--key-file", "-"}
+	if _, err = m.runCommandWithStdin(ctx, "cryptsetup", args, key); err != nil {
+		return cryptsetupError("luksOpen", device, err)
+	}
+	return nil
+}
+
+// luksClose closes the dm-crypt mapping at the device mapper location.
+func (m *Manager) luksClose(ctx context.Context, deviceMapperLocation string) error {
+	backend, err := m.cryptBackend()
+	if err != nil {
+		return err
+	}
+	if backend == CryptBackendNative {
+		if err = dm.Remove(volumeID(deviceMapperLocation)); err != nil {
+			return dmError("luksClose", deviceMapperLocation, err)
+		}
+		return nil
+	}
+
+	if _, err = m.runCommand(ctx, "cryptsetup", []string{"luksClose", deviceMapperLocation}); err != nil {
+		return cryptsetupError("luksClose", deviceMapperLocation, err)
+	}
+	return nil
+}
+
+// nativeOpen recovers the volume key from the LUKS header of the device and creates the crypt
+// target of its data segment.
+func nativeOpen(device, deviceMapperLocation string, key []byte) error {
+	file, err := os.Open(device)
+	if err != nil {
+		return luksError("luksOpen", device, err)
+	}
+	defer file.Close()
+
+	header, err := luks.Read(file)
+	if err != nil {
+		return luksError("luksOpen", device, err)
+	}
+	volumeKey, err := header.Unlock(file, key)
+	if err != nil {
+		return luksError("luksOpen", device, err)
+	}
+	defer wipeBytes(volumeKey.Key)
+
+	target, err := cryptTarget(file, device, volumeKey)
+	if err != nil {
+		return &VolumeError{Op: "luksOpen", Path: device, Err: err}
+	}
+	name := volumeID(deviceMapperLocation)
+	uuid := fmt.Sprintf("%sLUKS%d-%s-%s", cryptUUIDPrefix, header.Version, strings.Replace(header.UUID, "-", "", -1), name)
+	if _, err = dm.Create(name, []dm.Target{target}, dm.Options{UUID: uuid}); err != nil {
+		return dmError("luksOpen", deviceMapperLocation, err)
+	}
+	return nil
+}
+
+// cryptTarget returns the dm-crypt table of the segment encrypted with the volume key.
+func cryptTarget(file *os.File, device string, volumeKey *luks.VolumeKey) (dm.Target, error) {
+	segment := volumeKey.Segment
+	if segment.Type != "crypt" {
+		return dm.Target{}, fmt.Errorf("unsupported segment type %q", segment.Type)
+	}
+	if segment.Integrity != nil {
+		// the crypt target would sit on a dm-integrity device, which the dm package does not set up
+		return dm.Target{}, fmt.Errorf("segments with %s integrity protection are only opened by the %s backend",
+			segment.Integrity.Type, CryptBackendCryptsetup)
+	}
+	sectorSize := uint64(segment.SectorSize)
+	if sectorSize < dm.SectorSize || sectorSize%dm.SectorSize != 0 {
+		return dm.Target{}, fmt.Errorf("invalid sector size %d", segment.SectorSize)
+	}
+
+	offset := uint64(segment.Offset)
+	deviceSize, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return dm.Target{}, err
+	}
+	if uint64(deviceSize) <= offset {
+		return dm.Target{}, fmt.Errorf("device is smaller than the data offset %d", offset)
+	}
+	length := uint64(deviceSize) - offset
+	if segment.Size != luks.DynamicSize {
+		size, err := strconv.ParseUint(segment.Size, 10, 64)
+		if err != nil {
+			return dm.Target{}, fmt.Errorf("invalid segment size %q", segment.Size)
+		}
+		if size > length {
+			return dm.Target{}, fmt.Errorf("segment of %d bytes at offset %d exceeds the device", size, offset)
+		}
+		length = size
+	}
+	// the mapping holds whole encryption sectors
+	length -= length % sectorSize
+	if length == 0 {
+		return dm.Target{}, errors.New("segment is smaller than a sector")
+	}
+
+	// <cipher> <key> <iv_offset> <device path> <offset> [<#opt_params> <opt_params>]
+	params := fmt.Sprintf("%s %s %d %s %d", segment.Encryption, hex.EncodeToString(volumeKey.Key),
+		uint64(segment.IVTweak), device, offset/dm.SectorSize)
+	if sectorSize != dm.SectorSize {
+		params += fmt.Sprintf(" 1 sector_size:%d", sectorSize)
+	}
+	return dm.Target{Start: 0, Length: length / dm.SectorSize, Type: "crypt", Params: params}, nil
+}
+
+// nativeStatus fills status from the device-mapper table of the mapping.
+func nativeStatus(status *VolumeStatus) error {
+	name := volumeID(status.DeviceMapperLocation)
+	info, err := dm.GetInfo(name)
+	if errors.Is(err, dm.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return dmError("status", status.DeviceMapperLocation, err)
+	}
+	if !info.ActiveTable {
+		return nil
+	}
+	targets, err := dm.GetTable(name)
+	if err != nil {
+		return dmError("status", status.DeviceMapperLocation, err)
+	}
+	return cryptTableStatus(status, info, targets)
+}
+
+// cryptTableStatus fills status from the info and the live table of a dm-crypt mapping.
+func cryptTableStatus(status *VolumeStatus, info *dm.Info, targets []dm.Target) error {
+	if len(targets) != 1 || targets[0].Type != "crypt" {
+		return &VolumeError{Op: "status", Path: status.DeviceMapperLocation, Err: errors.New("not a dm-crypt volume")}
+	}
+
+	// <cipher> <key> <iv_offset> <device> <offset> [<#opt_params> <opt_params>]
+	params := strings.Fields(targets[0].Params)
+	if len(params) < 5 {
+		return &VolumeError{Op: "status", Path: status.DeviceMapperLocation, Err: errors.New("unexpected dm-crypt table")}
+	}
+	status.Active = true
+	status.InUse = info.OpenCount > 0
+	status.ReadOnly = info.ReadOnly
+	status.Cipher = params[0]
+	status.KeySize = cryptKeySize(params[1])
+	status.SectorSize = dm.SectorSize
+	status.Size = targets[0].Length * dm.SectorSize
+	if offset, err := strconv.ParseUint(params[4], 10, 64); err == nil {
+		status.DataOffset = offset * dm.SectorSize
+	}
+	for _, option := range params[5:] {
+		if value := strings.TrimPrefix(option, "sector_size:"); value != option {
+			status.SectorSize, _ = strconv.Atoi(value)
+		}
+		// integrity:<tag size>:<type>, set on volumes opened by cryptsetup
+		if value := strings.TrimPrefix(option, "integrity:"); value != option {
+			if fields := strings.SplitN(value, ":", 2); len(fields) == 2 {
+				status.Integrity = fields[1]
+			}
+		}
+	}
+
+	// CRYPT-LUKS2-<uuid>-<name>
+	if strings.HasPrefix(info.UUID, cryptUUIDPrefix) {
+		status.Type = strings.SplitN(strings.TrimPrefix(info.UUID, cryptUUIDPrefix), "-", 2)[0]
+		if strings.HasPrefix(status.Type, "LUKS") {
+			status.LUKSVersion, _ = strconv.Atoi(strings.TrimPrefix(status.Type, "LUKS"))
+			status.UUID = luksUUIDFromMapperUUID(info.UUID)
+		}
+	}
+
+	status.LoopDevice = tableDevicePath(params[3])
+	deviceName := filepath.Base(status.LoopDevice)
+	if backingFile, err := readSysfsValue(filepath.Join(sysBlockPath, deviceName, "loop", "backing_file")); err == nil {
+		status.SparseFilePath = strings.TrimSuffix(backingFile, deletedSuffix)
+	}
+	return nil
+}
+
+// tableDevicePath returns the path of a device of a device-mapper table, given as major:minor, or
+// as a path by older kernels.
+func tableDevicePath(device string) string {
+	if link, err := os.Readlink(filepath.Join("/sys/dev/block", device)); err == nil {
+		return "/dev/" + filepath.Base(link)
+	}
+	return "/dev/" + filepath.Base(device)
+}
+
+// cryptKeySize returns the size in bits of the key of a dm-crypt table, given in hex or as a
+// :<size>:<type>:<description> keyring reference.
+func cryptKeySize(key string) int {
+	if strings.HasPrefix(key, ":") {
+		fields := strings.SplitN(key[1:], ":", 2)
+		size, _ := strconv.Atoi(fields[0])
+		return size * 8
+	}
+	if key == "-" {
+		return 0
+	}
+	return len(key) * 4
+}
+
+// nativeLUKSUUID returns the LUKS UUID read from the header of the device.
+func nativeLUKSUUID(device string) (string, error) {
+	header, err := luks.ReadFile(device)
+	if err != nil {
+		return "", luksError("luksUUID", device, err)
+	}
+	return header.UUID, nil
+}
+
+// luksError wraps an error of the luks package in a VolumeError of the matching kind.
+func luksError(op, path string, err error) error {
+	volumeErr := &VolumeError{Op: op, Path: path, Err: err}
+	switch {
+	case os.IsNotExist(err):
+		volumeErr.Kind = ErrNotFound
+	case errors.Is(err, luks.ErrWrongKey):
+		volumeErr.Kind, volumeErr.Err = ErrWrongKey, nil
+	case errors.Is(err, luks.ErrNotLUKS):
+		volumeErr.Kind, volumeErr.Err = ErrNotLUKS, nil
+	}
+	return volumeErr
+}
+
+// dmError wraps an error of the dm package in a VolumeError of the matching kind.
+func dmError(op, path string, err error) error {
+	volumeErr := &VolumeError{Op: op, Path: path, Err: err}
+	switch {
+	case errors.Is(err, dm.ErrNotFound):
+		volumeErr.Kind = ErrNotFound
+	case errors.Is(err, dm.ErrExists):
+		volumeErr.Kind = ErrAlreadyExists
+	case errors.Is(err, dm.ErrBusy):
+		volumeErr.Kind = ErrBusy
+	}
+	return volumeErr
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
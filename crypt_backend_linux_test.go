@@ -0,0 +1,195 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"intel/isecl/lib/vml/v4/dm"
+	"intel/isecl/lib/vml/v4/luks"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCryptTarget(t *testing.T) {
+	const deviceSize = 16 << 20
+	key := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	segment := luks.Segment{Type: "crypt", Offset: 2 << 20, Size: luks.DynamicSize, Encryption: "aes-xts-plain64", SectorSize: 512}
+
+	tests := []struct {
+		name       string
+		edit       func(segment *luks.Segment)
+		wantLength uint64
+		wantParams string
+		wantErr    string
+	}{
+		{
+			name:       "dynamic size",
+			wantLength: (deviceSize - 2<<20) / dm.SectorSize,
+			wantParams: "aes-xts-plain64 0123456789abcdef 0 /dev/loop0 4096",
+		},
+		{
+			name:       "fixed size",
+			edit:       func(segment *luks.Segment) { segment.Size = "1048576" },
+			wantLength: 2048,
+			wantParams: "aes-xts-plain64 0123456789abcdef 0 /dev/loop0 4096",
+		},
+		{
+			name: "sector size",
+			edit: func(segment *luks.Segment) {
+				segment.SectorSize = 4096
+				segment.IVTweak = 8
+				// rounded down to whole encryption sectors
+				segment.Size = "1050000"
+			},
+			wantLength: 2048,
+			wantParams: "aes-xts-plain64 0123456789abcdef 8 /dev/loop0 4096 1 sector_size:4096",
+		},
+		{
+			name:    "data offset past the end of the device",
+			edit:    func(segment *luks.Segment) { segment.Offset = deviceSize + 4096 },
+			wantErr: "smaller than the data offset",
+		},
+		{
+			name:    "fixed size past the end of the device",
+			edit:    func(segment *luks.Segment) { segment.Size = "15728640" },
+			wantErr: "exceeds the device",
+		},
+		{
+			name:    "segment smaller than a sector",
+			edit:    func(segment *luks.Segment) { segment.Size = "511" },
+			wantErr: "smaller than a sector",
+		},
+		{
+			name:    "invalid size",
+			edit:    func(segment *luks.Segment) { segment.Size = "-1" },
+			wantErr: "invalid segment size",
+		},
+		{
+			name:    "invalid sector size",
+			edit:    func(segment *luks.Segment) { segment.SectorSize = 1000 },
+			wantErr: "invalid sector size",
+		},
+		{
+			name:    "integrity",
+			edit:    func(segment *luks.Segment) { segment.Integrity = &luks.SegmentIntegrity{Type: "hmac(sha256)"} },
+			wantErr: "only opened by the cryptsetup backend",
+		},
+		{
+			name:    "not a crypt segment",
+			edit:    func(segment *luks.Segment) { segment.Type = "linear" },
+			wantErr: "unsupported segment type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := os.Create(filepath.Join(t.TempDir(), "vol.img"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if err = file.Truncate(deviceSize); err != nil {
+				t.Fatal(err)
+			}
+
+			volumeKey := &luks.VolumeKey{Key: key, Segment: segment}
+			if tt.edit != nil {
+				tt.edit(&volumeKey.Segment)
+			}
+			target, err := cryptTarget(file, "/dev/loop0", volumeKey)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cryptTarget failed: %v", err)
+			}
+			want := dm.Target{Start: 0, Length: tt.wantLength, Type: "crypt", Params: tt.wantParams}
+			if target != want {
+				t.Errorf("cryptTarget() = %+v, want %+v", target, want)
+			}
+		})
+	}
+}
+
+func TestCryptTableStatus(t *testing.T) {
+	fakeSysBlock(t, []sysDevice{loopDevice("loop0", "7:0", "/var/lib/vml/vol.img")}, "22 1 0:21 / /proc rw,nosuid - proc proc rw")
+	info := &dm.Info{Name: "vol", UUID: "CRYPT-LUKS2-0123456789abcdef0123456789abcdef-vol", OpenCount: 1, ActiveTable: true}
+	key := strings.Repeat("0f", 64)
+
+	tests := []struct {
+		name    string
+		info    *dm.Info
+		targets []dm.Target
+		want    VolumeStatus
+		wantErr bool
+	}{
+		{
+			name:    "hex key",
+			info:    info,
+			targets: []dm.Target{{Length: 2048, Type: "crypt", Params: "aes-xts-plain64 " + key + " 0 /dev/loop0 32768"}},
+			want: VolumeStatus{Active: true, InUse: true, Type: "LUKS2", LUKSVersion: 2, UUID: "01234567-89ab-cdef-0123-456789abcdef",
+				Cipher: "aes-xts-plain64", KeySize: 512, LoopDevice: "/dev/loop0", SparseFilePath: "/var/lib/vml/vol.img",
+				SectorSize: 512, DataOffset: 16 << 20, Size: 1 << 20},
+		},
+		{
+			name: "keyring key and options",
+			info: &dm.Info{Name: "vol", UUID: "CRYPT-LUKS1-0123456789abcdef0123456789abcdef-vol", ReadOnly: true, ActiveTable: true},
+			targets: []dm.Target{{Length: 2048, Type: "crypt",
+				Params: "capi:authenc(hmac(sha256),xts(aes))-random :96:logon:cryptsetup:0123-d0 0 /dev/loop0 4096 2 sector_size:4096 integrity:32:hmac(sha256)"}},
+			want: VolumeStatus{Active: true, ReadOnly: true, Type: "LUKS1", LUKSVersion: 1, UUID: "01234567-89ab-cdef-0123-456789abcdef",
+				Cipher: "capi:authenc(hmac(sha256),xts(aes))-random", KeySize: 768, Integrity: "hmac(sha256)", LoopDevice: "/dev/loop0",
+				SparseFilePath: "/var/lib/vml/vol.img", SectorSize: 4096, DataOffset: 2 << 20, Size: 1 << 20},
+		},
+		{
+			name:    "mapping of another program",
+			info:    &dm.Info{Name: "vol", UUID: "LVM-vol", ActiveTable: true},
+			targets: []dm.Target{{Length: 8, Type: "crypt", Params: "aes-cbc-essiv:sha256 - 0 /dev/sdb 0"}},
+			want:    VolumeStatus{Active: true, Cipher: "aes-cbc-essiv:sha256", LoopDevice: "/dev/sdb", SectorSize: 512, Size: 4096},
+		},
+		{name: "not crypt", info: info, targets: []dm.Target{{Length: 8, Type: "linear", Params: "7:0 0"}}, wantErr: true},
+		{name: "several targets", info: info, targets: []dm.Target{{Type: "crypt"}, {Type: "crypt"}}, wantErr: true},
+		{name: "short table", info: info, targets: []dm.Target{{Length: 8, Type: "crypt", Params: "aes-xts-plain64 " + key}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &VolumeStatus{}
+			err := cryptTableStatus(status, tt.info, tt.targets)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("cryptTableStatus() = %+v", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cryptTableStatus failed: %v", err)
+			}
+			if !reflect.DeepEqual(*status, tt.want) {
+				t.Errorf("cryptTableStatus() = %+v, want %+v", *status, tt.want)
+			}
+		})
+	}
+}
+
+func TestCryptKeySize(t *testing.T) {
+	for key, want := range map[string]int{
+		strings.Repeat("0f", 64):            512,
+		strings.Repeat("0f", 32):            256,
+		":64:logon:cryptsetup:0123-d0":      512,
+		":32:user:vml:key":                  256,
+		":invalid:logon:cryptsetup:0123-d0": 0,
+		"-":                                 0,
+		"":                                  0,
+	} {
+		if got := cryptKeySize(key); got != want {
+			t.Errorf("cryptKeySize(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
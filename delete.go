@@ -0,0 +1,185 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/vml/v4/loop"
+	"os"
+	"strings"
+)
+
+// DeleteOptions are the optional teardown steps of DeleteVolumeWithOptions.
+type DeleteOptions struct {
+	// SparseFilePath is the sparse file backing the volume. It is only needed to finish the
+	// teardown of a volume that is no longer active, e.g. after an earlier DeleteVolume failed
+	// to detach the loop device.
+	SparseFilePath string
+	// EraseKeyslots wipes all the keyslots of the LUKS header with cryptsetup erase. The data on
+	// the volume can no longer be decrypted afterwards, whatever key is used.
+	EraseKeyslots bool
+	// DiscardSparseFile deallocates all the blocks of the sparse file, letting the storage below
+	// discard them. Combine it with EraseKeyslots to securely destroy the volume.
+	DiscardSparseFile bool
+	// RemoveSparseFile removes the sparse file once the volume is closed.
+	RemoveSparseFile bool
+}
+
+// DeleteReport records the teardown steps of DeleteVolumeWithOptions that succeeded.
+type DeleteReport struct {
+	LoopDevice          string `json:"loop_device,omitempty"`
+	SparseFilePath      string `json:"sparse_file_path,omitempty"`
+	Closed              bool   `json:"closed"`
+	KeyslotsErased      bool   `json:"keyslots_erased"`
+	LoopDetached        bool   `json:"loop_detached"`
+	SparseFileDiscarded bool   `json:"sparse_file_discarded"`
+	SparseFileRemoved   bool   `json:"sparse_file_removed"`
+}
+
+// DeleteVolumeWithOptions is used to tear down a dm-crypt volume: the volume is closed and the
+// loop device backing it is detached, then the optional steps of opts are run.
+//
+// Input Parameters:
+//
+// 	deviceMapperLocation – Absolute path of the dm-crypt volume.
+//
+// 	opts – Optional teardown steps, the zero value only closes the volume and detaches the loop device.
+//
+// A mounted volume is refused with ErrBusy. The report is returned even when an error occurs and
+// records the steps that were completed before it.
+func DeleteVolumeWithOptions(deviceMapperLocation string, opts DeleteOptions) (*DeleteReport, error) {
+	return DefaultManager.DeleteVolumeWithOptions(deviceMapperLocation, opts)
+}
+
+// DeleteVolumeWithOptionsContext is used to tear down the dm-crypt volume like
+// DeleteVolumeWithOptions. When ctx is done, the running command is killed, the remaining steps
+// are skipped and the error wraps ctx.Err().
+func DeleteVolumeWithOptionsContext(ctx context.Context, deviceMapperLocation string, opts DeleteOptions) (*DeleteReport, error) {
+	return DefaultManager.DeleteVolumeWithOptionsContext(ctx, deviceMapperLocation, opts)
+}
+
+// DeleteVolumeWithOptions tears down the dm-crypt volume like the package level DeleteVolumeWithOptions.
+func (m *Manager) DeleteVolumeWithOptions(deviceMapperLocation string, opts DeleteOptions) (*DeleteReport, error) {
+	return m.DeleteVolumeWithOptionsContext(context.Background(), deviceMapperLocation, opts)
+}
+
+// DeleteVolumeWithOptionsContext tears down the dm-crypt volume like the package level
+// DeleteVolumeWithOptionsContext.
+func (m *Manager) DeleteVolumeWithOptionsContext(ctx context.Context, deviceMapperLocation string, opts DeleteOptions) (*DeleteReport, error) {
+	report := &DeleteReport{SparseFilePath: opts.SparseFilePath}
+	if len(strings.TrimSpace(deviceMapperLocation)) <= 0 {
+		return report, errors.New("device mapper location not given")
+	}
+
+	unlock, err := m.lockVolume(ctx, opts.SparseFilePath, deviceMapperLocation, "")
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	status, err := m.volumeStatus(ctx, deviceMapperLocation)
+	if err != nil {
+		return report, err
+	}
+
+	if status.Active {
+		if len(status.MountPoints) > 0 {
+			return report, &VolumeError{Op: "delete", Path: deviceMapperLocation, Kind: ErrBusy,
+				Err: fmt.Errorf("volume is mounted on %s", strings.Join(status.MountPoints, ", "))}
+		}
+		// the sparse file is only reported by cryptsetup while the volume is active
+		if report.SparseFilePath == "" {
+			report.SparseFilePath = status.SparseFilePath
+		}
+		// the device holding the header, the loop device unless the volume is on a block device
+		report.LoopDevice = status.LoopDevice
+
+		// a volume left closed by a failed deletion is collected by Scan rather than restored
+		if err = m.markDeleting(ctx, deviceMapperLocation); err != nil {
+			return report, err
+		}
+
+		if err = m.luksClose(ctx, deviceMapperLocation); err != nil {
+			return report, err
+		}
+		report.Closed = true
+
+		// the device below a volume with integrity protection may be its dm-integrity device,
+		// removed along with the mapping, the loop device is found from the sparse file instead
+		if status.Integrity != "" && report.SparseFilePath != "" {
+			report.LoopDevice, err = m.loop().FindByBackingFile(report.SparseFilePath)
+			if err != nil && !errors.Is(err, loop.ErrNotFound) {
+				return report, &VolumeError{Op: "detach", Path: report.SparseFilePath, Err: err}
+			}
+		}
+	} else if report.SparseFilePath == "" {
+		return report, &VolumeError{Op: "luksClose", Path: deviceMapperLocation, Kind: ErrNotFound, Err: errors.New("volume is not active")}
+	} else {
+		if err = m.markDeleting(ctx, deviceMapperLocation); err != nil {
+			return report, err
+		}
+		report.LoopDevice, err = m.loop().FindByBackingFile(report.SparseFilePath)
+		if err != nil && !errors.Is(err, loop.ErrNotFound) {
+			return report, &VolumeError{Op: "detach", Path: report.SparseFilePath, Err: err}
+		}
+	}
+
+	if opts.EraseKeyslots {
+		headerDevice := report.LoopDevice
+		if headerDevice == "" {
+			headerDevice = report.SparseFilePath
+		}
+		args := []string{"--batch-mode", "erase", headerDevice}
+		if _, err = m.runCommand(ctx, "cryptsetup", args); err != nil {
+			return report, cryptsetupError("erase", headerDevice, err)
+		}
+		report.KeyslotsErased = true
+	}
+
+	// the remaining steps do not run commands that would notice ctx
+	if err = ctx.Err(); err != nil {
+		return report, &VolumeError{Op: "delete", Path: deviceMapperLocation, Err: err}
+	}
+
+	// only a loop device bound to the sparse file is detached, never a block device or a loop
+	// device of another file
+	var backed bool
+	if report.LoopDevice != "" && report.SparseFilePath != "" {
+		if backed, err = m.loopBackedBy(report.LoopDevice, report.SparseFilePath); err != nil {
+			return report, &VolumeError{Op: "detach", Path: report.LoopDevice, Err: err}
+		}
+	}
+	if backed {
+		if err = m.loop().Detach(report.LoopDevice); err != nil {
+			return report, &VolumeError{Op: "detach", Path: report.LoopDevice, Err: err}
+		}
+		report.LoopDetached = true
+	}
+
+	if (opts.DiscardSparseFile || opts.RemoveSparseFile) && report.SparseFilePath == "" {
+		return report, &VolumeError{Op: "delete", Path: deviceMapperLocation, Kind: ErrNotFound, Err: errors.New("volume is not backed by a sparse file")}
+	}
+
+	if opts.DiscardSparseFile {
+		if err = discardFile(report.SparseFilePath); err != nil {
+			return report, &VolumeError{Op: "discard", Path: report.SparseFilePath, Err: err}
+		}
+		report.SparseFileDiscarded = true
+	}
+
+	if opts.RemoveSparseFile {
+		if err = os.Remove(report.SparseFilePath); err != nil {
+			return report, &VolumeError{Op: "remove", Path: report.SparseFilePath, Err: err}
+		}
+		report.SparseFileRemoved = true
+	}
+
+	if err = m.forgetVolume(ctx, deviceMapperLocation); err != nil {
+		return report, err
+	}
+	return report, nil
+}
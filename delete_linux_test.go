@@ -0,0 +1,292 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeleteVolumeWithOptions(t *testing.T) {
+	data := bytes.Repeat([]byte("encrypted data"), 1024)
+
+	tests := []struct {
+		name string
+		// active volumes report the sparse file, unless noSparseFile is set
+		active       bool
+		integrity    bool
+		noSparseFile bool
+		mounted      bool
+		attached     bool
+		loopFile     string
+		canceled     bool
+		opts         func(sparseFile string) DeleteOptions
+		wantErr      error
+		wantCommands []string
+		wantErased   string
+		wantReport   func(sparseFile string) DeleteReport
+		wantFile     []byte
+	}{
+		{
+			name:         "closed and detached",
+			active:       true,
+			attached:     true,
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose"},
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{LoopDevice: "/dev/loop0", SparseFilePath: sparseFile, Closed: true, LoopDetached: true}
+			},
+			wantFile: data,
+		},
+		{
+			name:     "destroyed",
+			active:   true,
+			attached: true,
+			opts: func(string) DeleteOptions {
+				return DeleteOptions{EraseKeyslots: true, DiscardSparseFile: true, RemoveSparseFile: true}
+			},
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose", "cryptsetup erase"},
+			wantErased:   "/dev/loop0",
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{LoopDevice: "/dev/loop0", SparseFilePath: sparseFile, Closed: true, KeyslotsErased: true,
+					LoopDetached: true, SparseFileDiscarded: true, SparseFileRemoved: true}
+			},
+		},
+		{
+			name:     "sparse file discarded",
+			active:   true,
+			attached: true,
+			opts: func(string) DeleteOptions {
+				return DeleteOptions{DiscardSparseFile: true}
+			},
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose"},
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{LoopDevice: "/dev/loop0", SparseFilePath: sparseFile, Closed: true, LoopDetached: true, SparseFileDiscarded: true}
+			},
+			// the size is kept, the blocks read back as zeros
+			wantFile: make([]byte, len(data)),
+		},
+		{
+			name:         "loop device of another file is kept",
+			active:       true,
+			attached:     true,
+			loopFile:     "/var/lib/other.img",
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose"},
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{LoopDevice: "/dev/loop0", SparseFilePath: sparseFile, Closed: true}
+			},
+			wantFile: data,
+		},
+		{
+			name:         "integrity",
+			active:       true,
+			integrity:    true,
+			attached:     true,
+			opts:         func(string) DeleteOptions { return DeleteOptions{EraseKeyslots: true} },
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose", "cryptsetup erase"},
+			// the header is on the loop device, not on the dm-integrity device below the mapping
+			wantErased: "/dev/loop0",
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{LoopDevice: "/dev/loop0", SparseFilePath: sparseFile, Closed: true, KeyslotsErased: true, LoopDetached: true}
+			},
+			wantFile: data,
+		},
+		{
+			name:         "mounted",
+			active:       true,
+			attached:     true,
+			mounted:      true,
+			opts:         func(string) DeleteOptions { return DeleteOptions{RemoveSparseFile: true} },
+			wantErr:      ErrBusy,
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID"},
+			wantReport:   func(string) DeleteReport { return DeleteReport{} },
+			wantFile:     data,
+		},
+		{
+			name:         "sparse file unknown",
+			active:       true,
+			noSparseFile: true,
+			opts:         func(string) DeleteOptions { return DeleteOptions{RemoveSparseFile: true} },
+			wantErr:      ErrNotFound,
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose"},
+			wantReport:   func(string) DeleteReport { return DeleteReport{LoopDevice: "/dev/loop0", Closed: true} },
+			wantFile:     data,
+		},
+		{
+			name:     "inactive volume still attached",
+			attached: true,
+			opts: func(sparseFile string) DeleteOptions {
+				return DeleteOptions{SparseFilePath: sparseFile}
+			},
+			wantCommands: []string{"cryptsetup status"},
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{LoopDevice: "/dev/loop0", SparseFilePath: sparseFile, LoopDetached: true}
+			},
+			wantFile: data,
+		},
+		{
+			name: "inactive volume removed",
+			opts: func(sparseFile string) DeleteOptions {
+				return DeleteOptions{SparseFilePath: sparseFile, EraseKeyslots: true, RemoveSparseFile: true}
+			},
+			wantCommands: []string{"cryptsetup status", "cryptsetup erase"},
+			// without a loop device the header is erased on the sparse file
+			wantErased: "sparse file",
+			wantReport: func(sparseFile string) DeleteReport {
+				return DeleteReport{SparseFilePath: sparseFile, KeyslotsErased: true, SparseFileRemoved: true}
+			},
+		},
+		{
+			name:         "inactive volume without a sparse file",
+			wantErr:      ErrNotFound,
+			wantCommands: []string{"cryptsetup status"},
+			wantReport:   func(string) DeleteReport { return DeleteReport{} },
+			wantFile:     data,
+		},
+		{
+			name:     "canceled",
+			active:   true,
+			attached: true,
+			canceled: true,
+			wantErr:  context.Canceled,
+			// the runner records the command it refuses to run
+			wantCommands: []string{"cryptsetup status"},
+			wantReport:   func(string) DeleteReport { return DeleteReport{} },
+			wantFile:     data,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sparseFile := filepath.Join(dir, "vol.img")
+			if err := ioutil.WriteFile(sparseFile, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			mapper := filepath.Join(dir, "mapper", "vol")
+			mountInfo := "22 1 0:21 / /proc rw,nosuid - proc proc rw"
+			if tt.mounted {
+				mountInfo += "\n98 22 253:0 / /mnt/vol rw,relatime - ext4 " + mapper + " rw"
+			}
+			fakeSysBlock(t, nil, mountInfo)
+
+			loops := newFakeLoop()
+			if tt.attached {
+				loopFile := sparseFile
+				if tt.loopFile != "" {
+					loopFile = tt.loopFile
+				}
+				loops.devices["/dev/loop0"] = loopFile
+			}
+
+			statusDevice, statusFile := "/dev/loop0", sparseFile
+			if tt.integrity {
+				statusDevice = mapper + "_dif"
+			}
+			if tt.noSparseFile {
+				statusFile = ""
+			}
+			status := cryptsetupStatus(mapper, tt.active, statusDevice, statusFile)
+			if tt.integrity {
+				status.Stdout += "  integrity: hmac(sha256)\n"
+			}
+			scripted := &ScriptedRunner{}
+			scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: status})
+			m := &Manager{Runner: scripted, Loop: loops, LockDir: filepath.Join(dir, "locks")}
+
+			opts := DeleteOptions{}
+			if tt.opts != nil {
+				opts = tt.opts(sparseFile)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+			report, err := m.DeleteVolumeWithOptionsContext(ctx, mapper, opts)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("DeleteVolumeWithOptionsContext failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if want := tt.wantReport(sparseFile); report == nil || !reflect.DeepEqual(*report, want) {
+				t.Errorf("report %+v, want %+v", report, want)
+			}
+
+			var commands []string
+			for _, c := range scripted.Commands() {
+				commands = append(commands, commandVerb(c))
+				if commandVerb(c) == "cryptsetup erase" {
+					erased := c.Args[len(c.Args)-1]
+					if want := tt.wantErased; erased != want && !(want == "sparse file" && erased == sparseFile) {
+						t.Errorf("erased the keyslots of %s, want %s", erased, want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("ran %q, want %q", commands, tt.wantCommands)
+			}
+
+			content, err := ioutil.ReadFile(sparseFile)
+			if tt.wantFile == nil {
+				if !os.IsNotExist(err) {
+					t.Errorf("sparse file kept: %v", err)
+				}
+			} else if !bytes.Equal(content, tt.wantFile) {
+				t.Errorf("sparse file holds %d bytes starting with %q", len(content), content[:16])
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	sparseFile := filepath.Join(dir, "vol.img")
+	if err := ioutil.WriteFile(sparseFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mapper := filepath.Join(dir, "mapper", "vol")
+	fakeSysBlock(t, nil, "22 1 0:21 / /proc rw,nosuid - proc proc rw")
+
+	scripted := &ScriptedRunner{}
+	scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, true, "/dev/loop0", sparseFile)})
+	scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksClose"}, Result: CommandResult{ExitCode: 1, Stderr: "Cannot close the device."}})
+	loops := newFakeLoop()
+	loops.devices["/dev/loop0"] = sparseFile
+	m := &Manager{Runner: scripted, Loop: loops, LockDir: filepath.Join(dir, "locks"), StateDir: filepath.Join(dir, "state")}
+	ctx := context.Background()
+	if err := m.recordVolume(ctx, sparseFile, mapper, "/dev/loop0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.DeleteVolumeWithOptionsContext(ctx, mapper, DeleteOptions{}); err == nil {
+		t.Fatal("DeleteVolumeWithOptionsContext succeeded without closing the volume")
+	}
+	record, err := m.LookupVolume("vol")
+	if err != nil || !record.Deleting {
+		t.Fatalf("record after a failed deletion = %+v, %v", record, err)
+	}
+
+	// the volume is not reopened by RestoreAll
+	recorded := len(scripted.Commands())
+	results, err := m.RestoreAllContext(ctx, func(string) ([]byte, error) { return []byte("key"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Activated || results[0].Err == nil {
+		t.Errorf("RestoreAllContext() = %+v", results)
+	}
+	if got := scripted.Commands(); len(got) != recorded {
+		t.Errorf("ran %v for a volume being deleted", got[recorded:])
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package dm manages device-mapper devices through the /dev/mapper/control ioctls, without
+// shelling out to dmsetup or cryptsetup.
+package dm
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+var (
+	// ErrNotFound is returned when the device-mapper device does not exist.
+	ErrNotFound = errors.New("no such device-mapper device")
+	// ErrExists is returned when a device-mapper device of the same name or UUID exists.
+	ErrExists = errors.New("device-mapper device already exists")
+	// ErrBusy is returned when the device-mapper device is open and cannot be removed.
+	ErrBusy = errors.New("device-mapper device is busy")
+)
+
+// MapperDir is the directory of the device-mapper device nodes.
+const MapperDir = "/dev/mapper"
+
+// SectorSize is the unit of the start and length of the targets.
+const SectorSize = 512
+
+// Target is a line of a device-mapper table.
+type Target struct {
+	// Start and Length are in 512 byte sectors.
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+	// Type is the target type, e.g. "crypt".
+	Type string `json:"type"`
+	// Params are the parameters of the target. The parameters of a crypt target hold its key.
+	Params string `json:"-"`
+}
+
+// Options are the settings of a device-mapper device created by Create.
+type Options struct {
+	// UUID identifies the device, e.g. CRYPT-LUKS2-<uuid>-<name> for a LUKS2 volume.
+	UUID string
+	// ReadOnly creates a read-only device.
+	ReadOnly bool
+}
+
+// Info describes the state of a device-mapper device.
+type Info struct {
+	Name        string `json:"name"`
+	UUID        string `json:"uuid"`
+	Major       uint32 `json:"major"`
+	Minor       uint32 `json:"minor"`
+	OpenCount   int    `json:"open_count"`
+	TargetCount int    `json:"target_count"`
+	ReadOnly    bool   `json:"read_only"`
+	Suspended   bool   `json:"suspended"`
+	// ActiveTable is set when the device has a live table.
+	ActiveTable bool `json:"active_table"`
+}
+
+// DevicePath returns the path of the device node of a device-mapper device.
+func DevicePath(name string) string {
+	return filepath.Join(MapperDir, name)
+}
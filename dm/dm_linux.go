@@ -0,0 +1,347 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctl commands, flags and sizes from linux/dm-ioctl.h
+const (
+	dmDevCreate   = 3
+	dmDevRemove   = 4
+	dmDevSuspend  = 6
+	dmDevStatus   = 7
+	dmTableLoad   = 9
+	dmTableStatus = 12
+
+	dmReadOnlyFlag      = 1 << 0
+	dmSuspendFlag       = 1 << 1
+	dmStatusTableFlag   = 1 << 4
+	dmActivePresentFlag = 1 << 5
+	dmBufferFullFlag    = 1 << 8
+	dmSecureDataFlag    = 1 << 15
+
+	dmVersionMajor = 4
+
+	dmNameLen        = 128
+	dmUUIDLen        = 129
+	dmMaxTypeName    = 16
+	dmIoctlSize      = 312
+	dmTargetSpecSize = 40
+
+	controlPath = "/dev/mapper/control"
+
+	// size of the buffer passed to the ioctls, doubled when the kernel reports it is too small
+	dmBufferSize    = 16 * 1024
+	dmMaxBufferSize = 1024 * 1024
+)
+
+// dmIoctl mirrors struct dm_ioctl
+type dmIoctl struct {
+	version     [3]uint32
+	dataSize    uint32
+	dataStart   uint32
+	targetCount uint32
+	openCount   int32
+	flags       uint32
+	eventNr     uint32
+	padding     uint32
+	dev         uint64
+	name        [dmNameLen]byte
+	uuid        [dmUUIDLen]byte
+	data        [7]byte
+}
+
+// dmTargetSpec mirrors struct dm_target_spec, the target parameters follow it
+type dmTargetSpec struct {
+	sectorStart uint64
+	length      uint64
+	status      int32
+	next        uint32
+	targetType  [dmMaxTypeName]byte
+}
+
+// Create creates a device-mapper device with the given table and returns its device path.
+//
+// The device is created, its table loaded and the device resumed, like dmsetup create. The device
+// is removed again when a step fails. The device node is created when udev does not create it.
+// The kernel wipes its copies of the table, which holds the key of crypt targets.
+func Create(name string, targets []Target, opts Options) (string, error) {
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+	if len(opts.UUID) >= dmUUIDLen {
+		return "", fmt.Errorf("device-mapper UUID %q is too long", opts.UUID)
+	}
+	if len(targets) == 0 {
+		return "", fmt.Errorf("no targets given for %s", name)
+	}
+
+	control, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s: %s", controlPath, err.Error())
+	}
+	defer control.Close()
+
+	buf := newRequest(name, 0, dmIoctlSize)
+	copy(header(buf).uuid[:dmUUIDLen-1], opts.UUID)
+	if err = ioctl(control.Fd(), dmDevCreate, buf); err != nil {
+		return "", fmt.Errorf("error creating %s: %w", name, mapErrno(err))
+	}
+	dev := header(buf).dev
+
+	if err = loadTable(control.Fd(), name, targets, opts.ReadOnly); err == nil {
+		// resuming the device makes the loaded table live
+		err = ioctl(control.Fd(), dmDevSuspend, newRequest(name, 0, dmIoctlSize))
+	}
+	if err != nil {
+		ioctl(control.Fd(), dmDevRemove, newRequest(name, 0, dmIoctlSize))
+		return "", fmt.Errorf("error activating %s: %w", name, mapErrno(err))
+	}
+
+	device := DevicePath(name)
+	if err = createNode(device, dev); err != nil {
+		ioctl(control.Fd(), dmDevRemove, newRequest(name, 0, dmIoctlSize))
+		return "", fmt.Errorf("error creating the device node of %s: %s", name, err.Error())
+	}
+	return device, nil
+}
+
+// Remove removes the device-mapper device. ErrBusy is returned while the device is open, e.g.
+// mounted.
+func Remove(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	control, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", controlPath, err.Error())
+	}
+	defer control.Close()
+
+	if err = ioctl(control.Fd(), dmDevRemove, newRequest(name, 0, dmIoctlSize)); err != nil {
+		return fmt.Errorf("error removing %s: %w", name, mapErrno(err))
+	}
+	// udev removes the nodes it created, a node created by Create is removed here
+	if err = os.Remove(DevicePath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing the device node of %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// GetInfo returns the state of the device-mapper device.
+func GetInfo(name string) (*Info, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	control, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s", controlPath, err.Error())
+	}
+	defer control.Close()
+
+	buf := newRequest(name, 0, dmIoctlSize)
+	if err = ioctl(control.Fd(), dmDevStatus, buf); err != nil {
+		return nil, fmt.Errorf("error reading the status of %s: %w", name, mapErrno(err))
+	}
+	return info(header(buf)), nil
+}
+
+// GetTable returns the live table of the device-mapper device. The parameters of crypt targets
+// hold their key, in hex or as a kernel keyring reference.
+func GetTable(name string) ([]Target, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	control, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s", controlPath, err.Error())
+	}
+	defer control.Close()
+
+	for size := dmBufferSize; size <= dmMaxBufferSize; size *= 2 {
+		buf := newRequest(name, dmStatusTableFlag|dmSecureDataFlag, size)
+		if err = ioctl(control.Fd(), dmTableStatus, buf); err != nil {
+			return nil, fmt.Errorf("error reading the table of %s: %w", name, mapErrno(err))
+		}
+		if header(buf).flags&dmBufferFullFlag != 0 {
+			continue
+		}
+		targets := parseTargets(buf)
+		// the table may hold a key, wipe it from the buffer
+		wipe(buf)
+		return targets, nil
+	}
+	return nil, fmt.Errorf("error reading the table of %s: table larger than %d bytes", name, dmMaxBufferSize)
+}
+
+// loadTable loads the targets in the inactive table of the device.
+func loadTable(fd uintptr, name string, targets []Target, readOnly bool) error {
+	buf, err := tableRequest(name, targets, readOnly)
+	if err != nil {
+		return err
+	}
+	// the parameters of crypt targets hold the key, wipe them once loaded
+	defer wipe(buf)
+	return ioctl(fd, dmTableLoad, buf)
+}
+
+// tableRequest returns the DM_TABLE_LOAD buffer of the targets.
+func tableRequest(name string, targets []Target, readOnly bool) ([]byte, error) {
+	size := dmIoctlSize
+	for _, target := range targets {
+		size += targetSpecSize(target)
+	}
+	flags := uint32(dmSecureDataFlag)
+	if readOnly {
+		flags |= dmReadOnlyFlag
+	}
+	buf := newRequest(name, flags, size)
+	header(buf).targetCount = uint32(len(targets))
+
+	offset := dmIoctlSize
+	for _, target := range targets {
+		if len(target.Type) >= dmMaxTypeName {
+			wipe(buf)
+			return nil, fmt.Errorf("invalid target type %q", target.Type)
+		}
+		spec := (*dmTargetSpec)(unsafe.Pointer(&buf[offset]))
+		spec.sectorStart = target.Start
+		spec.length = target.Length
+		spec.next = uint32(targetSpecSize(target))
+		copy(spec.targetType[:], target.Type)
+		copy(buf[offset+dmTargetSpecSize:], target.Params)
+		offset += targetSpecSize(target)
+	}
+	return buf, nil
+}
+
+// targetSpecSize is the size of the target spec and its NUL terminated parameters, aligned on 8
+// bytes.
+func targetSpecSize(target Target) int {
+	return (dmTargetSpecSize + len(target.Params) + 1 + 7) &^ 7
+}
+
+// parseTargets reads the targets returned by DM_TABLE_STATUS. The targets are read up to the
+// first spec that does not fit the data or is not aligned, or whose next spec is not after it.
+func parseTargets(buf []byte) []Target {
+	hdr := header(buf)
+	dataSize := int(hdr.dataSize)
+	if dataSize > len(buf) {
+		dataSize = len(buf)
+	}
+	targets := []Target{}
+	start := int(hdr.dataStart)
+	offset := start
+	for i := 0; i < int(hdr.targetCount) && offset >= dmIoctlSize && offset%8 == 0 && offset+dmTargetSpecSize <= dataSize; i++ {
+		spec := (*dmTargetSpec)(unsafe.Pointer(&buf[offset]))
+		params := buf[offset+dmTargetSpecSize : dataSize]
+		if end := bytes.IndexByte(params, 0); end >= 0 {
+			params = params[:end]
+		}
+		targets = append(targets, Target{
+			Start:  spec.sectorStart,
+			Length: spec.length,
+			Type:   string(bytes.TrimRight(spec.targetType[:], "\x00")),
+			Params: string(params),
+		})
+		// on output next is relative to the first target spec
+		next := start + int(spec.next)
+		if next <= offset {
+			break
+		}
+		offset = next
+	}
+	return targets
+}
+
+func info(hdr *dmIoctl) *Info {
+	return &Info{
+		Name:        string(bytes.TrimRight(hdr.name[:], "\x00")),
+		UUID:        string(bytes.TrimRight(hdr.uuid[:], "\x00")),
+		Major:       unix.Major(hdr.dev),
+		Minor:       unix.Minor(hdr.dev),
+		OpenCount:   int(hdr.openCount),
+		TargetCount: int(hdr.targetCount),
+		ReadOnly:    hdr.flags&dmReadOnlyFlag != 0,
+		Suspended:   hdr.flags&dmSuspendFlag != 0,
+		ActiveTable: hdr.flags&dmActivePresentFlag != 0,
+	}
+}
+
+// createNode creates the block device node of the device, unless udev already did.
+func createNode(device string, dev uint64) error {
+	if _, err := os.Stat(device); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(MapperDir, 0755); err != nil {
+		return err
+	}
+	err := unix.Mknod(device, unix.S_IFBLK|0660, int(dev))
+	if err == unix.EEXIST {
+		return nil
+	}
+	return err
+}
+
+// newRequest returns an ioctl buffer of size bytes for the named device.
+func newRequest(name string, flags uint32, size int) []byte {
+	buf := make([]byte, size)
+	hdr := header(buf)
+	hdr.version = [3]uint32{dmVersionMajor, 0, 0}
+	hdr.dataSize = uint32(size)
+	hdr.dataStart = dmIoctlSize
+	hdr.flags = flags
+	copy(hdr.name[:dmNameLen-1], name)
+	return buf
+}
+
+func header(buf []byte) *dmIoctl {
+	return (*dmIoctl)(unsafe.Pointer(&buf[0]))
+}
+
+func validateName(name string) error {
+	if name == "" || len(name) >= dmNameLen || bytes.ContainsAny([]byte(name), "/\x00") {
+		return fmt.Errorf("invalid device-mapper name %q", name)
+	}
+	return nil
+}
+
+func mapErrno(err error) error {
+	switch err {
+	case unix.ENXIO:
+		return ErrNotFound
+	case unix.EEXIST:
+		return ErrExists
+	case unix.EBUSY:
+		return ErrBusy
+	}
+	return err
+}
+
+func wipe(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+func ioctl(fd uintptr, cmd uintptr, buf []byte) error {
+	// _IOWR(DM_IOCTL, cmd, struct dm_ioctl)
+	req := uintptr(3<<30|dmIoctlSize<<16|0xfd<<8) | cmd
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
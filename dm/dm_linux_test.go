@@ -0,0 +1,141 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package dm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+var testTargets = []Target{
+	{Start: 0, Length: 2048, Type: "crypt", Params: "aes-xts-plain64 " + strings.Repeat("0f", 64) + " 0 7:0 32768"},
+	{Start: 2048, Length: 8, Type: "linear", Params: "7:1 0"},
+	{Start: 2056, Length: 8, Type: "zero"},
+}
+
+// specAt returns the target spec at offset in the ioctl buffer
+func specAt(buf []byte, offset int) *dmTargetSpec {
+	return (*dmTargetSpec)(unsafe.Pointer(&buf[offset]))
+}
+
+// statusBuffer returns the targets laid out like the answer of DM_TABLE_STATUS, where next is
+// relative to the first target spec rather than to the spec it is in
+func statusBuffer(t *testing.T, targets []Target) []byte {
+	buf, err := tableRequest("vol", targets, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := dmIoctlSize
+	for range targets {
+		spec := specAt(buf, offset)
+		offset += int(spec.next)
+		spec.next = uint32(offset - dmIoctlSize)
+	}
+	return buf
+}
+
+func TestTargetSpecSize(t *testing.T) {
+	for params, want := range map[string]int{"": 48, "7:1 0": 48, "1234567": 48, "12345678": 56} {
+		if got := targetSpecSize(Target{Params: params}); got != want {
+			t.Errorf("targetSpecSize() of %q = %d, want %d", params, got, want)
+		}
+	}
+}
+
+func TestTableRequest(t *testing.T) {
+	buf, err := tableRequest("vol", testTargets, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := header(buf)
+	if hdr.targetCount != uint32(len(testTargets)) || hdr.dataStart != dmIoctlSize || int(hdr.dataSize) != len(buf) {
+		t.Errorf("header %+v", hdr)
+	}
+	if hdr.flags&dmReadOnlyFlag == 0 || hdr.flags&dmSecureDataFlag == 0 {
+		t.Errorf("flags %#x, want read-only and secure data", hdr.flags)
+	}
+
+	// on input next is the size of the spec and its parameters
+	offset := dmIoctlSize
+	for _, target := range testTargets {
+		spec := specAt(buf, offset)
+		if int(spec.next) != targetSpecSize(target) || spec.sectorStart != target.Start || spec.length != target.Length {
+			t.Errorf("spec of %s = %+v", target.Type, spec)
+		}
+		offset += int(spec.next)
+	}
+	if offset != len(buf) {
+		t.Errorf("specs end at %d of %d bytes", offset, len(buf))
+	}
+
+	if _, err = tableRequest("vol", []Target{{Type: strings.Repeat("t", dmMaxTypeName)}}, false); err == nil {
+		t.Error("tableRequest() accepted a target type too long")
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	if got := parseTargets(statusBuffer(t, testTargets)); !reflect.DeepEqual(got, testTargets) {
+		t.Errorf("parseTargets() = %+v, want %+v", got, testTargets)
+	}
+
+	tests := []struct {
+		name string
+		edit func(buf []byte)
+		want []Target
+	}{
+		{
+			name: "next does not move forward",
+			edit: func(buf []byte) { specAt(buf, dmIoctlSize).next = 0 },
+			want: testTargets[:1],
+		},
+		{
+			name: "next moves backward",
+			edit: func(buf []byte) {
+				second := dmIoctlSize + targetSpecSize(testTargets[0])
+				specAt(buf, second).next = 8
+			},
+			want: testTargets[:2],
+		},
+		{
+			name: "next past the data",
+			edit: func(buf []byte) { specAt(buf, dmIoctlSize).next = 1 << 31 },
+			want: testTargets[:1],
+		},
+		{
+			name: "next not aligned",
+			edit: func(buf []byte) { specAt(buf, dmIoctlSize).next++ },
+			want: testTargets[:1],
+		},
+		{
+			name: "more targets than the data holds",
+			edit: func(buf []byte) { header(buf).targetCount = 1 << 30 },
+			want: testTargets,
+		},
+		{
+			name: "data size past the buffer",
+			edit: func(buf []byte) { header(buf).dataSize = 1 << 30 },
+			want: testTargets,
+		},
+		{
+			name: "data start in the header",
+			edit: func(buf []byte) { header(buf).dataStart = 0 },
+			want: []Target{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := statusBuffer(t, testTargets)
+			tt.edit(buf)
+			if got := parseTargets(buf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTargets() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package dm
+
+import "fmt"
+
+// WARNING : Product does not work on windows  - stub implementation only
+
+// Create creates a device-mapper device with the given table and returns its device path.
+func Create(name string, targets []Target, opts Options) (string, error) {
+	return "", fmt.Errorf("function not implemented on Windows")
+}
+
+// Remove removes the device-mapper device.
+func Remove(name string) error {
+	return fmt.Errorf("function not implemented on Windows")
+}
+
+// GetInfo returns the state of the device-mapper device.
+func GetInfo(name string) (*Info, error) {
+	return nil, fmt.Errorf("function not implemented on Windows")
+}
+
+// GetTable returns the live table of the device-mapper device.
+func GetTable(name string) ([]Target, error) {
+	return nil, fmt.Errorf("function not implemented on Windows")
+}
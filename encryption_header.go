@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/common/v4/crypt"
+	"strings"
+)
+
+// Errors returned by ParseEncryptionHeader, as the kind of an *EncryptionHeaderError. Use
+// errors.Is to test for them.
+var (
+	ErrHeaderTruncated      = errors.New("encryption header truncated")
+	ErrNotEncrypted         = errors.New("not an encrypted image")
+	ErrUnsupportedVersion   = errors.New("unsupported encryption header version")
+	ErrUnsupportedAlgorithm = errors.New("unsupported encryption algorithm")
+	ErrInvalidHeaderField   = errors.New("invalid encryption header field")
+)
+
+const (
+	// size of crypt.EncryptionHeader as written to the files, and the largest data offset accepted
+	encryptionHeaderSize    = 44
+	maxEncryptionHeaderSize = 4096
+	// size of the V2 header, followed by the chunk size
+	encryptionHeaderSizeV2 = encryptionHeaderSize + 4
+)
+
+// key sizes in bytes of the encryption algorithms of the headers
+var encryptionKeySizes = map[string]int{
+	crypt.GCMEncryptionAlgorithm: 32,
+}
+
+// EncryptionHeader is the parsed header of an encrypted image, see ParseEncryptionHeader.
+type EncryptionHeader struct {
+	Version   string
+	Algorithm string
+	// KeySize is the size in bytes of the keys of Algorithm.
+	KeySize int
+	IV      [12]byte
+	// DataOffset is the offset of the encrypted data from the start of the image.
+	DataOffset uint32
+	// ChunkSize is the plaintext size of the chunks of a V2 image, zero for V1.
+	ChunkSize uint32
+}
+
+// EncryptionHeaderError reports the field of an encryption header that is missing or invalid.
+//
+// Kind is one of ErrHeaderTruncated, ErrNotEncrypted, ErrUnsupportedVersion,
+// ErrUnsupportedAlgorithm or ErrInvalidHeaderField.
+type EncryptionHeaderError struct {
+	Field  string
+	Kind   error
+	Detail string
+}
+
+func (e *EncryptionHeaderError) Error() string {
+	msg := e.Kind.Error()
+	if e.Field != "" {
+		msg += ": " + e.Field
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Is reports whether target is the kind of the error.
+func (e *EncryptionHeaderError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// ParseEncryptionHeader is used to parse and check the header at the start of an encrypted image.
+//
+// Input Parameters:
+//
+// 	data – The encrypted image, or at least its bytes up to the encrypted data.
+//
+// The header is decoded field by field with the layout of crypt.EncryptionHeader: the magic
+// text, the little endian data offset, the version, the IV and the encryption algorithm. The
+// magic text must start with crypt.EncryptionHeaderMagicText, the version V1 or V2 and the algorithm
+// crypt.GCMEncryptionAlgorithm. The data offset must point past the header, at most 4096 bytes
+// from the start of the image and within data. The chunk size and the nonce prefix of V2
+// headers are checked as well. An *EncryptionHeaderError is returned for the first field that
+// does not pass.
+func ParseEncryptionHeader(data []byte) (*EncryptionHeader, error) {
+	if len(data) < encryptionHeaderSize {
+		return nil, &EncryptionHeaderError{Kind: ErrHeaderTruncated,
+			Detail: fmt.Sprintf("%d bytes, at least %d expected", len(data), encryptionHeaderSize)}
+	}
+	// matched like crypt.EncryptionHeaderExists, the rest of the field is not checked
+	if !strings.HasPrefix(string(data[0:12]), crypt.EncryptionHeaderMagicText) {
+		return nil, &EncryptionHeaderError{Field: "magic text", Kind: ErrNotEncrypted}
+	}
+
+	header := &EncryptionHeader{
+		Version:    cString(data[16:20]),
+		Algorithm:  cString(data[32:44]),
+		DataOffset: binary.LittleEndian.Uint32(data[12:16]),
+	}
+	copy(header.IV[:], data[20:32])
+
+	minOffset := uint32(encryptionHeaderSize)
+	switch header.Version {
+	case crypt.EncryptionHeaderVersion:
+	case EncryptionHeaderVersionV2:
+		minOffset = encryptionHeaderSizeV2
+	default:
+		return nil, &EncryptionHeaderError{Field: "version", Kind: ErrUnsupportedVersion, Detail: fmt.Sprintf("%q", header.Version)}
+	}
+	keySize, ok := encryptionKeySizes[header.Algorithm]
+	if !ok {
+		return nil, &EncryptionHeaderError{Field: "algorithm", Kind: ErrUnsupportedAlgorithm, Detail: fmt.Sprintf("%q", header.Algorithm)}
+	}
+	header.KeySize = keySize
+
+	if header.DataOffset < minOffset || header.DataOffset > maxEncryptionHeaderSize {
+		return nil, &EncryptionHeaderError{Field: "offset", Kind: ErrInvalidHeaderField,
+			Detail: fmt.Sprintf("%d not between %d and %d", header.DataOffset, minOffset, maxEncryptionHeaderSize)}
+	}
+	if uint64(header.DataOffset) > uint64(len(data)) {
+		return nil, &EncryptionHeaderError{Field: "offset", Kind: ErrHeaderTruncated,
+			Detail: fmt.Sprintf("data offset %d beyond the %d bytes given", header.DataOffset, len(data))}
+	}
+
+	if header.Version == EncryptionHeaderVersionV2 {
+		header.ChunkSize = binary.LittleEndian.Uint32(data[encryptionHeaderSize:encryptionHeaderSizeV2])
+		if header.ChunkSize == 0 || header.ChunkSize > maxStreamChunkSize {
+			return nil, &EncryptionHeaderError{Field: "chunk size", Kind: ErrInvalidHeaderField,
+				Detail: fmt.Sprintf("%d not between 1 and %d", header.ChunkSize, maxStreamChunkSize)}
+		}
+		for _, b := range header.IV[streamNoncePrefixSize:] {
+			if b != 0 {
+				return nil, &EncryptionHeaderError{Field: "IV", Kind: ErrInvalidHeaderField,
+					Detail: fmt.Sprintf("only its first %d bytes should be set", streamNoncePrefixSize)}
+			}
+		}
+	}
+	return header, nil
+}
+
+// newEncryptionHeader returns the header of an image of the version, with the data at offset.
+func newEncryptionHeader(version string, offset uint32) crypt.EncryptionHeader {
+	var header crypt.EncryptionHeader
+	copy(header.MagicText[:], crypt.EncryptionHeaderMagicText)
+	header.OffsetInLittleEndian = offset
+	copy(header.Version[:], version)
+	copy(header.EncryptionAlgorithm[:], crypt.GCMEncryptionAlgorithm)
+	return header
+}
+
+// marshalEncryptionHeader encodes the header with the layout of the crypt.EncryptionHeader
+// struct, the offset in little endian.
+func marshalEncryptionHeader(header crypt.EncryptionHeader) []byte {
+	rawHeader := make([]byte, encryptionHeaderSize)
+	copy(rawHeader[0:12], header.MagicText[:])
+	binary.LittleEndian.PutUint32(rawHeader[12:16], header.OffsetInLittleEndian)
+	copy(rawHeader[16:20], header.Version[:])
+	copy(rawHeader[20:32], header.IV[:])
+	copy(rawHeader[32:44], header.EncryptionAlgorithm[:])
+	return rawHeader
+}
+
+// cString returns the NUL padded string of a header field.
+func cString(field []byte) string {
+	return strings.TrimRight(string(field), "\x00")
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"encoding/binary"
+	"errors"
+	"intel/isecl/lib/common/v4/crypt"
+	"testing"
+)
+
+// rawHeader returns a valid header of the version, followed by the chunk size of V2 and padded
+// with zeros up to size.
+func rawHeader(version string, size int) []byte {
+	offset := uint32(encryptionHeaderSize)
+	if version == EncryptionHeaderVersionV2 {
+		offset = encryptionHeaderSizeV2
+	}
+	header := newEncryptionHeader(version, offset)
+	copy(header.IV[:], "0123456")
+	raw := marshalEncryptionHeader(header)
+	if version == EncryptionHeaderVersionV2 {
+		raw = append(raw, make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(raw[encryptionHeaderSize:], streamChunkSize)
+	}
+	if len(raw) < size {
+		raw = append(raw, make([]byte, size-len(raw))...)
+	}
+	return raw
+}
+
+func TestParseEncryptionHeader(t *testing.T) {
+	edit := func(raw []byte, edit func(raw []byte)) []byte {
+		edit(raw)
+		return raw
+	}
+	setOffset := func(offset uint32) func(raw []byte) {
+		return func(raw []byte) { binary.LittleEndian.PutUint32(raw[12:16], offset) }
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantErr   error
+		wantField string
+	}{
+		{name: "V1", data: rawHeader("V1", 100)},
+		{name: "V1 without data", data: rawHeader("V1", 0)},
+		{name: "V2", data: rawHeader(EncryptionHeaderVersionV2, 100)},
+		{name: "V1 with a larger offset", data: edit(rawHeader("V1", maxEncryptionHeaderSize), setOffset(maxEncryptionHeaderSize))},
+		{
+			// external tools may pad the magic text with other bytes than NULs
+			name: "magic text followed by spaces",
+			data: edit(rawHeader("V1", 100), func(raw []byte) { copy(raw[len(crypt.EncryptionHeaderMagicText):12], "    ") }),
+		},
+		{name: "empty", data: nil, wantErr: ErrHeaderTruncated},
+		{name: "truncated", data: rawHeader("V1", 0)[:encryptionHeaderSize-1], wantErr: ErrHeaderTruncated},
+		{name: "V2 truncated", data: rawHeader(EncryptionHeaderVersionV2, 0)[:encryptionHeaderSize], wantErr: ErrHeaderTruncated, wantField: "offset"},
+		{name: "no magic text", data: make([]byte, 100), wantErr: ErrNotEncrypted, wantField: "magic text"},
+		{name: "other magic text", data: edit(rawHeader("V1", 100), func(raw []byte) { raw[0] ^= 0x20 }), wantErr: ErrNotEncrypted, wantField: "magic text"},
+		{name: "unknown version", data: edit(rawHeader("V1", 100), func(raw []byte) { copy(raw[16:20], "V3") }), wantErr: ErrUnsupportedVersion, wantField: "version"},
+		{name: "unknown algorithm", data: edit(rawHeader("V1", 100), func(raw []byte) { copy(raw[32:44], "AES-CBC\x00\x00\x00\x00\x00") }), wantErr: ErrUnsupportedAlgorithm, wantField: "algorithm"},
+		{name: "offset in the header", data: edit(rawHeader("V1", 100), setOffset(encryptionHeaderSize-1)), wantErr: ErrInvalidHeaderField, wantField: "offset"},
+		{name: "V2 offset in the chunk size", data: edit(rawHeader(EncryptionHeaderVersionV2, 100), setOffset(encryptionHeaderSize)), wantErr: ErrInvalidHeaderField, wantField: "offset"},
+		{name: "offset too large", data: edit(rawHeader("V1", 8192), setOffset(maxEncryptionHeaderSize+1)), wantErr: ErrInvalidHeaderField, wantField: "offset"},
+		{name: "offset past the data", data: edit(rawHeader("V1", 100), setOffset(101)), wantErr: ErrHeaderTruncated, wantField: "offset"},
+		{name: "largest offset", data: edit(rawHeader("V1", 100), setOffset(^uint32(0))), wantErr: ErrInvalidHeaderField, wantField: "offset"},
+		{
+			name:      "no chunk size",
+			data:      edit(rawHeader(EncryptionHeaderVersionV2, 100), func(raw []byte) { binary.LittleEndian.PutUint32(raw[encryptionHeaderSize:], 0) }),
+			wantErr:   ErrInvalidHeaderField,
+			wantField: "chunk size",
+		},
+		{
+			name:      "chunk size too large",
+			data:      edit(rawHeader(EncryptionHeaderVersionV2, 100), func(raw []byte) { binary.LittleEndian.PutUint32(raw[encryptionHeaderSize:], maxStreamChunkSize+1) }),
+			wantErr:   ErrInvalidHeaderField,
+			wantField: "chunk size",
+		},
+		{
+			name:      "V2 IV past the nonce prefix",
+			data:      edit(rawHeader(EncryptionHeaderVersionV2, 100), func(raw []byte) { raw[20+streamNoncePrefixSize] = 1 }),
+			wantErr:   ErrInvalidHeaderField,
+			wantField: "IV",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := ParseEncryptionHeader(tt.data)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("ParseEncryptionHeader failed: %v", err)
+				}
+				if header.KeySize != 32 || header.Algorithm != crypt.GCMEncryptionAlgorithm || string(header.IV[:7]) != "0123456" {
+					t.Fatalf("got header %+v", header)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			var headerErr *EncryptionHeaderError
+			if !errors.As(err, &headerErr) || headerErr.Field != tt.wantField {
+				t.Fatalf("got error %#v, want field %q", err, tt.wantField)
+			}
+		})
+	}
+}
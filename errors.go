@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors describing why a volume operation failed. Use errors.Is to test for them.
+var (
+	ErrAlreadyExists = errors.New("already exists")
+	ErrBusy          = errors.New("device or resource busy")
+	ErrNotFound      = errors.New("not found")
+	ErrWrongKey      = errors.New("wrong key")
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrNotLUKS       = errors.New("not a LUKS device")
+	ErrSizeMismatch  = errors.New("size mismatch")
+	ErrCommandFailed = errors.New("command failed")
+	ErrLocked        = errors.New("locked by another operation")
+)
+
+// cryptsetup exit codes, see cryptsetup(8)
+const (
+	cryptsetupExitWrongKey      = 2
+	cryptsetupExitWrongDevice   = 4
+	cryptsetupExitAlreadyExists = 5
+)
+
+// VolumeError records a failed volume operation along with the path it failed on.
+//
+// Kind is one of the sentinel errors, or nil when the failure does not fit any of them.
+// Err is the underlying cause, usually a *CommandError or a syscall error.
+type VolumeError struct {
+	Op   string
+	Path string
+	Kind error
+	Err  error
+}
+
+func (e *VolumeError) Error() string {
+	msg := e.Op
+	if e.Path != "" {
+		msg += " " + e.Path
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is reports whether target is the kind of the error.
+func (e *VolumeError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *VolumeError) Unwrap() error {
+	return e.Err
+}
+
+// CommandError reports an external command that could not be run or exited with a non zero status.
+// Arguments that may hold secrets are redacted.
+type CommandError struct {
+	Command    string
+	Args       []string
+	ExitStatus int
+	Stderr     string
+	// Err is set when the command could not be started, ExitStatus is -1 in that case.
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s could not be run: %s", e.Command, e.Err.Error())
+	}
+	msg := fmt.Sprintf("%s exited with status %d", e.Command, e.ExitStatus)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+// Is reports whether target is ErrCommandFailed.
+func (e *CommandError) Is(target error) bool {
+	return target == ErrCommandFailed
+}
+
+// Unwrap returns the error that prevented the command from being started, if any.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// options whose value is redacted from the arguments kept in a CommandError
+var sensitiveOptions = map[string]bool{
+	"--key-file":        true,
+	"--new-keyfile":     true,
+	"--master-key-file": true,
+	"--volume-key-file": true,
+	"--key-description": true,
+}
+
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		redacted[i] = args[i]
+		if option := strings.SplitN(args[i], "=", 2); len(option) == 2 && sensitiveOptions[option[0]] {
+			redacted[i] = option[0] + "=REDACTED"
+		} else if sensitiveOptions[args[i]] && i+1 < len(args) {
+			i++
+			redacted[i] = "REDACTED"
+		}
+	}
+	return redacted
+}
+
+// cryptsetupError wraps an error returned by a cryptsetup command in a VolumeError, deriving its
+// kind from the exit status and the error output.
+func cryptsetupError(op, path string, err error) error {
+	volumeErr := &VolumeError{Op: op, Path: path, Err: err}
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return volumeErr
+	}
+	stderr := strings.ToLower(cmdErr.Stderr)
+	switch {
+	case strings.Contains(stderr, "not a valid luks device"):
+		volumeErr.Kind = ErrNotLUKS
+	case cmdErr.ExitStatus == cryptsetupExitWrongKey:
+		volumeErr.Kind = ErrWrongKey
+	case cmdErr.ExitStatus == cryptsetupExitWrongDevice:
+		volumeErr.Kind = ErrNotFound
+	case cmdErr.ExitStatus == cryptsetupExitAlreadyExists && (strings.Contains(stderr, "in use") || strings.Contains(stderr, "busy")):
+		volumeErr.Kind = ErrBusy
+	case cmdErr.ExitStatus == cryptsetupExitAlreadyExists:
+		volumeErr.Kind = ErrAlreadyExists
+	}
+	return volumeErr
+}
+
+// RollbackError is returned when an operation failed and undoing the steps it had completed
+// failed as well. Err is the error the operation failed with.
+type RollbackError struct {
+	Err          error
+	RollbackErrs []error
+}
+
+func (e *RollbackError) Error() string {
+	msg := e.Err.Error() + "; rollback failed:"
+	for i, err := range e.RollbackErrs {
+		if i > 0 {
+			msg += ";"
+		}
+		msg += " " + err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the error the operation failed with.
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
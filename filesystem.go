@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Filesystem is the type of the filesystem created on a volume, as passed to mount(2).
+type Filesystem string
+
+// Filesystems supported by CreateVolumeWithOptions and detected by Mount
+const (
+	FilesystemExt4  Filesystem = "ext4"
+	FilesystemExt3  Filesystem = "ext3"
+	FilesystemExt2  Filesystem = "ext2"
+	FilesystemXFS   Filesystem = "xfs"
+	FilesystemBtrfs Filesystem = "btrfs"
+	FilesystemVFAT  Filesystem = "vfat"
+	// FilesystemNone leaves the volume as a raw block device, e.g. for VM disks.
+	FilesystemNone Filesystem = "none"
+)
+
+// ErrUnknownFilesystem is returned when no supported filesystem is found on a device.
+var ErrUnknownFilesystem = errors.New("no supported filesystem found")
+
+// MkfsOptions are the settings used when creating the filesystem of a volume.
+type MkfsOptions struct {
+	// Label is the filesystem label.
+	Label string
+	// ReservedBlocksPercent is the percentage of blocks reserved for the super-user. ext2/ext4 only.
+	// nil leaves the mkfs default.
+	ReservedBlocksPercent *int
+	// InodeRatio is the bytes-per-inode ratio. ext2/ext4 only.
+	InodeRatio int
+	// NoLazyInit initializes the inode tables and the journal at creation time instead of in the
+	// background after the first mount. ext2/ext4 only.
+	NoLazyInit bool
+}
+
+// superblock locations of the supported filesystems
+const (
+	extSuperblockOffset = 1024
+	extMagicOffset      = extSuperblockOffset + 0x38
+	extCompatOffset     = extSuperblockOffset + 0x5C
+	extIncompatOffset   = extSuperblockOffset + 0x60
+	extROCompatOffset   = extSuperblockOffset + 0x64
+	extMagic            = 0xEF53
+
+	extCompatHasJournal = 0x4
+	// incompat and ro_compat features that ext2 and ext3 do not support
+	extIncompatExt4  = 0x40 | 0x80 | 0x200 | 0x400 | 0x1000 | 0x8000 | 0x10000
+	extROCompatExt4  = 0x8 | 0x10 | 0x20 | 0x40 | 0x400
+	xfsMagic         = "XFSB"
+	btrfsMagicOffset = 0x10040
+	btrfsMagic       = "_BHRfS_M"
+	fatSignature     = 0xAA55
+	fat16TypeOffset  = 0x36
+	fat32TypeOffset  = 0x52
+
+	superblockProbeSize = btrfsMagicOffset + len(btrfsMagic)
+)
+
+// validate checks that the mkfs options apply to the filesystem.
+func (o MkfsOptions) validate(fs Filesystem) error {
+	extOnly := o.ReservedBlocksPercent != nil || o.InodeRatio != 0 || o.NoLazyInit
+	switch fs {
+	case FilesystemExt4, FilesystemExt3, FilesystemExt2:
+		if o.ReservedBlocksPercent != nil && (*o.ReservedBlocksPercent < 0 || *o.ReservedBlocksPercent > 50) {
+			return fmt.Errorf("reserved blocks percentage should be between 0 and 50")
+		}
+		if o.InodeRatio < 0 {
+			return fmt.Errorf("inode ratio should not be negative")
+		}
+		return nil
+	case FilesystemXFS, FilesystemBtrfs, FilesystemVFAT:
+		if extOnly {
+			return fmt.Errorf("reserved blocks, inode ratio and lazy init are only supported by ext filesystems")
+		}
+		if fs == FilesystemVFAT && len(o.Label) > 11 {
+			return fmt.Errorf("vfat labels are limited to 11 characters")
+		}
+		return nil
+	case FilesystemNone:
+		if extOnly || o.Label != "" {
+			return fmt.Errorf("mkfs options are not supported without a filesystem")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported filesystem %q", fs)
+}
+
+// mkfsCommand returns the command that creates the filesystem on the device.
+func (o MkfsOptions) mkfsCommand(fs Filesystem, device string) (string, []string) {
+	switch fs {
+	case FilesystemXFS:
+		args := []string{}
+		if o.Label != "" {
+			args = append(args, "-L", o.Label)
+		}
+		return "mkfs.xfs", append(args, device)
+	case FilesystemBtrfs:
+		args := []string{}
+		if o.Label != "" {
+			args = append(args, "-L", o.Label)
+		}
+		return "mkfs.btrfs", append(args, device)
+	case FilesystemVFAT:
+		args := []string{}
+		if o.Label != "" {
+			args = append(args, "-n", o.Label)
+		}
+		return "mkfs.vfat", append(args, device)
+	}
+
+	args := []string{"-v"}
+	if o.Label != "" {
+		args = append(args, "-L", o.Label)
+	}
+	if o.ReservedBlocksPercent != nil {
+		args = append(args, "-m", strconv.Itoa(*o.ReservedBlocksPercent))
+	}
+	if o.InodeRatio != 0 {
+		args = append(args, "-i", strconv.Itoa(o.InodeRatio))
+	}
+	if o.NoLazyInit {
+		extended := []string{"lazy_itable_init=0"}
+		if fs != FilesystemExt2 {
+			extended = append(extended, "lazy_journal_init=0")
+		}
+		args = append(args, "-E", strings.Join(extended, ","))
+	}
+	return "mkfs." + string(fs), append(args, device)
+}
+
+// detectFilesystem identifies the filesystem on the device by reading its superblock.
+func detectFilesystem(device string) (Filesystem, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	probe := make([]byte, superblockProbeSize)
+	n, err := io.ReadFull(file, probe)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("error reading the superblock: %w", err)
+	}
+	return probeFilesystem(probe[:n])
+}
+
+// probeFilesystem identifies the filesystem from the first bytes of a device.
+func probeFilesystem(probe []byte) (Filesystem, error) {
+	if len(probe) >= extROCompatOffset+4 && binary.LittleEndian.Uint16(probe[extMagicOffset:]) == extMagic {
+		compat := binary.LittleEndian.Uint32(probe[extCompatOffset:])
+		incompat := binary.LittleEndian.Uint32(probe[extIncompatOffset:])
+		roCompat := binary.LittleEndian.Uint32(probe[extROCompatOffset:])
+		switch {
+		case incompat&extIncompatExt4 != 0 || roCompat&extROCompatExt4 != 0:
+			return FilesystemExt4, nil
+		case compat&extCompatHasJournal != 0:
+			return FilesystemExt3, nil
+		}
+		return FilesystemExt2, nil
+	}
+
+	if bytes.HasPrefix(probe, []byte(xfsMagic)) {
+		return FilesystemXFS, nil
+	}
+
+	if len(probe) >= btrfsMagicOffset+len(btrfsMagic) && string(probe[btrfsMagicOffset:btrfsMagicOffset+len(btrfsMagic)]) == btrfsMagic {
+		return FilesystemBtrfs, nil
+	}
+
+	if len(probe) >= 512 && binary.LittleEndian.Uint16(probe[510:]) == fatSignature {
+		if bytes.HasPrefix(probe[fat16TypeOffset:], []byte("FAT")) || bytes.HasPrefix(probe[fat32TypeOffset:], []byte("FAT32")) {
+			return FilesystemVFAT, nil
+		}
+	}
+	return "", ErrUnknownFilesystem
+}
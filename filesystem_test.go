@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// extProbe returns the first bytes of a device holding an ext filesystem with the features
+func extProbe(compat, incompat, roCompat uint32) []byte {
+	probe := make([]byte, superblockProbeSize)
+	binary.LittleEndian.PutUint16(probe[extMagicOffset:], extMagic)
+	binary.LittleEndian.PutUint32(probe[extCompatOffset:], compat)
+	binary.LittleEndian.PutUint32(probe[extIncompatOffset:], incompat)
+	binary.LittleEndian.PutUint32(probe[extROCompatOffset:], roCompat)
+	return probe
+}
+
+// fatProbe returns the first bytes of a device holding a FAT filesystem of the type
+func fatProbe(typeOffset int, fsType string) []byte {
+	probe := make([]byte, superblockProbeSize)
+	copy(probe[typeOffset:], fsType)
+	binary.LittleEndian.PutUint16(probe[510:], fatSignature)
+	return probe
+}
+
+func TestProbeFilesystem(t *testing.T) {
+	xfs := make([]byte, superblockProbeSize)
+	copy(xfs, xfsMagic)
+	btrfs := make([]byte, superblockProbeSize)
+	copy(btrfs[btrfsMagicOffset:], btrfsMagic)
+	bootSector := make([]byte, superblockProbeSize)
+	binary.LittleEndian.PutUint16(bootSector[510:], fatSignature)
+
+	tests := []struct {
+		name    string
+		probe   []byte
+		want    Filesystem
+		wantErr error
+	}{
+		{"ext2", extProbe(0, 0x2, 0x1|0x2), FilesystemExt2, nil},
+		{"ext3", extProbe(extCompatHasJournal, 0x2, 0x1|0x2), FilesystemExt3, nil},
+		{"ext4 extents", extProbe(extCompatHasJournal, 0x2|0x40, 0x1), FilesystemExt4, nil},
+		{"ext4 without journal", extProbe(0, 0x2|0x40|0x200, 0x1), FilesystemExt4, nil},
+		{"ext4 metadata checksums", extProbe(extCompatHasJournal, 0x2, 0x400), FilesystemExt4, nil},
+		{"xfs", xfs, FilesystemXFS, nil},
+		{"btrfs", btrfs, FilesystemBtrfs, nil},
+		{"vfat FAT16", fatProbe(fat16TypeOffset, "FAT16   "), FilesystemVFAT, nil},
+		{"vfat FAT32", fatProbe(fat32TypeOffset, "FAT32   "), FilesystemVFAT, nil},
+		{"xfs on a short read", []byte(xfsMagic), FilesystemXFS, nil},
+		{"boot sector without FAT", bootSector, "", ErrUnknownFilesystem},
+		{"zeros", make([]byte, superblockProbeSize), "", ErrUnknownFilesystem},
+		{"truncated ext superblock", extProbe(0, 0x40, 0)[:extROCompatOffset], "", ErrUnknownFilesystem},
+		{"empty", nil, "", ErrUnknownFilesystem},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probeFilesystem(tt.probe)
+			if err != tt.wantErr {
+				t.Fatalf("probeFilesystem() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("probeFilesystem() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "device")
+	// shorter than the btrfs superblock, as small volumes are
+	if err := ioutil.WriteFile(device, extProbe(extCompatHasJournal, 0, 0)[:4096], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := detectFilesystem(device); err != nil || got != FilesystemExt3 {
+		t.Errorf("detectFilesystem() = %q, %v, want %q", got, err, FilesystemExt3)
+	}
+	if _, err := detectFilesystem(filepath.Join(dir, "missing")); err == nil {
+		t.Error("detectFilesystem() of a missing device succeeded")
+	}
+}
+
+func TestMkfsCommand(t *testing.T) {
+	five := 5
+	tests := []struct {
+		name     string
+		fs       Filesystem
+		opts     MkfsOptions
+		wantCmd  string
+		wantArgs []string
+	}{
+		{"ext4", FilesystemExt4, MkfsOptions{}, "mkfs.ext4", []string{"-v", "/dev/mapper/vol"}},
+		{
+			"ext4 with options", FilesystemExt4,
+			MkfsOptions{Label: "data", ReservedBlocksPercent: &five, InodeRatio: 65536, NoLazyInit: true},
+			"mkfs.ext4", []string{"-v", "-L", "data", "-m", "5", "-i", "65536", "-E", "lazy_itable_init=0,lazy_journal_init=0", "/dev/mapper/vol"},
+		},
+		{"ext3", FilesystemExt3, MkfsOptions{NoLazyInit: true}, "mkfs.ext3", []string{"-v", "-E", "lazy_itable_init=0,lazy_journal_init=0", "/dev/mapper/vol"}},
+		// ext2 has no journal to initialize
+		{"ext2", FilesystemExt2, MkfsOptions{NoLazyInit: true}, "mkfs.ext2", []string{"-v", "-E", "lazy_itable_init=0", "/dev/mapper/vol"}},
+		{"xfs", FilesystemXFS, MkfsOptions{}, "mkfs.xfs", []string{"/dev/mapper/vol"}},
+		{"xfs with label", FilesystemXFS, MkfsOptions{Label: "data"}, "mkfs.xfs", []string{"-L", "data", "/dev/mapper/vol"}},
+		{"btrfs with label", FilesystemBtrfs, MkfsOptions{Label: "data"}, "mkfs.btrfs", []string{"-L", "data", "/dev/mapper/vol"}},
+		{"vfat with label", FilesystemVFAT, MkfsOptions{Label: "DATA"}, "mkfs.vfat", []string{"-n", "DATA", "/dev/mapper/vol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := tt.opts.mkfsCommand(tt.fs, "/dev/mapper/vol")
+			if cmd != tt.wantCmd || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("mkfsCommand() = %s %q, want %s %q", cmd, args, tt.wantCmd, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestMkfsOptionsValidate(t *testing.T) {
+	five, negative, tooMany := 5, -1, 51
+	tests := []struct {
+		name    string
+		fs      Filesystem
+		opts    MkfsOptions
+		wantErr bool
+	}{
+		{"ext4", FilesystemExt4, MkfsOptions{Label: "data", ReservedBlocksPercent: &five, InodeRatio: 4096, NoLazyInit: true}, false},
+		{"ext4 negative reserved blocks", FilesystemExt4, MkfsOptions{ReservedBlocksPercent: &negative}, true},
+		{"ext4 too many reserved blocks", FilesystemExt4, MkfsOptions{ReservedBlocksPercent: &tooMany}, true},
+		{"ext2 negative inode ratio", FilesystemExt2, MkfsOptions{InodeRatio: -1}, true},
+		{"xfs", FilesystemXFS, MkfsOptions{Label: "data"}, false},
+		{"xfs with ext options", FilesystemXFS, MkfsOptions{NoLazyInit: true}, true},
+		{"btrfs with ext options", FilesystemBtrfs, MkfsOptions{InodeRatio: 4096}, true},
+		{"vfat", FilesystemVFAT, MkfsOptions{Label: "DATA"}, false},
+		{"vfat label too long", FilesystemVFAT, MkfsOptions{Label: "MORE THAN 11"}, true},
+		{"none", FilesystemNone, MkfsOptions{}, false},
+		{"none with label", FilesystemNone, MkfsOptions{Label: "data"}, true},
+		{"unknown", Filesystem("zfs"), MkfsOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(tt.fs); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"intel/isecl/lib/vml/v4/loop"
+	"os"
+	"strings"
+)
+
+// Actions taken by Collect
+const (
+	CollectClose  = "close"
+	CollectDetach = "detach"
+	CollectRemove = "remove"
+	CollectForget = "forget"
+)
+
+// CollectPolicy selects what Collect cleans up. The zero value is a dry run that cleans up nothing.
+type CollectPolicy struct {
+	// Apply performs the actions. When it is false Collect only reports the actions it would take.
+	Apply bool
+	// CloseMappers closes the orphaned dm-crypt mappings and, with DetachLoops, detaches the loop
+	// devices below them.
+	CloseMappers bool
+	// DetachLoops detaches the orphaned loop devices.
+	DetachLoops bool
+	// RemoveSparseFiles removes the orphaned sparse files along with their registry records.
+	// The data of the volumes is lost.
+	RemoveSparseFiles bool
+	// ForgetStaleRecords removes the registry records whose sparse file is gone.
+	ForgetStaleRecords bool
+}
+
+// CollectAction is an action taken, or planned on a dry run, by Collect.
+type CollectAction struct {
+	Action  string `json:"action"`
+	Target  string `json:"target"`
+	Applied bool   `json:"applied"`
+	// Err is the reason the action failed, nil when it succeeded or was not applied.
+	Err error `json:"-"`
+}
+
+// Collect is used to clean up the orphaned resources found by Scan.
+//
+// Input Parameters:
+//
+// 	report – The report returned by Scan.
+//
+// 	policy – The kinds of resources to clean up, and whether to actually do it.
+//
+// A failed action does not stop the others, it is reported with its error. The loop device below
+// a mapping is only detached once the mapping is closed. Mappings that were mounted or opened
+// since the scan are skipped.
+func Collect(report *ScanReport, policy CollectPolicy) ([]CollectAction, error) {
+	return DefaultManager.Collect(report, policy)
+}
+
+// Collect cleans up the orphaned resources like the package level Collect.
+func (m *Manager) Collect(report *ScanReport, policy CollectPolicy) ([]CollectAction, error) {
+	if report == nil {
+		return nil, errors.New("scan report not given")
+	}
+	ctx := context.Background()
+	actions := []CollectAction{}
+	apply := func(action, target string, do func() error) error {
+		result := CollectAction{Action: action, Target: target}
+		if policy.Apply {
+			result.Err = do()
+			result.Applied = result.Err == nil
+		}
+		actions = append(actions, result)
+		return result.Err
+	}
+
+	if policy.CloseMappers {
+		for _, mapper := range report.Mappers {
+			mapper := mapper
+			err := apply(CollectClose, mapper.DeviceMapperLocation, func() error {
+				return m.closeOrphanedMapper(ctx, mapper.DeviceMapperLocation)
+			})
+			// the loop device below a mapping that is still open is in use
+			if policy.DetachLoops && err == nil {
+				apply(CollectDetach, mapper.LoopDevice, func() error {
+					return m.detachOrphanedLoop(ctx, mapper.LoopDevice, mapper.BackingFile)
+				})
+			}
+		}
+	}
+
+	if policy.DetachLoops {
+		for _, orphan := range report.Loops {
+			orphan := orphan
+			apply(CollectDetach, orphan.Device, func() error {
+				return m.detachOrphanedLoop(ctx, orphan.Device, orphan.BackingFile)
+			})
+		}
+	}
+
+	if policy.RemoveSparseFiles {
+		for _, sparseFile := range report.SparseFiles {
+			sparseFile := sparseFile
+			apply(CollectRemove, sparseFile.Path, func() error {
+				return m.removeOrphanedSparseFile(ctx, sparseFile)
+			})
+		}
+	}
+
+	if policy.ForgetStaleRecords {
+		for _, record := range report.StaleRecords {
+			id := record.VolumeID
+			apply(CollectForget, id, func() error {
+				return m.forgetVolume(ctx, id)
+			})
+		}
+	}
+	return actions, nil
+}
+
+// closeOrphanedMapper closes the mapping unless it was mounted or opened since the scan.
+func (m *Manager) closeOrphanedMapper(ctx context.Context, deviceMapperLocation string) error {
+	unlock, err := m.lockVolume(ctx, "", deviceMapperLocation, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := m.volumeStatus(ctx, deviceMapperLocation)
+	if err != nil {
+		return err
+	}
+	if !status.Active {
+		return nil
+	}
+	if status.InUse || len(status.MountPoints) > 0 {
+		return &VolumeError{Op: "luksClose", Path: deviceMapperLocation, Kind: ErrBusy, Err: errors.New("volume is in use")}
+	}
+	return m.luksClose(ctx, deviceMapperLocation)
+}
+
+// detachOrphanedLoop detaches the loop device under the loop allocation lock, unless it was
+// detached, or bound to another file, since the scan.
+func (m *Manager) detachOrphanedLoop(ctx context.Context, device, backingFile string) error {
+	unlock, err := m.lock(ctx, loopLockName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := m.loop().BackingFile(device)
+	if errors.Is(err, loop.ErrNotLoopDevice) {
+		return nil
+	} else if err != nil {
+		return &VolumeError{Op: "detach", Path: device, Err: err}
+	}
+	if strings.TrimSuffix(current, deletedSuffix) != backingFile {
+		return &VolumeError{Op: "detach", Path: device, Kind: ErrBusy, Err: errors.New("loop device was bound to " + current + " since the scan")}
+	}
+
+	if err = m.loop().Detach(device); err != nil {
+		return &VolumeError{Op: "detach", Path: device, Err: err}
+	}
+	return nil
+}
+
+// removeOrphanedSparseFile removes the sparse file and its registry record, unless the sparse
+// file was attached to a loop device since the scan.
+func (m *Manager) removeOrphanedSparseFile(ctx context.Context, sparseFile OrphanedSparseFile) error {
+	unlock, err := m.lockVolume(ctx, sparseFile.Path, "", "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err = os.Stat(sparseFile.Path); err == nil {
+		if device, err := m.loop().FindByBackingFile(sparseFile.Path); err == nil {
+			return &VolumeError{Op: "remove", Path: sparseFile.Path, Kind: ErrBusy, Err: errors.New("sparse file is attached to " + device)}
+		} else if !errors.Is(err, loop.ErrNotFound) {
+			return &VolumeError{Op: "remove", Path: sparseFile.Path, Err: err}
+		}
+		if err = os.Remove(sparseFile.Path); err != nil && !os.IsNotExist(err) {
+			return &VolumeError{Op: "remove", Path: sparseFile.Path, Err: err}
+		}
+	} else if !os.IsNotExist(err) {
+		return &VolumeError{Op: "remove", Path: sparseFile.Path, Err: err}
+	}
+	return m.forgetVolume(ctx, sparseFile.VolumeID)
+}
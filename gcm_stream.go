@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	gcmBlockSize = 16
+	gcmTagSize   = 16
+	gcmNonceSize = 12
+	// largest plaintext of an AES-GCM message, 2^32 - 2 blocks
+	gcmMaxPlaintextSize = (1<<32 - 2) * gcmBlockSize
+)
+
+// errGCMTooLarge is returned when a message exceeds the size limit of AES-GCM.
+var errGCMTooLarge = errors.New("message exceeds the AES-GCM size limit")
+
+// gcmStreamOpener decrypts an AES-GCM message with a 12 byte nonce and no additional data, as
+// sealed by crypto/cipher, without holding it in memory. The ciphertext is decrypted in counter
+// mode as it is read and hashed with GHASH, the tag is only checked once all of it was read.
+// The plaintext returned before the tag is checked is not authenticated.
+type gcmStreamOpener struct {
+	ctr     cipher.Stream
+	ghash   *ghash
+	tagMask [gcmTagSize]byte
+	size    uint64
+}
+
+// newGCMStreamOpener returns the opener of the message sealed with the block cipher and nonce.
+func newGCMStreamOpener(block cipher.Block, nonce []byte) *gcmStreamOpener {
+	var hashKey [gcmBlockSize]byte
+	block.Encrypt(hashKey[:], hashKey[:])
+
+	// the first counter block encrypts the tag, the following ones the message
+	var counter [gcmBlockSize]byte
+	copy(counter[:], nonce[:gcmNonceSize])
+	counter[gcmBlockSize-1] = 1
+	o := &gcmStreamOpener{ghash: newGHash(hashKey)}
+	block.Encrypt(o.tagMask[:], counter[:])
+	// crypto/cipher increments the whole counter block, GCM only its last 32 bits, which do not
+	// wrap below gcmMaxPlaintextSize
+	counter[gcmBlockSize-1] = 2
+	o.ctr = cipher.NewCTR(block, counter[:])
+	return o
+}
+
+// decrypt hashes the ciphertext then decrypts it into dst, which may be the ciphertext itself.
+func (o *gcmStreamOpener) decrypt(dst, ciphertext []byte) error {
+	o.size += uint64(len(ciphertext))
+	if o.size > gcmMaxPlaintextSize {
+		return errGCMTooLarge
+	}
+	o.ghash.write(ciphertext)
+	o.ctr.XORKeyStream(dst, ciphertext)
+	return nil
+}
+
+// check reports whether the tag authenticates the ciphertext decrypted so far.
+func (o *gcmStreamOpener) check(tag []byte) bool {
+	sum := o.ghash.sum(0, o.size)
+	for i := range sum {
+		sum[i] ^= o.tagMask[i]
+	}
+	return len(tag) == gcmTagSize && subtle.ConstantTimeCompare(sum[:], tag) == 1
+}
+
+// gcmFieldElement is an element of GF(2^128) in the bit order of GCM, low holding the first bits.
+type gcmFieldElement struct {
+	low, high uint64
+}
+
+// ghash is the universal hash of GCM, with the 4 bit table multiplication of the generic
+// implementation of crypto/cipher.
+type ghash struct {
+	productTable [16]gcmFieldElement
+	y            gcmFieldElement
+	partial      [gcmBlockSize]byte
+	partialSize  int
+}
+
+func newGHash(key [gcmBlockSize]byte) *ghash {
+	g := &ghash{}
+	x := gcmFieldElement{binary.BigEndian.Uint64(key[:8]), binary.BigEndian.Uint64(key[8:])}
+	g.productTable[reverseBits(1)] = x
+	for i := 2; i < 16; i += 2 {
+		g.productTable[reverseBits(i)] = gcmDouble(&g.productTable[reverseBits(i/2)])
+		g.productTable[reverseBits(i+1)] = gcmAdd(&g.productTable[reverseBits(i)], &x)
+	}
+	return g
+}
+
+// write hashes data, the last incomplete block being kept until more data is written or the
+// hash is summed.
+func (g *ghash) write(data []byte) {
+	if g.partialSize > 0 {
+		n := copy(g.partial[g.partialSize:], data)
+		g.partialSize += n
+		data = data[n:]
+		if g.partialSize < gcmBlockSize {
+			return
+		}
+		g.updateBlock(g.partial[:])
+		g.partialSize = 0
+	}
+	for len(data) >= gcmBlockSize {
+		g.updateBlock(data[:gcmBlockSize])
+		data = data[gcmBlockSize:]
+	}
+	g.partialSize = copy(g.partial[:], data)
+}
+
+// sum returns the hash of the data written, given the sizes in bytes of the additional data and
+// of the ciphertext. The incomplete last block is padded with zeros.
+func (g *ghash) sum(additionalSize, ciphertextSize uint64) [gcmBlockSize]byte {
+	y := g.y
+	if g.partialSize > 0 {
+		var block [gcmBlockSize]byte
+		copy(block[:], g.partial[:g.partialSize])
+		g.update(&y, block[:])
+	}
+	y.low ^= additionalSize * 8
+	y.high ^= ciphertextSize * 8
+	g.mul(&y)
+
+	var sum [gcmBlockSize]byte
+	binary.BigEndian.PutUint64(sum[:8], y.low)
+	binary.BigEndian.PutUint64(sum[8:], y.high)
+	return sum
+}
+
+func (g *ghash) updateBlock(block []byte) {
+	g.update(&g.y, block)
+}
+
+func (g *ghash) update(y *gcmFieldElement, block []byte) {
+	y.low ^= binary.BigEndian.Uint64(block)
+	y.high ^= binary.BigEndian.Uint64(block[8:])
+	g.mul(y)
+}
+
+// gcmReductionTable is the reduction of the 4 bits shifted out by the multiplication
+var gcmReductionTable = []uint16{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+// mul sets y to y*H, H being the hash key.
+func (g *ghash) mul(y *gcmFieldElement) {
+	var z gcmFieldElement
+	for i := 0; i < 2; i++ {
+		word := y.high
+		if i == 1 {
+			word = y.low
+		}
+		for j := 0; j < 64; j += 4 {
+			msw := z.high & 0xf
+			z.high >>= 4
+			z.high |= z.low << 60
+			z.low >>= 4
+			z.low ^= uint64(gcmReductionTable[msw]) << 48
+
+			t := &g.productTable[word&0xf]
+			z.low ^= t.low
+			z.high ^= t.high
+			word >>= 4
+		}
+	}
+	*y = z
+}
+
+// reverseBits reverses the order of the 4 low bits of i.
+func reverseBits(i int) int {
+	i = ((i << 2) & 0xc) | ((i >> 2) & 0x3)
+	i = ((i << 1) & 0xa) | ((i >> 1) & 0x5)
+	return i
+}
+
+func gcmAdd(x, y *gcmFieldElement) gcmFieldElement {
+	return gcmFieldElement{x.low ^ y.low, x.high ^ y.high}
+}
+
+// gcmDouble returns x*2 in the bit order of GCM.
+func gcmDouble(x *gcmFieldElement) gcmFieldElement {
+	var double gcmFieldElement
+	msbSet := x.high&1 == 1
+	double.high = x.high >> 1
+	double.high |= x.low << 63
+	double.low = x.low >> 1
+	if msbSet {
+		double.low ^= 0xe100000000000000
+	}
+	return double
+}
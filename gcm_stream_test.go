@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+// gcmVectors are the test cases without additional data and with a 96 bit nonce of "The
+// Galois/Counter Mode of Operation (GCM)", McGrew and Viega, the known answers of NIST SP 800-38D
+var gcmVectors = []struct {
+	name, key, nonce, plaintext, ciphertext, tag string
+}{
+	{
+		name:  "test case 1",
+		key:   "00000000000000000000000000000000",
+		nonce: "000000000000000000000000",
+		tag:   "58e2fccefa7e3061367f1d57a4e7455a",
+	},
+	{
+		name:       "test case 2",
+		key:        "00000000000000000000000000000000",
+		nonce:      "000000000000000000000000",
+		plaintext:  "00000000000000000000000000000000",
+		ciphertext: "0388dace60b6a392f328c2b971b2fe78",
+		tag:        "ab6e47d42cec13bdf53a67b21257bddf",
+	},
+	{
+		name:  "test case 3",
+		key:   "feffe9928665731c6d6a8f9467308308",
+		nonce: "cafebabefacedbaddecaf888",
+		plaintext: "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" +
+			"1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b391aafd255",
+		ciphertext: "42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e" +
+			"21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091473f5985",
+		tag: "4d5c2af327cd64a62cf35abd2ba6fab4",
+	},
+	{
+		name:  "test case 13",
+		key:   "0000000000000000000000000000000000000000000000000000000000000000",
+		nonce: "000000000000000000000000",
+		tag:   "530f8afbc74536b9a963b4f1c4cb738b",
+	},
+	{
+		name:       "test case 14",
+		key:        "0000000000000000000000000000000000000000000000000000000000000000",
+		nonce:      "000000000000000000000000",
+		plaintext:  "00000000000000000000000000000000",
+		ciphertext: "cea7403d4d606b6e074ec5d3baf39d18",
+		tag:        "d0d1c8a799996bf0265b98b5d48ab919",
+	},
+	{
+		name:  "test case 15",
+		key:   "feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308",
+		nonce: "cafebabefacedbaddecaf888",
+		plaintext: "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" +
+			"1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b391aafd255",
+		ciphertext: "522dc1f099567d07f47f37a32a84427d643a8cdcbfe5c0c97598a2bd2555d1aa" +
+			"8cb08e48590dbb3da7b08b1056828838c5f61e6393ba7a0abcc9f662898015ad",
+		tag: "b094dac5d93471bdec1a502270e3cc6c",
+	},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// openGCMStream decrypts the ciphertext with a gcmStreamOpener, in chunks of the sizes returned
+// by chunkSize, and checks the tag
+func openGCMStream(t *testing.T, block cipher.Block, nonce, ciphertext, tag []byte, chunkSize func() int) ([]byte, bool) {
+	opener := newGCMStreamOpener(block, nonce)
+	plaintext := make([]byte, 0, len(ciphertext))
+	for len(ciphertext) > 0 {
+		n := chunkSize()
+		if n > len(ciphertext) {
+			n = len(ciphertext)
+		}
+		chunk := make([]byte, n)
+		if err := opener.decrypt(chunk, ciphertext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = append(plaintext, chunk...)
+		ciphertext = ciphertext[n:]
+	}
+	return plaintext, opener.check(tag)
+}
+
+func TestGCMStreamVectors(t *testing.T) {
+	for _, v := range gcmVectors {
+		t.Run(v.name, func(t *testing.T) {
+			block, err := aes.NewCipher(decodeHex(t, v.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce, ciphertext, tag := decodeHex(t, v.nonce), decodeHex(t, v.ciphertext), decodeHex(t, v.tag)
+			for _, size := range []int{1, 7, gcmBlockSize, 64} {
+				plaintext, ok := openGCMStream(t, block, nonce, ciphertext, tag, func() int { return size })
+				if !ok {
+					t.Errorf("tag refused in chunks of %d bytes", size)
+				}
+				if want := decodeHex(t, v.plaintext); !bytes.Equal(plaintext, want) {
+					t.Errorf("decrypted %x in chunks of %d bytes, want %x", plaintext, size, want)
+				}
+			}
+
+			// a modified tag is refused
+			tag[0] ^= 1
+			if _, ok := openGCMStream(t, block, nonce, ciphertext, tag, func() int { return gcmBlockSize }); ok {
+				t.Error("modified tag accepted")
+			}
+		})
+	}
+}
+
+// TestGCMStreamDifferential checks the opener against the AES-GCM of crypto/cipher on random
+// messages of any length, decrypted in chunks of random sizes.
+func TestGCMStreamDifferential(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomBytes := func(size int) []byte {
+		b := make([]byte, size)
+		random.Read(b)
+		return b
+	}
+
+	sizes := []int{0, 1, 15, 16, 17, 31, 32, 33, 255, 4095, 4096, 4097, 65537}
+	for i := 0; i < 200; i++ {
+		sizes = append(sizes, random.Intn(8192))
+	}
+	for _, size := range sizes {
+		for _, keySize := range []int{16, 32} {
+			block, err := aes.NewCipher(randomBytes(keySize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			gcm, err := cipher.NewGCM(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce, plaintext := randomBytes(gcmNonceSize), randomBytes(size)
+			sealed := gcm.Seal(nil, nonce, plaintext, nil)
+			ciphertext, tag := sealed[:size], sealed[size:]
+
+			opened, ok := openGCMStream(t, block, nonce, ciphertext, tag, func() int { return 1 + random.Intn(100) })
+			if !ok || !bytes.Equal(opened, plaintext) {
+				t.Fatalf("message of %d bytes with a %d byte key: tag accepted %v, plaintext matches %v", size, keySize, ok, bytes.Equal(opened, plaintext))
+			}
+
+			// a modified ciphertext is refused like crypto/cipher does
+			if size > 0 {
+				ciphertext[random.Intn(size)] ^= 0x80
+				_, openErr := gcm.Open(nil, nonce, sealed, nil)
+				if _, ok = openGCMStream(t, block, nonce, ciphertext, tag, func() int { return 1 + random.Intn(100) }); ok || openErr == nil {
+					t.Fatalf("modified message of %d bytes accepted", size)
+				}
+			}
+		}
+	}
+}
+
+func TestGCMStreamTooLarge(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener := newGCMStreamOpener(block, make([]byte, gcmNonceSize))
+	// the size is counted before anything is decrypted
+	opener.size = gcmMaxPlaintextSize
+	if err = opener.decrypt(make([]byte, 1), make([]byte, 1)); err != errGCMTooLarge {
+		t.Errorf("decrypt() past the size limit error = %v, want %v", err, errGCMTooLarge)
+	}
+}
@@ -1,7 +1,8 @@
 module intel/isecl/lib/vml/v4
 
 require (
-	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8
+	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
 	intel/isecl/lib/common/v4 v4.2.0-Beta
 )
 
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// suffix of the file recording the checksum and the LUKS UUID of a header backup
+const headerBackupInfoSuffix = ".json"
+
+// ErrHeaderMismatch is returned when a header backup does not match its recorded checksum or
+// belongs to another volume.
+var ErrHeaderMismatch = errors.New("header backup mismatch")
+
+// HeaderBackupInfo is recorded next to a header backup, in <backup>.json.
+type HeaderBackupInfo struct {
+	SparseFilePath string    `json:"sparse_file_path"`
+	LUKSUUID       string    `json:"luks_uuid"`
+	SHA256         string    `json:"sha256"`
+	Created        time.Time `json:"created"`
+}
+
+// BackupHeader is used to back up the LUKS header of a volume.
+//
+// Input Parameters:
+//
+// 	sparseFilePath – Absolute path of the sparse file holding the LUKS header.
+//
+// 	dest – Absolute path of the backup file. The backup is written atomically with 0600 permissions
+// 		   and its SHA-256 and the LUKS UUID of the volume are recorded in <dest>.json.
+func BackupHeader(sparseFilePath, dest string) error {
+	return DefaultManager.BackupHeader(sparseFilePath, dest)
+}
+
+// BackupHeader backs up the LUKS header like the package level BackupHeader.
+func (m *Manager) BackupHeader(sparseFilePath, dest string) error {
+	ctx := context.Background()
+	if len(strings.TrimSpace(sparseFilePath)) <= 0 {
+		return errors.New("sparse file path not given")
+	}
+	if len(strings.TrimSpace(dest)) <= 0 {
+		return errors.New("header backup path not given")
+	}
+
+	uuid, err := m.luksUUID(ctx, sparseFilePath)
+	if err != nil {
+		return err
+	}
+
+	// cryptsetup refuses to overwrite a file, back up into a private directory next to dest
+	// and rename the backup into place
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dest), ".vml-header-")
+	if err != nil {
+		return &VolumeError{Op: "luksHeaderBackup", Path: dest, Err: err}
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpBackup := filepath.Join(tmpDir, "header")
+	args := []string{"--batch-mode", "luksHeaderBackup", sparseFilePath, "--header-backup-file", tmpBackup}
+	if _, err = m.runCommand(ctx, "cryptsetup", args); err != nil {
+		return cryptsetupError("luksHeaderBackup", sparseFilePath, err)
+	}
+	if err = os.Chmod(tmpBackup, 0600); err != nil {
+		return &VolumeError{Op: "luksHeaderBackup", Path: dest, Err: err}
+	}
+	checksum, err := fileSHA256(tmpBackup)
+	if err == nil {
+		err = syncFile(tmpBackup)
+	}
+	if err != nil {
+		return &VolumeError{Op: "luksHeaderBackup", Path: dest, Err: err}
+	}
+
+	// the info is written before the backup is renamed into place, so that a backup is never
+	// left without the checksum it is verified against
+	info := HeaderBackupInfo{
+		SparseFilePath: sparseFilePath,
+		LUKSUUID:       uuid,
+		SHA256:         checksum,
+		Created:        time.Now().UTC(),
+	}
+	infoBytes, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return &VolumeError{Op: "luksHeaderBackup", Path: dest, Err: err}
+	}
+	if err = writeFileAtomic(dest+headerBackupInfoSuffix, infoBytes, 0600); err != nil {
+		return &VolumeError{Op: "luksHeaderBackup", Path: dest, Err: err}
+	}
+	if err = os.Rename(tmpBackup, dest); err != nil {
+		os.Remove(dest + headerBackupInfoSuffix)
+		return &VolumeError{Op: "luksHeaderBackup", Path: dest, Err: err}
+	}
+	return nil
+}
+
+// VerifyHeader is used to check that a header backup is intact and belongs to the volume.
+//
+// Input Parameters:
+//
+// 	sparseFilePath – Absolute path of the sparse file holding the LUKS header.
+//
+// 	backup – Absolute path of the backup file written by BackupHeader.
+func VerifyHeader(sparseFilePath, backup string) (*HeaderBackupInfo, error) {
+	return DefaultManager.VerifyHeader(sparseFilePath, backup)
+}
+
+// VerifyHeader checks a header backup like the package level VerifyHeader.
+func (m *Manager) VerifyHeader(sparseFilePath, backup string) (*HeaderBackupInfo, error) {
+	ctx := context.Background()
+	info, err := m.verifyHeaderBackup(ctx, backup)
+	if err != nil {
+		return nil, err
+	}
+
+	uuid, err := m.luksUUID(ctx, sparseFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if uuid != info.LUKSUUID {
+		return nil, &VolumeError{Op: "verify", Path: backup, Kind: ErrHeaderMismatch,
+			Err: fmt.Errorf("backup of volume %s does not belong to volume %s", info.LUKSUUID, uuid)}
+	}
+	return info, nil
+}
+
+// RestoreHeader is used to restore the LUKS header of a volume from a backup written by BackupHeader.
+//
+// Input Parameters:
+//
+// 	sparseFilePath – Absolute path of the sparse file holding the LUKS header.
+//
+// 	src – Absolute path of the backup file.
+//
+// The backup is checked against its recorded SHA-256 and LUKS UUID. When the header of the volume
+// can still be read, its LUKS UUID must match the backup as well.
+func RestoreHeader(sparseFilePath, src string) error {
+	return DefaultManager.RestoreHeader(sparseFilePath, src)
+}
+
+// RestoreHeader restores the LUKS header like the package level RestoreHeader.
+func (m *Manager) RestoreHeader(sparseFilePath, src string) error {
+	ctx := context.Background()
+	if len(strings.TrimSpace(sparseFilePath)) <= 0 {
+		return errors.New("sparse file path not given")
+	}
+
+	info, err := m.verifyHeaderBackup(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	uuid, err := m.luksUUID(ctx, sparseFilePath)
+	if err != nil && !errors.Is(err, ErrNotLUKS) {
+		return err
+	}
+	// a header too damaged to be read is restored based on the checksum alone
+	if err == nil && uuid != info.LUKSUUID {
+		return &VolumeError{Op: "luksHeaderRestore", Path: src, Kind: ErrHeaderMismatch,
+			Err: fmt.Errorf("backup of volume %s does not belong to volume %s", info.LUKSUUID, uuid)}
+	}
+
+	args := []string{"--batch-mode", "luksHeaderRestore", sparseFilePath, "--header-backup-file", src}
+	if _, err = m.runCommand(ctx, "cryptsetup", args); err != nil {
+		return cryptsetupError("luksHeaderRestore", sparseFilePath, err)
+	}
+	return nil
+}
+
+// verifyHeaderBackup checks the backup against the checksum and the LUKS UUID recorded for it.
+func (m *Manager) verifyHeaderBackup(ctx context.Context, backup string) (*HeaderBackupInfo, error) {
+	if len(strings.TrimSpace(backup)) <= 0 {
+		return nil, errors.New("header backup path not given")
+	}
+
+	infoBytes, err := ioutil.ReadFile(backup + headerBackupInfoSuffix)
+	if os.IsNotExist(err) {
+		return nil, &VolumeError{Op: "verify", Path: backup + headerBackupInfoSuffix, Kind: ErrNotFound}
+	} else if err != nil {
+		return nil, &VolumeError{Op: "verify", Path: backup, Err: err}
+	}
+	var info HeaderBackupInfo
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return nil, &VolumeError{Op: "verify", Path: backup + headerBackupInfoSuffix, Err: err}
+	}
+
+	checksum, err := fileSHA256(backup)
+	if os.IsNotExist(err) {
+		return nil, &VolumeError{Op: "verify", Path: backup, Kind: ErrNotFound}
+	} else if err != nil {
+		return nil, &VolumeError{Op: "verify", Path: backup, Err: err}
+	}
+	if checksum != info.SHA256 {
+		return nil, &VolumeError{Op: "verify", Path: backup, Kind: ErrHeaderMismatch, Err: errors.New("SHA-256 does not match the recorded one")}
+	}
+
+	uuid, err := m.luksUUID(ctx, backup)
+	if err != nil {
+		return nil, err
+	}
+	if uuid != info.LUKSUUID {
+		return nil, &VolumeError{Op: "verify", Path: backup, Kind: ErrHeaderMismatch, Err: errors.New("LUKS UUID does not match the recorded one")}
+	}
+	return &info, nil
+}
+
+// luksUUID returns the LUKS UUID of the device or header file.
+func (m *Manager) luksUUID(ctx context.Context, device string) (string, error) {
+	if backend, err := m.cryptBackend(); err != nil {
+		return "", err
+	} else if backend == CryptBackendNative {
+		return nativeLUKSUUID(device)
+	}
+
+	uuid, err := m.runCommand(ctx, "cryptsetup", []string{"luksUUID", device})
+	if err != nil {
+		return "", cryptsetupError("luksUUID", device, err)
+	}
+	return strings.TrimSpace(uuid), nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and renames it to path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// headerRunner answers the cryptsetup header commands from files: the LUKS UUID of a file is
+// looked up by its content, a header backup copies the sparse file and a restore copies it back
+type headerRunner struct {
+	uuids map[string]string
+	verbs []string
+}
+
+func (r *headerRunner) Run(c Command) (CommandResult, error) {
+	args := c.Args
+	if len(args) > 0 && args[0] == "--batch-mode" {
+		args = args[1:]
+	}
+	r.verbs = append(r.verbs, args[0])
+
+	switch args[0] {
+	case "luksUUID":
+		content, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return CommandResult{ExitCode: cryptsetupExitWrongDevice, Stderr: err.Error()}, nil
+		}
+		uuid, ok := r.uuids[string(content)]
+		if !ok {
+			return CommandResult{ExitCode: 1, Stderr: "Device " + args[1] + " is not a valid LUKS device."}, nil
+		}
+		return CommandResult{Stdout: uuid + "\n"}, nil
+	case "luksHeaderBackup":
+		return r.copy(args[1], args[3])
+	case "luksHeaderRestore":
+		return r.copy(args[3], args[1])
+	}
+	return CommandResult{ExitCode: 1}, nil
+}
+
+func (r *headerRunner) copy(src, dest string) (CommandResult, error) {
+	content, err := ioutil.ReadFile(src)
+	if err == nil {
+		err = ioutil.WriteFile(dest, content, 0644)
+	}
+	if err != nil {
+		return CommandResult{ExitCode: 1, Stderr: err.Error()}, nil
+	}
+	return CommandResult{}, nil
+}
+
+// headerFixture is a directory with a LUKS volume, the header backup of which is written to
+// backup
+type headerFixture struct {
+	sparseFile string
+	backup     string
+	runner     *headerRunner
+	m          *Manager
+}
+
+const (
+	volumeHeader      = "LUKS header of the volume"
+	otherVolumeHeader = "LUKS header of another volume"
+	volumeUUID        = "0b5c2a1e-3f4d-4e6a-9b7c-8d0e1f2a3b4c"
+	otherVolumeUUID   = "7e6d5c4b-3a29-4180-9f1e-2d3c4b5a6978"
+)
+
+func newHeaderFixture(t *testing.T) *headerFixture {
+	dir := t.TempDir()
+	f := &headerFixture{
+		sparseFile: filepath.Join(dir, "vol.img"),
+		backup:     filepath.Join(dir, "backups", "vol.header"),
+		runner:     &headerRunner{uuids: map[string]string{volumeHeader: volumeUUID, otherVolumeHeader: otherVolumeUUID}},
+	}
+	f.m = &Manager{Runner: f.runner}
+	if err := os.MkdirAll(filepath.Dir(f.backup), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f.writeVolume(t, volumeHeader)
+	return f
+}
+
+func (f *headerFixture) writeVolume(t *testing.T, header string) {
+	if err := ioutil.WriteFile(f.sparseFile, []byte(header), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupHeader(t *testing.T) {
+	f := newHeaderFixture(t)
+	if err := f.m.BackupHeader(f.sparseFile, f.backup); err != nil {
+		t.Fatalf("BackupHeader failed: %v", err)
+	}
+
+	backupInfo, err := os.Stat(f.backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupInfo.Mode().Perm() != 0600 {
+		t.Errorf("backup permissions %v, want 0600", backupInfo.Mode().Perm())
+	}
+	content, err := ioutil.ReadFile(f.backup + headerBackupInfoSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info HeaderBackupInfo
+	if err = json.Unmarshal(content, &info); err != nil {
+		t.Fatal(err)
+	}
+	checksum, _ := fileSHA256(f.sparseFile)
+	if info.SparseFilePath != f.sparseFile || info.LUKSUUID != volumeUUID || info.SHA256 != checksum || info.Created.IsZero() {
+		t.Errorf("recorded %+v", info)
+	}
+
+	// nothing but the backup and its info is left next to it
+	entries, err := ioutil.ReadDir(filepath.Dir(f.backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("backup directory holds %q", names)
+	}
+}
+
+func TestBackupHeaderInfoFailure(t *testing.T) {
+	f := newHeaderFixture(t)
+	// a directory in place of the info file makes writing the info fail
+	if err := os.Mkdir(f.backup+headerBackupInfoSuffix, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.m.BackupHeader(f.sparseFile, f.backup); err == nil {
+		t.Fatal("BackupHeader succeeded without writing the info")
+	}
+	if _, err := os.Stat(f.backup); !os.IsNotExist(err) {
+		t.Errorf("backup left without its info: %v", err)
+	}
+}
+
+func TestVerifyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(t *testing.T, f *headerFixture)
+		wantErr error
+	}{
+		{name: "intact"},
+		{
+			name:    "backup of another volume",
+			edit:    func(t *testing.T, f *headerFixture) { f.writeVolume(t, otherVolumeHeader) },
+			wantErr: ErrHeaderMismatch,
+		},
+		{
+			name: "backup modified",
+			edit: func(t *testing.T, f *headerFixture) {
+				if err := ioutil.WriteFile(f.backup, []byte(otherVolumeHeader), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrHeaderMismatch,
+		},
+		{
+			name: "info of another backup",
+			edit: func(t *testing.T, f *headerFixture) {
+				// the checksum matches but the backup is of another volume
+				if err := ioutil.WriteFile(f.backup, []byte(otherVolumeHeader), 0600); err != nil {
+					t.Fatal(err)
+				}
+				content, _ := ioutil.ReadFile(f.backup + headerBackupInfoSuffix)
+				var info HeaderBackupInfo
+				json.Unmarshal(content, &info)
+				info.SHA256, _ = fileSHA256(f.backup)
+				content, _ = json.Marshal(info)
+				if err := ioutil.WriteFile(f.backup+headerBackupInfoSuffix, content, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrHeaderMismatch,
+		},
+		{
+			name: "info missing",
+			edit: func(t *testing.T, f *headerFixture) {
+				if err := os.Remove(f.backup + headerBackupInfoSuffix); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrNotFound,
+		},
+		{
+			name: "backup missing",
+			edit: func(t *testing.T, f *headerFixture) {
+				if err := os.Remove(f.backup); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newHeaderFixture(t)
+			if err := f.m.BackupHeader(f.sparseFile, f.backup); err != nil {
+				t.Fatal(err)
+			}
+			if tt.edit != nil {
+				tt.edit(t, f)
+			}
+
+			info, err := f.m.VerifyHeader(f.sparseFile, f.backup)
+			if tt.wantErr == nil {
+				if err != nil || info.LUKSUUID != volumeUUID {
+					t.Fatalf("VerifyHeader() = %+v, %v", info, err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRestoreHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		volume      string
+		wantErr     error
+		wantRestore bool
+	}{
+		{name: "same volume", volume: volumeHeader, wantRestore: true},
+		{name: "damaged header", volume: "overwritten", wantRestore: true},
+		{name: "another volume", volume: otherVolumeHeader, wantErr: ErrHeaderMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newHeaderFixture(t)
+			if err := f.m.BackupHeader(f.sparseFile, f.backup); err != nil {
+				t.Fatal(err)
+			}
+			f.writeVolume(t, tt.volume)
+			f.runner.verbs = nil
+
+			err := f.m.RestoreHeader(f.sparseFile, f.backup)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("RestoreHeader failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			restored := false
+			for _, verb := range f.runner.verbs {
+				restored = restored || verb == "luksHeaderRestore"
+			}
+			if restored != tt.wantRestore {
+				t.Errorf("ran %q, want luksHeaderRestore: %v", f.runner.verbs, tt.wantRestore)
+			}
+			// the volume is only written by the restore
+			want := tt.volume
+			if tt.wantRestore {
+				want = volumeHeader
+			}
+			if content, _ := ioutil.ReadFile(f.sparseFile); string(content) != want {
+				t.Errorf("volume holds %q, want %q", content, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/vml/v4/luks"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Keyslot describes a LUKS keyslot as reported by ListKeyslots.
+type Keyslot struct {
+	Index    int    `json:"index"`
+	Active   bool   `json:"active"`
+	Type     string `json:"type,omitempty"`
+	KeySize  int    `json:"key_size,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	PBKDF    string `json:"pbkdf,omitempty"`
+}
+
+// AddKey is used to add a key to a free keyslot of a LUKS volume and returns the index of the keyslot.
+//
+// Input Parameters:
+//
+// 	device – Absolute path of the sparse file or the loop device holding the LUKS header.
+//
+// 	key – A key that already opens the volume.
+//
+// 	newKey – The key to add.
+func AddKey(device string, key, newKey []byte) (int, error) {
+	return DefaultManager.AddKey(device, key, newKey)
+}
+
+// AddKeyContext is used to add a key like AddKey. When ctx is done before the key is added, the
+// running command is killed and the error wraps ctx.Err().
+func AddKeyContext(ctx context.Context, device string, key, newKey []byte) (int, error) {
+	return DefaultManager.AddKeyContext(ctx, device, key, newKey)
+}
+
+// AddKey adds a key to a free keyslot like the package level AddKey.
+func (m *Manager) AddKey(device string, key, newKey []byte) (int, error) {
+	return m.AddKeyContext(context.Background(), device, key, newKey)
+}
+
+// AddKeyContext adds a key to a free keyslot like the package level AddKeyContext.
+func (m *Manager) AddKeyContext(ctx context.Context, device string, key, newKey []byte) (int, error) {
+	if err := validateKeyslotInput(device, key); err != nil {
+		return -1, err
+	}
+	if len(newKey) == 0 {
+		return -1, errors.New("new key not given")
+	}
+
+	before, err := m.listKeyslots(ctx, device)
+	if err != nil {
+		return -1, err
+	}
+
+	// the existing key is read from stdin and the new key from a pipe, neither touches the disk
+	_, err = m.run(ctx, Command{
+		Name:       "cryptsetup",
+		Args:       []string{"--batch-mode", "luksAddKey", "--key-file", "-", device, ExtraFilePath(0)},
+		Stdin:      key,
+		ExtraFiles: [][]byte{newKey},
+	})
+	if err != nil {
+		return -1, cryptsetupError("luksAddKey", device, err)
+	}
+
+	after, err := m.listKeyslots(ctx, device)
+	if err != nil {
+		return -1, err
+	}
+	active := map[int]bool{}
+	for _, slot := range before {
+		active[slot.Index] = slot.Active
+	}
+	for _, slot := range after {
+		if slot.Active && !active[slot.Index] {
+			return slot.Index, nil
+		}
+	}
+	return -1, &VolumeError{Op: "luksAddKey", Path: device, Err: errors.New("new keyslot not found in the LUKS header")}
+}
+
+// ChangeKey is used to replace a key of a LUKS volume, keeping the keyslot it is stored in.
+//
+// Input Parameters:
+//
+// 	device – Absolute path of the sparse file or the loop device holding the LUKS header.
+//
+// 	key – The key to replace.
+//
+// 	newKey – The key replacing it.
+func ChangeKey(device string, key, newKey []byte) error {
+	return DefaultManager.ChangeKey(device, key, newKey)
+}
+
+// ChangeKeyContext is used to replace a key like ChangeKey. When ctx is done before the key is
+// replaced, the running command is killed and the error wraps ctx.Err().
+func ChangeKeyContext(ctx context.Context, device string, key, newKey []byte) error {
+	return DefaultManager.ChangeKeyContext(ctx, device, key, newKey)
+}
+
+// ChangeKey replaces a key like the package level ChangeKey.
+func (m *Manager) ChangeKey(device string, key, newKey []byte) error {
+	return m.ChangeKeyContext(context.Background(), device, key, newKey)
+}
+
+// ChangeKeyContext replaces a key like the package level ChangeKeyContext.
+func (m *Manager) ChangeKeyContext(ctx context.Context, device string, key, newKey []byte) error {
+	if err := validateKeyslotInput(device, key); err != nil {
+		return err
+	}
+	if len(newKey) == 0 {
+		return errors.New("new key not given")
+	}
+
+	_, err := m.run(ctx, Command{
+		Name:       "cryptsetup",
+		Args:       []string{"--batch-mode", "luksChangeKey", "--key-file", "-", device, ExtraFilePath(0)},
+		Stdin:      key,
+		ExtraFiles: [][]byte{newKey},
+	})
+	if err != nil {
+		return cryptsetupError("luksChangeKey", device, err)
+	}
+	return nil
+}
+
+// KillKeyslot is used to wipe a keyslot of a LUKS volume by index. The last active keyslot
+// is never wiped, as that would make the volume unrecoverable.
+//
+// Input Parameters:
+//
+// 	device – Absolute path of the sparse file or the loop device holding the LUKS header.
+//
+// 	slot – Index of the keyslot to wipe.
+//
+// 	key – A key stored in another keyslot, to authorize the operation.
+func KillKeyslot(device string, slot int, key []byte) error {
+	return DefaultManager.KillKeyslot(device, slot, key)
+}
+
+// KillKeyslotContext is used to wipe a keyslot like KillKeyslot. When ctx is done before the
+// keyslot is wiped, the running command is killed and the error wraps ctx.Err().
+func KillKeyslotContext(ctx context.Context, device string, slot int, key []byte) error {
+	return DefaultManager.KillKeyslotContext(ctx, device, slot, key)
+}
+
+// KillKeyslot wipes a keyslot like the package level KillKeyslot.
+func (m *Manager) KillKeyslot(device string, slot int, key []byte) error {
+	return m.KillKeyslotContext(context.Background(), device, slot, key)
+}
+
+// KillKeyslotContext wipes a keyslot like the package level KillKeyslotContext.
+func (m *Manager) KillKeyslotContext(ctx context.Context, device string, slot int, key []byte) error {
+	if err := validateKeyslotInput(device, key); err != nil {
+		return err
+	}
+
+	slots, err := m.listKeyslots(ctx, device)
+	if err != nil {
+		return err
+	}
+	found := false
+	activeSlots := 0
+	for _, s := range slots {
+		if s.Active {
+			activeSlots++
+			found = found || s.Index == slot
+		}
+	}
+	if !found {
+		return &VolumeError{Op: "luksKillSlot", Path: device, Kind: ErrNotFound, Err: fmt.Errorf("keyslot %d is not active", slot)}
+	}
+	if activeSlots == 1 {
+		return &VolumeError{Op: "luksKillSlot", Path: device, Err: fmt.Errorf("keyslot %d is the last active keyslot", slot)}
+	}
+
+	args := []string{"--batch-mode", "luksKillSlot", "--key-file", "-", device, strconv.Itoa(slot)}
+	if _, err = m.runCommandWithStdin(ctx, "cryptsetup", args, key); err != nil {
+		return cryptsetupError("luksKillSlot", device, err)
+	}
+	return nil
+}
+
+// RemoveKey is used to wipe the keyslot a key is stored in. The last active keyslot is never
+// wiped, as that would make the volume unrecoverable.
+//
+// Input Parameters:
+//
+// 	device – Absolute path of the sparse file or the loop device holding the LUKS header.
+//
+// 	key – The key to remove.
+func RemoveKey(device string, key []byte) error {
+	return DefaultManager.RemoveKey(device, key)
+}
+
+// RemoveKeyContext is used to remove a key like RemoveKey. When ctx is done before the key is
+// removed, the running command is killed and the error wraps ctx.Err().
+func RemoveKeyContext(ctx context.Context, device string, key []byte) error {
+	return DefaultManager.RemoveKeyContext(ctx, device, key)
+}
+
+// RemoveKey wipes the keyslot of a key like the package level RemoveKey.
+func (m *Manager) RemoveKey(device string, key []byte) error {
+	return m.RemoveKeyContext(context.Background(), device, key)
+}
+
+// RemoveKeyContext wipes the keyslot of a key like the package level RemoveKeyContext.
+func (m *Manager) RemoveKeyContext(ctx context.Context, device string, key []byte) error {
+	if err := validateKeyslotInput(device, key); err != nil {
+		return err
+	}
+
+	slots, err := m.listKeyslots(ctx, device)
+	if err != nil {
+		return err
+	}
+	activeSlots := 0
+	for _, s := range slots {
+		if s.Active {
+			activeSlots++
+		}
+	}
+	if activeSlots <= 1 {
+		return &VolumeError{Op: "luksRemoveKey", Path: device, Err: errors.New("the key is in the last active keyslot")}
+	}
+
+	args := []string{"--batch-mode", "luksRemoveKey", "--key-file", "-", device}
+	if _, err = m.runCommandWithStdin(ctx, "cryptsetup", args, key); err != nil {
+		return cryptsetupError("luksRemoveKey", device, err)
+	}
+	return nil
+}
+
+// ListKeyslots is used to list the keyslots of a LUKS volume. LUKS1 volumes report all their
+// keyslots, LUKS2 volumes only report the active ones.
+//
+// Input Parameter:
+//
+// 	device – Absolute path of the sparse file or the loop device holding the LUKS header.
+func ListKeyslots(device string) ([]Keyslot, error) {
+	return DefaultManager.ListKeyslots(device)
+}
+
+// ListKeyslots lists the keyslots like the package level ListKeyslots.
+func (m *Manager) ListKeyslots(device string) ([]Keyslot, error) {
+	return m.listKeyslots(context.Background(), device)
+}
+
+func (m *Manager) listKeyslots(ctx context.Context, device string) ([]Keyslot, error) {
+	if len(strings.TrimSpace(device)) <= 0 {
+		return nil, errors.New("device not given")
+	}
+
+	cmdOutput, err := m.runCommand(ctx, "cryptsetup", []string{"luksDump", device})
+	if err != nil {
+		return nil, cryptsetupError("luksDump", device, err)
+	}
+	return parseLuksDumpKeyslots(cmdOutput), nil
+}
+
+// CheckKey is used to check that a key opens a LUKS volume before using it, e.g. to open the
+// volume. The keyslots are read and decrypted without cryptsetup, a sparse file needs no privileges.
+//
+// Input Parameters:
+//
+// 	device – Absolute path of the sparse file or the loop device holding the LUKS header.
+//
+// 	key – The key to check.
+func CheckKey(device string, key []byte) error {
+	return DefaultManager.CheckKey(device, key)
+}
+
+// CheckKey checks the key like the package level CheckKey.
+func (m *Manager) CheckKey(device string, key []byte) error {
+	if err := validateKeyslotInput(device, key); err != nil {
+		return err
+	}
+
+	if _, err := luks.UnlockFile(device, key); err != nil {
+		return luksError("checkKey", device, err)
+	}
+	return nil
+}
+
+func validateKeyslotInput(device string, key []byte) error {
+	if len(strings.TrimSpace(device)) <= 0 {
+		return errors.New("device not given")
+	}
+	if len(key) == 0 {
+		return errors.New("key not given")
+	}
+	return nil
+}
+
+// parseLuksDumpKeyslots extracts the keyslots from the output of cryptsetup luksDump, in both
+// the LUKS1 ("Key Slot 0: ENABLED") and the LUKS2 ("Keyslots:" section) formats.
+func parseLuksDumpKeyslots(output string) []Keyslot {
+	var slots []*Keyslot
+	var current *Keyslot
+	inLUKS2Keyslots := false
+	luks1KeySize := 0
+
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "MK bits:"):
+			luks1KeySize, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "MK bits:")))
+		case strings.HasPrefix(line, "Key Slot "):
+			// LUKS1: "Key Slot 0: ENABLED"
+			fields := strings.SplitN(strings.TrimPrefix(line, "Key Slot "), ":", 2)
+			index, err := strconv.Atoi(fields[0])
+			if err != nil || len(fields) != 2 {
+				continue
+			}
+			current = &Keyslot{Index: index, Active: strings.TrimSpace(fields[1]) == "ENABLED"}
+			if current.Active {
+				current.Type = "luks1"
+				current.PBKDF = PBKDF2
+				current.KeySize = luks1KeySize
+			}
+			slots = append(slots, current)
+		case line == "Keyslots:":
+			inLUKS2Keyslots = true
+		case inLUKS2Keyslots && trimmed != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t"):
+			// next section
+			inLUKS2Keyslots = false
+			current = nil
+		case inLUKS2Keyslots && strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "\t"):
+			// LUKS2: "  0: luks2"
+			fields := strings.SplitN(trimmed, ":", 2)
+			index, err := strconv.Atoi(fields[0])
+			if err != nil || len(fields) != 2 {
+				continue
+			}
+			current = &Keyslot{Index: index, Active: true, Type: strings.TrimSpace(fields[1])}
+			slots = append(slots, current)
+		case inLUKS2Keyslots && current != nil:
+			fields := strings.SplitN(trimmed, ":", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(fields[1])
+			switch fields[0] {
+			case "Key":
+				current.KeySize, _ = strconv.Atoi(strings.TrimSuffix(value, " bits"))
+			case "Priority":
+				current.Priority = value
+			case "PBKDF":
+				current.PBKDF = value
+			}
+		}
+	}
+
+	result := make([]Keyslot, 0, len(slots))
+	for _, slot := range slots {
+		result = append(result, *slot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result
+}
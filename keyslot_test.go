@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const luks1Dump = `LUKS header information for /dev/loop0
+
+Version:       	1
+Cipher name:   	aes
+Cipher mode:   	xts-plain64
+Hash spec:     	sha256
+Payload offset:	4096
+MK bits:       	512
+MK digest:     	c7 f8 2b 0e 4d 38 51 1b 5e 2c 0d 1e 6a 3f 7b 55 e0 9a 41 3c
+MK salt:       	6f 2d 8c 7a 55 13 0b 9e 4a 21 7d 3c 60 1f 84 22
+               	9b 70 d4 25 3e 1a 6c 08 f1 57 2e 9d 43 b0 1c 7a
+MK iterations: 	120470
+UUID:          	5c3ea7d9-0f5e-4b6c-8d2f-0a1b2c3d4e5f
+
+Key Slot 0: ENABLED
+	Iterations:         	1927529
+	Salt:               	2a 4c 1e 9b 70 55 d3 0f 8e 61 2c 4a 97 13 b5 e8
+	                      	3d 6e 0f 24 91 ab 5c 7e 10 c4 88 2f 6d 39 e1 07
+	Key material offset:	8
+	AF stripes:            	4000
+Key Slot 1: DISABLED
+Key Slot 2: ENABLED
+	Iterations:         	1927529
+	Salt:               	91 3e 0c 6a 2f 58 e4 17 b2 4d 7c 09 a8 36 f1 5e
+	                      	c0 27 8b 4f 1d 93 6e 25 5a e7 30 bc 48 0f d6 72
+	Key material offset:	520
+	AF stripes:            	4000
+Key Slot 3: DISABLED
+Key Slot 4: DISABLED
+Key Slot 5: DISABLED
+Key Slot 6: DISABLED
+Key Slot 7: DISABLED
+`
+
+const luks2Dump = `LUKS header information
+Version:       	2
+Epoch:         	5
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	9b4f1e2a-6c3d-4e5f-8a7b-0c1d2e3f4a5b
+Label:         	(no label)
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: (whole device)
+	cipher: aes-xts-plain64
+	sector: 512 [bytes]
+
+Keyslots:
+  2: luks2
+	Key:        512 bits
+	Priority:   prefer
+	Cipher:     aes-xts-plain64
+	Cipher key: 512 bits
+	PBKDF:      pbkdf2
+	Hash:       sha256
+	Iterations: 1000
+	Salt:       3a 7e 11 c5 09 4d 62 8f 2b e0 57 9c 14 a6 3d 70
+	            8e 25 f1 4b 6a 0d c3 92 57 1e 8a 36 b4 0f 6c d2
+	AF stripes: 4000
+	AF hash:    sha256
+	Area offset:290816 [bytes]
+	Area length:258048 [bytes]
+	Digest ID:  0
+  0: luks2
+	Key:        512 bits
+	Priority:   normal
+	Cipher:     aes-xts-plain64
+	Cipher key: 512 bits
+	PBKDF:      argon2id
+	Time cost:  4
+	Memory:     1048576
+	Threads:    4
+	Salt:       5d 0b 8e 27 c1 4a 93 6f 12 e8 3c 75 a0 49 d6 1b
+	            6e 30 f4 8a 57 2d b9 c3 08 71 1f e5 4c 96 a2 3d
+	AF stripes: 4000
+	AF hash:    sha256
+	Area offset:32768 [bytes]
+	Area length:258048 [bytes]
+	Digest ID:  0
+Tokens:
+  0: luks2-keyring
+	Keyslot:    0
+Digests:
+  0: pbkdf2
+	Hash:       sha256
+	Iterations: 106184
+	Salt:       a4 17 6c 3e 90 5b d2 08 e7 41 1a 8f 62 c9 35 7d
+	Digest:     0f 8a 2d 5c 61 e3 97 4b 1c a8 70 35 d6 2e 49 b0
+`
+
+// setKeyslot enables or disables a keyslot in the output of cryptsetup luksDump of a LUKS1 volume
+func setKeyslot(dump string, index int, enabled bool) string {
+	line := "Key Slot " + strconv.Itoa(index) + ": "
+	if enabled {
+		return strings.Replace(dump, line+"DISABLED", line+"ENABLED", 1)
+	}
+	return strings.Replace(dump, line+"ENABLED", line+"DISABLED", 1)
+}
+
+func TestParseLuksDumpKeyslots(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Keyslot
+	}{
+		{
+			name:   "LUKS1",
+			output: luks1Dump,
+			want: []Keyslot{
+				{Index: 0, Active: true, Type: "luks1", KeySize: 512, PBKDF: PBKDF2},
+				{Index: 1},
+				{Index: 2, Active: true, Type: "luks1", KeySize: 512, PBKDF: PBKDF2},
+				{Index: 3}, {Index: 4}, {Index: 5}, {Index: 6}, {Index: 7},
+			},
+		},
+		{
+			name:   "LUKS2",
+			output: luks2Dump,
+			want: []Keyslot{
+				{Index: 0, Active: true, Type: "luks2", KeySize: 512, Priority: "normal", PBKDF: Argon2id},
+				{Index: 2, Active: true, Type: "luks2", KeySize: 512, Priority: "prefer", PBKDF: PBKDF2},
+			},
+		},
+		{
+			name:   "LUKS2 without keyslots",
+			output: "LUKS header information\nVersion:       \t2\n\nKeyslots:\nTokens:\nDigests:\n",
+			want:   []Keyslot{},
+		},
+		{
+			name:   "not LUKS",
+			output: "Device /dev/loop0 is not a valid LUKS device.\n",
+			want:   []Keyslot{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLuksDumpKeyslots(tt.output); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLuksDumpKeyslots() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddKey(t *testing.T) {
+	key, newKey := []byte("old key"), []byte("new key")
+	r := &ScriptedRunner{}
+	r.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksDump"}, Times: 1, Result: CommandResult{Stdout: luks1Dump}})
+	r.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksDump"}, Times: 1, Result: CommandResult{Stdout: setKeyslot(luks1Dump, 1, true)}})
+	m := &Manager{Runner: r}
+
+	slot, err := m.AddKeyContext(context.Background(), "/dev/loop0", key, newKey)
+	if err != nil || slot != 1 {
+		t.Fatalf("AddKeyContext() = %d, %v, want 1", slot, err)
+	}
+	commands := r.Commands()
+	if len(commands) != 3 {
+		t.Fatalf("ran %v, want luksDump, luksAddKey and luksDump", commands)
+	}
+	add := commands[1]
+	if !reflect.DeepEqual(add.Args[:2], []string{"--batch-mode", "luksAddKey"}) || !bytes.Equal(add.Stdin, key) ||
+		len(add.ExtraFiles) != 1 || !bytes.Equal(add.ExtraFiles[0], newKey) {
+		t.Errorf("ran %s, want luksAddKey with the key on stdin and the new key in an extra file", add)
+	}
+}
+
+func TestKillKeyslot(t *testing.T) {
+	tests := []struct {
+		name        string
+		dump        string
+		slot        int
+		wantErr     error
+		wantCommand bool
+	}{
+		{name: "active keyslot", dump: luks1Dump, slot: 2, wantCommand: true},
+		{name: "inactive keyslot", dump: luks1Dump, slot: 1, wantErr: ErrNotFound},
+		{name: "last active keyslot", dump: setKeyslot(luks1Dump, 2, false), slot: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ScriptedRunner{}
+			r.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksDump"}, Result: CommandResult{Stdout: tt.dump}})
+			m := &Manager{Runner: r}
+
+			err := m.KillKeyslotContext(context.Background(), "/dev/loop0", tt.slot, []byte("key"))
+			if tt.wantCommand && err != nil {
+				t.Fatalf("KillKeyslotContext() failed: %v", err)
+			}
+			if !tt.wantCommand && err == nil {
+				t.Fatal("KillKeyslotContext() succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			killed := false
+			for _, c := range r.Commands() {
+				killed = killed || c.Args[1] == "luksKillSlot"
+			}
+			if killed != tt.wantCommand {
+				t.Errorf("ran luksKillSlot: %v, want %v", killed, tt.wantCommand)
+			}
+		})
+	}
+}
+
+func TestKeyslotContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := &Manager{Runner: &ScriptedRunner{}}
+	key, newKey := []byte("key"), []byte("new key")
+
+	calls := map[string]func() error{
+		"AddKeyContext": func() error {
+			_, err := m.AddKeyContext(ctx, "/dev/loop0", key, newKey)
+			return err
+		},
+		"ChangeKeyContext":   func() error { return m.ChangeKeyContext(ctx, "/dev/loop0", key, newKey) },
+		"KillKeyslotContext": func() error { return m.KillKeyslotContext(ctx, "/dev/loop0", 1, key) },
+		"RemoveKeyContext":   func() error { return m.RemoveKeyContext(ctx, "/dev/loop0", key) },
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s() error = %v, want %v", name, err, context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultLockDir is the directory of the lock files when Manager.LockDir is empty.
+const DefaultLockDir = "/var/run/vml"
+
+// DefaultLockTimeout is how long a volume operation waits for a lock held by another process
+// when Manager.LockTimeout is zero.
+const DefaultLockTimeout = 60 * time.Second
+
+// lock file serializing the loop device allocations of all the volumes of the host
+const loopLockName = "loop.lock"
+
+// how often a lock held by another process is retried
+const lockPollInterval = 50 * time.Millisecond
+
+func (m *Manager) lockDir() string {
+	if m.LockDir == "" {
+		return DefaultLockDir
+	}
+	return m.LockDir
+}
+
+func (m *Manager) lockTimeout() time.Duration {
+	if m.LockTimeout == 0 {
+		return DefaultLockTimeout
+	}
+	if m.LockTimeout < 0 {
+		return 0
+	}
+	return m.LockTimeout
+}
+
+// lockVolume takes the locks of the sparse file, the dm-crypt volume and the mount point given,
+// skipping the empty ones, and returns the function releasing them.
+func (m *Manager) lockVolume(ctx context.Context, sparseFilePath, deviceMapperLocation, mountLocation string) (func(), error) {
+	var names []string
+	if sparseFilePath != "" {
+		names = append(names, pathLockName("sparse", sparseFilePath))
+	}
+	if deviceMapperLocation != "" {
+		names = append(names, "mapper-"+filepath.Base(deviceMapperLocation)+".lock")
+	}
+	if mountLocation != "" {
+		names = append(names, pathLockName("mount", mountLocation))
+	}
+	// the locks are always taken in the same order, so that two operations sharing some of
+	// them cannot deadlock
+	sort.Strings(names)
+	return m.lock(ctx, names...)
+}
+
+// pathLockName derives the name of the lock file of a path. The base name is kept for
+// readability and the hash of the cleaned path tells apart files of the same name.
+func pathLockName(kind, path string) string {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(path)))
+	base := strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, filepath.Base(path))
+	return kind + "-" + base + "-" + hex.EncodeToString(sum[:8]) + ".lock"
+}
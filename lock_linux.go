@@ -0,0 +1,76 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lock takes an exclusive flock on each of the lock files in the lock directory, in the order
+// given, and returns the function releasing them. Waiting for a lock stops when ctx is done.
+//
+// The lock files are never removed, as removing a lock file another process is waiting on
+// would let two processes hold the lock at once.
+func (m *Manager) lock(ctx context.Context, names ...string) (func(), error) {
+	if err := os.MkdirAll(m.lockDir(), 0700); err != nil {
+		return nil, &VolumeError{Op: "lock", Path: m.lockDir(), Err: err}
+	}
+
+	var held []*os.File
+	unlock := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			unix.Flock(int(held[i].Fd()), unix.LOCK_UN)
+			held[i].Close()
+		}
+	}
+
+	deadline := time.Now().Add(m.lockTimeout())
+	for _, name := range names {
+		file, err := flockFile(ctx, filepath.Join(m.lockDir(), name), deadline)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, file)
+	}
+	return unlock, nil
+}
+
+// flockFile opens the lock file and polls for an exclusive flock on it until the deadline.
+func flockFile(ctx context.Context, path string, deadline time.Time) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, &VolumeError{Op: "lock", Path: path, Err: err}
+	}
+
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, &VolumeError{Op: "lock", Path: path, Err: err}
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, &VolumeError{Op: "lock", Path: path, Kind: ErrLocked}
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, &VolumeError{Op: "lock", Path: path, Err: ctx.Err()}
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
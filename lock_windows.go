@@ -0,0 +1,20 @@
+//go:build windows
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"fmt"
+)
+
+// WARNING : Product does not work on windows  - stub implementation only
+
+func (m *Manager) lock(ctx context.Context, names ...string) (func(), error) {
+
+	return nil, fmt.Errorf("function not implemented on Windows")
+
+}
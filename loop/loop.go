@@ -0,0 +1,45 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package loop manages loop devices through the /dev/loop-control and loop device ioctls,
+// without shelling out to losetup.
+package loop
+
+import "errors"
+
+// ErrNotFound is returned when no loop device is bound to the given backing file.
+var ErrNotFound = errors.New("no loop device associated with the backing file")
+
+// ErrNotLoopDevice is returned when a device is not a loop device bound to a backing file.
+var ErrNotLoopDevice = errors.New("not an attached loop device")
+
+// Options are the settings applied to a loop device when it is attached.
+type Options struct {
+	// AutoClear detaches the loop device when its last user closes it.
+	AutoClear bool
+	// ReadOnly attaches the backing file read-only.
+	ReadOnly bool
+	// DirectIO bypasses the page cache of the backing file.
+	DirectIO bool
+	// Offset is the offset in bytes of the data in the backing file.
+	Offset uint64
+	// SizeLimit limits the size in bytes of the loop device. Zero means the whole backing file.
+	SizeLimit uint64
+}
+
+// Info describes the state of an attached loop device.
+type Info struct {
+	Device        string `json:"device"`
+	Number        uint32 `json:"number"`
+	BackingFile   string `json:"backing_file"`
+	BackingDevice uint64 `json:"backing_device"`
+	BackingInode  uint64 `json:"backing_inode"`
+	Offset        uint64 `json:"offset"`
+	SizeLimit     uint64 `json:"size_limit"`
+	AutoClear     bool   `json:"autoclear"`
+	ReadOnly      bool   `json:"read_only"`
+	DirectIO      bool   `json:"direct_io"`
+	PartScan      bool   `json:"partscan"`
+}
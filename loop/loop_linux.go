@@ -0,0 +1,292 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package loop
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctl requests and flags from linux/loop.h
+const (
+	loopSetFd       = 0x4C00
+	loopClrFd       = 0x4C01
+	loopSetStatus64 = 0x4C04
+	loopGetStatus64 = 0x4C05
+	loopSetCapacity = 0x4C07
+	loopSetDirectIO = 0x4C08
+	loopConfigure   = 0x4C0A
+	loopCtlGetFree  = 0x4C82
+
+	loFlagsReadOnly  = 1
+	loFlagsAutoClear = 4
+	loFlagsPartScan  = 8
+	loFlagsDirectIO  = 16
+
+	loNameSize = 64
+	loKeySize  = 32
+
+	loopControlPath = "/dev/loop-control"
+
+	// number of times a free device is requested when another process binds it first
+	attachRetries = 16
+)
+
+// sysBlockPath lists the block devices of the host
+var sysBlockPath = "/sys/block"
+
+// loopInfo64 mirrors struct loop_info64
+type loopInfo64 struct {
+	device         uint64
+	inode          uint64
+	rdevice        uint64
+	offset         uint64
+	sizeLimit      uint64
+	number         uint32
+	encryptType    uint32
+	encryptKeySize uint32
+	flags          uint32
+	fileName       [loNameSize]byte
+	cryptName      [loNameSize]byte
+	encryptKey     [loKeySize]byte
+	init           [2]uint64
+}
+
+// loopConfig mirrors struct loop_config
+type loopConfig struct {
+	fd        uint32
+	blockSize uint32
+	info      loopInfo64
+	reserved  [8]uint64
+}
+
+// Attach binds the backing file to a free loop device and returns the loop device path.
+//
+// The free device is requested from /dev/loop-control and configured with LOOP_CONFIGURE, falling
+// back to LOOP_SET_FD and LOOP_SET_STATUS64 on kernels without it. If another process binds the
+// device first, a new free device is requested.
+func Attach(backingFile string, opts Options) (string, error) {
+	fileFlags := os.O_RDWR
+	if opts.ReadOnly {
+		fileFlags = os.O_RDONLY
+	}
+	if opts.DirectIO {
+		fileFlags |= unix.O_DIRECT
+	}
+	file, err := os.OpenFile(backingFile, fileFlags, 0)
+	if err != nil {
+		return "", fmt.Errorf("error opening the backing file: %s", err.Error())
+	}
+	defer file.Close()
+
+	control, err := os.OpenFile(loopControlPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s: %s", loopControlPath, err.Error())
+	}
+	defer control.Close()
+
+	config := loopConfig{fd: uint32(file.Fd())}
+	config.info.offset = opts.Offset
+	config.info.sizeLimit = opts.SizeLimit
+	config.info.flags = flags(opts)
+	copy(config.info.fileName[:loNameSize-1], backingFile)
+
+	for i := 0; i < attachRetries; i++ {
+		number, err := ioctl(control.Fd(), loopCtlGetFree, 0)
+		if err != nil {
+			return "", fmt.Errorf("error getting a free loop device: %s", err.Error())
+		}
+		device := "/dev/loop" + strconv.Itoa(int(number))
+
+		err = configure(device, &config, opts)
+		if err == unix.EBUSY {
+			// lost the race for the device to another process
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error configuring %s: %s", device, err.Error())
+		}
+		return device, nil
+	}
+	return "", fmt.Errorf("error attaching the backing file: no free loop device after %d attempts", attachRetries)
+}
+
+func configure(device string, config *loopConfig, opts Options) error {
+	loopFile, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer loopFile.Close()
+
+	_, err = ioctl(loopFile.Fd(), loopConfigure, uintptr(unsafe.Pointer(config)))
+	if err != unix.EINVAL && err != unix.ENOTTY {
+		return err
+	}
+
+	// LOOP_CONFIGURE is not available before linux 5.8
+	if _, err = ioctl(loopFile.Fd(), loopSetFd, uintptr(config.fd)); err != nil {
+		return err
+	}
+	info := config.info
+	info.flags &^= loFlagsDirectIO
+	if _, err = ioctl(loopFile.Fd(), loopSetStatus64, uintptr(unsafe.Pointer(&info))); err == nil && opts.DirectIO {
+		_, err = ioctl(loopFile.Fd(), loopSetDirectIO, 1)
+	}
+	if err != nil {
+		ioctl(loopFile.Fd(), loopClrFd, 0)
+		return err
+	}
+	return nil
+}
+
+// FindByBackingFile returns the loop device the backing file is bound to. ErrNotFound is
+// returned when the file is not bound to any loop device.
+func FindByBackingFile(backingFile string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(backingFile, &stat); err != nil {
+		return "", fmt.Errorf("error reading the backing file: %s", err.Error())
+	}
+
+	devices, err := filepath.Glob(filepath.Join(sysBlockPath, "loop*", "loop"))
+	if err != nil {
+		return "", err
+	}
+	for _, sysLoop := range devices {
+		device := "/dev/" + filepath.Base(filepath.Dir(sysLoop))
+		info, err := getStatus(device)
+		if err != nil {
+			// the device was detached since it was listed
+			continue
+		}
+		if info.device == uint64(stat.Dev) && info.inode == stat.Ino {
+			return device, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// BackingFile returns the path of the file the loop device is bound to, as listed in sysfs. The
+// kernel appends " (deleted)" to the path once the file is removed. ErrNotLoopDevice is returned
+// when the device is not an attached loop device, e.g. a partition or a device-mapper device.
+func BackingFile(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if os.IsNotExist(err) {
+		return "", ErrNotLoopDevice
+	} else if err != nil {
+		return "", err
+	}
+	backingFile, err := ioutil.ReadFile(filepath.Join(sysBlockPath, filepath.Base(resolved), "loop", "backing_file"))
+	if os.IsNotExist(err) {
+		return "", ErrNotLoopDevice
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(backingFile)), nil
+}
+
+// Detach unbinds the loop device from its backing file.
+func Detach(device string) error {
+	loopFile, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", device, err.Error())
+	}
+	defer loopFile.Close()
+
+	if _, err = ioctl(loopFile.Fd(), loopClrFd, 0); err != nil {
+		return fmt.Errorf("error detaching %s: %s", device, err.Error())
+	}
+	return nil
+}
+
+// SetCapacity makes the loop device pick up the current size of its backing file.
+func SetCapacity(device string) error {
+	loopFile, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", device, err.Error())
+	}
+	defer loopFile.Close()
+
+	if _, err = ioctl(loopFile.Fd(), loopSetCapacity, 0); err != nil {
+		return fmt.Errorf("error setting the capacity of %s: %s", device, err.Error())
+	}
+	return nil
+}
+
+// GetInfo returns the state of the loop device.
+func GetInfo(device string) (*Info, error) {
+	status, err := getStatus(device)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the status of %s: %s", device, err.Error())
+	}
+
+	info := &Info{
+		Device:        device,
+		Number:        status.number,
+		BackingDevice: status.device,
+		BackingInode:  status.inode,
+		Offset:        status.offset,
+		SizeLimit:     status.sizeLimit,
+		AutoClear:     status.flags&loFlagsAutoClear != 0,
+		ReadOnly:      status.flags&loFlagsReadOnly != 0,
+		DirectIO:      status.flags&loFlagsDirectIO != 0,
+		PartScan:      status.flags&loFlagsPartScan != 0,
+	}
+
+	// lo_file_name is truncated to 64 bytes, sysfs has the full path
+	backingFile, err := ioutil.ReadFile(filepath.Join(sysBlockPath, filepath.Base(device), "loop", "backing_file"))
+	if err == nil {
+		info.BackingFile = strings.TrimSpace(string(backingFile))
+	} else {
+		info.BackingFile = string(bytes.TrimRight(status.fileName[:], "\x00"))
+	}
+	return info, nil
+}
+
+func getStatus(device string) (*loopInfo64, error) {
+	loopFile, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer loopFile.Close()
+
+	var info loopInfo64
+	if _, err = ioctl(loopFile.Fd(), loopGetStatus64, uintptr(unsafe.Pointer(&info))); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func flags(opts Options) uint32 {
+	var flags uint32
+	if opts.AutoClear {
+		flags |= loFlagsAutoClear
+	}
+	if opts.ReadOnly {
+		flags |= loFlagsReadOnly
+	}
+	if opts.DirectIO {
+		flags |= loFlagsDirectIO
+	}
+	return flags
+}
+
+func ioctl(fd uintptr, req uint, arg uintptr) (uintptr, error) {
+	ret, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), arg)
+	if errno != 0 {
+		return 0, errno
+	}
+	return ret, nil
+}
@@ -0,0 +1,203 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package loop
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		got  uint
+		want uint
+	}{
+		{"LOOP_SET_FD", loopSetFd, unix.LOOP_SET_FD},
+		{"LOOP_CLR_FD", loopClrFd, unix.LOOP_CLR_FD},
+		{"LOOP_SET_STATUS64", loopSetStatus64, unix.LOOP_SET_STATUS64},
+		{"LOOP_GET_STATUS64", loopGetStatus64, unix.LOOP_GET_STATUS64},
+		{"LOOP_SET_CAPACITY", loopSetCapacity, unix.LOOP_SET_CAPACITY},
+		{"LOOP_SET_DIRECT_IO", loopSetDirectIO, unix.LOOP_SET_DIRECT_IO},
+		// not in x/sys yet, _IO(0x4C, 0x0A) in linux/loop.h
+		{"LOOP_CONFIGURE", loopConfigure, 0x4C0A},
+		{"LOOP_CTL_GET_FREE", loopCtlGetFree, unix.LOOP_CTL_GET_FREE},
+		{"LO_FLAGS_READ_ONLY", loFlagsReadOnly, unix.LO_FLAGS_READ_ONLY},
+		{"LO_FLAGS_AUTOCLEAR", loFlagsAutoClear, unix.LO_FLAGS_AUTOCLEAR},
+		{"LO_FLAGS_PARTSCAN", loFlagsPartScan, unix.LO_FLAGS_PARTSCAN},
+		{"LO_FLAGS_DIRECT_IO", loFlagsDirectIO, unix.LO_FLAGS_DIRECT_IO},
+		{"LO_NAME_SIZE", loNameSize, unix.LO_NAME_SIZE},
+		{"LO_KEY_SIZE", loKeySize, unix.LO_KEY_SIZE},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %#x, want %#x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	var info loopInfo64
+	var want unix.LoopInfo64
+	if unsafe.Sizeof(info) != unsafe.Sizeof(want) {
+		t.Errorf("loop_info64 is %d bytes, want %d", unsafe.Sizeof(info), unsafe.Sizeof(want))
+	}
+	offsets := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"lo_offset", unsafe.Offsetof(info.offset), unsafe.Offsetof(want.Offset)},
+		{"lo_sizelimit", unsafe.Offsetof(info.sizeLimit), unsafe.Offsetof(want.Sizelimit)},
+		{"lo_number", unsafe.Offsetof(info.number), unsafe.Offsetof(want.Number)},
+		{"lo_flags", unsafe.Offsetof(info.flags), unsafe.Offsetof(want.Flags)},
+		{"lo_file_name", unsafe.Offsetof(info.fileName), unsafe.Offsetof(want.File_name)},
+		{"lo_crypt_name", unsafe.Offsetof(info.cryptName), unsafe.Offsetof(want.Crypt_name)},
+		{"lo_encrypt_key", unsafe.Offsetof(info.encryptKey), unsafe.Offsetof(want.Encrypt_key)},
+		{"lo_init", unsafe.Offsetof(info.init), unsafe.Offsetof(want.Init)},
+	}
+	for _, tt := range offsets {
+		if tt.got != tt.want {
+			t.Errorf("%s is at offset %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// struct loop_config: __u32 fd, __u32 block_size, struct loop_info64 info, __u64 __reserved[8]
+	var config loopConfig
+	if unsafe.Sizeof(config) != 8+unsafe.Sizeof(want)+8*8 {
+		t.Errorf("loop_config is %d bytes, want %d", unsafe.Sizeof(config), 8+unsafe.Sizeof(want)+8*8)
+	}
+	if unsafe.Offsetof(config.info) != 8 {
+		t.Errorf("loop_config.info is at offset %d, want 8", unsafe.Offsetof(config.info))
+	}
+}
+
+func TestFlags(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want uint32
+	}{
+		{Options{}, 0},
+		{Options{AutoClear: true}, loFlagsAutoClear},
+		{Options{ReadOnly: true}, loFlagsReadOnly},
+		{Options{DirectIO: true}, loFlagsDirectIO},
+		{Options{AutoClear: true, ReadOnly: true, DirectIO: true, Offset: 512, SizeLimit: 4096}, loFlagsAutoClear | loFlagsReadOnly | loFlagsDirectIO},
+	}
+	for _, tt := range tests {
+		if got := flags(tt.opts); got != tt.want {
+			t.Errorf("flags(%+v) = %#x, want %#x", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestBackingFile(t *testing.T) {
+	root := t.TempDir()
+	devDir := filepath.Join(root, "dev")
+	write := func(path, value string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sysBlock := filepath.Join(root, "sys", "block")
+	write(filepath.Join(sysBlock, "loop0", "loop", "backing_file"), "/var/lib/vml/volume.img\n")
+	write(filepath.Join(sysBlock, "loop1", "loop", "backing_file"), "/var/lib/vml/removed.img (deleted)\n")
+	write(filepath.Join(sysBlock, "sda1", "partition"), "1\n")
+	for _, name := range []string{"loop0", "loop1", "loop2", "sda1"} {
+		write(filepath.Join(devDir, name), "")
+	}
+	if err := os.Symlink(filepath.Join(devDir, "loop0"), filepath.Join(devDir, "volume")); err != nil {
+		t.Fatal(err)
+	}
+
+	oldSysBlockPath := sysBlockPath
+	sysBlockPath = sysBlock
+	defer func() { sysBlockPath = oldSysBlockPath }()
+
+	tests := []struct {
+		name    string
+		device  string
+		want    string
+		wantErr error
+	}{
+		{"attached", "loop0", "/var/lib/vml/volume.img", nil},
+		{"symlink", "volume", "/var/lib/vml/volume.img", nil},
+		{"deleted", "loop1", "/var/lib/vml/removed.img (deleted)", nil},
+		// detached loop devices have no loop directory in sysfs
+		{"detached", "loop2", "", ErrNotLoopDevice},
+		{"partition", "sda1", "", ErrNotLoopDevice},
+		{"missing", "loop9", "", ErrNotLoopDevice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BackingFile(filepath.Join(devDir, tt.device))
+			if err != tt.wantErr {
+				t.Fatalf("BackingFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("BackingFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttach(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("attaching loop devices requires root")
+	}
+	if _, err := os.Stat(loopControlPath); err != nil {
+		t.Skipf("%s is not available: %s", loopControlPath, err.Error())
+	}
+
+	backingFile := filepath.Join(t.TempDir(), "backing.img")
+	if err := ioutil.WriteFile(backingFile, make([]byte, 1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := Attach(backingFile, Options{ReadOnly: true, Offset: 4096})
+	if err != nil {
+		t.Skipf("loop devices cannot be attached here: %s", err.Error())
+	}
+	defer Detach(device)
+
+	found, err := FindByBackingFile(backingFile)
+	if err != nil || found != device {
+		t.Errorf("FindByBackingFile() = %q, %v, want %q", found, err, device)
+	}
+	if got, err := BackingFile(device); err != nil || got != backingFile {
+		t.Errorf("BackingFile() = %q, %v, want %q", got, err, backingFile)
+	}
+	info, err := GetInfo(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Device != device || info.BackingFile != backingFile || info.Offset != 4096 || !info.ReadOnly || info.AutoClear {
+		t.Errorf("GetInfo() = %+v", info)
+	}
+
+	if err := os.Truncate(backingFile, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetCapacity(device); err != nil {
+		t.Errorf("SetCapacity() error = %v", err)
+	}
+
+	if err := Detach(device); err != nil {
+		t.Fatalf("Detach() error = %v", err)
+	}
+	if _, err := FindByBackingFile(backingFile); err != ErrNotFound {
+		t.Errorf("FindByBackingFile() after Detach error = %v, want %v", err, ErrNotFound)
+	}
+}
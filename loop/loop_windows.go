@@ -0,0 +1,42 @@
+//go:build windows
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package loop
+
+import "fmt"
+
+// WARNING : Product does not work on windows  - stub implementation only
+
+// Attach binds the backing file to a free loop device and returns the loop device path.
+func Attach(backingFile string, opts Options) (string, error) {
+	return "", fmt.Errorf("function not implemented on Windows")
+}
+
+// FindByBackingFile returns the loop device the backing file is bound to.
+func FindByBackingFile(backingFile string) (string, error) {
+	return "", fmt.Errorf("function not implemented on Windows")
+}
+
+// BackingFile returns the path of the file the loop device is bound to.
+func BackingFile(device string) (string, error) {
+	return "", fmt.Errorf("function not implemented on Windows")
+}
+
+// Detach unbinds the loop device from its backing file.
+func Detach(device string) error {
+	return fmt.Errorf("function not implemented on Windows")
+}
+
+// SetCapacity makes the loop device pick up the current size of its backing file.
+func SetCapacity(device string) error {
+	return fmt.Errorf("function not implemented on Windows")
+}
+
+// GetInfo returns the state of the loop device.
+func GetInfo(device string) (*Info, error) {
+	return nil, fmt.Errorf("function not implemented on Windows")
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/xts"
+)
+
+// sectorSize is the unit of the dm-crypt IVs, whatever the sector size of the segment
+const sectorSize = 512
+
+// sectorCipher decrypts the sectors of a keyslot area or a segment.
+type sectorCipher interface {
+	// decrypt decrypts src into dst, both the length of one sector, using the IV of sector.
+	decrypt(dst, src []byte, sector uint64)
+}
+
+// newSectorCipher returns the cipher of a dm-crypt specification such as aes-xts-plain64 or
+// aes-cbc-essiv:sha256.
+func newSectorCipher(encryption string, key []byte) (sectorCipher, error) {
+	spec := strings.SplitN(encryption, "-", 3)
+	if len(spec) != 3 || spec[0] != "aes" {
+		return nil, fmt.Errorf("unsupported encryption %q", encryption)
+	}
+	mode, ivMode := spec[1], spec[2]
+
+	switch mode {
+	case "xts":
+		if ivMode != "plain64" && ivMode != "plain" {
+			return nil, fmt.Errorf("unsupported IV mode of encryption %q", encryption)
+		}
+		c, err := xts.NewCipher(aes.NewCipher, key)
+		if err != nil {
+			return nil, err
+		}
+		return &xtsCipher{cipher: c, truncate: ivMode == "plain"}, nil
+
+	case "cbc":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		c := &cbcCipher{block: block, truncate: ivMode == "plain"}
+		switch {
+		case ivMode == "plain64" || ivMode == "plain":
+		case strings.HasPrefix(ivMode, "essiv:"):
+			newHash, ok := hashes[strings.TrimPrefix(ivMode, "essiv:")]
+			if !ok {
+				return nil, fmt.Errorf("unsupported IV mode of encryption %q", encryption)
+			}
+			h := newHash()
+			h.Write(key)
+			if c.essiv, err = aes.NewCipher(h.Sum(nil)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported IV mode of encryption %q", encryption)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported encryption %q", encryption)
+}
+
+// xtsCipher is aes-xts with the plain64 IV, or the plain IV truncated to 32 bits
+type xtsCipher struct {
+	cipher   *xts.Cipher
+	truncate bool
+}
+
+func (c *xtsCipher) decrypt(dst, src []byte, sector uint64) {
+	if c.truncate {
+		sector &= 0xffffffff
+	}
+	c.cipher.Decrypt(dst, src, sector)
+}
+
+// cbcCipher is aes-cbc with the plain64, plain or essiv IV
+type cbcCipher struct {
+	block    cipher.Block
+	essiv    cipher.Block
+	truncate bool
+}
+
+func (c *cbcCipher) decrypt(dst, src []byte, sector uint64) {
+	iv := make([]byte, aes.BlockSize)
+	if c.truncate {
+		binary.LittleEndian.PutUint32(iv, uint32(sector))
+	} else {
+		binary.LittleEndian.PutUint64(iv, sector)
+	}
+	if c.essiv != nil {
+		c.essiv.Encrypt(iv, iv)
+	}
+	cipher.NewCBCDecrypter(c.block, iv).CryptBlocks(dst, src)
+}
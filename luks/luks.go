@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package luks reads LUKS1 and LUKS2 headers from a file or a block device, without cryptsetup.
+// Both header copies of LUKS2 are validated against their checksum and compared with each other.
+package luks
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrNotLUKS is returned when no LUKS header is found.
+	ErrNotLUKS = errors.New("not a LUKS header")
+	// ErrUnsupportedVersion is returned for a LUKS header of an unknown version.
+	ErrUnsupportedVersion = errors.New("unsupported LUKS version")
+	// ErrInvalidHeader is returned when no copy of a LUKS2 header is valid.
+	ErrInvalidHeader = errors.New("invalid LUKS header")
+	// ErrMismatch is returned by Header.Verify when the LUKS2 header copies do not match.
+	ErrMismatch = errors.New("LUKS header copies do not match")
+)
+
+// magic of a LUKS1 header and of the primary LUKS2 header
+var magic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// magic of the secondary LUKS2 header
+var secondaryMagic = []byte{'S', 'K', 'U', 'L', 0xba, 0xbe}
+
+// hashes are the supported hash algorithms of the header checksum, the KDFs and the AF splitter
+var hashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// Header is a LUKS header. LUKS1 headers are presented with the keyslot, segment and digest
+// metadata of LUKS2 so both versions can be handled alike.
+type Header struct {
+	Version int    `json:"version"`
+	UUID    string `json:"uuid"`
+	// Label and Subsystem are only set by LUKS2.
+	Label     string `json:"label,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+	// SequenceID is incremented by every update of a LUKS2 header.
+	SequenceID uint64 `json:"sequence_id,omitempty"`
+	// HeaderSize is the size of the binary header, plus the JSON area for LUKS2.
+	HeaderSize        uint64 `json:"header_size"`
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty"`
+	// Checksum is the hex encoded checksum of the LUKS2 header copy in use.
+	Checksum string   `json:"checksum,omitempty"`
+	Metadata Metadata `json:"metadata"`
+	// Copies are the primary and secondary LUKS2 headers.
+	Copies []Copy `json:"copies,omitempty"`
+	// Mismatches lists the differences found between the LUKS2 header copies.
+	Mismatches []string `json:"mismatches"`
+}
+
+// Copy is the state of a LUKS2 header copy.
+type Copy struct {
+	Offset     uint64 `json:"offset"`
+	SequenceID uint64 `json:"sequence_id"`
+	Checksum   string `json:"checksum"`
+	Valid      bool   `json:"valid"`
+	// Err is the reason the copy is not valid, nil when it is.
+	Err error `json:"-"`
+}
+
+// ReadFile reads the LUKS header at the start of a file or a block device. The file is opened
+// read-only, a sparse file needs no privileges.
+func ReadFile(path string) (*Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, err := Read(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the LUKS header of %s: %w", path, err)
+	}
+	return header, nil
+}
+
+// Read reads the LUKS header at the start of r.
+//
+// A LUKS2 header is returned as long as one copy is valid, the valid copy with the highest
+// sequence ID is used like cryptsetup does. Invalid or differing copies are listed in Mismatches.
+func Read(r io.ReaderAt) (*Header, error) {
+	prefix, err := readAt(r, len(magic)+2, 0)
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrNotLUKS
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(prefix[:len(magic)], magic) {
+		switch version := int(prefix[6])<<8 | int(prefix[7]); version {
+		case 1:
+			return readLUKS1(r)
+		case 2:
+			return readLUKS2(r)
+		default:
+			return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+		}
+	}
+	// the primary LUKS2 header can be damaged while the secondary is intact
+	return readLUKS2(r)
+}
+
+// Verify returns an error wrapping ErrMismatch when the LUKS2 header copies are not both valid
+// and identical.
+func (h *Header) Verify() error {
+	if len(h.Mismatches) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrMismatch, strings.Join(h.Mismatches, ", "))
+}
+
+// readAt reads size bytes at offset, io.ErrUnexpectedEOF is returned when r is shorter.
+func readAt(r io.ReaderAt, size int, offset int64) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := r.ReadAt(data, offset)
+	if n == size {
+		return data, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// cString returns the NUL terminated string at the start of b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+// layout of the LUKS1 header, all integers are big endian
+const (
+	luks1HeaderSize     = 592
+	luks1KeyslotCount   = 8
+	luks1KeyslotSize    = 48
+	luks1KeyslotsOffset = 208
+	luks1KeyslotEnabled = 0x00AC71F3
+	luks1SectorSize     = 512
+	luks1DigestSize     = 20
+	luks1SaltSize       = 32
+	luks1CipherNameSize = 32
+	luks1CipherModeSize = 32
+	luks1HashSpecSize   = 32
+	luks1UUIDSize       = 40
+	luks1FieldsOffset   = 8
+)
+
+// readLUKS1 reads a LUKS1 header and presents it as LUKS2 metadata.
+func readLUKS1(r io.ReaderAt) (*Header, error) {
+	raw, err := readAt(r, luks1HeaderSize, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// the fields following the magic and the version
+	offset := luks1FieldsOffset
+	field := func(size int) []byte {
+		value := raw[offset : offset+size]
+		offset += size
+		return value
+	}
+	cipherName := cString(field(luks1CipherNameSize))
+	cipherMode := cString(field(luks1CipherModeSize))
+	hashSpec := cString(field(luks1HashSpecSize))
+	payloadOffset := binary.BigEndian.Uint32(field(4))
+	keyBytes := binary.BigEndian.Uint32(field(4))
+	mkDigest := append([]byte(nil), field(luks1DigestSize)...)
+	mkDigestSalt := append([]byte(nil), field(luks1SaltSize)...)
+	mkDigestIterations := binary.BigEndian.Uint32(field(4))
+	uuid := cString(field(luks1UUIDSize))
+
+	encryption := cipherName + "-" + cipherMode
+	header := &Header{
+		Version:    1,
+		UUID:       uuid,
+		HeaderSize: luks1HeaderSize,
+		Metadata: Metadata{
+			Keyslots: map[string]Keyslot{},
+			Tokens:   map[string]Token{},
+			Segments: map[string]Segment{
+				"0": {
+					Type:       "crypt",
+					Offset:     Number(uint64(payloadOffset) * luks1SectorSize),
+					Size:       DynamicSize,
+					Encryption: encryption,
+					SectorSize: luks1SectorSize,
+				},
+			},
+			Digests: map[string]Digest{},
+		},
+		Mismatches: []string{},
+	}
+
+	digest := Digest{
+		Type:       "pbkdf2",
+		Keyslots:   []string{},
+		Segments:   []string{"0"},
+		Hash:       hashSpec,
+		Iterations: int(mkDigestIterations),
+		Salt:       mkDigestSalt,
+		Digest:     mkDigest,
+	}
+	for i := 0; i < luks1KeyslotCount; i++ {
+		slot := raw[luks1KeyslotsOffset+i*luks1KeyslotSize : luks1KeyslotsOffset+(i+1)*luks1KeyslotSize]
+		if binary.BigEndian.Uint32(slot[0:4]) != luks1KeyslotEnabled {
+			continue
+		}
+		iterations := binary.BigEndian.Uint32(slot[4:8])
+		salt := append([]byte(nil), slot[8:40]...)
+		keyMaterialOffset := binary.BigEndian.Uint32(slot[40:44])
+		stripes := binary.BigEndian.Uint32(slot[44:48])
+
+		// the key material is split in stripes copies of the key, padded to whole sectors
+		areaSize := (uint64(keyBytes)*uint64(stripes) + luks1SectorSize - 1) / luks1SectorSize * luks1SectorSize
+		id := strconv.Itoa(i)
+		header.Metadata.Keyslots[id] = Keyslot{
+			Type:    "luks2",
+			KeySize: int(keyBytes),
+			Area: KeyslotArea{
+				Type:       "raw",
+				Offset:     Number(uint64(keyMaterialOffset) * luks1SectorSize),
+				Size:       Number(areaSize),
+				Encryption: encryption,
+				KeySize:    int(keyBytes),
+			},
+			KDF: KDF{Type: "pbkdf2", Salt: salt, Hash: hashSpec, Iterations: int(iterations)},
+			AF:  AF{Type: "luks1", Stripes: int(stripes), Hash: hashSpec},
+		}
+		digest.Keyslots = append(digest.Keyslots, id)
+	}
+	header.Metadata.Digests["0"] = digest
+	return header, nil
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// layout of the LUKS2 binary header, all integers are big endian
+const (
+	luks2BinaryHeaderSize = 4096
+	luks2HeaderSizeOffset = 8
+	luks2SeqIDOffset      = 16
+	luks2LabelOffset      = 24
+	luks2LabelSize        = 48
+	luks2CsumAlgOffset    = 72
+	luks2CsumAlgSize      = 32
+	luks2UUIDOffset       = 168
+	luks2UUIDSize         = 40
+	luks2SubsystemOffset  = 208
+	luks2SubsystemSize    = 48
+	luks2HeaderOffset     = 256
+	luks2CsumOffset       = 448
+	luks2CsumSize         = 64
+)
+
+// luks2HeaderSizes are the valid sizes of a LUKS2 header copy, the secondary copy starts right
+// after the primary one
+var luks2HeaderSizes = []uint64{
+	0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000,
+}
+
+// luks2Copy is a LUKS2 header copy as read from the device
+type luks2Copy struct {
+	offset     uint64
+	found      bool
+	headerSize uint64
+	seqID      uint64
+	label      string
+	csumAlg    string
+	uuid       string
+	subsystem  string
+	checksum   []byte
+	json       []byte
+	metadata   Metadata
+	err        error
+}
+
+// readLUKS2 reads both copies of a LUKS2 header.
+func readLUKS2(r io.ReaderAt) (*Header, error) {
+	primary := readLUKS2Copy(r, 0, magic)
+	var secondary *luks2Copy
+	if primary.headerSize != 0 {
+		secondary = readLUKS2Copy(r, primary.headerSize, secondaryMagic)
+	} else {
+		// the primary copy does not tell where the secondary is, look for it at every valid offset
+		for _, offset := range luks2HeaderSizes {
+			secondary = readLUKS2Copy(r, offset, secondaryMagic)
+			if secondary.found {
+				break
+			}
+		}
+	}
+	if !primary.found && !secondary.found {
+		return nil, ErrNotLUKS
+	}
+
+	active := primary
+	if secondary.err == nil && (primary.err != nil || secondary.seqID > primary.seqID) {
+		active = secondary
+	}
+	if active.err != nil {
+		return nil, fmt.Errorf("%w: primary header: %v, secondary header: %v", ErrInvalidHeader, primary.err, secondary.err)
+	}
+
+	header := &Header{
+		Version:           2,
+		UUID:              active.uuid,
+		Label:             active.label,
+		Subsystem:         active.subsystem,
+		SequenceID:        active.seqID,
+		HeaderSize:        active.headerSize,
+		ChecksumAlgorithm: active.csumAlg,
+		Checksum:          hex.EncodeToString(active.checksum),
+		Metadata:          active.metadata,
+		Copies:            []Copy{primary.state(), secondary.state()},
+		Mismatches:        compareLUKS2Copies(primary, secondary),
+	}
+	return header, nil
+}
+
+// readLUKS2Copy reads and validates the header copy at offset.
+func readLUKS2Copy(r io.ReaderAt, offset uint64, wantMagic []byte) *luks2Copy {
+	c := &luks2Copy{offset: offset}
+	binaryHeader, err := readAt(r, luks2BinaryHeaderSize, int64(offset))
+	if err != nil {
+		c.err = err
+		return c
+	}
+	if !bytes.Equal(binaryHeader[:len(wantMagic)], wantMagic) {
+		c.err = errors.New("bad magic")
+		return c
+	}
+	c.found = true
+
+	if version := binary.BigEndian.Uint16(binaryHeader[len(wantMagic):]); version != 2 {
+		c.err = fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+		return c
+	}
+	headerSize := binary.BigEndian.Uint64(binaryHeader[luks2HeaderSizeOffset:])
+	if !validLUKS2HeaderSize(headerSize) {
+		c.err = fmt.Errorf("invalid header size %d", headerSize)
+		return c
+	}
+	c.headerSize = headerSize
+	c.seqID = binary.BigEndian.Uint64(binaryHeader[luks2SeqIDOffset:])
+	c.label = cString(binaryHeader[luks2LabelOffset : luks2LabelOffset+luks2LabelSize])
+	c.csumAlg = cString(binaryHeader[luks2CsumAlgOffset : luks2CsumAlgOffset+luks2CsumAlgSize])
+	c.uuid = cString(binaryHeader[luks2UUIDOffset : luks2UUIDOffset+luks2UUIDSize])
+	c.subsystem = cString(binaryHeader[luks2SubsystemOffset : luks2SubsystemOffset+luks2SubsystemSize])
+	if headerOffset := binary.BigEndian.Uint64(binaryHeader[luks2HeaderOffset:]); headerOffset != offset {
+		c.err = fmt.Errorf("header offset %d does not match its location %d", headerOffset, offset)
+		return c
+	}
+
+	newHash, ok := hashes[c.csumAlg]
+	if !ok {
+		c.err = fmt.Errorf("unsupported checksum algorithm %q", c.csumAlg)
+		return c
+	}
+	full, err := readAt(r, int(headerSize), int64(offset))
+	if err != nil {
+		c.err = err
+		return c
+	}
+	// the checksum covers the binary header, with the checksum field zeroed, and the JSON area
+	stored := append([]byte(nil), full[luks2CsumOffset:luks2CsumOffset+luks2CsumSize]...)
+	copy(full[luks2CsumOffset:luks2CsumOffset+luks2CsumSize], make([]byte, luks2CsumSize))
+	h := newHash()
+	h.Write(full)
+	c.checksum = h.Sum(nil)
+	if !bytes.Equal(c.checksum, stored[:len(c.checksum)]) {
+		c.err = fmt.Errorf("checksum mismatch, computed %s, stored %s", hex.EncodeToString(c.checksum), hex.EncodeToString(stored[:len(c.checksum)]))
+		return c
+	}
+
+	jsonArea := full[luks2BinaryHeaderSize:]
+	if i := bytes.IndexByte(jsonArea, 0); i >= 0 {
+		jsonArea = jsonArea[:i]
+	}
+	c.json = jsonArea
+	if err = json.Unmarshal(jsonArea, &c.metadata); err != nil {
+		c.err = fmt.Errorf("invalid JSON metadata: %w", err)
+		return c
+	}
+	if uint64(c.metadata.Config.JSONSize) != headerSize-luks2BinaryHeaderSize {
+		c.err = fmt.Errorf("JSON area size %d does not match the header size %d", c.metadata.Config.JSONSize, headerSize)
+		return c
+	}
+	return c
+}
+
+// state reports the state of the header copy.
+func (c *luks2Copy) state() Copy {
+	return Copy{
+		Offset:     c.offset,
+		SequenceID: c.seqID,
+		Checksum:   hex.EncodeToString(c.checksum),
+		Valid:      c.err == nil,
+		Err:        c.err,
+	}
+}
+
+// compareLUKS2Copies lists the differences between the header copies.
+func compareLUKS2Copies(primary, secondary *luks2Copy) []string {
+	mismatches := []string{}
+	if primary.err != nil {
+		mismatches = append(mismatches, fmt.Sprintf("primary header is invalid: %v", primary.err))
+	}
+	if secondary.err != nil {
+		mismatches = append(mismatches, fmt.Sprintf("secondary header is invalid: %v", secondary.err))
+	}
+	if len(mismatches) > 0 {
+		return mismatches
+	}
+
+	compare := func(field string, primaryValue, secondaryValue interface{}) {
+		if primaryValue != secondaryValue {
+			mismatches = append(mismatches, fmt.Sprintf("%s differs, primary %v, secondary %v", field, primaryValue, secondaryValue))
+		}
+	}
+	compare("sequence id", primary.seqID, secondary.seqID)
+	compare("header size", primary.headerSize, secondary.headerSize)
+	compare("uuid", primary.uuid, secondary.uuid)
+	compare("label", primary.label, secondary.label)
+	compare("subsystem", primary.subsystem, secondary.subsystem)
+	compare("checksum algorithm", primary.csumAlg, secondary.csumAlg)
+	if !bytes.Equal(primary.json, secondary.json) {
+		mismatches = append(mismatches, "JSON metadata differs")
+	}
+	return mismatches
+}
+
+func validLUKS2HeaderSize(size uint64) bool {
+	for _, valid := range luks2HeaderSizes {
+		if size == valid {
+			return true
+		}
+	}
+	return false
+}
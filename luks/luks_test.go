@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	testUUID       = "0f2c5a6e-8d3b-4a51-9c7e-2b1d4f6a8e90"
+	testEncryption = "aes-xts-plain64"
+	testKeySize    = 32
+	testStripes    = 4
+	// the test images hold their keyslot areas after two 16 KiB LUKS2 header copies, one 4 KiB
+	// area per keyslot, and the data segment after the keyslots
+	testHeaderSize   = 0x4000
+	testAreasOffset  = 2 * testHeaderSize
+	testAreaSize     = 0x1000
+	testDataOffset   = 0x10000
+	testDataSize     = 4 * sectorSize
+	testIterations   = 1000
+	testLUKS1Payload = testDataOffset / luks1SectorSize
+)
+
+// testSlot is a keyslot of a test image, opened with key.
+type testSlot struct {
+	key []byte
+	kdf KDF
+}
+
+func pbkdf2Slot(key string) testSlot {
+	return testSlot{key: []byte(key), kdf: KDF{Type: "pbkdf2", Hash: "sha256", Iterations: testIterations}}
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// afSplit splits the key in stripes with the LUKS anti-forensic splitter, the reverse of afMerge.
+func afSplit(t *testing.T, key []byte, stripes int) []byte {
+	split := randomBytes(t, len(key)*stripes)
+	merged := make([]byte, len(key))
+	for i := 0; i < stripes-1; i++ {
+		xorBytes(merged, split[i*len(key):(i+1)*len(key)])
+		merged = afDiffuse(merged, sha256.New)
+	}
+	last := split[(stripes-1)*len(key):]
+	copy(last, merged)
+	xorBytes(last, key)
+	return split
+}
+
+// encryptSectors encrypts data in place with aes-xts-plain64, the IVs counting from firstSector.
+func encryptSectors(t *testing.T, key, data []byte, firstSector uint64) {
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i*sectorSize < len(data); i++ {
+		sector := data[i*sectorSize : (i+1)*sectorSize]
+		c.Encrypt(sector, sector, firstSector+uint64(i))
+	}
+}
+
+// keyMaterial returns the encrypted key material of a keyslot area. The area of a keyslot whose
+// KDF parameters are refused is filled with random bytes.
+func keyMaterial(t *testing.T, slot testSlot, volumeKey []byte) []byte {
+	material := make([]byte, testAreaSize)
+	areaKey, err := deriveKey(slot.kdf, slot.key, len(volumeKey))
+	if err != nil {
+		return randomBytes(t, testAreaSize)
+	}
+	copy(material, afSplit(t, volumeKey, testStripes))
+	encryptSectors(t, areaKey, material, 0)
+	return material
+}
+
+// encryptedData returns the data segment of a test image, with the plaintext encrypted with the
+// volume key.
+func encryptedData(t *testing.T, volumeKey, plaintext []byte) []byte {
+	data := append([]byte(nil), plaintext...)
+	encryptSectors(t, volumeKey, data, 0)
+	return data
+}
+
+func testPlaintext() []byte {
+	return bytes.Repeat([]byte("plaintext sector"), testDataSize/16)
+}
+
+// buildLUKS1 returns a LUKS1 image with a keyslot per slot and the test plaintext as data.
+func buildLUKS1(t *testing.T, volumeKey []byte, slots ...testSlot) []byte {
+	image := make([]byte, testDataOffset+testDataSize)
+	copy(image, magic)
+	binary.BigEndian.PutUint16(image[6:], 1)
+	copy(image[8:], "aes")
+	copy(image[40:], "xts-plain64")
+	copy(image[72:], "sha256")
+	binary.BigEndian.PutUint32(image[104:], testLUKS1Payload)
+	binary.BigEndian.PutUint32(image[108:], uint32(len(volumeKey)))
+	digestSalt := randomBytes(t, luks1SaltSize)
+	copy(image[112:], pbkdf2.Key(volumeKey, digestSalt, testIterations, luks1DigestSize, sha256.New))
+	copy(image[132:], digestSalt)
+	binary.BigEndian.PutUint32(image[164:], testIterations)
+	copy(image[168:], testUUID)
+
+	for i, slot := range slots {
+		slot.kdf.Salt = randomBytes(t, luks1SaltSize)
+		raw := image[luks1KeyslotsOffset+i*luks1KeyslotSize:]
+		binary.BigEndian.PutUint32(raw[0:], luks1KeyslotEnabled)
+		binary.BigEndian.PutUint32(raw[4:], uint32(slot.kdf.Iterations))
+		copy(raw[8:40], slot.kdf.Salt)
+		areaOffset := testAreasOffset + i*testAreaSize
+		binary.BigEndian.PutUint32(raw[40:], uint32(areaOffset/luks1SectorSize))
+		binary.BigEndian.PutUint32(raw[44:], testStripes)
+		copy(image[areaOffset:], keyMaterial(t, slot, volumeKey))
+	}
+	copy(image[testDataOffset:], encryptedData(t, volumeKey, testPlaintext()))
+	return image
+}
+
+// luks2Metadata returns the metadata of a LUKS2 test image with a keyslot per slot, along with
+// their key material.
+func luks2Metadata(t *testing.T, volumeKey []byte, slots ...testSlot) (Metadata, [][]byte) {
+	digestSalt := randomBytes(t, 32)
+	metadata := Metadata{
+		Keyslots: map[string]Keyslot{},
+		Tokens:   map[string]Token{},
+		Segments: map[string]Segment{
+			"0": {Type: "crypt", Offset: testDataOffset, Size: DynamicSize, Encryption: testEncryption, SectorSize: sectorSize},
+		},
+		Digests: map[string]Digest{
+			"0": {
+				Type:       "pbkdf2",
+				Keyslots:   []string{},
+				Segments:   []string{"0"},
+				Hash:       "sha256",
+				Iterations: testIterations,
+				Salt:       digestSalt,
+				Digest:     pbkdf2.Key(volumeKey, digestSalt, testIterations, sha256.Size, sha256.New),
+			},
+		},
+		Config: Config{JSONSize: testHeaderSize - luks2BinaryHeaderSize, KeyslotsSize: testDataOffset - testAreasOffset},
+	}
+
+	var materials [][]byte
+	for i, slot := range slots {
+		slot.kdf.Salt = randomBytes(t, 32)
+		id := string(rune('0' + i))
+		metadata.Keyslots[id] = Keyslot{
+			Type:    "luks2",
+			KeySize: len(volumeKey),
+			Area: KeyslotArea{
+				Type:       "raw",
+				Offset:     Number(testAreasOffset + i*testAreaSize),
+				Size:       testAreaSize,
+				Encryption: testEncryption,
+				KeySize:    len(volumeKey),
+			},
+			KDF: slot.kdf,
+			AF:  AF{Type: "luks1", Stripes: testStripes, Hash: "sha256"},
+		}
+		digest := metadata.Digests["0"]
+		digest.Keyslots = append(digest.Keyslots, id)
+		metadata.Digests["0"] = digest
+		materials = append(materials, keyMaterial(t, slot, volumeKey))
+	}
+	return metadata, materials
+}
+
+// buildLUKS2 returns a LUKS2 image with both header copies holding the metadata, the key
+// material of its keyslots and the test plaintext as data.
+func buildLUKS2(t *testing.T, volumeKey []byte, metadata Metadata, materials [][]byte) []byte {
+	image := make([]byte, testDataOffset+testDataSize)
+	writeLUKS2Copy(t, image, 0, 1, metadata)
+	writeLUKS2Copy(t, image, testHeaderSize, 1, metadata)
+	for i, material := range materials {
+		copy(image[testAreasOffset+i*testAreaSize:], material)
+	}
+	copy(image[testDataOffset:], encryptedData(t, volumeKey, testPlaintext()))
+	return image
+}
+
+// writeLUKS2Copy writes the header copy at offset, the primary copy at offset 0.
+func writeLUKS2Copy(t *testing.T, image []byte, offset int, seqID uint64, metadata Metadata) {
+	jsonArea, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jsonArea) >= testHeaderSize-luks2BinaryHeaderSize {
+		t.Fatalf("JSON metadata of %d bytes does not fit the header", len(jsonArea))
+	}
+
+	header := image[offset : offset+testHeaderSize]
+	for i := range header {
+		header[i] = 0
+	}
+	if offset == 0 {
+		copy(header, magic)
+	} else {
+		copy(header, secondaryMagic)
+	}
+	binary.BigEndian.PutUint16(header[6:], 2)
+	binary.BigEndian.PutUint64(header[luks2HeaderSizeOffset:], testHeaderSize)
+	binary.BigEndian.PutUint64(header[luks2SeqIDOffset:], seqID)
+	copy(header[luks2LabelOffset:], "test")
+	copy(header[luks2CsumAlgOffset:], "sha256")
+	copy(header[luks2UUIDOffset:], testUUID)
+	binary.BigEndian.PutUint64(header[luks2HeaderOffset:], uint64(offset))
+	copy(header[luks2BinaryHeaderSize:], jsonArea)
+	sum := sha256.Sum256(header)
+	copy(header[luks2CsumOffset:], sum[:])
+}
+
+func TestRead(t *testing.T) {
+	volumeKey := make([]byte, testKeySize)
+	metadata, materials := luks2Metadata(t, volumeKey, pbkdf2Slot("key"))
+	luks2 := buildLUKS2(t, volumeKey, metadata, materials)
+
+	// the primary copy is damaged, the secondary one is used
+	damagedPrimary := append([]byte(nil), luks2...)
+	damagedPrimary[luks2BinaryHeaderSize+1] ^= 0xff
+
+	// the secondary copy was updated last
+	newerSecondary := append([]byte(nil), luks2...)
+	writeLUKS2Copy(t, newerSecondary, testHeaderSize, 2, metadata)
+
+	badVersion := append([]byte(nil), luks2...)
+	binary.BigEndian.PutUint16(badVersion[6:], 3)
+
+	tests := []struct {
+		name           string
+		image          []byte
+		wantErr        error
+		wantVersion    int
+		wantSeqID      uint64
+		wantMismatches []string
+	}{
+		{name: "LUKS1", image: buildLUKS1(t, volumeKey, pbkdf2Slot("key")), wantVersion: 1},
+		{name: "LUKS2", image: luks2, wantVersion: 2, wantSeqID: 1},
+		{name: "damaged primary", image: damagedPrimary, wantVersion: 2, wantSeqID: 1, wantMismatches: []string{"primary header is invalid"}},
+		{name: "newer secondary", image: newerSecondary, wantVersion: 2, wantSeqID: 2, wantMismatches: []string{"sequence id differs"}},
+		{name: "unsupported version", image: badVersion, wantErr: ErrUnsupportedVersion},
+		{name: "not LUKS", image: make([]byte, testDataOffset), wantErr: ErrNotLUKS},
+		{name: "short", image: []byte("LUKS"), wantErr: ErrNotLUKS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := Read(bytes.NewReader(tt.image))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if header.Version != tt.wantVersion || header.UUID != testUUID || header.SequenceID != tt.wantSeqID {
+				t.Fatalf("got version %d, UUID %q, sequence id %d", header.Version, header.UUID, header.SequenceID)
+			}
+			if len(header.Mismatches) != len(tt.wantMismatches) {
+				t.Fatalf("got mismatches %q, want %q", header.Mismatches, tt.wantMismatches)
+			}
+			for i, want := range tt.wantMismatches {
+				if !strings.Contains(header.Mismatches[i], want) {
+					t.Errorf("got mismatch %q, want %q", header.Mismatches[i], want)
+				}
+			}
+			if err = header.Verify(); (err != nil) != (len(tt.wantMismatches) > 0) {
+				t.Errorf("Verify returned %v", err)
+			}
+
+			segment := header.Metadata.Segments["0"]
+			if segment.Encryption != testEncryption || segment.Offset != testDataOffset || segment.Size != DynamicSize {
+				t.Errorf("got segment %+v", segment)
+			}
+			if len(header.Metadata.Keyslots) != 1 || len(header.Metadata.Digests["0"].Keyslots) != 1 {
+				t.Errorf("got keyslots %+v, digests %+v", header.Metadata.Keyslots, header.Metadata.Digests)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// DynamicSize is the size of a segment that extends to the end of the device.
+const DynamicSize = "dynamic"
+
+// Metadata is the JSON metadata area of a LUKS2 header. Binary values are base64 encoded in the
+// header and decoded here.
+type Metadata struct {
+	Keyslots map[string]Keyslot `json:"keyslots"`
+	Tokens   map[string]Token   `json:"tokens"`
+	Segments map[string]Segment `json:"segments"`
+	Digests  map[string]Digest  `json:"digests"`
+	Config   Config             `json:"config"`
+}
+
+// Keyslot holds a copy of the volume key encrypted with a passphrase or key file.
+type Keyslot struct {
+	Type     string      `json:"type"`
+	KeySize  int         `json:"key_size"`
+	Priority *int        `json:"priority,omitempty"`
+	Area     KeyslotArea `json:"area"`
+	KDF      KDF         `json:"kdf"`
+	AF       AF          `json:"af"`
+}
+
+// KeyslotArea is where the encrypted key material of a keyslot is stored.
+type KeyslotArea struct {
+	Type       string `json:"type"`
+	Offset     Number `json:"offset"`
+	Size       Number `json:"size"`
+	Encryption string `json:"encryption"`
+	KeySize    int    `json:"key_size"`
+}
+
+// KDF derives the key of a keyslot area from the passphrase. Iterations and Hash are set by
+// pbkdf2, Time, Memory and CPUs by argon2i and argon2id.
+type KDF struct {
+	Type       string `json:"type"`
+	Salt       []byte `json:"salt"`
+	Hash       string `json:"hash,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Time       int    `json:"time,omitempty"`
+	Memory     int    `json:"memory,omitempty"`
+	CPUs       int    `json:"cpus,omitempty"`
+}
+
+// AF is the anti-forensic splitter applied to the key material of a keyslot.
+type AF struct {
+	Type    string `json:"type"`
+	Stripes int    `json:"stripes"`
+	Hash    string `json:"hash"`
+}
+
+// Segment is an encrypted data area of the device.
+type Segment struct {
+	Type   string `json:"type"`
+	Offset Number `json:"offset"`
+	// Size is a size in bytes or DynamicSize.
+	Size       string            `json:"size"`
+	IVTweak    Number            `json:"iv_tweak"`
+	Encryption string            `json:"encryption"`
+	SectorSize int               `json:"sector_size"`
+	Integrity  *SegmentIntegrity `json:"integrity,omitempty"`
+	Flags      []string          `json:"flags,omitempty"`
+}
+
+// SegmentIntegrity is the dm-integrity protection of a segment.
+type SegmentIntegrity struct {
+	Type              string `json:"type"`
+	JournalEncryption string `json:"journal_encryption"`
+	JournalIntegrity  string `json:"journal_integrity"`
+}
+
+// Digest verifies the volume key recovered from the keyslots it lists.
+type Digest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       []byte   `json:"salt"`
+	Digest     []byte   `json:"digest"`
+}
+
+// Token is external metadata, e.g. how to get the passphrase of the keyslots it lists. The
+// fields specific to the token type are kept in Raw.
+type Token struct {
+	Type     string          `json:"type"`
+	Keyslots []string        `json:"keyslots"`
+	Raw      json.RawMessage `json:"-"`
+}
+
+// Config is the configuration of a LUKS2 header.
+type Config struct {
+	JSONSize     Number        `json:"json_size"`
+	KeyslotsSize Number        `json:"keyslots_size"`
+	Flags        []string      `json:"flags,omitempty"`
+	Requirements *Requirements `json:"requirements,omitempty"`
+}
+
+// Requirements lists the features an implementation must support to use the header.
+type Requirements struct {
+	Mandatory []string `json:"mandatory,omitempty"`
+}
+
+// Number is a 64 bit value, stored as a decimal string in the LUKS2 metadata.
+type Number uint64
+
+// UnmarshalJSON decodes a decimal string, or a plain JSON number.
+func (n *Number) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		var value uint64
+		if err = json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		*n = Number(value)
+		return nil
+	}
+	value, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = Number(value)
+	return nil
+}
+
+// MarshalJSON encodes the number as a decimal string.
+func (n Number) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(n), 10))
+}
+
+// UnmarshalJSON decodes the token and keeps its JSON in Raw.
+func (t *Token) UnmarshalJSON(data []byte) error {
+	type token Token
+	var value token
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*t = Token(value)
+	t.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON encodes the token from Raw when it is set, to keep the fields of its type.
+func (t Token) MarshalJSON() ([]byte, error) {
+	if len(t.Raw) > 0 {
+		return t.Raw, nil
+	}
+	type token Token
+	return json.Marshal(token(t))
+}
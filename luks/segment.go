@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// segmentReader decrypts the segment of a volume
+type segmentReader struct {
+	r          io.ReaderAt
+	cipher     sectorCipher
+	offset     int64
+	size       int64
+	ivTweak    uint64
+	sectorSize int64
+}
+
+// NewSegmentReader returns a reader of the plaintext of the segment encrypted with the volume
+// key, r being the device the key was recovered from. It reads the volume offline, the way
+// dm-crypt would present it, e.g. to check the content of a volume in tests.
+func NewSegmentReader(r io.ReaderAt, volumeKey *VolumeKey) (io.ReaderAt, error) {
+	segment := volumeKey.Segment
+	if segment.Type != "crypt" {
+		return nil, errors.New("unsupported segment type " + strconv.Quote(segment.Type))
+	}
+	if segment.Integrity != nil {
+		return nil, errors.New("segments with integrity protection are not supported")
+	}
+	if segment.SectorSize < sectorSize || segment.SectorSize%sectorSize != 0 {
+		return nil, errors.New("invalid sector size " + strconv.Itoa(segment.SectorSize))
+	}
+	c, err := newSectorCipher(segment.Encryption, volumeKey.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &segmentReader{
+		r:          r,
+		cipher:     c,
+		offset:     int64(segment.Offset),
+		size:       -1,
+		ivTweak:    uint64(segment.IVTweak),
+		sectorSize: int64(segment.SectorSize),
+	}
+	if segment.Size != DynamicSize {
+		size, err := strconv.ParseInt(segment.Size, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		reader.size = size
+	}
+	return reader, nil
+}
+
+// ReadAt reads the whole sectors covering p and decrypts them. The IVs count 512 byte sectors
+// from the start of the segment, plus the IV tweak, whatever the sector size.
+func (s *segmentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	var eof error
+	if s.size >= 0 && end > s.size {
+		end = s.size
+		eof = io.EOF
+	}
+	if off >= end {
+		return 0, io.EOF
+	}
+
+	start := off / s.sectorSize * s.sectorSize
+	alignedEnd := (end + s.sectorSize - 1) / s.sectorSize * s.sectorSize
+	buf := make([]byte, alignedEnd-start)
+	n, err := s.r.ReadAt(buf, s.offset+start)
+	// only the sectors read in full can be decrypted
+	n = n / int(s.sectorSize) * int(s.sectorSize)
+	for i := 0; i < n; i += int(s.sectorSize) {
+		sector := buf[i : i+int(s.sectorSize)]
+		s.cipher.decrypt(sector, sector, s.ivTweak+uint64(start+int64(i))/sectorSize)
+	}
+
+	available := int64(n) - (off - start)
+	if available <= 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	copied := copy(p[:end-off], buf[off-start:off-start+available])
+	if int64(copied) < end-off {
+		if err == nil {
+			err = io.EOF
+		}
+		return copied, err
+	}
+	return copied, eof
+}
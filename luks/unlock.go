@@ -0,0 +1,348 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrWrongKey is returned when the key opens none of the keyslots.
+var ErrWrongKey = errors.New("no keyslot opens with the key")
+
+// keyslot priorities of LUKS2, keyslots with the ignore priority are only used when asked for
+const (
+	priorityIgnore = 0
+	priorityNormal = 1
+)
+
+// limits of the parameters read from the keyslots, which come from an untrusted header: the
+// argon2 limits of cryptsetup, memory being in KiB, the largest key size it accepts and the AF
+// stripes it always writes
+const (
+	maxArgon2Memory = 4 * 1024 * 1024
+	maxArgon2CPUs   = 255
+	maxKeySize      = 512
+	maxStripes      = 4000
+)
+
+// VolumeKey is the volume key recovered from a keyslot, with the segment it encrypts.
+type VolumeKey struct {
+	Keyslot string  `json:"keyslot"`
+	Key     []byte  `json:"-"`
+	Segment Segment `json:"segment"`
+}
+
+// UnlockFile recovers the volume key of the LUKS volume in a file or a block device. The file is
+// opened read-only, a sparse file needs no privileges.
+func UnlockFile(path string, key []byte) (*VolumeKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	volumeKey, err := Unlock(file, key)
+	if err != nil {
+		return nil, fmt.Errorf("error unlocking the LUKS volume %s: %w", path, err)
+	}
+	return volumeKey, nil
+}
+
+// Unlock recovers the volume key of the LUKS volume at the start of r. The keyslots are tried in
+// the order of their priority, ErrWrongKey is returned when the key opens none of them.
+//
+// The key is run through the KDF of each keyslot, argon2i, argon2id or pbkdf2, which is meant to
+// be slow and, for argon2, to use as much memory as the keyslot asks for.
+func Unlock(r io.ReaderAt, key []byte) (*VolumeKey, error) {
+	header, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return header.Unlock(r, key)
+}
+
+// Unlock recovers the volume key like the package level Unlock, r being the device the header
+// was read from.
+//
+// A keyslot that cannot be tried, e.g. because of an unsupported cipher, is skipped. Its error is
+// only returned when no keyslot could be tried at all.
+func (h *Header) Unlock(r io.ReaderAt, key []byte) (*VolumeKey, error) {
+	tried := 0
+	var skipped error
+	for _, id := range h.keyslotOrder() {
+		digestID, digest, ok := h.keyslotDigest(id)
+		if !ok {
+			continue
+		}
+		volumeKey, err := h.unlockKeyslot(r, id, key)
+		if err != nil {
+			if skipped == nil {
+				skipped = fmt.Errorf("error unlocking keyslot %s: %w", id, err)
+			}
+			continue
+		}
+		match, err := verifyDigest(digest, volumeKey, h.Version)
+		if err != nil {
+			if skipped == nil {
+				skipped = fmt.Errorf("error verifying digest %s: %w", digestID, err)
+			}
+			continue
+		}
+		tried++
+		if !match {
+			continue
+		}
+
+		result := &VolumeKey{Keyslot: id, Key: volumeKey}
+		if len(digest.Segments) > 0 {
+			result.Segment = h.Metadata.Segments[digest.Segments[0]]
+		}
+		return result, nil
+	}
+	if tried == 0 && skipped != nil {
+		return nil, skipped
+	}
+	return nil, ErrWrongKey
+}
+
+// keyslotOrder returns the IDs of the keyslots to try, by priority then by ID.
+func (h *Header) keyslotOrder() []string {
+	priority := func(slot Keyslot) int {
+		if slot.Priority == nil {
+			return priorityNormal
+		}
+		return *slot.Priority
+	}
+
+	ids := []string{}
+	for id, slot := range h.Metadata.Keyslots {
+		if slot.Type == "luks2" && priority(slot) != priorityIgnore {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		left, right := h.Metadata.Keyslots[ids[i]], h.Metadata.Keyslots[ids[j]]
+		if priority(left) != priority(right) {
+			return priority(left) > priority(right)
+		}
+		leftID, _ := strconv.Atoi(ids[i])
+		rightID, _ := strconv.Atoi(ids[j])
+		return leftID < rightID
+	})
+	return ids
+}
+
+// keyslotDigest returns the digest verifying the volume key of the keyslot.
+func (h *Header) keyslotDigest(keyslot string) (string, Digest, bool) {
+	for id, digest := range h.Metadata.Digests {
+		for _, slot := range digest.Keyslots {
+			if slot == keyslot {
+				return id, digest, true
+			}
+		}
+	}
+	return "", Digest{}, false
+}
+
+// unlockKeyslot derives the area key from the key, decrypts the keyslot area and merges the AF
+// stripes into the candidate volume key.
+func (h *Header) unlockKeyslot(r io.ReaderAt, id string, key []byte) ([]byte, error) {
+	slot := h.Metadata.Keyslots[id]
+	if slot.AF.Type != "luks1" {
+		return nil, fmt.Errorf("unsupported AF type %q", slot.AF.Type)
+	}
+	afHash, ok := hashes[slot.AF.Hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported AF hash %q", slot.AF.Hash)
+	}
+	if slot.KeySize <= 0 || slot.KeySize > maxKeySize || slot.AF.Stripes <= 0 || slot.AF.Stripes > maxStripes {
+		return nil, errors.New("invalid key size or stripes")
+	}
+	if err := h.checkKeyslotArea(r, slot.Area); err != nil {
+		return nil, err
+	}
+
+	areaKey, err := deriveKey(slot.KDF, key, slot.Area.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	areaCipher, err := newSectorCipher(slot.Area.Encryption, areaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	splitSize := slot.KeySize * slot.AF.Stripes
+	sectors := (splitSize + sectorSize - 1) / sectorSize
+	if uint64(sectors*sectorSize) > uint64(slot.Area.Size) {
+		return nil, errors.New("key material exceeds the keyslot area")
+	}
+	material, err := readAt(r, sectors*sectorSize, int64(slot.Area.Offset))
+	if err != nil {
+		return nil, err
+	}
+	// the IVs of the keyslot area count from its first sector
+	for i := 0; i < sectors; i++ {
+		sector := material[i*sectorSize : (i+1)*sectorSize]
+		areaCipher.decrypt(sector, sector, uint64(i))
+	}
+	return afMerge(material[:splitSize], slot.KeySize, slot.AF.Stripes, afHash), nil
+}
+
+// checkKeyslotArea checks that the keyslot area lies in the keyslots area of the header, and
+// within the device when its size is known, before it is read.
+func (h *Header) checkKeyslotArea(r io.ReaderAt, area KeyslotArea) error {
+	offset, size := uint64(area.Offset), uint64(area.Size)
+	end := offset + size
+	if end < offset {
+		return errors.New("keyslot area overflows")
+	}
+
+	// LUKS2 keeps the keyslots after both header copies, LUKS1 between its header and the data
+	// segment, unless the header is detached from the data
+	var start, limit uint64
+	switch h.Version {
+	case 1:
+		start, limit = h.HeaderSize, uint64(h.Metadata.Segments["0"].Offset)
+	case 2:
+		start = 2 * h.HeaderSize
+		limit = start + uint64(h.Metadata.Config.KeyslotsSize)
+	}
+	if limit > start && (offset < start || end > limit) {
+		return fmt.Errorf("keyslot area [%d, %d) outside the keyslots area [%d, %d)", offset, end, start, limit)
+	}
+	if deviceSize, ok := readerSize(r); ok && end > uint64(deviceSize) {
+		return fmt.Errorf("keyslot area [%d, %d) past the end of the device of %d bytes", offset, end, deviceSize)
+	}
+	return nil
+}
+
+// readerSize returns the size of r when it can be found, e.g. for a file, a block device or a
+// bytes.Reader.
+func readerSize(r io.ReaderAt) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	case io.Seeker:
+		size, err := r.Seek(0, io.SeekEnd)
+		return size, err == nil
+	}
+	return 0, false
+}
+
+// deriveKey runs the KDF of a keyslot. The KDF parameters are checked first, argon2 panics on
+// some of them and would allocate whatever memory the header asks for.
+func deriveKey(kdf KDF, key []byte, size int) ([]byte, error) {
+	if size <= 0 || size > maxKeySize {
+		return nil, fmt.Errorf("invalid keyslot area key size %d", size)
+	}
+	switch kdf.Type {
+	case "pbkdf2":
+		newHash, ok := hashes[kdf.Hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported pbkdf2 hash %q", kdf.Hash)
+		}
+		if kdf.Iterations < 1 {
+			return nil, fmt.Errorf("invalid pbkdf2 iterations %d", kdf.Iterations)
+		}
+		return pbkdf2.Key(key, kdf.Salt, kdf.Iterations, size, newHash), nil
+	case "argon2i", "argon2id":
+		if err := checkArgon2(kdf); err != nil {
+			return nil, err
+		}
+		if kdf.Type == "argon2i" {
+			return argon2.Key(key, kdf.Salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.CPUs), uint32(size)), nil
+		}
+		return argon2.IDKey(key, kdf.Salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.CPUs), uint32(size)), nil
+	}
+	return nil, fmt.Errorf("unsupported KDF %q", kdf.Type)
+}
+
+// checkArgon2 checks the argon2 parameters against the limits of cryptsetup.
+func checkArgon2(kdf KDF) error {
+	if kdf.Time < 1 || int64(kdf.Time) > math.MaxUint32 {
+		return fmt.Errorf("invalid %s time %d", kdf.Type, kdf.Time)
+	}
+	if kdf.Memory < 1 || kdf.Memory > maxArgon2Memory {
+		return fmt.Errorf("invalid %s memory %d KiB, at most %d KiB", kdf.Type, kdf.Memory, maxArgon2Memory)
+	}
+	if kdf.CPUs < 1 || kdf.CPUs > maxArgon2CPUs {
+		return fmt.Errorf("invalid %s cpus %d", kdf.Type, kdf.CPUs)
+	}
+	return nil
+}
+
+// verifyDigest checks the candidate volume key against the digest. A digest shorter than the
+// hash is refused, as an empty digest would match every key. LUKS1 headers, whose version is
+// given, truncate the digest to 20 bytes.
+func verifyDigest(digest Digest, volumeKey []byte, version int) (bool, error) {
+	if digest.Type != "pbkdf2" {
+		return false, fmt.Errorf("unsupported digest type %q", digest.Type)
+	}
+	newHash, ok := hashes[digest.Hash]
+	if !ok {
+		return false, fmt.Errorf("unsupported digest hash %q", digest.Hash)
+	}
+	minSize := newHash().Size()
+	if version == 1 && minSize > luks1DigestSize {
+		minSize = luks1DigestSize
+	}
+	if len(digest.Digest) < minSize {
+		return false, fmt.Errorf("digest is %d bytes, at least %d expected", len(digest.Digest), minSize)
+	}
+	if digest.Iterations < 1 {
+		return false, fmt.Errorf("invalid digest iterations %d", digest.Iterations)
+	}
+	computed := pbkdf2.Key(volumeKey, digest.Salt, digest.Iterations, len(digest.Digest), newHash)
+	return subtle.ConstantTimeCompare(computed, digest.Digest) == 1, nil
+}
+
+// afMerge recovers the key from the stripes of the LUKS anti-forensic splitter.
+func afMerge(material []byte, keySize, stripes int, newHash func() hash.Hash) []byte {
+	merged := make([]byte, keySize)
+	for i := 0; i < stripes-1; i++ {
+		xorBytes(merged, material[i*keySize:(i+1)*keySize])
+		merged = afDiffuse(merged, newHash)
+	}
+	xorBytes(merged, material[(stripes-1)*keySize:])
+	return merged
+}
+
+// afDiffuse hashes each hash sized block of src, prefixed with its big endian index.
+func afDiffuse(src []byte, newHash func() hash.Hash) []byte {
+	diffused := make([]byte, len(src))
+	blockSize := newHash().Size()
+	index := make([]byte, 4)
+	for block := 0; block*blockSize < len(src); block++ {
+		end := (block + 1) * blockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		h := newHash()
+		binary.BigEndian.PutUint32(index, uint32(block))
+		h.Write(index)
+		h.Write(src[block*blockSize : end])
+		copy(diffused[block*blockSize:end], h.Sum(nil))
+	}
+	return diffused
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
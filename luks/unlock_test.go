@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestUnlock(t *testing.T) {
+	volumeKey := randomBytes(t, testKeySize)
+	argon2Slot := testSlot{key: []byte("argon2 key"), kdf: KDF{Type: "argon2id", Time: 1, Memory: 64, CPUs: 1}}
+	metadata, materials := luks2Metadata(t, volumeKey, pbkdf2Slot("first key"), pbkdf2Slot("second key"), argon2Slot)
+	luks2 := buildLUKS2(t, volumeKey, metadata, materials)
+	luks1 := buildLUKS1(t, volumeKey, pbkdf2Slot("first key"), pbkdf2Slot("second key"))
+
+	tests := []struct {
+		name        string
+		image       []byte
+		key         string
+		wantKeyslot string
+		wantErr     error
+	}{
+		{name: "LUKS1 first keyslot", image: luks1, key: "first key", wantKeyslot: "0"},
+		{name: "LUKS1 second keyslot", image: luks1, key: "second key", wantKeyslot: "1"},
+		{name: "LUKS1 wrong key", image: luks1, key: "wrong key", wantErr: ErrWrongKey},
+		{name: "LUKS2 first keyslot", image: luks2, key: "first key", wantKeyslot: "0"},
+		{name: "LUKS2 second keyslot", image: luks2, key: "second key", wantKeyslot: "1"},
+		{name: "LUKS2 argon2id keyslot", image: luks2, key: "argon2 key", wantKeyslot: "2"},
+		{name: "LUKS2 wrong key", image: luks2, key: "wrong key", wantErr: ErrWrongKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.image)
+			result, err := Unlock(r, []byte(tt.key))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unlock failed: %v", err)
+			}
+			if result.Keyslot != tt.wantKeyslot || !bytes.Equal(result.Key, volumeKey) {
+				t.Fatalf("got keyslot %s, key %x, want keyslot %s, key %x", result.Keyslot, result.Key, tt.wantKeyslot, volumeKey)
+			}
+
+			segment, err := NewSegmentReader(r, result)
+			if err != nil {
+				t.Fatalf("NewSegmentReader failed: %v", err)
+			}
+			plaintext := make([]byte, testDataSize)
+			if _, err = segment.ReadAt(plaintext, 0); err != nil && err != io.EOF {
+				t.Fatalf("reading the segment failed: %v", err)
+			}
+			if !bytes.Equal(plaintext, testPlaintext()) {
+				t.Fatal("segment does not decrypt to the plaintext")
+			}
+		})
+	}
+}
+
+func TestUnlockPriority(t *testing.T) {
+	volumeKey := randomBytes(t, testKeySize)
+	metadata, materials := luks2Metadata(t, volumeKey, pbkdf2Slot("key"), pbkdf2Slot("key"))
+	high, ignore := 2, priorityIgnore
+	first, second := metadata.Keyslots["0"], metadata.Keyslots["1"]
+	first.Priority, second.Priority = &ignore, &high
+	metadata.Keyslots["0"], metadata.Keyslots["1"] = first, second
+
+	result, err := Unlock(bytes.NewReader(buildLUKS2(t, volumeKey, metadata, materials)), []byte("key"))
+	if err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if result.Keyslot != "1" {
+		t.Fatalf("opened keyslot %s, want the keyslot with the highest priority", result.Keyslot)
+	}
+}
+
+func TestUnlockUntrustedParameters(t *testing.T) {
+	volumeKey := randomBytes(t, testKeySize)
+	argon2 := func(time, memory, cpus int) testSlot {
+		return testSlot{key: []byte("key"), kdf: KDF{Type: "argon2i", Time: time, Memory: memory, CPUs: cpus}}
+	}
+
+	tests := []struct {
+		name    string
+		slot    testSlot
+		edit    func(metadata *Metadata)
+		wantErr string
+	}{
+		{name: "argon2 time", slot: argon2(0, 64, 1), wantErr: "invalid argon2i time 0"},
+		{name: "argon2 memory", slot: argon2(1, maxArgon2Memory+1, 1), wantErr: "invalid argon2i memory"},
+		{name: "argon2 no memory", slot: argon2(1, 0, 1), wantErr: "invalid argon2i memory"},
+		{name: "argon2 cpus", slot: argon2(1, 64, maxArgon2CPUs+1), wantErr: "invalid argon2i cpus"},
+		{name: "argon2 no cpus", slot: argon2(1, 64, 0), wantErr: "invalid argon2i cpus"},
+		{name: "pbkdf2 iterations", slot: testSlot{key: []byte("key"), kdf: KDF{Type: "pbkdf2", Hash: "sha256"}}, wantErr: "invalid pbkdf2 iterations"},
+		{name: "unsupported KDF", slot: testSlot{key: []byte("key"), kdf: KDF{Type: "scrypt"}}, wantErr: "unsupported KDF"},
+		{name: "unsupported pbkdf2 hash", slot: testSlot{key: []byte("key"), kdf: KDF{Type: "pbkdf2", Hash: "md5", Iterations: testIterations}}, wantErr: "unsupported pbkdf2 hash"},
+		{
+			name: "unsupported AF hash",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				slot := metadata.Keyslots["0"]
+				slot.AF.Hash = "md5"
+				metadata.Keyslots["0"] = slot
+			},
+			wantErr: "unsupported AF hash",
+		},
+		{
+			name: "unsupported digest",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				digest := metadata.Digests["0"]
+				digest.Type = "argon2id"
+				metadata.Digests["0"] = digest
+			},
+			wantErr: "unsupported digest type",
+		},
+		{
+			name: "unsupported digest hash",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				digest := metadata.Digests["0"]
+				digest.Hash = "md5"
+				metadata.Digests["0"] = digest
+			},
+			wantErr: "unsupported digest hash",
+		},
+		{
+			name: "key size",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				slot := metadata.Keyslots["0"]
+				slot.KeySize = maxKeySize + 1
+				metadata.Keyslots["0"] = slot
+			},
+			wantErr: "invalid key size",
+		},
+		{
+			name: "stripes",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				slot := metadata.Keyslots["0"]
+				slot.AF.Stripes = maxStripes + 1
+				metadata.Keyslots["0"] = slot
+			},
+			wantErr: "invalid key size or stripes",
+		},
+		{
+			name: "area past the keyslots area",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				slot := metadata.Keyslots["0"]
+				slot.Area.Offset = testDataOffset
+				metadata.Keyslots["0"] = slot
+			},
+			wantErr: "outside the keyslots area",
+		},
+		{
+			name: "area before the keyslots area",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				slot := metadata.Keyslots["0"]
+				slot.Area.Offset = 0
+				metadata.Keyslots["0"] = slot
+			},
+			wantErr: "outside the keyslots area",
+		},
+		{
+			name: "area size overflows",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				slot := metadata.Keyslots["0"]
+				slot.Area.Size = math.MaxUint64 - testAreasOffset + 1
+				metadata.Keyslots["0"] = slot
+			},
+			wantErr: "keyslot area overflows",
+		},
+		{
+			name: "empty digest",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				digest := metadata.Digests["0"]
+				digest.Digest = nil
+				metadata.Digests["0"] = digest
+			},
+			wantErr: "digest is 0 bytes",
+		},
+		{
+			name: "short digest",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				digest := metadata.Digests["0"]
+				digest.Digest = digest.Digest[:4]
+				metadata.Digests["0"] = digest
+			},
+			wantErr: "digest is 4 bytes",
+		},
+		{
+			name: "digest iterations",
+			slot: pbkdf2Slot("key"),
+			edit: func(metadata *Metadata) {
+				digest := metadata.Digests["0"]
+				digest.Iterations = 0
+				metadata.Digests["0"] = digest
+			},
+			wantErr: "invalid digest iterations",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, materials := luks2Metadata(t, volumeKey, tt.slot)
+			if tt.edit != nil {
+				tt.edit(&metadata)
+			}
+			// any key is refused, the key of the keyslot included
+			for _, key := range []string{"key", "wrong key"} {
+				result, err := Unlock(bytes.NewReader(buildLUKS2(t, volumeKey, metadata, materials)), []byte(key))
+				if err == nil {
+					t.Fatalf("keyslot %s opened with %q", result.Keyslot, key)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+// TestUnlockLUKS1UntrustedParameters checks that the key material of a LUKS1 keyslot is bounded
+// before it is read, its size derives from the stripes of the header.
+func TestUnlockLUKS1UntrustedParameters(t *testing.T) {
+	volumeKey := randomBytes(t, testKeySize)
+	tests := []struct {
+		name    string
+		stripes uint32
+		// offset of the key material in sectors
+		offset  uint32
+		payload uint32
+		wantErr string
+	}{
+		{name: "huge stripes", stripes: 0x7fffffff, offset: testAreasOffset / luks1SectorSize, payload: testLUKS1Payload, wantErr: "invalid key size or stripes"},
+		{name: "no stripes", stripes: 0, offset: testAreasOffset / luks1SectorSize, payload: testLUKS1Payload, wantErr: "invalid key size or stripes"},
+		{name: "key material in the data segment", stripes: testStripes, offset: testLUKS1Payload, payload: testLUKS1Payload, wantErr: "outside the keyslots area"},
+		{name: "key material in the header", stripes: testStripes, offset: 0, payload: testLUKS1Payload, wantErr: "outside the keyslots area"},
+		// a detached header has no data segment to bound its keyslots, the device does
+		{name: "key material past the device", stripes: testStripes, offset: 0x7fffffff, payload: 0, wantErr: "past the end of the device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := buildLUKS1(t, volumeKey, pbkdf2Slot("key"))
+			binary.BigEndian.PutUint32(image[104:], tt.payload)
+			slot := image[luks1KeyslotsOffset:]
+			binary.BigEndian.PutUint32(slot[40:], tt.offset)
+			binary.BigEndian.PutUint32(slot[44:], tt.stripes)
+
+			result, err := Unlock(bytes.NewReader(image), []byte("key"))
+			if err == nil {
+				t.Fatalf("keyslot %s opened", result.Keyslot)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAFMerge(t *testing.T) {
+	for _, stripes := range []int{1, 2, testStripes, 4000} {
+		for _, keySize := range []int{16, testKeySize, 33, 64} {
+			key := randomBytes(t, keySize)
+			merged := afMerge(afSplit(t, key, stripes), keySize, stripes, hashes["sha256"])
+			if !bytes.Equal(merged, key) {
+				t.Fatalf("%d stripes of a %d byte key: got %x, want %x", stripes, keySize, merged, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"intel/isecl/lib/vml/v4/loop"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Manager holds the configuration used by the volume operations. The zero value is ready to use
+// and runs the commands on the host.
+type Manager struct {
+	// Runner executes the external commands. ExecRunner is used when it is nil. The commands of
+	// a runner that is not a ContextCommandRunner run to completion once started.
+	Runner CommandRunner
+
+	// Loop attaches the sparse files to loop devices. The loop package is used when it is nil.
+	Loop LoopController
+
+	// LockDir holds the lock files serializing the volume operations of all the processes of
+	// the host. DefaultLockDir is used when it is empty.
+	LockDir string
+
+	// LockTimeout is how long an operation waits for a lock held by another operation before
+	// failing with ErrLocked. DefaultLockTimeout is used when it is zero, a negative timeout
+	// fails at once.
+	LockTimeout time.Duration
+
+	// CryptBackend opens, closes and inspects the dm-crypt mappings. CryptBackendCryptsetup is
+	// used when it is empty. Both backends set up the mappings alike, a volume opened with one
+	// can be inspected and closed with the other.
+	CryptBackend CryptBackend
+
+	// StateDir holds the registry of the volumes created by the manager, see ListVolumes.
+	// The registry is disabled when it is empty.
+	StateDir string
+}
+
+// LoopController attaches backing files to loop devices, finds, resizes and detaches them.
+//
+// BackingFile returns loop.ErrNotLoopDevice for a device that is not an attached loop device, the
+// operations check it before detaching a device they did not attach themselves.
+type LoopController interface {
+	Attach(backingFile string, opts loop.Options) (string, error)
+	FindByBackingFile(backingFile string) (string, error)
+	BackingFile(device string) (string, error)
+	Detach(device string) error
+	SetCapacity(device string) error
+}
+
+// nativeLoop is the default LoopController, backed by the loop package.
+type nativeLoop struct{}
+
+func (nativeLoop) Attach(backingFile string, opts loop.Options) (string, error) {
+	return loop.Attach(backingFile, opts)
+}
+
+func (nativeLoop) FindByBackingFile(backingFile string) (string, error) {
+	return loop.FindByBackingFile(backingFile)
+}
+
+func (nativeLoop) BackingFile(device string) (string, error) {
+	return loop.BackingFile(device)
+}
+
+func (nativeLoop) Detach(device string) error {
+	return loop.Detach(device)
+}
+
+func (nativeLoop) SetCapacity(device string) error {
+	return loop.SetCapacity(device)
+}
+
+// DefaultManager is the Manager used by the package level functions.
+var DefaultManager = &Manager{}
+
+func (m *Manager) runner() CommandRunner {
+	if m.Runner == nil {
+		return ExecRunner{}
+	}
+	return m.Runner
+}
+
+func (m *Manager) loop() LoopController {
+	if m.Loop == nil {
+		return nativeLoop{}
+	}
+	return m.Loop
+}
+
+// loopBackedBy reports whether the device is a loop device bound to the file, so that
+// LOOP_CLR_FD is never sent to a block device or to a loop device of another file.
+func (m *Manager) loopBackedBy(device, file string) (bool, error) {
+	backingFile, err := m.loop().BackingFile(device)
+	if errors.Is(err, loop.ErrNotLoopDevice) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if backingFile == filepath.Clean(file) {
+		return true, nil
+	}
+	// the sparse file may be given through a symbolic link or a relative path
+	backingInfo, err := os.Stat(backingFile)
+	if err != nil {
+		return false, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return false, nil
+	}
+	return os.SameFile(backingInfo, info), nil
+}
+
+// runCommand runs the command with the manager's runner and returns its standard output.
+// A command that cannot be started or exits with a non zero status is reported as a *CommandError.
+func (m *Manager) runCommand(ctx context.Context, cmd string, args []string) (string, error) {
+	return m.runCommandWithStdin(ctx, cmd, args, nil)
+}
+
+// runCommandWithStdin runs the command like runCommand, feeding stdin to its standard input.
+func (m *Manager) runCommandWithStdin(ctx context.Context, cmd string, args []string, stdin []byte) (string, error) {
+	return m.run(ctx, Command{Name: cmd, Args: args, Stdin: stdin})
+}
+
+// run runs the command like runCommand. When ctx is done before the command completes, the
+// CommandError wraps ctx.Err().
+func (m *Manager) run(ctx context.Context, c Command) (string, error) {
+	result, err := runContext(ctx, m.runner(), c)
+	if err != nil {
+		return result.Stdout, &CommandError{Command: c.Name, Args: redactArgs(c.Args), ExitStatus: -1, Err: err}
+	}
+	if result.ExitCode != 0 {
+		return result.Stdout, &CommandError{
+			Command:    c.Name,
+			Args:       redactArgs(c.Args),
+			ExitStatus: result.ExitCode,
+			Stderr:     strings.TrimSpace(result.Stderr),
+		}
+	}
+	return result.Stdout, nil
+}
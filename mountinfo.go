@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mountInfoPath is the mount table of the calling process
+var mountInfoPath = "/proc/self/mountinfo"
+
+// mountInfo is a single entry of /proc/self/mountinfo
+type mountInfo struct {
+	MountID    int
+	ParentID   int
+	Device     string // major:minor
+	Root       string
+	MountPoint string
+	Options    string
+	FSType     string
+	Source     string
+}
+
+// readMountInfo parses the mount table of the calling process.
+func readMountInfo() ([]mountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the mount table: %w", err)
+	}
+	defer file.Close()
+	return parseMountInfo(file)
+}
+
+// parseMountInfo parses the mountinfo format described in proc(5).
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// the optional fields are terminated by a single hyphen
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+
+		mountID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			MountID:    mountID,
+			ParentID:   parentID,
+			Device:     fields[2],
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    fields[5],
+			FSType:     fields[separator+1],
+			Source:     unescapeMountInfo(fields[separator+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the mount table: %w", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 for a space, ...) used in mountinfo fields.
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// mountPoints returns the mount points of the device, matching the mount sources by path
+// after resolving symbolic links such as /dev/mapper/<name> -> /dev/dm-<n>.
+func mountPoints(device string) ([]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		resolved = device
+	}
+
+	var points []string
+	for _, mount := range mounts {
+		if mount.Source == device || mount.Source == resolved {
+			points = append(points, mount.MountPoint)
+			continue
+		}
+		if strings.HasPrefix(mount.Source, "/dev/") {
+			if source, err := filepath.EvalSymlinks(mount.Source); err == nil && source == resolved {
+				points = append(points, mount.MountPoint)
+			}
+		}
+	}
+	return points, nil
+}
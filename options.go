@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// PBKDF types supported by cryptsetup
+const (
+	PBKDF2   = "pbkdf2"
+	Argon2i  = "argon2i"
+	Argon2id = "argon2id"
+)
+
+// Integrity algorithms of LUKS2 authenticated encryption supported by cryptsetup
+const (
+	IntegrityHMACSHA256 = "hmac-sha256"
+	IntegrityHMACSHA512 = "hmac-sha512"
+	// IntegrityAEAD authenticates with the cipher itself, which must be an AEAD cipher such as
+	// aes-gcm-random, the default, or chacha20-random.
+	IntegrityAEAD = "aead"
+)
+
+// cipher used with IntegrityAEAD when no cipher is given
+const defaultAEADCipher = "aes-gcm-random"
+
+var luksUUIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// VolumeOptions are the LUKS format settings used by CreateVolumeWithOptions. A zero value
+// leaves the setting to the cryptsetup defaults of the host.
+type VolumeOptions struct {
+	// LUKSVersion is the on-disk format, 1 or 2.
+	LUKSVersion int
+	// Cipher is the cipher specification, e.g. "aes-xts-plain64".
+	Cipher string
+	// KeySize is the size of the volume key in bits, e.g. 512 for AES-256 in XTS mode.
+	KeySize int
+	// Hash is the hash used by the PBKDF and the key digest, e.g. "sha256".
+	Hash string
+
+	// PBKDF is the key derivation function, one of PBKDF2, Argon2i or Argon2id.
+	PBKDF string
+	// PBKDFIterations forces the iteration count (pbkdf2) or time cost (argon2), disabling benchmarking.
+	PBKDFIterations int
+	// PBKDFMemory is the argon2 memory cost in KiB.
+	PBKDFMemory int
+	// PBKDFParallel is the argon2 parallel cost.
+	PBKDFParallel int
+	// IterTime is the time in milliseconds spent by the benchmarked PBKDF.
+	IterTime int
+
+	// SectorSize is the encryption sector size in bytes, 512 or 4096. LUKS2 only.
+	SectorSize int
+	// Label and Subsystem are the LUKS2 header label and subsystem. LUKS2 only.
+	Label     string
+	Subsystem string
+	// UUID is an explicit LUKS UUID for the volume.
+	UUID string
+
+	// Integrity formats the volume with LUKS2 authenticated encryption, stacking dm-crypt on a
+	// dm-integrity device so that modified ciphertext fails to read instead of decrypting to
+	// garbage. It is one of IntegrityHMACSHA256, IntegrityHMACSHA512 or IntegrityAEAD, and should
+	// be set for the volumes of workloads with ImageIntegrityEnforced. LUKS2 only.
+	//
+	// The integrity tags are initialized by writing the whole device during the format, which
+	// allocates the whole sparse file and takes time proportional to the disk size. The volume
+	// cannot be resized and only opens with the cryptsetup backend.
+	Integrity string
+	// IntegrityNoWipe skips writing the device during the format. Sectors never written fail to
+	// read, so it requires FilesystemNone and a caller writing the whole volume, e.g. an image.
+	IntegrityNoWipe bool
+
+	// Filesystem is the filesystem created on the volume, FilesystemExt4 when empty.
+	Filesystem Filesystem
+	// Mkfs are the settings used when creating the filesystem.
+	Mkfs MkfsOptions
+
+	// InstanceID and ImageID are recorded in the volume registry, see Manager.StateDir.
+	InstanceID string
+	ImageID    string
+}
+
+// validate checks the options for values cryptsetup would reject or silently ignore.
+func (o VolumeOptions) validate() error {
+	if o.LUKSVersion != 0 && o.LUKSVersion != 1 && o.LUKSVersion != 2 {
+		return fmt.Errorf("unsupported LUKS version %d", o.LUKSVersion)
+	}
+	if o.KeySize < 0 || o.KeySize%8 != 0 {
+		return fmt.Errorf("invalid key size %d", o.KeySize)
+	}
+	switch o.PBKDF {
+	case "", PBKDF2, Argon2i, Argon2id:
+	default:
+		return fmt.Errorf("unsupported PBKDF %q", o.PBKDF)
+	}
+	if o.PBKDFIterations < 0 || o.PBKDFMemory < 0 || o.PBKDFParallel < 0 || o.IterTime < 0 {
+		return fmt.Errorf("PBKDF costs should not be negative")
+	}
+	if o.PBKDFIterations > 0 && o.IterTime > 0 {
+		return fmt.Errorf("PBKDF iterations and iteration time are mutually exclusive")
+	}
+	if o.SectorSize != 0 && o.SectorSize != 512 && o.SectorSize != 4096 {
+		return fmt.Errorf("unsupported sector size %d", o.SectorSize)
+	}
+	if o.UUID != "" && !luksUUIDRegex.MatchString(o.UUID) {
+		return fmt.Errorf("invalid LUKS UUID %q", o.UUID)
+	}
+
+	switch o.Integrity {
+	case "", IntegrityHMACSHA256, IntegrityHMACSHA512, IntegrityAEAD:
+	default:
+		return fmt.Errorf("unsupported integrity algorithm %q", o.Integrity)
+	}
+	if o.IntegrityNoWipe {
+		if o.Integrity == "" {
+			return fmt.Errorf("integrity wipe can only be skipped with an integrity algorithm")
+		}
+		if o.filesystem() != FilesystemNone {
+			return fmt.Errorf("integrity wipe can only be skipped without a filesystem")
+		}
+	}
+
+	if err := o.Mkfs.validate(o.filesystem()); err != nil {
+		return err
+	}
+
+	if o.LUKSVersion == 1 {
+		if o.PBKDF == Argon2i || o.PBKDF == Argon2id {
+			return fmt.Errorf("LUKS1 only supports the %s PBKDF", PBKDF2)
+		}
+		if o.SectorSize != 0 || o.Label != "" || o.Subsystem != "" || o.Integrity != "" {
+			return fmt.Errorf("sector size, label, subsystem and integrity are only supported by LUKS2")
+		}
+	}
+	return nil
+}
+
+// filesystem returns the filesystem to create on the volume
+func (o VolumeOptions) filesystem() Filesystem {
+	if o.Filesystem == "" {
+		return FilesystemExt4
+	}
+	return o.Filesystem
+}
+
+// luksFormatArgs builds the cryptsetup luksFormat arguments for the device. The key is read
+// from stdin.
+func (o VolumeOptions) luksFormatArgs(device string) []string {
+	args := []string{"-v", "--batch-mode", "luksFormat"}
+	if o.LUKSVersion != 0 {
+		args = append(args, "--type", "luks"+strconv.Itoa(o.LUKSVersion))
+	} else if o.Integrity != "" {
+		// the default format of the host may be LUKS1
+		args = append(args, "--type", "luks2")
+	}
+	if o.Cipher != "" {
+		args = append(args, "--cipher", o.Cipher)
+	} else if o.Integrity == IntegrityAEAD {
+		args = append(args, "--cipher", defaultAEADCipher)
+	}
+	if o.KeySize != 0 {
+		args = append(args, "--key-size", strconv.Itoa(o.KeySize))
+	}
+	if o.Hash != "" {
+		args = append(args, "--hash", o.Hash)
+	}
+	if o.PBKDF != "" {
+		args = append(args, "--pbkdf", o.PBKDF)
+	}
+	if o.PBKDFIterations != 0 {
+		args = append(args, "--pbkdf-force-iterations", strconv.Itoa(o.PBKDFIterations))
+	}
+	if o.PBKDFMemory != 0 {
+		args = append(args, "--pbkdf-memory", strconv.Itoa(o.PBKDFMemory))
+	}
+	if o.PBKDFParallel != 0 {
+		args = append(args, "--pbkdf-parallel", strconv.Itoa(o.PBKDFParallel))
+	}
+	if o.IterTime != 0 {
+		args = append(args, "--iter-time", strconv.Itoa(o.IterTime))
+	}
+	if o.SectorSize != 0 {
+		args = append(args, "--sector-size", strconv.Itoa(o.SectorSize))
+	}
+	if o.Label != "" {
+		args = append(args, "--label", o.Label)
+	}
+	if o.Subsystem != "" {
+		args = append(args, "--subsystem", o.Subsystem)
+	}
+	if o.UUID != "" {
+		args = append(args, "--uuid", o.UUID)
+	}
+	if o.Integrity != "" {
+		args = append(args, "--integrity", o.Integrity)
+		if o.IntegrityNoWipe {
+			args = append(args, "--integrity-no-wipe")
+		}
+	}
+	return append(args, device, "--key-file", "-")
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// file of the state directory holding the volume records
+const registryFileName = "volumes.json"
+
+// lock file serializing the updates of the registry
+const registryLockName = "registry.lock"
+
+// ErrRegistryDisabled is returned by the registry queries when Manager.StateDir is not set.
+var ErrRegistryDisabled = errors.New("volume registry is disabled")
+
+// ErrNotRecorded is returned when a volume was created or activated but its record could not be
+// written to the registry. The volume is kept and usable, its record is missing or outdated.
+var ErrNotRecorded = errors.New("volume not recorded in the registry")
+
+// VolumeRecord is the registry entry of a volume created by CreateVolume. It is kept until the
+// volume is deleted with DeleteVolume.
+type VolumeRecord struct {
+	// ID identifies the volume, it is the name of its dm-crypt mapping.
+	ID                   string    `json:"id"`
+	SparseFilePath       string    `json:"sparse_file_path"`
+	LoopDevice           string    `json:"loop_device,omitempty"`
+	DeviceMapperLocation string    `json:"device_mapper_location"`
+	LUKSUUID             string    `json:"luks_uuid,omitempty"`
+	MountPoints          []string  `json:"mount_points"`
+	InstanceID           string    `json:"instance_id,omitempty"`
+	ImageID              string    `json:"image_id,omitempty"`
+	Created              time.Time `json:"created"`
+	Updated              time.Time `json:"updated"`
+	// Deleting is set once DeleteVolume starts tearing the volume down, a record left with it
+	// set belongs to a deletion that failed or was interrupted.
+	Deleting bool `json:"deleting,omitempty"`
+}
+
+// registryFile is the content of the registry file.
+type registryFile struct {
+	Volumes []VolumeRecord `json:"volumes"`
+}
+
+// ListVolumes is used to list the volumes recorded in the registry of the DefaultManager.
+func ListVolumes() ([]VolumeRecord, error) {
+	return DefaultManager.ListVolumes()
+}
+
+// LookupVolume is used to get the registry record of a volume by ID, the name of its dm-crypt
+// mapping. A volume that is not recorded is reported as ErrNotFound.
+func LookupVolume(id string) (*VolumeRecord, error) {
+	return DefaultManager.LookupVolume(id)
+}
+
+// VolumesByInstance is used to list the recorded volumes of an instance.
+func VolumesByInstance(instanceID string) ([]VolumeRecord, error) {
+	return DefaultManager.VolumesByInstance(instanceID)
+}
+
+// VolumesByImage is used to list the recorded volumes of an image.
+func VolumesByImage(imageID string) ([]VolumeRecord, error) {
+	return DefaultManager.VolumesByImage(imageID)
+}
+
+// ListVolumes lists the recorded volumes like the package level ListVolumes, sorted by ID.
+func (m *Manager) ListVolumes() ([]VolumeRecord, error) {
+	return m.findVolumes(func(*VolumeRecord) bool { return true })
+}
+
+// LookupVolume gets the record of a volume like the package level LookupVolume.
+func (m *Manager) LookupVolume(id string) (*VolumeRecord, error) {
+	if len(strings.TrimSpace(id)) <= 0 {
+		return nil, errors.New("volume id not given")
+	}
+	records, err := m.findVolumes(func(record *VolumeRecord) bool { return record.ID == id })
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, &VolumeError{Op: "lookup", Path: id, Kind: ErrNotFound}
+	}
+	return &records[0], nil
+}
+
+// VolumesByInstance lists the volumes of an instance like the package level VolumesByInstance.
+func (m *Manager) VolumesByInstance(instanceID string) ([]VolumeRecord, error) {
+	return m.findVolumes(func(record *VolumeRecord) bool { return record.InstanceID == instanceID })
+}
+
+// VolumesByImage lists the volumes of an image like the package level VolumesByImage.
+func (m *Manager) VolumesByImage(imageID string) ([]VolumeRecord, error) {
+	return m.findVolumes(func(record *VolumeRecord) bool { return record.ImageID == imageID })
+}
+
+func (m *Manager) findVolumes(match func(*VolumeRecord) bool) ([]VolumeRecord, error) {
+	if m.StateDir == "" {
+		return nil, ErrRegistryDisabled
+	}
+	// the registry is replaced atomically, it is read without taking the lock
+	records, err := m.readRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []VolumeRecord{}
+	for _, record := range records {
+		if match(record) {
+			result = append(result, *record)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// volumeID returns the registry ID of the volume at the device mapper location.
+func volumeID(deviceMapperLocation string) string {
+	return filepath.Base(deviceMapperLocation)
+}
+
+// recordVolume adds the volume to the registry, or refreshes its record if it is already there.
+// opts is nil when an existing volume is refreshed, e.g. on activation, the instance and image
+// of its record are then kept.
+func (m *Manager) recordVolume(ctx context.Context, sparseFilePath, deviceMapperLocation, loopDevice string, opts *VolumeOptions) error {
+	if m.StateDir == "" {
+		return nil
+	}
+	uuid, err := m.luksUUID(ctx, loopDevice)
+	if err != nil {
+		return err
+	}
+
+	return m.updateRegistry(ctx, func(records map[string]*VolumeRecord, now time.Time) {
+		id := volumeID(deviceMapperLocation)
+		record, ok := records[id]
+		if !ok {
+			record = &VolumeRecord{ID: id, MountPoints: []string{}, Created: now}
+			records[id] = record
+		}
+		record.SparseFilePath = sparseFilePath
+		record.DeviceMapperLocation = deviceMapperLocation
+		record.LoopDevice = loopDevice
+		record.LUKSUUID = uuid
+		record.Deleting = false
+		if opts != nil && opts.InstanceID != "" {
+			record.InstanceID = opts.InstanceID
+		}
+		if opts != nil && opts.ImageID != "" {
+			record.ImageID = opts.ImageID
+		}
+		record.Updated = now
+	})
+}
+
+// recordMount adds the mount point to the record of the volume, if the volume is recorded.
+func (m *Manager) recordMount(ctx context.Context, deviceMapperLocation, mountLocation string) error {
+	if m.StateDir == "" {
+		return nil
+	}
+	mountLocation = filepath.Clean(mountLocation)
+	return m.updateRegistry(ctx, func(records map[string]*VolumeRecord, now time.Time) {
+		record, ok := records[volumeID(deviceMapperLocation)]
+		if !ok {
+			return
+		}
+		for _, point := range record.MountPoints {
+			if point == mountLocation {
+				return
+			}
+		}
+		record.MountPoints = append(record.MountPoints, mountLocation)
+		record.Updated = now
+	})
+}
+
+// recordUnmount removes the mount point from the record holding it.
+func (m *Manager) recordUnmount(ctx context.Context, mountLocation string) error {
+	if m.StateDir == "" {
+		return nil
+	}
+	mountLocation = filepath.Clean(mountLocation)
+	return m.updateRegistry(ctx, func(records map[string]*VolumeRecord, now time.Time) {
+		for _, record := range records {
+			points := record.MountPoints[:0]
+			for _, point := range record.MountPoints {
+				if point != mountLocation {
+					points = append(points, point)
+				}
+			}
+			if len(points) != len(record.MountPoints) {
+				record.MountPoints = points
+				record.Updated = now
+			}
+		}
+	})
+}
+
+// markDeleting flags the record of the volume, if the volume is recorded, as being deleted.
+func (m *Manager) markDeleting(ctx context.Context, deviceMapperLocation string) error {
+	if m.StateDir == "" {
+		return nil
+	}
+	return m.updateRegistry(ctx, func(records map[string]*VolumeRecord, now time.Time) {
+		if record, ok := records[volumeID(deviceMapperLocation)]; ok && !record.Deleting {
+			record.Deleting = true
+			record.Updated = now
+		}
+	})
+}
+
+// forgetVolume removes the record of the volume from the registry.
+func (m *Manager) forgetVolume(ctx context.Context, deviceMapperLocation string) error {
+	if m.StateDir == "" {
+		return nil
+	}
+	return m.updateRegistry(ctx, func(records map[string]*VolumeRecord, now time.Time) {
+		delete(records, volumeID(deviceMapperLocation))
+	})
+}
+
+// updateRegistry applies update to the records under the registry lock and replaces the
+// registry file atomically.
+func (m *Manager) updateRegistry(ctx context.Context, update func(records map[string]*VolumeRecord, now time.Time)) error {
+	unlock, err := m.lock(ctx, registryLockName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := m.readRegistry()
+	if err != nil {
+		return err
+	}
+	update(records, time.Now().UTC())
+
+	content := registryFile{Volumes: []VolumeRecord{}}
+	for _, record := range records {
+		content.Volumes = append(content.Volumes, *record)
+	}
+	sort.Slice(content.Volumes, func(i, j int) bool { return content.Volumes[i].ID < content.Volumes[j].ID })
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return &VolumeError{Op: "registry", Path: m.registryPath(), Err: err}
+	}
+
+	if err = os.MkdirAll(m.StateDir, 0700); err != nil {
+		return &VolumeError{Op: "registry", Path: m.StateDir, Err: err}
+	}
+	if err = writeFileAtomic(m.registryPath(), data, 0600); err != nil {
+		return &VolumeError{Op: "registry", Path: m.registryPath(), Err: err}
+	}
+	return nil
+}
+
+// readRegistry returns the records of the registry by ID. A missing registry file has no records.
+func (m *Manager) readRegistry() (map[string]*VolumeRecord, error) {
+	records := map[string]*VolumeRecord{}
+	data, err := ioutil.ReadFile(m.registryPath())
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, &VolumeError{Op: "registry", Path: m.registryPath(), Err: err}
+	}
+
+	var content registryFile
+	if err = json.Unmarshal(data, &content); err != nil {
+		return nil, &VolumeError{Op: "registry", Path: m.registryPath(), Err: err}
+	}
+	for i := range content.Volumes {
+		record := content.Volumes[i]
+		if record.MountPoints == nil {
+			record.MountPoints = []string{}
+		}
+		records[record.ID] = &record
+	}
+	return records, nil
+}
+
+func (m *Manager) registryPath() string {
+	return filepath.Join(m.StateDir, registryFileName)
+}
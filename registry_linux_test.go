@@ -0,0 +1,219 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newRegistryManager returns a manager with a registry in a temporary state directory,
+// answering luksUUID with the UUID given for each loop device
+func newRegistryManager(t *testing.T, uuids map[string]string) *Manager {
+	dir := t.TempDir()
+	r := &ScriptedRunner{}
+	for device, uuid := range uuids {
+		r.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksUUID", device}, Result: CommandResult{Stdout: uuid + "\n"}})
+	}
+	return &Manager{Runner: r, Loop: newFakeLoop(), LockDir: filepath.Join(dir, "locks"), StateDir: filepath.Join(dir, "state")}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	m := newRegistryManager(t, map[string]string{"/dev/loop0": "uuid-0", "/dev/loop1": "uuid-1", "/dev/loop5": "uuid-0"})
+
+	if err := m.recordVolume(ctx, "/var/lib/vml/a.img", "/dev/mapper/a", "/dev/loop0", &VolumeOptions{InstanceID: "vm-1", ImageID: "image-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordVolume(ctx, "/var/lib/vml/b.img", "/dev/mapper/b", "/dev/loop1", &VolumeOptions{InstanceID: "vm-2", ImageID: "image-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordMount(ctx, "/dev/mapper/a", "/mnt/a/"); err != nil {
+		t.Fatal(err)
+	}
+	// mounting twice on the same point records it once, volumes that are not recorded are ignored
+	if err := m.recordMount(ctx, "/dev/mapper/a", "/mnt/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordMount(ctx, "/dev/mapper/unknown", "/mnt/unknown"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := m.LookupVolume("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.SparseFilePath != "/var/lib/vml/a.img" || a.DeviceMapperLocation != "/dev/mapper/a" || a.LoopDevice != "/dev/loop0" ||
+		a.LUKSUUID != "uuid-0" || a.InstanceID != "vm-1" || a.ImageID != "image-1" || !reflect.DeepEqual(a.MountPoints, []string{"/mnt/a"}) {
+		t.Errorf("LookupVolume(a) = %+v", a)
+	}
+	if a.Created.IsZero() || a.Updated.Before(a.Created) {
+		t.Errorf("LookupVolume(a) created %v, updated %v", a.Created, a.Updated)
+	}
+
+	// a refreshed record keeps its creation time, instance, image and mount points
+	if err = m.recordVolume(ctx, "/var/lib/vml/a.img", "/dev/mapper/a", "/dev/loop5", nil); err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := m.LookupVolume("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.LoopDevice != "/dev/loop5" || !refreshed.Created.Equal(a.Created) || refreshed.InstanceID != "vm-1" ||
+		refreshed.ImageID != "image-1" || !reflect.DeepEqual(refreshed.MountPoints, []string{"/mnt/a"}) {
+		t.Errorf("refreshed record %+v", refreshed)
+	}
+
+	ids := func(records []VolumeRecord, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := []string{}
+		for _, record := range records {
+			result = append(result, record.ID)
+		}
+		return result
+	}
+	if got := ids(m.ListVolumes()); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("ListVolumes() = %q", got)
+	}
+	if got := ids(m.VolumesByInstance("vm-2")); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("VolumesByInstance(vm-2) = %q", got)
+	}
+	if got := ids(m.VolumesByImage("image-1")); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("VolumesByImage(image-1) = %q", got)
+	}
+	if got := ids(m.VolumesByImage("image-2")); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("VolumesByImage(image-2) = %q", got)
+	}
+
+	if err = m.recordUnmount(ctx, "/mnt/a"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ = m.LookupVolume("a"); len(a.MountPoints) != 0 {
+		t.Errorf("mount points %q after unmount", a.MountPoints)
+	}
+
+	if err = m.forgetVolume(ctx, "/dev/mapper/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.LookupVolume("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupVolume(a) after forgetVolume error = %v, want %v", err, ErrNotFound)
+	}
+	if got := ids(m.ListVolumes()); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("ListVolumes() = %q", got)
+	}
+
+	// a new manager on the same state directory reads the same records
+	reopened := &Manager{StateDir: m.StateDir}
+	if got := ids(reopened.ListVolumes()); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("ListVolumes() of another manager = %q", got)
+	}
+}
+
+func TestRegistryDisabled(t *testing.T) {
+	m := &Manager{Runner: &ScriptedRunner{Strict: true}}
+	if err := m.recordVolume(context.Background(), "/var/lib/vml/a.img", "/dev/mapper/a", "/dev/loop0", nil); err != nil {
+		t.Errorf("recordVolume() without a state directory error = %v", err)
+	}
+	if _, err := m.ListVolumes(); err != ErrRegistryDisabled {
+		t.Errorf("ListVolumes() error = %v, want %v", err, ErrRegistryDisabled)
+	}
+	if _, err := m.LookupVolume("a"); err != ErrRegistryDisabled {
+		t.Errorf("LookupVolume() error = %v, want %v", err, ErrRegistryDisabled)
+	}
+}
+
+func TestRegistryAtomicWrite(t *testing.T) {
+	ctx := context.Background()
+	m := newRegistryManager(t, map[string]string{"/dev/loop0": "uuid-0"})
+	if err := m.recordVolume(ctx, "/var/lib/vml/a.img", "/dev/mapper/a", "/dev/loop0", nil); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(m.registryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(m.registryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("registry permissions %v, want 0600", info.Mode().Perm())
+	}
+
+	// the registry is replaced without leaving temporary files, a failed write is covered by
+	// TestWriteFileAtomic
+	if err = m.recordMount(ctx, "/dev/mapper/a", "/mnt/a"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(m.registryPath())
+	if err != nil || string(after) == string(before) {
+		t.Errorf("registry not updated: %v", err)
+	}
+	entries, err := ioutil.ReadDir(m.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("state directory holds %d files, want the registry only", len(entries))
+	}
+
+	// a corrupted registry is reported, not silently replaced
+	if err = ioutil.WriteFile(m.registryPath(), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.ListVolumes(); err == nil {
+		t.Error("ListVolumes() of a corrupted registry succeeded")
+	}
+	if err = m.forgetVolume(ctx, "/dev/mapper/a"); err == nil {
+		t.Error("forgetVolume() replaced a corrupted registry")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := writeFileAtomic(path, []byte("first"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "second" {
+		t.Errorf("file holds %q, %v, want %q", content, err, "second")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// a path that cannot be replaced keeps its content and no temporary file is left
+	target := filepath.Join(dir, "directory")
+	if err = os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFileAtomic(target, []byte("data"), 0600); err == nil {
+		t.Error("writeFileAtomic() replaced a directory")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory holds %d entries, want 2", len(entries))
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ResizeVolume is used to grow an active dm-crypt volume and the filesystem on it, without
+// unmounting it.
+//
+// Input Parameters:
+//
+// 	sparseFilePath – Absolute path of the sparse file backing the volume.
+//
+// 	deviceMapperLocation – Absolute path of the dm-crypt volume.
+//
+// 	newSize – New size of the sparse file, in the same unit as the diskSize of CreateVolume.
+// 			  Shrinking a volume is refused.
+//
+// The sparse file must be the one backing the volume, a volume on another file is refused before
+// anything is changed.
+func ResizeVolume(sparseFilePath string, deviceMapperLocation string, newSize int) error {
+	return DefaultManager.ResizeVolume(sparseFilePath, deviceMapperLocation, newSize)
+}
+
+// ResizeVolumeContext is used to grow the volume like ResizeVolume. When ctx is done before the
+// volume is resized, the running command is killed and the error wraps ctx.Err().
+func ResizeVolumeContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, newSize int) error {
+	return DefaultManager.ResizeVolumeContext(ctx, sparseFilePath, deviceMapperLocation, newSize)
+}
+
+// ResizeVolume grows the dm-crypt volume like the package level ResizeVolume.
+func (m *Manager) ResizeVolume(sparseFilePath string, deviceMapperLocation string, newSize int) error {
+	return m.ResizeVolumeContext(context.Background(), sparseFilePath, deviceMapperLocation, newSize)
+}
+
+// ResizeVolumeContext grows the dm-crypt volume like the package level ResizeVolumeContext.
+func (m *Manager) ResizeVolumeContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, newSize int) error {
+	// input validation
+	if len(strings.TrimSpace(sparseFilePath)) <= 0 {
+		return errors.New("sparse file path not given")
+	}
+
+	if len(strings.TrimSpace(deviceMapperLocation)) <= 0 {
+		return errors.New("device mapper location not given")
+	}
+
+	if newSize <= 0 {
+		return errors.New("sparse file size should be greater than 0")
+	}
+
+	unlock, err := m.lockVolume(ctx, sparseFilePath, deviceMapperLocation, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fileInfo, err := os.Stat(sparseFilePath)
+	if os.IsNotExist(err) {
+		return &VolumeError{Op: "resize", Path: sparseFilePath, Kind: ErrNotFound}
+	} else if err != nil {
+		return &VolumeError{Op: "resize", Path: sparseFilePath, Err: err}
+	}
+
+	newSizeInBytes := sizeInBytes(newSize)
+	if newSizeInBytes < fileInfo.Size() {
+		return &VolumeError{Op: "resize", Path: sparseFilePath, Kind: ErrSizeMismatch,
+			Err: fmt.Errorf("shrinking the volume from %d to %d bytes is not supported", fileInfo.Size(), newSizeInBytes)}
+	}
+
+	status, err := m.volumeStatus(ctx, deviceMapperLocation)
+	if err != nil {
+		return err
+	}
+	if !status.Active {
+		return &VolumeError{Op: "resize", Path: deviceMapperLocation, Kind: ErrNotFound, Err: errors.New("volume is not active")}
+	}
+	if status.Integrity != "" {
+		return &VolumeError{Op: "resize", Path: deviceMapperLocation, Err: errors.New("volumes with integrity protection cannot be resized")}
+	}
+
+	// never grow a file that does not back the volume
+	backed := isSameFile(fileInfo, status.SparseFilePath)
+	if !backed && status.LoopDevice != "" {
+		if backed, err = m.loopBackedBy(status.LoopDevice, sparseFilePath); err != nil {
+			return &VolumeError{Op: "resize", Path: status.LoopDevice, Err: err}
+		}
+	}
+	if !backed {
+		return &VolumeError{Op: "resize", Path: deviceMapperLocation, Err: fmt.Errorf("volume is not backed by %s", sparseFilePath)}
+	}
+
+	// grow the sparse file, the loop device and then the dm-crypt mapping on top of it
+	args := []string{"-s", strconv.Itoa(newSize) + "GB", sparseFilePath}
+	if _, err = m.runCommand(ctx, "truncate", args); err != nil {
+		return &VolumeError{Op: "truncate", Path: sparseFilePath, Err: err}
+	}
+
+	if err = m.loop().SetCapacity(status.LoopDevice); err != nil {
+		return &VolumeError{Op: "resize", Path: status.LoopDevice, Err: err}
+	}
+
+	args = []string{"resize", deviceMapperLocation}
+	if _, err = m.runCommand(ctx, "cryptsetup", args); err != nil {
+		return cryptsetupError("resize", deviceMapperLocation, err)
+	}
+
+	return m.growFilesystem(ctx, deviceMapperLocation, status.MountPoints)
+}
+
+// growFilesystem grows the filesystem on the device to the size of the device. xfs and btrfs
+// can only be grown while mounted.
+func (m *Manager) growFilesystem(ctx context.Context, device string, mountPoints []string) error {
+	fs, err := detectFilesystem(device)
+	if err == ErrUnknownFilesystem {
+		// raw volume, nothing to grow
+		return nil
+	} else if err != nil {
+		return &VolumeError{Op: "resize", Path: device, Err: err}
+	}
+
+	var cmd string
+	var args []string
+	switch fs {
+	case FilesystemExt4, FilesystemExt3, FilesystemExt2:
+		cmd, args = "resize2fs", []string{device}
+	case FilesystemXFS:
+		if len(mountPoints) == 0 {
+			return &VolumeError{Op: "resize", Path: device, Err: errors.New("xfs can only be grown while mounted")}
+		}
+		cmd, args = "xfs_growfs", []string{mountPoints[0]}
+	case FilesystemBtrfs:
+		if len(mountPoints) == 0 {
+			return &VolumeError{Op: "resize", Path: device, Err: errors.New("btrfs can only be grown while mounted")}
+		}
+		cmd, args = "btrfs", []string{"filesystem", "resize", "max", mountPoints[0]}
+	default:
+		return &VolumeError{Op: "resize", Path: device, Err: fmt.Errorf("growing %s is not supported", fs)}
+	}
+
+	if _, err = m.runCommand(ctx, cmd, args); err != nil {
+		return &VolumeError{Op: cmd, Path: device, Err: err}
+	}
+	return nil
+}
+
+// sizeInBytes converts a volume size given to CreateVolume or ResizeVolume to bytes
+func sizeInBytes(size int) int64 {
+	return int64(size) * 1000000000
+}
@@ -0,0 +1,168 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResizeVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		fileSize     int64
+		active       bool
+		integrity    string
+		loopFile     string
+		filesystem   []byte
+		wantErr      error
+		wantErrText  string
+		wantCommands []string
+		wantResized  []string
+	}{
+		{
+			name:         "ext4 volume",
+			active:       true,
+			filesystem:   extProbe(extCompatHasJournal, 0x40, 0),
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "truncate", "cryptsetup resize", "resize2fs"},
+			wantResized:  []string{"/dev/loop0"},
+		},
+		{
+			name:         "raw volume",
+			active:       true,
+			filesystem:   make([]byte, 4096),
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "truncate", "cryptsetup resize"},
+			wantResized:  []string{"/dev/loop0"},
+		},
+		{
+			name:        "shrinking is refused",
+			fileSize:    sizeInBytes(2),
+			active:      true,
+			wantErr:     ErrSizeMismatch,
+			wantErrText: "shrinking",
+		},
+		{
+			name:         "inactive volume",
+			wantErr:      ErrNotFound,
+			wantErrText:  "not active",
+			wantCommands: []string{"cryptsetup status"},
+		},
+		{
+			name:         "integrity is refused",
+			active:       true,
+			integrity:    "hmac(sha256)",
+			wantErrText:  "integrity",
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID"},
+		},
+		{
+			name:         "volume on another file is refused",
+			active:       true,
+			loopFile:     "/var/lib/other.img",
+			wantErrText:  "not backed by",
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sparseFile := filepath.Join(dir, "vol.img")
+			if err := ioutil.WriteFile(sparseFile, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(sparseFile, tt.fileSize); err != nil {
+				t.Fatal(err)
+			}
+			// the dm-crypt volume is a plain file holding the filesystem superblock, if any
+			mapper := filepath.Join(dir, "vol")
+			if err := ioutil.WriteFile(mapper, tt.filesystem, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			loopFile := sparseFile
+			if tt.loopFile != "" {
+				loopFile = tt.loopFile
+			}
+			loops := newFakeLoop()
+			loops.devices["/dev/loop0"] = loopFile
+
+			// the status lists the file the loop device is bound to, as cryptsetup does
+			status := cryptsetupStatus(mapper, tt.active, "/dev/loop0", loopFile)
+			if tt.integrity != "" {
+				status.Stdout += "  integrity: " + tt.integrity + "\n"
+			}
+			scripted := &ScriptedRunner{}
+			scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: status})
+			m := &Manager{Runner: scripted, Loop: loops, LockDir: filepath.Join(dir, "locks")}
+
+			err := m.ResizeVolumeContext(context.Background(), sparseFile, mapper, 1)
+			if tt.wantErrText == "" && err != nil {
+				t.Fatalf("ResizeVolumeContext failed: %v", err)
+			}
+			if tt.wantErrText != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErrText)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErrText)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			var commands []string
+			for _, c := range scripted.Commands() {
+				commands = append(commands, commandVerb(c))
+				switch commandVerb(c) {
+				case "truncate":
+					if want := []string{"-s", "1GB", sparseFile}; !reflect.DeepEqual(c.Args, want) {
+						t.Errorf("truncate %q, want %q", c.Args, want)
+					}
+				case "cryptsetup resize":
+					if want := []string{"resize", mapper}; !reflect.DeepEqual(c.Args, want) {
+						t.Errorf("cryptsetup %q, want %q", c.Args, want)
+					}
+				case "resize2fs":
+					if want := []string{mapper}; !reflect.DeepEqual(c.Args, want) {
+						t.Errorf("resize2fs %q, want %q", c.Args, want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("ran %q, want %q", commands, tt.wantCommands)
+			}
+			if !reflect.DeepEqual(loops.resized, tt.wantResized) {
+				t.Errorf("set the capacity of %q, want %q", loops.resized, tt.wantResized)
+			}
+		})
+	}
+}
+
+func TestResizeVolumeCanceled(t *testing.T) {
+	dir := t.TempDir()
+	sparseFile := filepath.Join(dir, "vol.img")
+	if err := ioutil.WriteFile(sparseFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mapper := filepath.Join(dir, "vol")
+	loops := newFakeLoop()
+	loops.devices["/dev/loop0"] = sparseFile
+	scripted := &ScriptedRunner{}
+	scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, true, "/dev/loop0", sparseFile)})
+	m := &Manager{Runner: scripted, Loop: loops, LockDir: filepath.Join(dir, "locks")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.ResizeVolumeContext(ctx, sparseFile, mapper, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(loops.resized) != 0 {
+		t.Errorf("set the capacity of %q after ctx was canceled", loops.resized)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+// rollback collects the undo actions of the steps an operation completed, so that they can be
+// run in reverse order when a later step fails.
+type rollback struct {
+	steps []func() error
+}
+
+// add registers the undo action of a completed step. The error it returns should name the
+// resource it failed to clean up. Undo actions must not use the context of the operation, as
+// the rollback also runs after it was canceled.
+func (r *rollback) add(undo func() error) {
+	r.steps = append(r.steps, undo)
+}
+
+// commit drops the registered steps once the operation has succeeded far enough that it must no
+// longer be undone.
+func (r *rollback) commit() {
+	r.steps = nil
+}
+
+// run undoes the registered steps, the last one first, after the operation failed with err.
+// Every step is undone even if an earlier undo fails. err is returned as is when all of them
+// succeed, otherwise it is wrapped in a RollbackError along with the undo errors.
+func (r *rollback) run(err error) error {
+	var rollbackErrs []error
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		if undoErr := r.steps[i](); undoErr != nil {
+			rollbackErrs = append(rollbackErrs, undoErr)
+		}
+	}
+	r.steps = nil
+	if len(rollbackErrs) > 0 {
+		return &RollbackError{Err: err, RollbackErrs: rollbackErrs}
+	}
+	return err
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sysBlockPath lists the block devices of the host
+var sysBlockPath = "/sys/block"
+
+// suffix the kernel appends to the backing file of a loop device once the file is removed
+const deletedSuffix = " (deleted)"
+
+// prefix of the device mapper UUID of the dm-crypt mappings opened from a LUKS header
+const luksMapperUUIDPrefix = "CRYPT-LUKS"
+
+// suffix of the name of the dm-integrity device cryptsetup stacks below the dm-crypt mapping of
+// a volume with integrity protection
+const integritySubdeviceSuffix = "_dif"
+
+// OrphanReason tells why a resource was reported by Scan.
+type OrphanReason string
+
+// Reasons reported by Scan
+const (
+	// ReasonBackingFileDeleted is a loop device, or a mapping on top of one, whose sparse file
+	// was removed.
+	ReasonBackingFileDeleted OrphanReason = "backing file deleted"
+	// ReasonUnused is a loop device or a mapping of a registered volume that nothing mounts,
+	// opens or is stacked on.
+	ReasonUnused OrphanReason = "unused"
+	// ReasonNoMapper is the sparse file of a volume whose deletion failed or was interrupted,
+	// with neither a loop device nor a mapping.
+	ReasonNoMapper OrphanReason = "no mapper"
+	// ReasonSparseFileMissing is a registry record whose sparse file no longer exists.
+	ReasonSparseFileMissing OrphanReason = "sparse file missing"
+)
+
+// ScanReport lists the resources left behind by failed or interrupted volume operations.
+type ScanReport struct {
+	Loops        []OrphanedLoop       `json:"loops"`
+	Mappers      []OrphanedMapper     `json:"mappers"`
+	SparseFiles  []OrphanedSparseFile `json:"sparse_files"`
+	StaleRecords []OrphanedSparseFile `json:"stale_records"`
+}
+
+// OrphanedLoop is a loop device of a registered sparse file, or of a removed one, that no mapping
+// is stacked on and that is not mounted.
+type OrphanedLoop struct {
+	Device      string       `json:"device"`
+	BackingFile string       `json:"backing_file"`
+	Reason      OrphanReason `json:"reason"`
+}
+
+// OrphanedMapper is a LUKS dm-crypt mapping of a registered volume, or on a loop device whose
+// backing file was removed, that is neither mounted nor open.
+type OrphanedMapper struct {
+	Name                 string `json:"name"`
+	DeviceMapperLocation string `json:"device_mapper_location"`
+	LUKSUUID             string `json:"luks_uuid,omitempty"`
+	LoopDevice           string `json:"loop_device"`
+	BackingFile          string `json:"backing_file"`
+	// Registered is set when the mapping is recorded in the registry.
+	Registered bool         `json:"registered"`
+	Reason     OrphanReason `json:"reason"`
+}
+
+// OrphanedSparseFile is a registered sparse file that is not in use, or the record of a
+// registered sparse file that is gone.
+type OrphanedSparseFile struct {
+	Path     string       `json:"path"`
+	VolumeID string       `json:"volume_id"`
+	Reason   OrphanReason `json:"reason"`
+}
+
+// sysLoop is a loop device as listed in sysfs
+type sysLoop struct {
+	name        string
+	dev         string
+	backingFile string
+	deleted     bool
+	holders     []string
+}
+
+// sysMapper is a device mapper device as listed in sysfs
+type sysMapper struct {
+	// sysName is the dm-<minor> name of the device in sysfs
+	sysName string
+	name    string
+	dev     string
+	uuid    string
+	slaves  []string
+	holders []string
+}
+
+// Scan is used to find the loop devices, dm-crypt mappings and sparse files left behind by
+// volume operations that crashed or were interrupted.
+//
+// Only the resources created by the library are reported: the loop devices and the mappings of
+// the sparse files and volumes in the registry, and those whose backing file was removed. The
+// loop devices and mappings of other software, e.g. snap or other LUKS users, are never reported,
+// so that Collect cannot close or detach them. Without the registry, only the resources whose
+// backing file was removed are found. The sparse files of the registered volumes that are closed,
+// e.g. after a reboot, are left for RestoreAll, only those of a failed deletion are reported.
+//
+// Scan cannot tell a leftover from a volume that is being created or restored, e.g. one that was
+// opened but not mounted yet. It is meant to be run when no volume operation is in progress, such
+// as when the agent starts.
+func Scan() (*ScanReport, error) {
+	return DefaultManager.Scan()
+}
+
+// Scan finds the orphaned resources like the package level Scan.
+func (m *Manager) Scan() (*ScanReport, error) {
+	ctx := context.Background()
+	report := &ScanReport{
+		Loops:        []OrphanedLoop{},
+		Mappers:      []OrphanedMapper{},
+		SparseFiles:  []OrphanedSparseFile{},
+		StaleRecords: []OrphanedSparseFile{},
+	}
+
+	loops, err := readSysLoops()
+	if err != nil {
+		return nil, err
+	}
+	mappers, err := readSysMappers()
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	mounted := map[string]bool{}
+	for _, mount := range mounts {
+		mounted[mount.Device] = true
+	}
+
+	records := map[string]*VolumeRecord{}
+	if m.StateDir != "" {
+		if records, err = m.readRegistry(); err != nil {
+			return nil, err
+		}
+	}
+
+	registeredFiles := map[string]bool{}
+	for _, record := range records {
+		registeredFiles[canonicalPath(record.SparseFilePath)] = true
+	}
+
+	loopsByName := map[string]*sysLoop{}
+	for i := range loops {
+		loopsByName[loops[i].name] = &loops[i]
+	}
+
+	mappersBySysName := map[string]*sysMapper{}
+	for i := range mappers {
+		mappersBySysName[mappers[i].sysName] = &mappers[i]
+	}
+
+	activeMappers := map[string]bool{}
+	for _, mapper := range mappers {
+		activeMappers[mapper.name] = true
+		if !strings.HasPrefix(mapper.uuid, luksMapperUUIDPrefix) || len(mapper.slaves) != 1 {
+			continue
+		}
+		slave := mapper.slaves[0]
+		// a volume with integrity protection sits on a dm-integrity device on the loop device,
+		// both are removed when the mapping is closed
+		if sub, ok := mappersBySysName[slave]; ok && sub.name == mapper.name+integritySubdeviceSuffix && len(sub.slaves) == 1 {
+			slave = sub.slaves[0]
+		}
+		backing, ok := loopsByName[slave]
+		if !ok || mounted[mapper.dev] || len(mapper.holders) > 0 {
+			continue
+		}
+		// the mappings of other LUKS users are left alone
+		_, registered := records[mapper.name]
+		if !registered && !registeredFiles[backing.backingFile] && !backing.deleted {
+			continue
+		}
+
+		location := filepath.Join("/dev/mapper", mapper.name)
+		// VM disks are opened by the hypervisor rather than mounted
+		status, err := m.volumeStatus(ctx, location)
+		if err != nil || !status.Active || status.InUse {
+			continue
+		}
+
+		orphan := OrphanedMapper{
+			Name:                 mapper.name,
+			DeviceMapperLocation: location,
+			LUKSUUID:             luksUUIDFromMapperUUID(mapper.uuid),
+			LoopDevice:           "/dev/" + backing.name,
+			BackingFile:          backing.backingFile,
+			Registered:           registered,
+			Reason:               ReasonUnused,
+		}
+		if backing.deleted {
+			orphan.Reason = ReasonBackingFileDeleted
+		}
+		report.Mappers = append(report.Mappers, orphan)
+	}
+
+	attached := map[string]bool{}
+	for _, loop := range loops {
+		attached[loop.backingFile] = true
+		if len(loop.holders) > 0 || mounted[loop.dev] {
+			continue
+		}
+		// the loop devices of other software are left alone
+		if !registeredFiles[loop.backingFile] && !loop.deleted {
+			continue
+		}
+		orphan := OrphanedLoop{Device: "/dev/" + loop.name, BackingFile: loop.backingFile, Reason: ReasonUnused}
+		if loop.deleted {
+			orphan.Reason = ReasonBackingFileDeleted
+		}
+		report.Loops = append(report.Loops, orphan)
+	}
+
+	for _, record := range records {
+		if _, err := os.Stat(record.SparseFilePath); os.IsNotExist(err) {
+			report.StaleRecords = append(report.StaleRecords, OrphanedSparseFile{Path: record.SparseFilePath, VolumeID: record.ID, Reason: ReasonSparseFileMissing})
+			continue
+		}
+		// the volumes closed by a reboot are restored by RestoreAll, only the sparse files of
+		// the volumes being deleted are left over
+		if !record.Deleting || activeMappers[volumeID(record.DeviceMapperLocation)] || attached[canonicalPath(record.SparseFilePath)] {
+			continue
+		}
+		report.SparseFiles = append(report.SparseFiles, OrphanedSparseFile{Path: record.SparseFilePath, VolumeID: record.ID, Reason: ReasonNoMapper})
+	}
+	sort.Slice(report.SparseFiles, func(i, j int) bool { return report.SparseFiles[i].VolumeID < report.SparseFiles[j].VolumeID })
+	sort.Slice(report.StaleRecords, func(i, j int) bool { return report.StaleRecords[i].VolumeID < report.StaleRecords[j].VolumeID })
+	return report, nil
+}
+
+// canonicalPath returns the path the way the kernel reports the backing file of a loop device.
+func canonicalPath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
+
+// readSysLoops lists the loop devices that are bound to a backing file.
+func readSysLoops() ([]sysLoop, error) {
+	backingFiles, err := filepath.Glob(filepath.Join(sysBlockPath, "loop*", "loop", "backing_file"))
+	if err != nil {
+		return nil, err
+	}
+
+	var loops []sysLoop
+	for _, backingFilePath := range backingFiles {
+		sysDevice := filepath.Dir(filepath.Dir(backingFilePath))
+		backingFile, err := readSysfsValue(backingFilePath)
+		if err != nil {
+			// the device was detached since it was listed
+			continue
+		}
+		loop := sysLoop{name: filepath.Base(sysDevice), backingFile: backingFile}
+		if strings.HasSuffix(backingFile, deletedSuffix) {
+			loop.backingFile = strings.TrimSuffix(backingFile, deletedSuffix)
+			loop.deleted = true
+		}
+		loop.dev, _ = readSysfsValue(filepath.Join(sysDevice, "dev"))
+		loop.holders = readSysfsDir(filepath.Join(sysDevice, "holders"))
+		loops = append(loops, loop)
+	}
+	sort.Slice(loops, func(i, j int) bool { return loops[i].name < loops[j].name })
+	return loops, nil
+}
+
+// readSysMappers lists the device mapper devices.
+func readSysMappers() ([]sysMapper, error) {
+	names, err := filepath.Glob(filepath.Join(sysBlockPath, "dm-*", "dm", "name"))
+	if err != nil {
+		return nil, err
+	}
+
+	var mappers []sysMapper
+	for _, namePath := range names {
+		sysDevice := filepath.Dir(filepath.Dir(namePath))
+		name, err := readSysfsValue(namePath)
+		if err != nil {
+			// the device was removed since it was listed
+			continue
+		}
+		mapper := sysMapper{sysName: filepath.Base(sysDevice), name: name}
+		mapper.uuid, _ = readSysfsValue(filepath.Join(sysDevice, "dm", "uuid"))
+		mapper.dev, _ = readSysfsValue(filepath.Join(sysDevice, "dev"))
+		mapper.slaves = readSysfsDir(filepath.Join(sysDevice, "slaves"))
+		mapper.holders = readSysfsDir(filepath.Join(sysDevice, "holders"))
+		mappers = append(mappers, mapper)
+	}
+	sort.Slice(mappers, func(i, j int) bool { return mappers[i].name < mappers[j].name })
+	return mappers, nil
+}
+
+func readSysfsValue(path string) (string, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// readSysfsDir returns the names of the entries of a sysfs directory such as holders or slaves.
+func readSysfsDir(path string) []string {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// luksUUIDFromMapperUUID extracts the LUKS UUID from a device mapper UUID such as
+// CRYPT-LUKS2-<32 hex digits>-<name>.
+func luksUUIDFromMapperUUID(mapperUUID string) string {
+	fields := strings.SplitN(mapperUUID, "-", 4)
+	if len(fields) < 3 || len(fields[2]) != 32 {
+		return ""
+	}
+	hex := fields[2]
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hex[0:8], hex[8:12], hex[12:16], hex[16:20], hex[20:32])
+}
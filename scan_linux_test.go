@@ -0,0 +1,361 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"intel/isecl/lib/vml/v4/loop"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLoop is a LoopController keeping the attached loop devices in memory
+type fakeLoop struct {
+	devices  map[string]string
+	detached []string
+	resized  []string
+}
+
+func newFakeLoop() *fakeLoop {
+	return &fakeLoop{devices: map[string]string{}}
+}
+
+func (l *fakeLoop) Attach(backingFile string, opts loop.Options) (string, error) {
+	device := "/dev/loop" + string(rune('0'+len(l.devices)))
+	l.devices[device] = backingFile
+	return device, nil
+}
+
+func (l *fakeLoop) FindByBackingFile(backingFile string) (string, error) {
+	for device, file := range l.devices {
+		if file == backingFile {
+			return device, nil
+		}
+	}
+	return "", loop.ErrNotFound
+}
+
+func (l *fakeLoop) BackingFile(device string) (string, error) {
+	file, ok := l.devices[device]
+	if !ok {
+		return "", loop.ErrNotLoopDevice
+	}
+	return file, nil
+}
+
+func (l *fakeLoop) Detach(device string) error {
+	if _, ok := l.devices[device]; !ok {
+		return loop.ErrNotLoopDevice
+	}
+	delete(l.devices, device)
+	l.detached = append(l.detached, device)
+	return nil
+}
+
+func (l *fakeLoop) SetCapacity(device string) error {
+	if _, ok := l.devices[device]; !ok {
+		return loop.ErrNotLoopDevice
+	}
+	l.resized = append(l.resized, device)
+	return nil
+}
+
+func cryptsetupStatus(mapper string, active bool, loopDevice, sparseFile string) CommandResult {
+	if !active {
+		return CommandResult{Stdout: mapper + " is inactive.\n", ExitCode: 4}
+	}
+	return CommandResult{Stdout: mapper + " is active.\n" +
+		"  type:    LUKS2\n" +
+		"  cipher:  aes-xts-plain64\n" +
+		"  keysize: 512 bits\n" +
+		"  device:  " + loopDevice + "\n" +
+		"  loop:    " + sparseFile + "\n"}
+}
+
+// commandVerb returns the program and the first argument that is not a flag, e.g.
+// "cryptsetup luksOpen"
+func commandVerb(c Command) string {
+	if c.Name != "cryptsetup" {
+		return c.Name
+	}
+	for _, arg := range c.Args {
+		if !strings.HasPrefix(arg, "-") {
+			return c.Name + " " + arg
+		}
+	}
+	return c.Name
+}
+
+// sysDevice describes a loop or device mapper device of the fake sysfs tree
+type sysDevice struct {
+	name    string
+	dev     string
+	files   map[string]string
+	holders []string
+	slaves  []string
+}
+
+// fakeSysBlock writes the devices to a directory laid out like /sys/block and points
+// sysBlockPath and mountInfoPath to it for the duration of the test.
+func fakeSysBlock(t *testing.T, devices []sysDevice, mountInfo string) {
+	root := t.TempDir()
+	write := func(path, value string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, device := range devices {
+		dir := filepath.Join(root, device.name)
+		write(filepath.Join(dir, "dev"), device.dev)
+		for name, value := range device.files {
+			write(filepath.Join(dir, name), value)
+		}
+		for _, holder := range device.holders {
+			write(filepath.Join(dir, "holders", holder), "")
+		}
+		for _, slave := range device.slaves {
+			write(filepath.Join(dir, "slaves", slave), "")
+		}
+	}
+	write(filepath.Join(root, "mountinfo"), mountInfo)
+
+	oldSysBlockPath, oldMountInfoPath := sysBlockPath, mountInfoPath
+	sysBlockPath, mountInfoPath = root, filepath.Join(root, "mountinfo")
+	t.Cleanup(func() { sysBlockPath, mountInfoPath = oldSysBlockPath, oldMountInfoPath })
+}
+
+func loopDevice(name, dev, backingFile string, holders ...string) sysDevice {
+	return sysDevice{name: name, dev: dev, files: map[string]string{"loop/backing_file": backingFile}, holders: holders}
+}
+
+func mapperDevice(sysName, dev, name, uuid string, slaves ...string) sysDevice {
+	return sysDevice{name: sysName, dev: dev, files: map[string]string{"dm/name": name, "dm/uuid": uuid}, slaves: slaves}
+}
+
+// scanFixture is a host with the loop devices and mappings of registered volumes, of a removed
+// sparse file and of other software
+type scanFixture struct {
+	dir     string
+	manager *Manager
+	runner  *ScriptedRunner
+	loops   *fakeLoop
+}
+
+func newScanFixture(t *testing.T) *scanFixture {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparseFile := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	unused, open, mounted, detached := sparseFile("unused.img"), sparseFile("open.img"), sparseFile("mounted.img"), sparseFile("detached.img")
+	closed := sparseFile("closed.img")
+	gone := filepath.Join(dir, "gone.img")
+	// the record of a volume being deleted may name its sparse file through a symbolic link
+	linked := filepath.Join(dir, "linked")
+	if err = os.Symlink(unused, linked); err != nil {
+		t.Fatal(err)
+	}
+	const luksUUID = "CRYPT-LUKS2-0123456789abcdef0123456789abcdef-"
+
+	fakeSysBlock(t, []sysDevice{
+		loopDevice("loop0", "7:0", unused),
+		loopDevice("loop1", "7:1", "/var/lib/snapd/snaps/core_1.snap"),
+		loopDevice("loop2", "7:2", gone+deletedSuffix),
+		loopDevice("loop3", "7:3", open, "dm-0"),
+		loopDevice("loop4", "7:4", "/srv/other.img", "dm-1"),
+		loopDevice("loop5", "7:5", mounted),
+		mapperDevice("dm-0", "253:0", "open", luksUUID+"open", "loop3"),
+		mapperDevice("dm-1", "253:1", "other", luksUUID+"other", "loop4"),
+	}, "36 25 7:5 / /mnt/mounted rw,relatime shared:1 - ext4 /dev/loop5 rw")
+
+	loops := newFakeLoop()
+	for device, file := range map[string]string{"/dev/loop0": unused, "/dev/loop1": "/var/lib/snapd/snaps/core_1.snap", "/dev/loop2": gone + deletedSuffix, "/dev/loop3": open, "/dev/loop4": "/srv/other.img", "/dev/loop5": mounted} {
+		loops.devices[device] = file
+	}
+	runner := &ScriptedRunner{}
+	runner.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus("mapper", true, "/dev/loop3", open)})
+	runner.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"luksUUID"}, Result: CommandResult{Stdout: "01234567-89ab-cdef-0123-456789abcdef\n"}})
+	m := &Manager{Runner: runner, Loop: loops, LockDir: filepath.Join(dir, "locks"), StateDir: filepath.Join(dir, "state")}
+
+	err = m.updateRegistry(context.Background(), func(records map[string]*VolumeRecord, now time.Time) {
+		for id, file := range map[string]string{"unused": unused, "open": open, "mounted": mounted, "closed": closed, "stale": filepath.Join(dir, "stale.img")} {
+			records[id] = &VolumeRecord{ID: id, SparseFilePath: file, DeviceMapperLocation: "/dev/mapper/" + id, MountPoints: []string{}, Created: now, Updated: now}
+		}
+		// the deletion of these volumes was interrupted, the sparse file of linked is still attached
+		for id, file := range map[string]string{"detached": detached, "linked": linked} {
+			records[id] = &VolumeRecord{ID: id, SparseFilePath: file, DeviceMapperLocation: "/dev/mapper/" + id, MountPoints: []string{}, Created: now, Updated: now, Deleting: true}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &scanFixture{dir: dir, manager: m, runner: runner, loops: loops}
+}
+
+func TestScan(t *testing.T) {
+	f := newScanFixture(t)
+	report, err := f.manager.Scan()
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	// the snap and the LUKS volume of another user are not reported
+	wantLoops := []OrphanedLoop{
+		{Device: "/dev/loop0", BackingFile: filepath.Join(f.dir, "unused.img"), Reason: ReasonUnused},
+		{Device: "/dev/loop2", BackingFile: filepath.Join(f.dir, "gone.img"), Reason: ReasonBackingFileDeleted},
+	}
+	if !reflect.DeepEqual(report.Loops, wantLoops) {
+		t.Errorf("got loops %+v, want %+v", report.Loops, wantLoops)
+	}
+	wantMappers := []OrphanedMapper{{
+		Name:                 "open",
+		DeviceMapperLocation: "/dev/mapper/open",
+		LUKSUUID:             "01234567-89ab-cdef-0123-456789abcdef",
+		LoopDevice:           "/dev/loop3",
+		BackingFile:          filepath.Join(f.dir, "open.img"),
+		Registered:           true,
+		Reason:               ReasonUnused,
+	}}
+	if !reflect.DeepEqual(report.Mappers, wantMappers) {
+		t.Errorf("got mappers %+v, want %+v", report.Mappers, wantMappers)
+	}
+	// the volume closed by a reboot is left for RestoreAll
+	wantSparseFiles := []OrphanedSparseFile{{Path: filepath.Join(f.dir, "detached.img"), VolumeID: "detached", Reason: ReasonNoMapper}}
+	if !reflect.DeepEqual(report.SparseFiles, wantSparseFiles) {
+		t.Errorf("got sparse files %+v, want %+v", report.SparseFiles, wantSparseFiles)
+	}
+	wantStale := []OrphanedSparseFile{{Path: filepath.Join(f.dir, "stale.img"), VolumeID: "stale", Reason: ReasonSparseFileMissing}}
+	if !reflect.DeepEqual(report.StaleRecords, wantStale) {
+		t.Errorf("got stale records %+v, want %+v", report.StaleRecords, wantStale)
+	}
+
+	// without the registry only the resources of removed sparse files are found
+	f.manager.StateDir = ""
+	if report, err = f.manager.Scan(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(report.Loops) != 1 || report.Loops[0].Device != "/dev/loop2" || len(report.Mappers) != 0 {
+		t.Errorf("got loops %+v and mappers %+v without the registry", report.Loops, report.Mappers)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       CollectPolicy
+		wantActions  []string
+		wantCommands []string
+		wantDetached []string
+		wantFiles    []string
+	}{
+		{
+			name:        "dry run",
+			policy:      CollectPolicy{CloseMappers: true, DetachLoops: true, RemoveSparseFiles: true, ForgetStaleRecords: true},
+			wantActions: []string{"close /dev/mapper/open", "detach /dev/loop3", "detach /dev/loop0", "detach /dev/loop2", "remove detached.img", "forget stale"},
+			wantFiles:   []string{"closed.img", "detached.img", "mounted.img", "open.img", "unused.img"},
+		},
+		{
+			name:        "nothing selected",
+			policy:      CollectPolicy{Apply: true},
+			wantActions: []string{},
+			wantFiles:   []string{"closed.img", "detached.img", "mounted.img", "open.img", "unused.img"},
+		},
+		{
+			name:         "loops only",
+			policy:       CollectPolicy{Apply: true, DetachLoops: true},
+			wantActions:  []string{"detach /dev/loop0", "detach /dev/loop2"},
+			wantDetached: []string{"/dev/loop0", "/dev/loop2"},
+			wantFiles:    []string{"closed.img", "detached.img", "mounted.img", "open.img", "unused.img"},
+		},
+		{
+			name:         "everything",
+			policy:       CollectPolicy{Apply: true, CloseMappers: true, DetachLoops: true, RemoveSparseFiles: true, ForgetStaleRecords: true},
+			wantActions:  []string{"close /dev/mapper/open", "detach /dev/loop3", "detach /dev/loop0", "detach /dev/loop2", "remove detached.img", "forget stale"},
+			wantCommands: []string{"cryptsetup luksClose"},
+			wantDetached: []string{"/dev/loop0", "/dev/loop2", "/dev/loop3"},
+			wantFiles:    []string{"closed.img", "mounted.img", "open.img", "unused.img"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newScanFixture(t)
+			report, err := f.manager.Scan()
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			scanned := len(f.runner.Commands())
+
+			actions, err := f.manager.Collect(report, tt.policy)
+			if err != nil {
+				t.Fatalf("Collect failed: %v", err)
+			}
+			got := []string{}
+			for _, action := range actions {
+				if action.Err != nil || action.Applied != tt.policy.Apply {
+					t.Errorf("%s %s: applied %v, error %v", action.Action, action.Target, action.Applied, action.Err)
+				}
+				got = append(got, action.Action+" "+strings.TrimPrefix(action.Target, f.dir+"/"))
+			}
+			if !reflect.DeepEqual(got, tt.wantActions) {
+				t.Errorf("got actions %q, want %q", got, tt.wantActions)
+			}
+
+			var closed []string
+			for _, c := range f.runner.Commands()[scanned:] {
+				if verb := commandVerb(c); verb != "cryptsetup status" && verb != "cryptsetup luksUUID" {
+					closed = append(closed, verb)
+				}
+			}
+			if !reflect.DeepEqual(closed, tt.wantCommands) {
+				t.Errorf("ran %q, want %q", closed, tt.wantCommands)
+			}
+			detached := append([]string(nil), f.loops.detached...)
+			sort.Strings(detached)
+			if !reflect.DeepEqual(detached, tt.wantDetached) {
+				t.Errorf("detached %q, want %q", detached, tt.wantDetached)
+			}
+
+			files, err := filepath.Glob(filepath.Join(f.dir, "*.img"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range files {
+				files[i] = filepath.Base(files[i])
+			}
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("got sparse files %q, want %q", files, tt.wantFiles)
+			}
+			records, err := f.manager.readRegistry()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, detachedRecord := records["detached"]
+			_, staleRecord := records["stale"]
+			if detachedRecord == (tt.policy.Apply && tt.policy.RemoveSparseFiles) {
+				t.Errorf("record of the removed sparse file kept: %v", detachedRecord)
+			}
+			if staleRecord == (tt.policy.Apply && tt.policy.ForgetStaleRecords) {
+				t.Errorf("stale record kept: %v", staleRecord)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// cryptsetup reports offsets and sizes in 512 byte sectors regardless of the volume sector size
+const cryptsetupSectorSize = 512
+
+// VolumeStatus describes a dm-crypt volume as reported by GetVolumeStatus.
+type VolumeStatus struct {
+	DeviceMapperLocation string   `json:"device_mapper_location"`
+	Active               bool     `json:"active"`
+	InUse                bool     `json:"in_use"`
+	Type                 string   `json:"type,omitempty"`
+	LUKSVersion          int      `json:"luks_version,omitempty"`
+	UUID                 string   `json:"uuid,omitempty"`
+	Cipher               string   `json:"cipher,omitempty"`
+	KeySize              int      `json:"key_size,omitempty"`
+	Integrity            string   `json:"integrity,omitempty"`
+	LoopDevice           string   `json:"loop_device,omitempty"`
+	SparseFilePath       string   `json:"sparse_file_path,omitempty"`
+	SectorSize           int      `json:"sector_size,omitempty"`
+	DataOffset           uint64   `json:"data_offset"`
+	Size                 uint64   `json:"size"`
+	ReadOnly             bool     `json:"read_only"`
+	MountPoints          []string `json:"mount_points"`
+}
+
+// GetVolumeStatus is used to inspect a dm-crypt volume.
+//
+// Input Parameter:
+//
+// 	deviceMapperLocation – Absolute path of the dm-crypt volume.
+//
+// An inactive volume is reported with Active set to false and no error. DataOffset and Size
+// are in bytes, KeySize is in bits. Integrity is the algorithm authenticating the sectors of a
+// volume created with VolumeOptions.Integrity, e.g. "hmac(sha256)" or "aead".
+func GetVolumeStatus(deviceMapperLocation string) (*VolumeStatus, error) {
+	return DefaultManager.GetVolumeStatus(deviceMapperLocation)
+}
+
+// GetVolumeStatus inspects the dm-crypt volume like the package level GetVolumeStatus.
+func (m *Manager) GetVolumeStatus(deviceMapperLocation string) (*VolumeStatus, error) {
+	return m.volumeStatus(context.Background(), deviceMapperLocation)
+}
+
+func (m *Manager) volumeStatus(ctx context.Context, deviceMapperLocation string) (*VolumeStatus, error) {
+	if len(strings.TrimSpace(deviceMapperLocation)) <= 0 {
+		return nil, errors.New("device mapper location not given")
+	}
+
+	backend, err := m.cryptBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &VolumeStatus{DeviceMapperLocation: deviceMapperLocation, MountPoints: []string{}}
+	if backend == CryptBackendNative {
+		if err = nativeStatus(status); err != nil {
+			return nil, err
+		}
+	} else {
+		cmdOutput, err := m.runCommand(ctx, "cryptsetup", []string{"status", deviceMapperLocation})
+		if !parseCryptsetupStatus(cmdOutput, status) {
+			if err != nil {
+				return nil, cryptsetupError("status", deviceMapperLocation, err)
+			}
+			return nil, &VolumeError{Op: "status", Path: deviceMapperLocation, Err: errors.New("unexpected cryptsetup status output")}
+		}
+		if status.Active && strings.HasPrefix(status.Type, "LUKS") && status.LoopDevice != "" {
+			status.UUID, err = m.luksUUID(ctx, status.LoopDevice)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !status.Active {
+		return status, nil
+	}
+
+	points, err := mountPoints(deviceMapperLocation)
+	if err != nil {
+		return nil, &VolumeError{Op: "status", Path: deviceMapperLocation, Err: err}
+	}
+	status.MountPoints = append(status.MountPoints, points...)
+	return status, nil
+}
+
+// parseCryptsetupStatus fills status from the output of cryptsetup status. It returns false if
+// the output does not report the volume as either active or inactive.
+func parseCryptsetupStatus(output string, status *VolumeStatus) bool {
+	lines := strings.Split(output, "\n")
+	switch {
+	case strings.Contains(lines[0], " is inactive"):
+		return true
+	case strings.Contains(lines[0], " is active"):
+		status.Active = true
+		status.InUse = strings.Contains(lines[0], "in use")
+	default:
+		return false
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+		switch strings.TrimSpace(fields[0]) {
+		case "type":
+			status.Type = value
+			if strings.HasPrefix(value, "LUKS") {
+				status.LUKSVersion, _ = strconv.Atoi(strings.TrimPrefix(value, "LUKS"))
+			}
+		case "cipher":
+			status.Cipher = value
+		case "integrity":
+			status.Integrity = value
+		case "keysize":
+			status.KeySize, _ = strconv.Atoi(strings.TrimSuffix(value, " bits"))
+		case "device":
+			status.LoopDevice = value
+		case "loop":
+			status.SparseFilePath = value
+		case "sector size":
+			status.SectorSize, _ = strconv.Atoi(value)
+		case "offset":
+			status.DataOffset = parseSectors(value)
+		case "size":
+			status.Size = parseSectors(value)
+		case "mode":
+			status.ReadOnly = value == "readonly"
+		}
+	}
+	return true
+}
+
+// parseSectors converts a "<n> sectors" value of cryptsetup status to bytes
+func parseSectors(value string) uint64 {
+	sectors, err := strconv.ParseUint(strings.TrimSuffix(value, " sectors"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return sectors * cryptsetupSectorSize
+}
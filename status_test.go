@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCryptsetupStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   VolumeStatus
+		wantOk bool
+	}{
+		{
+			name: "LUKS1",
+			output: `/dev/mapper/vol1 is active.
+  type:    LUKS1
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: dm-crypt
+  device:  /dev/loop0
+  loop:    /var/lib/vml/vol1.img
+  sector size:  512
+  offset:  4096 sectors
+  size:    200704 sectors
+  mode:    read/write
+`,
+			want: VolumeStatus{
+				Active: true, Type: "LUKS1", LUKSVersion: 1, Cipher: "aes-xts-plain64", KeySize: 512,
+				LoopDevice: "/dev/loop0", SparseFilePath: "/var/lib/vml/vol1.img", SectorSize: 512,
+				DataOffset: 4096 * 512, Size: 200704 * 512,
+			},
+			wantOk: true,
+		},
+		{
+			name: "LUKS2 in use and read-only",
+			output: `/dev/mapper/vol2 is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 256 bits
+  key location: keyring
+  device:  /dev/loop3
+  loop:    /var/lib/vml/vol2.img
+  sector size:  4096
+  offset:  32768 sectors
+  size:    2064384 sectors
+  mode:    readonly
+`,
+			want: VolumeStatus{
+				Active: true, InUse: true, Type: "LUKS2", LUKSVersion: 2, Cipher: "aes-xts-plain64", KeySize: 256,
+				LoopDevice: "/dev/loop3", SparseFilePath: "/var/lib/vml/vol2.img", SectorSize: 4096,
+				DataOffset: 32768 * 512, Size: 2064384 * 512, ReadOnly: true,
+			},
+			wantOk: true,
+		},
+		{
+			name: "LUKS2 with integrity",
+			output: `/dev/mapper/vol3 is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 768 bits
+  key location: keyring
+  integrity: hmac(sha256)
+  integrity keysize: 256 bits
+  device:  /dev/mapper/vol3_dif
+  sector size:  512
+  offset:  0 sectors
+  size:    1881360 sectors
+  mode:    read/write
+`,
+			want: VolumeStatus{
+				Active: true, Type: "LUKS2", LUKSVersion: 2, Cipher: "aes-xts-plain64", KeySize: 768,
+				Integrity: "hmac(sha256)", LoopDevice: "/dev/mapper/vol3_dif", SectorSize: 512,
+				Size: 1881360 * 512,
+			},
+			wantOk: true,
+		},
+		{
+			name: "plain",
+			output: `/dev/mapper/plain is active.
+  type:    PLAIN
+  cipher:  aes-cbc-essiv:sha256
+  keysize: 256 bits
+  device:  /dev/sdb
+  offset:  0 sectors
+  size:    2048 sectors
+  mode:    read/write
+`,
+			want: VolumeStatus{
+				Active: true, Type: "PLAIN", Cipher: "aes-cbc-essiv:sha256", KeySize: 256,
+				LoopDevice: "/dev/sdb", Size: 2048 * 512,
+			},
+			wantOk: true,
+		},
+		{
+			name:   "inactive",
+			output: "/dev/mapper/vol1 is inactive.\n",
+			wantOk: true,
+		},
+		{
+			name:   "unknown device",
+			output: "Device vol1 not found\n",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got VolumeStatus
+			if ok := parseCryptsetupStatus(tt.output, &got); ok != tt.wantOk {
+				t.Fatalf("parseCryptsetupStatus() = %v, want %v", ok, tt.wantOk)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCryptsetupStatus() status = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSectors(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint64
+	}{
+		{"0 sectors", 0},
+		{"4096 sectors", 4096 * 512},
+		{"18014398509481983 sectors", 18014398509481983 * 512},
+		{"4096", 4096 * 512},
+		{"", 0},
+		{"-1 sectors", 0},
+		{"many sectors", 0},
+	}
+	for _, tt := range tests {
+		if got := parseSectors(tt.value); got != tt.want {
+			t.Errorf("parseSectors(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/common/v4/crypt"
+	"io"
+)
+
+// ErrCorruptedStream is returned when an encrypted stream is truncated, reordered or modified
+// after its first chunk was decrypted.
+var ErrCorruptedStream = errors.New("encrypted stream truncated or corrupted")
+
+// EncryptionHeaderVersionV2 is the version of the chunked format read by DecryptStream. The V1
+// format of crypt.EncryptionHeaderVersion encrypts the whole image as a single AES-GCM message.
+//
+// A V2 stream starts with the crypt.EncryptionHeader, followed by the plaintext size of the
+// chunks as a little endian uint32, OffsetInLittleEndian pointing past it. The first 7 bytes of
+// the IV are a random nonce prefix, the other 5 bytes are zero. Each chunk is sealed with
+// AES-256-GCM, with the header as additional data and a nonce made of the prefix, the big endian
+// index of the chunk and a byte set to 1 for the last chunk only. Every chunk but the last one
+// holds exactly the chunk size, the last one may be empty.
+const EncryptionHeaderVersionV2 = "V2"
+
+const (
+	// plaintext size of the chunks of the V2 streams written by the library
+	streamChunkSize = 64 * 1024
+	// largest chunk accepted, bounding the memory used to decrypt a stream
+	maxStreamChunkSize    = 16 * 1024 * 1024
+	streamNoncePrefixSize = 7
+)
+
+// DecryptStream is used to decrypt an encrypted image from r to w with the key, without holding
+// the image in memory.
+//
+// Input Parameters:
+//
+// 	r – The encrypted image, in the V2 chunked format or the V1 format of Decrypt.
+//
+// 	w – The writer receiving the decrypted image.
+//
+// 	key – The AES-256 key used to encrypt the image.
+//
+// An error of kind ErrInvalidKey is returned when the key is not of the size the encryption
+// algorithm of the header uses.
+//
+// V2 images are decrypted a chunk at a time, each chunk being written once it is authenticated.
+// An error of kind ErrWrongKey is returned when the first chunk does not decrypt, and
+// ErrCorruptedStream when a later chunk does not, e.g. because the image was truncated or its
+// chunks reordered. The data already written to w must be discarded on error.
+//
+// V1 images are a single AES-GCM message that can only be authenticated as a whole. They are
+// decrypted as they are read, in constant memory, but the tag is only checked once the whole
+// image was read: the plaintext written to w is not authenticated until DecryptStream returns
+// nil. It must be written to a temporary file, renamed or used only once DecryptStream succeeds.
+func DecryptStream(r io.Reader, w io.Writer, key []byte) error {
+	return DecryptStreamContext(context.Background(), r, w, key)
+}
+
+// DecryptStreamContext is used to decrypt the image like DecryptStream, returning an error
+// wrapping ctx.Err() when ctx is done before the last chunk is decrypted.
+func DecryptStreamContext(ctx context.Context, r io.Reader, w io.Writer, key []byte) error {
+	header, rawHeader, err := readStreamHeader(r)
+	if err != nil {
+		return &VolumeError{Op: "decrypt", Err: err}
+	}
+
+	block, err := newDecryptionBlock(header, key)
+	if err != nil {
+		return err
+	}
+	if header.Version != EncryptionHeaderVersionV2 {
+		return decryptV1(ctx, r, w, block, header)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("error while creating a cipher block: %s", err.Error())
+	}
+	return decryptV2(ctx, r, w, gcm, header, rawHeader)
+}
+
+// EncryptStream is used to encrypt an image from r to w with the key in the V2 chunked format,
+// without holding the image in memory. The image is decrypted by DecryptStream.
+//
+// Input Parameters:
+//
+// 	r – The image to encrypt.
+//
+// 	w – The writer receiving the encrypted image.
+//
+// 	key – The AES-256 key, 32 bytes.
+//
+// A fresh random nonce prefix is used for every image.
+func EncryptStream(r io.Reader, w io.Writer, key []byte) error {
+	return EncryptStreamContext(context.Background(), r, w, key)
+}
+
+// EncryptStreamContext is used to encrypt the image like EncryptStream, returning an error
+// wrapping ctx.Err() when ctx is done before the last chunk is encrypted.
+func EncryptStreamContext(ctx context.Context, r io.Reader, w io.Writer, key []byte) error {
+	gcm, err := newGCM256(key)
+	if err != nil {
+		return err
+	}
+	prefix, err := crypt.GetRandomBytes(streamNoncePrefixSize)
+	if err != nil {
+		return &VolumeError{Op: "encrypt", Err: err}
+	}
+
+	header := newEncryptionHeader(EncryptionHeaderVersionV2, encryptionHeaderSizeV2)
+	copy(header.IV[:], prefix)
+	rawHeader := marshalEncryptionHeader(header)
+	rawHeader = append(rawHeader, make([]byte, encryptionHeaderSizeV2-encryptionHeaderSize)...)
+	binary.LittleEndian.PutUint32(rawHeader[encryptionHeaderSize:], streamChunkSize)
+	if _, err = w.Write(rawHeader); err != nil {
+		return &VolumeError{Op: "encrypt", Err: err}
+	}
+
+	// like the decryption, one byte is read past each chunk to tell whether it is the last one
+	buf := make([]byte, streamChunkSize+1)
+	sealed := make([]byte, 0, streamChunkSize+gcm.Overhead())
+	filled, err := io.ReadFull(r, buf)
+	for index := uint32(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return &VolumeError{Op: "encrypt", Err: err}
+		}
+		if err = ctx.Err(); err != nil {
+			return &VolumeError{Op: "encrypt", Err: err}
+		}
+
+		last := filled <= streamChunkSize
+		size := filled
+		if !last {
+			size = streamChunkSize
+		}
+		sealed = gcm.Seal(sealed[:0], streamNonce(header.IV[:], index, last), buf[:size], rawHeader)
+		if _, err = w.Write(sealed); err != nil {
+			return &VolumeError{Op: "encrypt", Err: err}
+		}
+		if last {
+			return nil
+		}
+		if index == ^uint32(0) {
+			return &VolumeError{Op: "encrypt", Err: errors.New("image too large")}
+		}
+
+		buf[0] = buf[streamChunkSize]
+		filled, err = io.ReadFull(r, buf[1:])
+		filled++
+	}
+}
+
+// newGCM256 returns the AES-256-GCM cipher of the key used by the encryption.
+func newGCM256(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, &VolumeError{Op: "encrypt", Kind: ErrInvalidKey, Err: fmt.Errorf("%s needs a 256 bit key", crypt.GCMEncryptionAlgorithm)}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, &VolumeError{Op: "encrypt", Kind: ErrInvalidKey, Err: fmt.Errorf("error while creating the cipher: %w", err)}
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating a cipher block: %s", err.Error())
+	}
+	return gcm, nil
+}
+
+// readStreamHeader reads the encryption header and the bytes up to the encrypted data, checked
+// by ParseEncryptionHeader. The raw header returned is the additional data of the V2 chunks.
+func readStreamHeader(r io.Reader) (*EncryptionHeader, []byte, error) {
+	rawHeader := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(r, rawHeader)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("error reading the encryption header: %w", err)
+	}
+	rawHeader = rawHeader[:n]
+
+	// the offset is bounded before the rest of the header is read, it is checked by the parsing
+	if n == encryptionHeaderSize {
+		offset := binary.LittleEndian.Uint32(rawHeader[12:16])
+		if offset > encryptionHeaderSize && offset <= maxEncryptionHeaderSize {
+			rawHeader = append(rawHeader, make([]byte, offset-encryptionHeaderSize)...)
+			n, err = io.ReadFull(r, rawHeader[encryptionHeaderSize:])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, nil, fmt.Errorf("error reading the encryption header: %w", err)
+			}
+			rawHeader = rawHeader[:encryptionHeaderSize+n]
+		}
+	}
+
+	header, err := ParseEncryptionHeader(rawHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, rawHeader, nil
+}
+
+// newDecryptionBlock returns the block cipher of the header algorithm, once the key size is
+// checked.
+func newDecryptionBlock(header *EncryptionHeader, key []byte) (cipher.Block, error) {
+	if len(key) != header.KeySize {
+		return nil, &VolumeError{Op: "decrypt", Kind: ErrInvalidKey, Err: fmt.Errorf("%s needs a %d bit key", header.Algorithm, header.KeySize*8)}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, &VolumeError{Op: "decrypt", Kind: ErrInvalidKey, Err: fmt.Errorf("error while creating the cipher: %w", err)}
+	}
+	return block, nil
+}
+
+// decryptV1 decrypts the single AES-GCM message of a V1 image as it is read, holding back the
+// last bytes read until the next read tells whether they are the tag.
+func decryptV1(ctx context.Context, r io.Reader, w io.Writer, block cipher.Block, header *EncryptionHeader) error {
+	opener := newGCMStreamOpener(block, header.IV[:])
+	buf := make([]byte, streamChunkSize+gcmTagSize)
+	held := 0
+	for {
+		n, err := io.ReadFull(r, buf[held:])
+		held += n
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return &VolumeError{Op: "decrypt", Err: err}
+		}
+		if err = ctx.Err(); err != nil {
+			return &VolumeError{Op: "decrypt", Err: err}
+		}
+
+		if size := held - gcmTagSize; size > 0 {
+			if err = opener.decrypt(buf[:size], buf[:size]); err != nil {
+				return &VolumeError{Op: "decrypt", Kind: ErrCorruptedStream, Err: err}
+			}
+			if _, err = w.Write(buf[:size]); err != nil {
+				return &VolumeError{Op: "decrypt", Err: err}
+			}
+			held = copy(buf, buf[size:held])
+		}
+		if eof {
+			break
+		}
+	}
+
+	if held < gcmTagSize || !opener.check(buf[:held]) {
+		return &VolumeError{Op: "decrypt", Kind: ErrWrongKey, Err: errors.New("error while decrypting the file: message authentication failed")}
+	}
+	return nil
+}
+
+// decryptV2 decrypts the chunks of a V2 image, reading one byte past each chunk to tell whether
+// it is the last one.
+func decryptV2(ctx context.Context, r io.Reader, w io.Writer, gcm cipher.AEAD, header *EncryptionHeader, rawHeader []byte) error {
+	sealedSize := int(header.ChunkSize) + gcm.Overhead()
+	buf := make([]byte, sealedSize+1)
+	filled, err := io.ReadFull(r, buf)
+	for index := uint32(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return &VolumeError{Op: "decrypt", Err: err}
+		}
+		if err = ctx.Err(); err != nil {
+			return &VolumeError{Op: "decrypt", Err: err}
+		}
+
+		last := filled <= sealedSize
+		size := filled
+		if !last {
+			size = sealedSize
+		}
+		if size < gcm.Overhead() {
+			return &VolumeError{Op: "decrypt", Kind: ErrCorruptedStream, Err: fmt.Errorf("chunk %d is truncated", index)}
+		}
+		var plaintext []byte
+		plaintext, err = gcm.Open(buf[:0], streamNonce(header.IV[:], index, last), buf[:size], rawHeader)
+		if err != nil {
+			if index == 0 {
+				return &VolumeError{Op: "decrypt", Kind: ErrWrongKey, Err: fmt.Errorf("error while decrypting the first chunk: %w", err)}
+			}
+			return &VolumeError{Op: "decrypt", Kind: ErrCorruptedStream, Err: fmt.Errorf("error while decrypting chunk %d: %w", index, err)}
+		}
+		if _, err = w.Write(plaintext); err != nil {
+			return &VolumeError{Op: "decrypt", Err: err}
+		}
+		if last {
+			return nil
+		}
+		if index == ^uint32(0) {
+			return &VolumeError{Op: "decrypt", Kind: ErrCorruptedStream, Err: errors.New("too many chunks")}
+		}
+
+		// the byte read past the chunk starts the next one
+		buf[0] = buf[sealedSize]
+		filled, err = io.ReadFull(r, buf[1:])
+		filled++
+	}
+}
+
+// streamNonce returns the nonce of a V2 chunk.
+func streamNonce(iv []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, iv[:streamNoncePrefixSize])
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
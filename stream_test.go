@@ -0,0 +1,299 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/common/v4/crypt"
+	"testing"
+)
+
+const (
+	// size of the authentication tag of an AES-GCM message
+	testTagSize = 16
+	// size of a sealed V2 chunk of the library
+	testSealedChunkSize = streamChunkSize + testTagSize
+)
+
+func testKey(seed byte) []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = seed + byte(i)
+	}
+	return key
+}
+
+func testImage(size int) []byte {
+	image := make([]byte, size)
+	for i := range image {
+		image[i] = byte(i*31 + i/251)
+	}
+	return image
+}
+
+func testGCM(t *testing.T, key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gcm
+}
+
+// testHeader returns the encryption header of an image as laid out by crypt.EncryptionHeader,
+// followed by extra bytes up to the data offset.
+func testHeader(version string, iv []byte, extra []byte) []byte {
+	header := make([]byte, encryptionHeaderSize, encryptionHeaderSize+len(extra))
+	copy(header[0:12], crypt.EncryptionHeaderMagicText)
+	binary.LittleEndian.PutUint32(header[12:16], uint32(encryptionHeaderSize+len(extra)))
+	copy(header[16:20], version)
+	copy(header[20:32], iv)
+	copy(header[32:44], crypt.GCMEncryptionAlgorithm)
+	return append(header, extra...)
+}
+
+// sealV1 returns a V1 image of the plaintext, a single AES-GCM message after the header.
+func sealV1(t *testing.T, plaintext, key []byte) []byte {
+	iv := []byte("unique nonce")
+	return testGCM(t, key).Seal(testHeader(crypt.EncryptionHeaderVersion, iv, nil), iv, plaintext, nil)
+}
+
+// sealV2 returns a V2 image of the plaintext in chunks of streamChunkSize, as the format is
+// documented on EncryptionHeaderVersionV2. A full last chunk is not followed by an empty one.
+func sealV2(t *testing.T, plaintext, key []byte) []byte {
+	gcm := testGCM(t, key)
+	chunkSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(chunkSize, streamChunkSize)
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0}
+	header := testHeader(EncryptionHeaderVersionV2, iv, chunkSize)
+
+	sealed := append([]byte(nil), header...)
+	for index := uint32(0); ; index++ {
+		chunk := plaintext
+		if len(chunk) > streamChunkSize {
+			chunk = chunk[:streamChunkSize]
+		}
+		plaintext = plaintext[len(chunk):]
+		last := len(plaintext) == 0
+		sealed = gcm.Seal(sealed, streamNonce(iv, index, last), chunk, header)
+		if last {
+			return sealed
+		}
+	}
+}
+
+func encryptStream(t *testing.T, image, key []byte) []byte {
+	var encrypted bytes.Buffer
+	if err := EncryptStream(bytes.NewReader(image), &encrypted, key); err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	return encrypted.Bytes()
+}
+
+// splitChunks splits a V2 image of the library in its header and sealed chunks.
+func splitChunks(encrypted []byte) ([]byte, [][]byte) {
+	header, data := encrypted[:encryptionHeaderSizeV2], encrypted[encryptionHeaderSizeV2:]
+	var chunks [][]byte
+	for len(data) > testSealedChunkSize {
+		chunks = append(chunks, data[:testSealedChunkSize])
+		data = data[testSealedChunkSize:]
+	}
+	return header, append(chunks, data)
+}
+
+func joinChunks(header []byte, chunks ...[]byte) []byte {
+	joined := append([]byte(nil), header...)
+	for _, chunk := range chunks {
+		joined = append(joined, chunk...)
+	}
+	return joined
+}
+
+func TestStreamV2(t *testing.T) {
+	key := testKey(1)
+	sizes := []int{0, 1, 15, 17, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize, 3*streamChunkSize + 5}
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			image := testImage(size)
+			var decrypted bytes.Buffer
+			encrypted := sealV2(t, image, key)
+			if err := DecryptStream(bytes.NewReader(encrypted), &decrypted, key); err != nil {
+				t.Fatalf("DecryptStream failed: %v", err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), image) {
+				t.Fatal("decrypted image differs")
+			}
+			plaintext, err := Decrypt(encrypted, key)
+			if err != nil || !bytes.Equal(plaintext, image) {
+				t.Fatalf("Decrypt returned %d bytes, %v", len(plaintext), err)
+			}
+		})
+	}
+}
+
+func TestEncryptStream(t *testing.T) {
+	key := testKey(1)
+	sizes := []int{0, 1, 15, 17, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize, 3*streamChunkSize + 5}
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			image := testImage(size)
+			encrypted := encryptStream(t, image, key)
+
+			// the header is the one of sealV2 but for the random nonce prefix
+			want := sealV2(t, image, key)
+			if !bytes.Equal(encrypted[:20], want[:20]) || !bytes.Equal(encrypted[27:encryptionHeaderSizeV2], want[27:encryptionHeaderSizeV2]) {
+				t.Fatalf("got header %x, want %x", encrypted[:encryptionHeaderSizeV2], want[:encryptionHeaderSizeV2])
+			}
+			// a full last chunk is not followed by an empty one
+			if len(encrypted) != len(want) {
+				t.Fatalf("encrypted to %d bytes, want %d", len(encrypted), len(want))
+			}
+
+			var decrypted bytes.Buffer
+			if err := DecryptStream(bytes.NewReader(encrypted), &decrypted, key); err != nil {
+				t.Fatalf("DecryptStream failed: %v", err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), image) {
+				t.Fatal("decrypted image differs")
+			}
+		})
+	}
+}
+
+func TestStreamV2Corrupted(t *testing.T) {
+	key := testKey(1)
+	encrypted := sealV2(t, testImage(3*streamChunkSize+5), key)
+	header, chunks := splitChunks(encrypted)
+	if len(chunks) != 4 {
+		t.Fatalf("got %d chunks, want 4", len(chunks))
+	}
+	flipped := func(data []byte, i int) []byte {
+		data = append([]byte(nil), data...)
+		data[i] ^= 1
+		return data
+	}
+	// a V2 image of a single chunk
+	_, single := splitChunks(sealV2(t, testImage(10), key))
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+		key       []byte
+		wantErr   error
+	}{
+		{name: "wrong key", encrypted: encrypted, key: testKey(2), wantErr: ErrWrongKey},
+		{name: "short key", encrypted: encrypted, key: key[:16], wantErr: ErrInvalidKey},
+		{name: "last chunk dropped", encrypted: joinChunks(header, chunks[:3]...), key: key, wantErr: ErrCorruptedStream},
+		{name: "truncated in a chunk", encrypted: encrypted[:len(encrypted)-100], key: key, wantErr: ErrCorruptedStream},
+		{name: "truncated to a tag", encrypted: joinChunks(header, chunks[0], chunks[1][:testTagSize-1]), key: key, wantErr: ErrCorruptedStream},
+		{name: "chunks reordered", encrypted: joinChunks(header, chunks[0], chunks[2], chunks[1], chunks[3]), key: key, wantErr: ErrCorruptedStream},
+		{name: "chunk repeated", encrypted: joinChunks(header, chunks[0], chunks[1], chunks[1], chunks[3]), key: key, wantErr: ErrCorruptedStream},
+		{name: "first chunks swapped", encrypted: joinChunks(header, chunks[1], chunks[0], chunks[2], chunks[3]), key: key, wantErr: ErrWrongKey},
+		{name: "chunk modified", encrypted: joinChunks(header, chunks[0], flipped(chunks[1], 7), chunks[2], chunks[3]), key: key, wantErr: ErrCorruptedStream},
+		{name: "data appended", encrypted: append(append([]byte(nil), encrypted...), 0), key: key, wantErr: ErrCorruptedStream},
+		{name: "chunk appended", encrypted: joinChunks(header, chunks[0], chunks[1], chunks[2], chunks[3], single[0]), key: key, wantErr: ErrCorruptedStream},
+		{name: "header modified", encrypted: joinChunks(flipped(header, 20), chunks...), key: key, wantErr: ErrWrongKey},
+		{name: "no chunk", encrypted: header, key: key, wantErr: ErrCorruptedStream},
+		{name: "header truncated", encrypted: header[:encryptionHeaderSizeV2-1], key: key, wantErr: ErrHeaderTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DecryptStream(bytes.NewReader(tt.encrypted), &bytes.Buffer{}, tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if _, err = Decrypt(tt.encrypted, tt.key); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decrypt returned %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamV1(t *testing.T) {
+	key := testKey(3)
+	sizes := []int{0, 1, 15, 16, 17, 33, streamChunkSize - 1, streamChunkSize, streamChunkSize + testTagSize, streamChunkSize + testTagSize + 1, 200001}
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			image := testImage(size)
+			encrypted := sealV1(t, image, key)
+
+			var decrypted bytes.Buffer
+			if err := DecryptStream(bytes.NewReader(encrypted), &decrypted, key); err != nil {
+				t.Fatalf("DecryptStream failed: %v", err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), image) {
+				t.Fatal("decrypted image differs")
+			}
+
+			// the tag covers every byte of the message
+			for _, i := range []int{encryptionHeaderSize, len(encrypted) / 2, len(encrypted) - 1} {
+				if i < encryptionHeaderSize {
+					continue
+				}
+				tampered := append([]byte(nil), encrypted...)
+				tampered[i] ^= 0x80
+				if err := DecryptStream(bytes.NewReader(tampered), &bytes.Buffer{}, key); !errors.Is(err, ErrWrongKey) {
+					t.Fatalf("byte %d modified: got error %v, want %v", i, err, ErrWrongKey)
+				}
+			}
+			if err := DecryptStream(bytes.NewReader(encrypted[:len(encrypted)-1]), &bytes.Buffer{}, key); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("truncated: got error %v, want %v", err, ErrWrongKey)
+			}
+			if err := DecryptStream(bytes.NewReader(append(append([]byte(nil), encrypted...), 0)), &bytes.Buffer{}, key); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("byte appended: got error %v, want %v", err, ErrWrongKey)
+			}
+			if err := DecryptStream(bytes.NewReader(encrypted), &bytes.Buffer{}, testKey(4)); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("wrong key: got error %v, want %v", err, ErrWrongKey)
+			}
+		})
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	key := testKey(1)
+	image := testImage(2 * streamChunkSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := EncryptStreamContext(ctx, bytes.NewReader(image), &bytes.Buffer{}, key); !errors.Is(err, context.Canceled) {
+		t.Fatalf("EncryptStreamContext returned %v, want %v", err, context.Canceled)
+	}
+	for name, encrypted := range map[string][]byte{"V1": sealV1(t, image, key), "V2": sealV2(t, image, key)} {
+		if err := DecryptStreamContext(ctx, bytes.NewReader(encrypted), &bytes.Buffer{}, key); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: DecryptStreamContext returned %v, want %v", name, err, context.Canceled)
+		}
+		if _, err := DecryptContext(ctx, encrypted, key); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: DecryptContext returned %v, want %v", name, err, context.Canceled)
+		}
+	}
+}
+
+func TestStreamNonce(t *testing.T) {
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0}
+	tests := []struct {
+		index uint32
+		last  bool
+		want  []byte
+	}{
+		{index: 0, want: []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0}},
+		{index: 0, last: true, want: []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 1}},
+		{index: 0x01020304, want: []byte{1, 2, 3, 4, 5, 6, 7, 1, 2, 3, 4, 0}},
+		{index: 0xffffffff, last: true, want: []byte{1, 2, 3, 4, 5, 6, 7, 0xff, 0xff, 0xff, 0xff, 1}},
+	}
+	for _, tt := range tests {
+		if got := streamNonce(iv, tt.index, tt.last); !bytes.Equal(got, tt.want) {
+			t.Errorf("chunk %d, last %v: got nonce %x, want %x", tt.index, tt.last, got, tt.want)
+		}
+	}
+}
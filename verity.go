@@ -0,0 +1,331 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/vml/v4/dm"
+	"intel/isecl/lib/vml/v4/loop"
+	"intel/isecl/lib/vml/v4/verity"
+	"os"
+	"strings"
+)
+
+// ErrVerityMismatch is returned when the hash tree of a verity volume does not match the root
+// hash, or the signature of the root hash does not verify.
+var ErrVerityMismatch = errors.New("dm-verity verification failed")
+
+// prefix of the device-mapper UUID of the verity volumes, followed by the UUID of the hash tree
+// without dashes and the mapping name, like veritysetup
+const verityUUIDPrefix = "CRYPT-VERITY-"
+
+// VerityVolume describes the dm-verity hash tree built by CreateVerityVolume. RootHash is in hex,
+// as given to OpenVerityVolume and veritysetup.
+type VerityVolume struct {
+	DataFile string        `json:"data_file"`
+	HashFile string        `json:"hash_file"`
+	RootHash string        `json:"root_hash"`
+	Params   verity.Params `json:"params"`
+}
+
+// VerityOptions are the settings used by OpenVerityVolumeWithOptions.
+type VerityOptions struct {
+	// RootHashSignature is the signature of the root hash, verified with Certificate before the
+	// volume is opened, see verity.VerifySignature.
+	RootHashSignature []byte
+	Certificate       *x509.Certificate
+}
+
+// CreateVerityVolume is used to build the dm-verity hash tree of a read-only image.
+//
+// Input Parameters:
+//
+// 	dataFile – Absolute path of the image, whose size is a multiple of 4096 bytes.
+//
+// 	hashFile – Absolute path of the hash tree file, created or overwritten.
+//
+// The hash tree is in the format of veritysetup, with a random salt. The returned root hash is
+// the only value needed to open the volume, the other parameters are read from the hash file.
+// The whole image is read, which takes time proportional to its size.
+func CreateVerityVolume(dataFile, hashFile string) (*VerityVolume, error) {
+	return DefaultManager.CreateVerityVolume(dataFile, hashFile)
+}
+
+// CreateVerityVolumeWithOptions is used to build the dm-verity hash tree like
+// CreateVerityVolume, with the given hash algorithm, block sizes, salt or UUID.
+func CreateVerityVolumeWithOptions(dataFile, hashFile string, opts verity.FormatOptions) (*VerityVolume, error) {
+	return DefaultManager.CreateVerityVolumeWithOptions(dataFile, hashFile, opts)
+}
+
+// OpenVerityVolume is used to open a read-only image checked against its dm-verity hash tree.
+//
+// Input Parameters:
+//
+// 	dataFile – Absolute path of the image.
+//
+// 	hashFile – Absolute path of the hash tree file built by CreateVerityVolume.
+//
+// 	rootHash – Root hash of the hash tree in hex, e.g. from the manifest of the instance.
+//
+// 	mapperName – Name of the device-mapper device, opened at /dev/mapper/<mapperName>.
+//
+// Both files are attached to read-only loop devices. An error of kind ErrVerityMismatch is
+// returned when the root hash does not match the hash tree. Once the volume is open, the kernel
+// checks every block as it is read and fails the reads of the modified ones with an I/O error.
+// The path of the opened volume is returned.
+func OpenVerityVolume(dataFile, hashFile, rootHash, mapperName string) (string, error) {
+	return DefaultManager.OpenVerityVolume(dataFile, hashFile, rootHash, mapperName)
+}
+
+// OpenVerityVolumeWithOptions is used to open the dm-verity volume like OpenVerityVolume, after
+// verifying the signature of the root hash when one is given.
+func OpenVerityVolumeWithOptions(dataFile, hashFile, rootHash, mapperName string, opts VerityOptions) (string, error) {
+	return DefaultManager.OpenVerityVolumeWithOptions(dataFile, hashFile, rootHash, mapperName, opts)
+}
+
+// CloseVerityVolume is used to close a dm-verity volume opened by OpenVerityVolume and detach
+// the loop devices of its data and hash files. The devices of a volume that are not loop
+// devices, e.g. partitions given to veritysetup, are left as they are.
+func CloseVerityVolume(mapperName string) error {
+	return DefaultManager.CloseVerityVolume(mapperName)
+}
+
+// CreateVerityVolume builds the hash tree like the package level CreateVerityVolume.
+func (m *Manager) CreateVerityVolume(dataFile, hashFile string) (*VerityVolume, error) {
+	return m.CreateVerityVolumeWithOptions(dataFile, hashFile, verity.FormatOptions{})
+}
+
+// CreateVerityVolumeWithOptions builds the hash tree like the package level
+// CreateVerityVolumeWithOptions.
+func (m *Manager) CreateVerityVolumeWithOptions(dataFile, hashFile string, opts verity.FormatOptions) (*VerityVolume, error) {
+	if len(strings.TrimSpace(dataFile)) <= 0 {
+		return nil, errors.New("data file path not given")
+	}
+	if len(strings.TrimSpace(hashFile)) <= 0 {
+		return nil, errors.New("hash file path not given")
+	}
+
+	// the image must not change while it is hashed
+	unlock, err := m.lockVolume(context.Background(), dataFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	params, rootHash, err := verity.FormatFile(dataFile, hashFile, opts)
+	if err != nil {
+		volumeErr := &VolumeError{Op: "verityFormat", Path: dataFile, Err: err}
+		if os.IsNotExist(err) {
+			volumeErr.Kind = ErrNotFound
+		}
+		return nil, volumeErr
+	}
+	return &VerityVolume{DataFile: dataFile, HashFile: hashFile, RootHash: hex.EncodeToString(rootHash), Params: *params}, nil
+}
+
+// OpenVerityVolume opens the dm-verity volume like the package level OpenVerityVolume.
+func (m *Manager) OpenVerityVolume(dataFile, hashFile, rootHash, mapperName string) (string, error) {
+	return m.OpenVerityVolumeWithOptions(dataFile, hashFile, rootHash, mapperName, VerityOptions{})
+}
+
+// OpenVerityVolumeWithOptions opens the dm-verity volume like the package level
+// OpenVerityVolumeWithOptions.
+//
+// When a step fails, the loop devices attached by this call are detached again.
+func (m *Manager) OpenVerityVolumeWithOptions(dataFile, hashFile, rootHash, mapperName string, opts VerityOptions) (location string, err error) {
+	if len(strings.TrimSpace(dataFile)) <= 0 {
+		return "", errors.New("data file path not given")
+	}
+	if len(strings.TrimSpace(hashFile)) <= 0 {
+		return "", errors.New("hash file path not given")
+	}
+	if len(strings.TrimSpace(mapperName)) <= 0 {
+		return "", errors.New("mapper name not given")
+	}
+	root, err := hex.DecodeString(rootHash)
+	if err != nil || len(root) == 0 {
+		return "", errors.New("invalid format for the root hash")
+	}
+	location = dm.DevicePath(mapperName)
+
+	if opts.RootHashSignature != nil {
+		if err = verity.VerifySignature(root, opts.RootHashSignature, opts.Certificate); err != nil {
+			volumeErr := &VolumeError{Op: "verityOpen", Path: dataFile, Err: err}
+			if errors.Is(err, verity.ErrInvalidSignature) {
+				volumeErr.Kind = ErrVerityMismatch
+			}
+			return "", volumeErr
+		}
+	}
+
+	ctx := context.Background()
+	unlock, err := m.lockVolume(ctx, dataFile, location, "")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, err = os.Stat(location); !os.IsNotExist(err) {
+		return "", &VolumeError{Op: "verityOpen", Path: location, Kind: ErrAlreadyExists}
+	}
+
+	params, err := checkVerityRootHash(dataFile, hashFile, root)
+	if err != nil {
+		return "", err
+	}
+
+	// the rollback runs before the locks are released
+	undo := &rollback{}
+	defer func() {
+		if err != nil {
+			err = undo.run(err)
+		}
+	}()
+
+	dataLoop, err := m.attachReadOnly(ctx, dataFile, undo)
+	if err != nil {
+		return "", err
+	}
+	hashLoop, err := m.attachReadOnly(ctx, hashFile, undo)
+	if err != nil {
+		return "", err
+	}
+
+	target := params.Target(dataLoop, hashLoop, root)
+	uuid := verityUUIDPrefix + strings.Replace(params.UUID, "-", "", -1) + "-" + mapperName
+	if _, err = dm.Create(mapperName, []dm.Target{target}, dm.Options{UUID: uuid, ReadOnly: true}); err != nil {
+		return "", dmError("verityOpen", location, err)
+	}
+	return location, nil
+}
+
+// CloseVerityVolume closes the dm-verity volume like the package level CloseVerityVolume.
+func (m *Manager) CloseVerityVolume(mapperName string) error {
+	if len(strings.TrimSpace(mapperName)) <= 0 {
+		return errors.New("mapper name not given")
+	}
+	location := dm.DevicePath(mapperName)
+
+	ctx := context.Background()
+	unlock, err := m.lockVolume(ctx, "", location, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	targets, err := dm.GetTable(mapperName)
+	if err != nil {
+		return dmError("verityClose", location, err)
+	}
+	// <version> <dev> <hash_dev> ...
+	var params []string
+	if len(targets) == 1 && targets[0].Type == "verity" {
+		params = strings.Fields(targets[0].Params)
+	}
+	if len(params) < 3 {
+		return &VolumeError{Op: "verityClose", Path: location, Err: errors.New("not a dm-verity volume")}
+	}
+
+	if err = dm.Remove(mapperName); err != nil {
+		return dmError("verityClose", location, err)
+	}
+
+	unlockLoop, err := m.lock(ctx, loopLockName)
+	if err != nil {
+		return err
+	}
+	defer unlockLoop()
+
+	devices := []string{tableDevicePath(params[1])}
+	// veritysetup can keep the hash tree on the data device
+	if params[2] != params[1] {
+		devices = append(devices, tableDevicePath(params[2]))
+	}
+	for _, device := range devices {
+		// a volume opened by veritysetup may sit on partitions rather than loop devices
+		if _, err = m.loop().BackingFile(device); errors.Is(err, loop.ErrNotLoopDevice) {
+			continue
+		} else if err != nil {
+			return &VolumeError{Op: "detach", Path: device, Err: err}
+		}
+		if err = m.loop().Detach(device); err != nil {
+			return &VolumeError{Op: "detach", Path: device, Err: err}
+		}
+	}
+	return nil
+}
+
+// checkVerityRootHash reads the hash tree parameters from the hash file and checks the root hash
+// against the top of the tree.
+func checkVerityRootHash(dataFile, hashFile string, rootHash []byte) (*verity.Params, error) {
+	data, err := os.Open(dataFile)
+	if err != nil {
+		return nil, verityError(dataFile, err)
+	}
+	defer data.Close()
+	hashes, err := os.Open(hashFile)
+	if err != nil {
+		return nil, verityError(hashFile, err)
+	}
+	defer hashes.Close()
+
+	params, err := verity.ReadParams(hashes)
+	if err != nil {
+		return nil, verityError(hashFile, err)
+	}
+	if len(rootHash) != params.DigestSize() {
+		return nil, &VolumeError{Op: "verityOpen", Path: dataFile, Kind: ErrVerityMismatch,
+			Err: fmt.Errorf("root hash is %d bytes, %s digests are %d bytes", len(rootHash), params.Algorithm, params.DigestSize())}
+	}
+	info, err := data.Stat()
+	if err != nil {
+		return nil, verityError(dataFile, err)
+	}
+	if uint64(info.Size()) < params.DataBlocks*uint64(params.DataBlockSize) {
+		return nil, &VolumeError{Op: "verityOpen", Path: dataFile, Kind: ErrSizeMismatch,
+			Err: fmt.Errorf("data file is smaller than the %d blocks of the hash tree", params.DataBlocks)}
+	}
+	if err = params.CheckRootHash(data, hashes, rootHash); err != nil {
+		return nil, verityError(dataFile, err)
+	}
+	return params, nil
+}
+
+// attachReadOnly attaches the file to a free read-only loop device, registered with undo.
+func (m *Manager) attachReadOnly(ctx context.Context, path string, undo *rollback) (string, error) {
+	unlockLoop, err := m.lock(ctx, loopLockName)
+	if err != nil {
+		return "", err
+	}
+	defer unlockLoop()
+
+	device, err := m.loop().Attach(path, loop.Options{ReadOnly: true})
+	if err != nil {
+		return "", &VolumeError{Op: "attach", Path: path, Err: err}
+	}
+	undo.add(func() error {
+		if err := m.loop().Detach(device); err != nil {
+			return &VolumeError{Op: "detach", Path: device, Err: err}
+		}
+		return nil
+	})
+	return device, nil
+}
+
+// verityError wraps an error of the verity package in a VolumeError of the matching kind.
+func verityError(path string, err error) error {
+	volumeErr := &VolumeError{Op: "verityOpen", Path: path, Err: err}
+	switch {
+	case os.IsNotExist(err):
+		volumeErr.Kind = ErrNotFound
+	case errors.Is(err, verity.ErrRootHashMismatch):
+		volumeErr.Kind, volumeErr.Err = ErrVerityMismatch, nil
+	}
+	return volumeErr
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package verity
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/common/v4/crypt"
+)
+
+// ErrInvalidSignature is returned when the signature of a root hash does not verify.
+var ErrInvalidSignature = errors.New("invalid dm-verity root hash signature")
+
+// SignedData returns the data signed by a root hash signature, the root hash in lower case hex
+// as veritysetup signatures do.
+func SignedData(rootHash []byte) []byte {
+	return []byte(hex.EncodeToString(rootHash))
+}
+
+// VerifySignature verifies the signature of the root hash with the public key of the
+// certificate. The signature is over SignedData of the root hash, with SHA-384 and PKCS #1 v1.5
+// for an RSA key, e.g. as made by crypt.HashAndSignPKCS1v15, or with ECDSA and the hash matching
+// the curve. The certificate is expected to be trusted by the caller, it is not verified.
+func VerifySignature(rootHash, signature []byte, cert *x509.Certificate) error {
+	if cert == nil {
+		return errors.New("no certificate given to verify the root hash signature")
+	}
+	algorithm, err := crypt.GetSignatureAlgorithm(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err = cert.CheckSignature(algorithm, SignedData(rootHash), signature); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+	return nil
+}
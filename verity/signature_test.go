@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package verity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"intel/isecl/lib/common/v4/crypt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate of the key.
+func selfSigned(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "verity test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestVerifySignature(t *testing.T) {
+	rootHash := []byte{0xde, 0xad, 0xbe, 0xef}
+	otherRootHash := []byte{0xde, 0xad, 0xbe, 0xee}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSignature, err := crypt.HashAndSignPKCS1v15(SignedData(rootHash), rsaKey, crypto.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum384(SignedData(rootHash))
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		rootHash  []byte
+		signature []byte
+		cert      *x509.Certificate
+		wantErr   error
+	}{
+		{name: "RSA", rootHash: rootHash, signature: rsaSignature, cert: selfSigned(t, rsaKey)},
+		{name: "ECDSA", rootHash: rootHash, signature: ecSignature, cert: selfSigned(t, ecKey)},
+		{name: "other root hash", rootHash: otherRootHash, signature: rsaSignature, cert: selfSigned(t, rsaKey), wantErr: ErrInvalidSignature},
+		{name: "other key", rootHash: rootHash, signature: rsaSignature, cert: selfSigned(t, otherKey), wantErr: ErrInvalidSignature},
+		{name: "no signature", rootHash: rootHash, cert: selfSigned(t, rsaKey), wantErr: ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySignature(tt.rootHash, tt.signature, tt.cert)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("VerifySignature failed: %v", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err = VerifySignature(rootHash, rsaSignature, nil); err == nil {
+		t.Fatal("signature verified without a certificate")
+	}
+}
+
+func TestSignedData(t *testing.T) {
+	if got := string(SignedData([]byte{0x0a, 0xbc})); got != "0abc" {
+		t.Fatalf("got %q, want the lower case hex root hash", got)
+	}
+}
@@ -0,0 +1,514 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+// Package verity builds, reads and checks dm-verity hash trees in the on-disk format of
+// veritysetup: hash type 1 with a superblock at the start of the hash device. A hash tree built by
+// the package can be opened with veritysetup and the other way around.
+package verity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"intel/isecl/lib/vml/v4/dm"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrNoSuperblock is returned when the hash device does not start with a verity superblock.
+	ErrNoSuperblock = errors.New("no dm-verity superblock")
+	// ErrRootHashMismatch is returned when the hash tree does not match the root hash.
+	ErrRootHashMismatch = errors.New("dm-verity root hash mismatch")
+	// ErrCorrupted is returned by Verify when a data or hash block does not match the hash tree.
+	ErrCorrupted = errors.New("dm-verity hash tree does not match the data")
+)
+
+// Defaults of FormatOptions, those of veritysetup
+const (
+	DefaultAlgorithm = "sha256"
+	DefaultBlockSize = 4096
+	DefaultSaltSize  = 32
+)
+
+// HashType is the version of the hash tree format supported, the one of veritysetup.
+const HashType = 1
+
+const (
+	superblockSignature = "verity\x00\x00"
+	superblockVersion   = 1
+	superblockSize      = 512
+	maxSaltSize         = 256
+	minBlockSize        = 512
+	// the kernel limits the data blocks to the page size
+	maxBlockSize = 4096
+)
+
+// hash algorithms of the hash tree
+var algorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Params are the settings of a hash tree, as recorded in its superblock.
+type Params struct {
+	HashType      int    `json:"hash_type"`
+	UUID          string `json:"uuid"`
+	Algorithm     string `json:"algorithm"`
+	DataBlockSize uint32 `json:"data_block_size"`
+	HashBlockSize uint32 `json:"hash_block_size"`
+	DataBlocks    uint64 `json:"data_blocks"`
+	Salt          []byte `json:"salt"`
+	// HashOffset is the offset in bytes of the hash tree in the hash device, after the
+	// superblock.
+	HashOffset uint64 `json:"hash_offset"`
+}
+
+// ReadWriterAt is the hash device written by Format, which reads back the levels of the tree.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// FormatOptions are the settings of the hash tree built by Format. A zero value uses the
+// defaults.
+type FormatOptions struct {
+	// Algorithm is the hash algorithm, sha1, sha256 or sha512.
+	Algorithm string
+	// DataBlockSize and HashBlockSize are powers of two between 512 and 4096 bytes.
+	DataBlockSize uint32
+	HashBlockSize uint32
+	// Salt is prepended to every hashed block, DefaultSaltSize random bytes when nil.
+	Salt []byte
+	// UUID is recorded in the superblock, a random one is generated when empty.
+	UUID string
+}
+
+// FormatFile builds the hash tree of the data file in the hash file, created or truncated, and
+// returns its parameters and root hash. The data file is only read.
+func FormatFile(dataFile, hashFile string, opts FormatOptions) (*Params, []byte, error) {
+	data, err := os.Open(dataFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer data.Close()
+	info, err := data.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes, err := os.OpenFile(hashFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, rootHash, err := Format(data, info.Size(), hashes, opts)
+	if err == nil {
+		err = hashes.Sync()
+	}
+	if closeErr := hashes.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building the hash tree of %s: %w", dataFile, err)
+	}
+	return params, rootHash, nil
+}
+
+// Format builds the hash tree of the first size bytes of data in hashes, starting with the
+// superblock, and returns its parameters and root hash. The size is a multiple of the data block
+// size. The levels of the tree are read back from hashes to hash the next one, so that the tree
+// is never held in memory.
+func Format(data io.ReaderAt, size int64, hashes ReadWriterAt, opts FormatOptions) (*Params, []byte, error) {
+	params, err := newParams(size, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := newTree(params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	superblock, err := params.marshalSuperblock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = hashes.WriteAt(superblock, 0); err != nil {
+		return nil, nil, err
+	}
+
+	// each level hashes the blocks of the level below it, the data blocks for the lowest one
+	var src io.ReaderAt = data
+	srcOffset, srcBlocks, srcBlockSize := int64(0), params.DataBlocks, params.DataBlockSize
+	for level := 0; level < t.levels; level++ {
+		if err = t.hashLevel(src, srcOffset, srcBlocks, srcBlockSize, hashes, t.levelOffset(level)); err != nil {
+			return nil, nil, err
+		}
+		src, srcOffset, srcBlocks, srcBlockSize = hashes, t.levelOffset(level), t.levelBlocks[level], params.HashBlockSize
+	}
+
+	rootHash, err := t.rootHash(data, hashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return params, rootHash, nil
+}
+
+// ReadParams reads the parameters of the hash tree from the superblock of the hash device.
+func ReadParams(hashes io.ReaderAt) (*Params, error) {
+	superblock := make([]byte, superblockSize)
+	if _, err := hashes.ReadAt(superblock, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNoSuperblock
+		}
+		return nil, err
+	}
+	if string(superblock[:8]) != superblockSignature {
+		return nil, ErrNoSuperblock
+	}
+	le := binary.LittleEndian
+	if version := le.Uint32(superblock[8:]); version != superblockVersion {
+		return nil, fmt.Errorf("unsupported superblock version %d", version)
+	}
+
+	params := &Params{
+		HashType:      int(le.Uint32(superblock[12:])),
+		Algorithm:     strings.ToLower(string(bytes.TrimRight(superblock[32:64], "\x00"))),
+		DataBlockSize: le.Uint32(superblock[64:]),
+		HashBlockSize: le.Uint32(superblock[68:]),
+		DataBlocks:    le.Uint64(superblock[72:]),
+	}
+	uuid := hex.EncodeToString(superblock[16:32])
+	params.UUID = fmt.Sprintf("%s-%s-%s-%s-%s", uuid[0:8], uuid[8:12], uuid[12:16], uuid[16:20], uuid[20:32])
+	saltSize := int(le.Uint16(superblock[80:]))
+	if saltSize > maxSaltSize {
+		return nil, fmt.Errorf("invalid salt size %d", saltSize)
+	}
+	params.Salt = append([]byte{}, superblock[88:88+saltSize]...)
+	params.HashOffset = hashOffset(params.HashBlockSize)
+
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// CheckRootHash checks the root hash against the top of the hash tree, without reading the rest
+// of the tree. The kernel checks the other blocks as they are read.
+func (p *Params) CheckRootHash(data, hashes io.ReaderAt, rootHash []byte) error {
+	t, err := newTree(p)
+	if err != nil {
+		return err
+	}
+	computed, err := t.rootHash(data, hashes)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, rootHash) {
+		return ErrRootHashMismatch
+	}
+	return nil
+}
+
+// Verify checks every data and hash block against the root hash, like veritysetup verify. It
+// reads the whole data and returns ErrRootHashMismatch or an error wrapping ErrCorrupted naming
+// the first block that does not match.
+func (p *Params) Verify(data, hashes io.ReaderAt, rootHash []byte) error {
+	if err := p.CheckRootHash(data, hashes, rootHash); err != nil {
+		return err
+	}
+	t, err := newTree(p)
+	if err != nil {
+		return err
+	}
+
+	src, srcOffset, srcBlocks, srcBlockSize := data, int64(0), p.DataBlocks, p.DataBlockSize
+	for level := 0; level < t.levels; level++ {
+		err = t.checkLevel(src, srcOffset, srcBlocks, srcBlockSize, hashes, t.levelOffset(level))
+		if err != nil {
+			if level > 0 {
+				return fmt.Errorf("hash level %d: %w", level-1, err)
+			}
+			return fmt.Errorf("data: %w", err)
+		}
+		src, srcOffset, srcBlocks, srcBlockSize = hashes, t.levelOffset(level), t.levelBlocks[level], p.HashBlockSize
+	}
+	return nil
+}
+
+// Target returns the verity table of the data device checked against the hash device. I/O
+// errors are returned for the blocks that do not match the hash tree.
+func (p *Params) Target(dataDevice, hashDevice string, rootHash []byte) dm.Target {
+	salt := "-"
+	if len(p.Salt) > 0 {
+		salt = hex.EncodeToString(p.Salt)
+	}
+	// <version> <dev> <hash_dev> <data_block_size> <hash_block_size> <num_data_blocks>
+	// <hash_start_block> <algorithm> <digest> <salt>
+	params := fmt.Sprintf("%d %s %s %d %d %d %d %s %s %s", p.HashType, dataDevice, hashDevice,
+		p.DataBlockSize, p.HashBlockSize, p.DataBlocks, p.HashOffset/uint64(p.HashBlockSize),
+		p.Algorithm, hex.EncodeToString(rootHash), salt)
+	return dm.Target{
+		Start:  0,
+		Length: p.DataBlocks * uint64(p.DataBlockSize) / dm.SectorSize,
+		Type:   "verity",
+		Params: params,
+	}
+}
+
+// DigestSize returns the size in bytes of the root hash.
+func (p *Params) DigestSize() int {
+	newHash, ok := algorithms[p.Algorithm]
+	if !ok {
+		return 0
+	}
+	return newHash().Size()
+}
+
+func newParams(size int64, opts FormatOptions) (*Params, error) {
+	params := &Params{
+		HashType:      HashType,
+		UUID:          opts.UUID,
+		Algorithm:     strings.ToLower(opts.Algorithm),
+		DataBlockSize: opts.DataBlockSize,
+		HashBlockSize: opts.HashBlockSize,
+		Salt:          opts.Salt,
+	}
+	if params.Algorithm == "" {
+		params.Algorithm = DefaultAlgorithm
+	}
+	if params.DataBlockSize == 0 {
+		params.DataBlockSize = DefaultBlockSize
+	}
+	if params.HashBlockSize == 0 {
+		params.HashBlockSize = DefaultBlockSize
+	}
+	if params.Salt == nil {
+		params.Salt = make([]byte, DefaultSaltSize)
+		if _, err := rand.Read(params.Salt); err != nil {
+			return nil, err
+		}
+	}
+	if params.UUID == "" {
+		uuid := make([]byte, 16)
+		if _, err := rand.Read(uuid); err != nil {
+			return nil, err
+		}
+		// version 4, variant 1
+		uuid[6] = uuid[6]&0x0f | 0x40
+		uuid[8] = uuid[8]&0x3f | 0x80
+		h := hex.EncodeToString(uuid)
+		params.UUID = fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+	}
+	params.HashOffset = hashOffset(params.HashBlockSize)
+
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	if size <= 0 || size%int64(params.DataBlockSize) != 0 {
+		return nil, fmt.Errorf("data size %d is not a multiple of the data block size %d", size, params.DataBlockSize)
+	}
+	params.DataBlocks = uint64(size) / uint64(params.DataBlockSize)
+	return params, nil
+}
+
+func (p *Params) validate() error {
+	if p.HashType != HashType {
+		return fmt.Errorf("unsupported hash type %d", p.HashType)
+	}
+	newHash, ok := algorithms[p.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported hash algorithm %q", p.Algorithm)
+	}
+	for _, size := range []uint32{p.DataBlockSize, p.HashBlockSize} {
+		if size < minBlockSize || size > maxBlockSize || size&(size-1) != 0 {
+			return fmt.Errorf("invalid block size %d", size)
+		}
+	}
+	if int(p.HashBlockSize) < 2*newHash().Size() {
+		return fmt.Errorf("hash block size %d is too small for %s", p.HashBlockSize, p.Algorithm)
+	}
+	if len(p.Salt) > maxSaltSize {
+		return fmt.Errorf("salt is longer than %d bytes", maxSaltSize)
+	}
+	if _, err := uuidBytes(p.UUID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// marshalSuperblock encodes struct verity_sb of veritysetup.
+func (p *Params) marshalSuperblock() ([]byte, error) {
+	uuid, err := uuidBytes(p.UUID)
+	if err != nil {
+		return nil, err
+	}
+	superblock := make([]byte, superblockSize)
+	le := binary.LittleEndian
+	copy(superblock, superblockSignature)
+	le.PutUint32(superblock[8:], superblockVersion)
+	le.PutUint32(superblock[12:], uint32(p.HashType))
+	copy(superblock[16:32], uuid)
+	copy(superblock[32:64], p.Algorithm)
+	le.PutUint32(superblock[64:], p.DataBlockSize)
+	le.PutUint32(superblock[68:], p.HashBlockSize)
+	le.PutUint64(superblock[72:], p.DataBlocks)
+	le.PutUint16(superblock[80:], uint16(len(p.Salt)))
+	copy(superblock[88:88+maxSaltSize], p.Salt)
+	return superblock, nil
+}
+
+// hashOffset returns the offset of the hash tree, the superblock rounded up to a hash block.
+func hashOffset(hashBlockSize uint32) uint64 {
+	if hashBlockSize == 0 {
+		return 0
+	}
+	return (superblockSize + uint64(hashBlockSize) - 1) / uint64(hashBlockSize) * uint64(hashBlockSize)
+}
+
+func uuidBytes(uuid string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	if err != nil || len(raw) != 16 {
+		return nil, fmt.Errorf("invalid UUID %q", uuid)
+	}
+	return raw, nil
+}
+
+// tree is the layout of a hash tree. Level 0 holds the hashes of the data blocks and each level
+// above it the hashes of the blocks of the level below, up to a single block. The levels are
+// stored top level first after the superblock.
+type tree struct {
+	params  *Params
+	newHash func() hash.Hash
+	// hashes per hash block and the size of their slot, the digest padded to a power of two
+	hashesPerBlock int
+	slotSize       int
+	levels         int
+	levelBlocks    []uint64
+	levelOffsets   []int64
+}
+
+func newTree(p *Params) (*tree, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	if p.DataBlocks == 0 {
+		return nil, errors.New("no data blocks")
+	}
+	t := &tree{params: p, newHash: algorithms[p.Algorithm]}
+	perBlockBits := bits.Len(uint(int(p.HashBlockSize)/t.newHash().Size())) - 1
+	t.hashesPerBlock = 1 << perBlockBits
+	t.slotSize = int(p.HashBlockSize) >> perBlockBits
+
+	// like the kernel, a single data block is hashed into the root hash directly
+	for t.levels*perBlockBits < 64 && (p.DataBlocks-1)>>(uint(t.levels*perBlockBits)) != 0 {
+		t.levels++
+	}
+	blocks := p.DataBlocks
+	for level := 0; level < t.levels; level++ {
+		blocks = (blocks + uint64(t.hashesPerBlock) - 1) / uint64(t.hashesPerBlock)
+		t.levelBlocks = append(t.levelBlocks, blocks)
+	}
+	t.levelOffsets = make([]int64, t.levels)
+	offset := int64(p.HashOffset)
+	for level := t.levels - 1; level >= 0; level-- {
+		t.levelOffsets[level] = offset
+		offset += int64(t.levelBlocks[level]) * int64(p.HashBlockSize)
+	}
+	return t, nil
+}
+
+func (t *tree) levelOffset(level int) int64 {
+	return t.levelOffsets[level]
+}
+
+// digest hashes the salt followed by the block, as hash type 1 does.
+func (t *tree) digest(block []byte) []byte {
+	h := t.newHash()
+	h.Write(t.params.Salt)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// hashLevel writes at dst the hash blocks of the count blocks of blockSize bytes at src.
+func (t *tree) hashLevel(src io.ReaderAt, srcOffset int64, count uint64, blockSize uint32, dst io.WriterAt, dstOffset int64) error {
+	block := make([]byte, blockSize)
+	hashBlock := make([]byte, t.params.HashBlockSize)
+	filled := 0
+	for i := uint64(0); i < count; i++ {
+		if _, err := src.ReadAt(block, srcOffset+int64(i)*int64(blockSize)); err != nil {
+			return fmt.Errorf("error reading block %d: %w", i, err)
+		}
+		copy(hashBlock[filled*t.slotSize:], t.digest(block))
+		filled++
+		if filled == t.hashesPerBlock || i == count-1 {
+			if _, err := dst.WriteAt(hashBlock, dstOffset); err != nil {
+				return err
+			}
+			dstOffset += int64(len(hashBlock))
+			for j := range hashBlock {
+				hashBlock[j] = 0
+			}
+			filled = 0
+		}
+	}
+	return nil
+}
+
+// checkLevel checks the count blocks of blockSize bytes at src against the hash blocks at
+// hashOffset, including the zero padding of the hash blocks.
+func (t *tree) checkLevel(src io.ReaderAt, srcOffset int64, count uint64, blockSize uint32, hashes io.ReaderAt, hashOffset int64) error {
+	block := make([]byte, blockSize)
+	expected := make([]byte, t.params.HashBlockSize)
+	stored := make([]byte, t.params.HashBlockSize)
+	filled := 0
+	for i := uint64(0); i < count; i++ {
+		if _, err := src.ReadAt(block, srcOffset+int64(i)*int64(blockSize)); err != nil {
+			return fmt.Errorf("error reading block %d: %w", i, err)
+		}
+		copy(expected[filled*t.slotSize:], t.digest(block))
+		filled++
+		if filled == t.hashesPerBlock || i == count-1 {
+			if _, err := hashes.ReadAt(stored, hashOffset); err != nil {
+				return fmt.Errorf("error reading the hash of block %d: %w", i, err)
+			}
+			if !bytes.Equal(expected, stored) {
+				first := i - uint64(filled) + 1
+				return fmt.Errorf("%w: blocks %d to %d", ErrCorrupted, first, i)
+			}
+			hashOffset += int64(len(stored))
+			for j := range expected {
+				expected[j] = 0
+			}
+			filled = 0
+		}
+	}
+	return nil
+}
+
+// rootHash hashes the top level block of the tree, or the data block when there is only one.
+func (t *tree) rootHash(data, hashes io.ReaderAt) ([]byte, error) {
+	if t.levels == 0 {
+		block := make([]byte, t.params.DataBlockSize)
+		if _, err := data.ReadAt(block, 0); err != nil {
+			return nil, fmt.Errorf("error reading the data block: %w", err)
+		}
+		return t.digest(block), nil
+	}
+	block := make([]byte, t.params.HashBlockSize)
+	if _, err := hashes.ReadAt(block, t.levelOffset(t.levels-1)); err != nil {
+		return nil, fmt.Errorf("error reading the top of the hash tree: %w", err)
+	}
+	return t.digest(block), nil
+}
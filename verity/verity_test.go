@@ -0,0 +1,315 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+const testUUID = "6f3a1c2e-9b4d-4e5f-8a7b-1c2d3e4f5a6b"
+
+// device is an in-memory hash device growing as it is written
+type device struct {
+	data []byte
+}
+
+func (d *device) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *device) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(d.data) {
+		d.data = append(d.data, make([]byte, end-len(d.data))...)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+// testData returns blocks data blocks that all differ.
+func testData(blocks int, blockSize uint32) []byte {
+	data := make([]byte, blocks*int(blockSize))
+	for i := range data {
+		data[i] = byte(i*7 + i/int(blockSize))
+	}
+	return data
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		blocks     int
+		opts       FormatOptions
+		wantLevels int
+	}{
+		{name: "single block", blocks: 1, wantLevels: 0},
+		{name: "one hash block", blocks: 128, wantLevels: 1},
+		{name: "two levels", blocks: 129, wantLevels: 2},
+		{name: "small blocks", blocks: 300, opts: FormatOptions{DataBlockSize: 512, HashBlockSize: 512}, wantLevels: 3},
+		{name: "sha1", blocks: 300, opts: FormatOptions{Algorithm: "sha1"}, wantLevels: 2},
+		{name: "sha512", blocks: 300, opts: FormatOptions{Algorithm: "SHA512", HashBlockSize: 1024}, wantLevels: 3},
+		{name: "no salt", blocks: 10, opts: FormatOptions{Salt: []byte{}}, wantLevels: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blockSize := tt.opts.DataBlockSize
+			if blockSize == 0 {
+				blockSize = DefaultBlockSize
+			}
+			data := bytes.NewReader(testData(tt.blocks, blockSize))
+			hashes := &device{}
+			params, rootHash, err := Format(data, data.Size(), hashes, tt.opts)
+			if err != nil {
+				t.Fatalf("Format failed: %v", err)
+			}
+			if params.DataBlocks != uint64(tt.blocks) || len(rootHash) != params.DigestSize() {
+				t.Fatalf("got %d data blocks and a %d byte root hash", params.DataBlocks, len(rootHash))
+			}
+			tree, err := newTree(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree.levels != tt.wantLevels {
+				t.Fatalf("got %d levels, want %d", tree.levels, tt.wantLevels)
+			}
+
+			read, err := ReadParams(hashes)
+			if err != nil {
+				t.Fatalf("ReadParams failed: %v", err)
+			}
+			if !reflect.DeepEqual(read, params) {
+				t.Fatalf("read %+v, want %+v", read, params)
+			}
+			if err = read.CheckRootHash(data, hashes, rootHash); err != nil {
+				t.Fatalf("CheckRootHash failed: %v", err)
+			}
+			if err = read.Verify(data, hashes, rootHash); err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestFormatLayout checks the root hash of small trees against the layout of veritysetup: the
+// superblock padded to a hash block, then the hashes of the data blocks, salt first, each padded
+// to a power of two and the block padded with zeros.
+func TestFormatLayout(t *testing.T) {
+	salt := []byte("salt")
+	digest := func(block []byte) []byte {
+		sum := sha256.Sum256(append(append([]byte(nil), salt...), block...))
+		return sum[:]
+	}
+
+	for _, blocks := range []int{1, 2, 3} {
+		t.Run(fmt.Sprintf("%d blocks", blocks), func(t *testing.T) {
+			raw := testData(blocks, DefaultBlockSize)
+			hashes := &device{}
+			_, rootHash, err := Format(bytes.NewReader(raw), int64(len(raw)), hashes, FormatOptions{Salt: salt, UUID: testUUID})
+			if err != nil {
+				t.Fatalf("Format failed: %v", err)
+			}
+
+			want := digest(raw)
+			if blocks > 1 {
+				hashBlock := make([]byte, DefaultBlockSize)
+				for i := 0; i < blocks; i++ {
+					copy(hashBlock[i*sha256.Size:], digest(raw[i*DefaultBlockSize:(i+1)*DefaultBlockSize]))
+				}
+				if !bytes.Equal(hashes.data[DefaultBlockSize:2*DefaultBlockSize], hashBlock) {
+					t.Fatal("hash block does not hold the hashes of the data blocks")
+				}
+				want = digest(hashBlock)
+			}
+			if !bytes.Equal(rootHash, want) {
+				t.Fatalf("got root hash %x, want %x", rootHash, want)
+			}
+			if !bytes.HasPrefix(hashes.data, []byte("verity\x00\x00")) {
+				t.Fatal("hash device does not start with the superblock")
+			}
+		})
+	}
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	const blocks = 300
+	raw := testData(blocks, DefaultBlockSize)
+	hashes := &device{}
+	params, rootHash, err := Format(bytes.NewReader(raw), int64(len(raw)), hashes, FormatOptions{})
+	if err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+	tree, err := newTree(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// corrupt changes the data or the hash device
+		corrupt       func(data, hashes []byte) []byte
+		rootHash      []byte
+		wantCheckErr  error
+		wantVerifyErr error
+	}{
+		{
+			name:          "data block",
+			corrupt:       func(data, hashes []byte) []byte { data[200*DefaultBlockSize+5] ^= 1; return data },
+			wantVerifyErr: ErrCorrupted,
+		},
+		{
+			name:          "hash block",
+			corrupt:       func(data, hashes []byte) []byte { hashes[tree.levelOffset(0)+DefaultBlockSize+3] ^= 1; return data },
+			wantVerifyErr: ErrCorrupted,
+		},
+		{
+			name:          "hash block padding",
+			corrupt:       func(data, hashes []byte) []byte { hashes[len(hashes)-1] ^= 1; return data },
+			wantVerifyErr: ErrCorrupted,
+		},
+		{
+			name:          "top of the tree",
+			corrupt:       func(data, hashes []byte) []byte { hashes[tree.levelOffset(tree.levels-1)] ^= 1; return data },
+			wantCheckErr:  ErrRootHashMismatch,
+			wantVerifyErr: ErrRootHashMismatch,
+		},
+		{
+			name:          "wrong root hash",
+			rootHash:      make([]byte, len(rootHash)),
+			wantCheckErr:  ErrRootHashMismatch,
+			wantVerifyErr: ErrRootHashMismatch,
+		},
+		{
+			name:          "truncated data",
+			corrupt:       func(data, hashes []byte) []byte { return data[:len(data)-1] },
+			wantVerifyErr: io.EOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), raw...)
+			hashDevice := &device{data: append([]byte(nil), hashes.data...)}
+			if tt.corrupt != nil {
+				data = tt.corrupt(data, hashDevice.data)
+			}
+			want := rootHash
+			if tt.rootHash != nil {
+				want = tt.rootHash
+			}
+
+			err := params.CheckRootHash(bytes.NewReader(data), hashDevice, want)
+			if !errors.Is(err, tt.wantCheckErr) {
+				t.Errorf("CheckRootHash returned %v, want %v", err, tt.wantCheckErr)
+			}
+			if err = params.Verify(bytes.NewReader(data), hashDevice, want); !errors.Is(err, tt.wantVerifyErr) {
+				t.Errorf("Verify returned %v, want %v", err, tt.wantVerifyErr)
+			}
+		})
+	}
+}
+
+func TestFormatInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		opts FormatOptions
+	}{
+		{name: "unknown algorithm", size: DefaultBlockSize, opts: FormatOptions{Algorithm: "md5"}},
+		{name: "block size not a power of two", size: 3000, opts: FormatOptions{DataBlockSize: 1000}},
+		{name: "block size too large", size: 8192, opts: FormatOptions{DataBlockSize: 8192}},
+		{name: "block size too small", size: DefaultBlockSize, opts: FormatOptions{HashBlockSize: 256}},
+		{name: "salt too long", size: DefaultBlockSize, opts: FormatOptions{Salt: make([]byte, maxSaltSize+1)}},
+		{name: "invalid UUID", size: DefaultBlockSize, opts: FormatOptions{UUID: "not a uuid"}},
+		{name: "partial block", size: DefaultBlockSize + 1},
+		{name: "no data", size: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.NewReader(make([]byte, tt.size))
+			if _, _, err := Format(data, tt.size, &device{}, tt.opts); err == nil {
+				t.Fatal("Format succeeded")
+			}
+		})
+	}
+}
+
+func TestReadParams(t *testing.T) {
+	raw := testData(4, DefaultBlockSize)
+	hashes := &device{}
+	if _, _, err := Format(bytes.NewReader(raw), int64(len(raw)), hashes, FormatOptions{UUID: testUUID}); err != nil {
+		t.Fatal(err)
+	}
+	superblock := hashes.data[:superblockSize]
+	edited := func(offset int, value ...byte) []byte {
+		b := append([]byte(nil), superblock...)
+		copy(b[offset:], value)
+		return b
+	}
+
+	tests := []struct {
+		name       string
+		superblock []byte
+		wantErr    error
+	}{
+		{name: "valid", superblock: superblock},
+		{name: "empty", superblock: nil, wantErr: ErrNoSuperblock},
+		{name: "short", superblock: superblock[:100], wantErr: ErrNoSuperblock},
+		{name: "bad signature", superblock: edited(0, 'V'), wantErr: ErrNoSuperblock},
+		{name: "bad version", superblock: edited(8, 2)},
+		{name: "bad hash type", superblock: edited(12, 0)},
+		{name: "bad block size", superblock: edited(64, 0, 0x20)},
+		{name: "salt too long", superblock: edited(80, 0, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ReadParams(bytes.NewReader(tt.superblock))
+			switch {
+			case tt.name == "valid":
+				if err != nil || params.UUID != testUUID || params.DataBlocks != 4 {
+					t.Fatalf("got %+v, %v", params, err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+			case err == nil:
+				t.Fatal("ReadParams succeeded")
+			}
+		})
+	}
+}
+
+func TestTarget(t *testing.T) {
+	params := &Params{
+		HashType:      HashType,
+		Algorithm:     "sha256",
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		DataBlocks:    256,
+		Salt:          []byte{0xab, 0xcd},
+		HashOffset:    4096,
+	}
+	target := params.Target("/dev/loop0", "/dev/loop1", []byte{0x01, 0x02})
+	want := "1 /dev/loop0 /dev/loop1 4096 4096 256 1 sha256 0102 abcd"
+	if target.Type != "verity" || target.Start != 0 || target.Length != 256*8 || target.Params != want {
+		t.Fatalf("got %+v, want params %q", target, want)
+	}
+
+	params.Salt = nil
+	if target = params.Target("/dev/loop0", "/dev/loop1", []byte{0x01}); target.Params != "1 /dev/loop0 /dev/loop1 4096 4096 256 1 sha256 01 -" {
+		t.Fatalf("got params %q without a salt", target.Params)
+	}
+}
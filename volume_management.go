@@ -5,19 +5,18 @@
 package vml
 
 import (
-	"crypto/aes"
+	"bytes"
+	"context"
 	"crypto/cipher"
-	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"intel/isecl/lib/common/v4/crypt"
 	"intel/isecl/lib/common/v4/pkg/instance"
-	"io/ioutil"
+	"intel/isecl/lib/vml/v4/loop"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
-	"unsafe"
 )
 
 // CreateVolume is used to create the sparse file if it does not exist, associate the sparse file
@@ -30,14 +29,59 @@ import (
 //
 // 	deviceMapperLocation – Absolute path of the dm-crypt volume.
 //
-// 	keyPath – Absolute path of the key file.
+// 	key – The key used to format and open the dm-crypt volume. It is handed to cryptsetup
+// 		  on stdin and is never written to a file.
 //
-// 	diskSize – Size of the sparse file to be created.
+// 	diskSize – Size of the sparse file to be created. An existing sparse file of a different size
+// 			   is reported as ErrSizeMismatch, use ResizeVolume to grow it.
 func CreateVolume(sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int) error {
-	var args []string
+	return DefaultManager.CreateVolume(sparseFilePath, deviceMapperLocation, key, diskSize)
+}
+
+// CreateVolumeWithOptions is used to create the dm-crypt volume like CreateVolume, formatting
+// it with the LUKS settings given in opts instead of the cryptsetup defaults of the host.
+func CreateVolumeWithOptions(sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int, opts VolumeOptions) error {
+	return DefaultManager.CreateVolumeWithOptions(sparseFilePath, deviceMapperLocation, key, diskSize, opts)
+}
+
+// CreateVolumeContext is used to create the dm-crypt volume like CreateVolume. When ctx is done
+// before the volume is created, the running command is killed along with the processes it
+// started, the steps already completed are rolled back and the error wraps ctx.Err().
+func CreateVolumeContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int) error {
+	return DefaultManager.CreateVolumeContext(ctx, sparseFilePath, deviceMapperLocation, key, diskSize)
+}
+
+// CreateVolumeWithOptionsContext is used to create the dm-crypt volume like CreateVolumeWithOptions,
+// stopping when ctx is done like CreateVolumeContext.
+func CreateVolumeWithOptionsContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int, opts VolumeOptions) error {
+	return DefaultManager.CreateVolumeWithOptionsContext(ctx, sparseFilePath, deviceMapperLocation, key, diskSize, opts)
+}
+
+// CreateVolume creates the dm-crypt volume like the package level CreateVolume, running the
+// commands with the manager's CommandRunner.
+func (m *Manager) CreateVolume(sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int) error {
+	return m.CreateVolumeWithOptionsContext(context.Background(), sparseFilePath, deviceMapperLocation, key, diskSize, VolumeOptions{})
+}
+
+// CreateVolumeWithOptions creates the dm-crypt volume like the package level CreateVolumeWithOptions.
+func (m *Manager) CreateVolumeWithOptions(sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int, opts VolumeOptions) error {
+	return m.CreateVolumeWithOptionsContext(context.Background(), sparseFilePath, deviceMapperLocation, key, diskSize, opts)
+}
+
+// CreateVolumeContext creates the dm-crypt volume like the package level CreateVolumeContext.
+func (m *Manager) CreateVolumeContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int) error {
+	return m.CreateVolumeWithOptionsContext(ctx, sparseFilePath, deviceMapperLocation, key, diskSize, VolumeOptions{})
+}
+
+// CreateVolumeWithOptionsContext creates the dm-crypt volume like the package level
+// CreateVolumeWithOptionsContext.
+//
+// When a step fails, the sparse file, loop device and dm-crypt mapping created by this call are
+// removed again, in reverse order. Resources that existed before the call are left untouched.
+// A volume that cannot be recorded in the registry once formatted is kept, the error is then
+// ErrNotRecorded.
+func (m *Manager) CreateVolumeWithOptionsContext(ctx context.Context, sparseFilePath string, deviceMapperLocation string, key []byte, diskSize int, opts VolumeOptions) (err error) {
 	var deviceLoop string
-	var cmdOutput string
-	var err error
 
 	// input validation
 	if len(strings.TrimSpace(sparseFilePath)) <= 0 {
@@ -52,69 +96,66 @@ func CreateVolume(sparseFilePath string, deviceMapperLocation string, key []byte
 		return errors.New("sparse file size should be greater than 0")
 	}
 
+	if err = opts.validate(); err != nil {
+		return fmt.Errorf("invalid volume options: %w", err)
+	}
+
 	// check if device mapper of the same name exists in the given location
 	_, err = os.Stat(deviceMapperLocation)
 	if !os.IsNotExist(err) {
-		return errors.New("device mapper of the same already exists")
+		return &VolumeError{Op: "create", Path: deviceMapperLocation, Kind: ErrAlreadyExists}
 	}
 
-	tmpKeyFile, err := ioutil.TempFile("/tmp", "volumeKey")
+	unlock, err := m.lockVolume(ctx, sparseFilePath, deviceMapperLocation, "")
 	if err != nil {
-		return errors.New("error creating a temp key file")
-	}
-
-	defer os.Remove(tmpKeyFile.Name()) // clean up
-
-	if _, err := tmpKeyFile.Write(key); err != nil {
-		return errors.New("error while writing key to a temp file")
+		return err
 	}
+	defer unlock()
 
-	if err := tmpKeyFile.Close(); err != nil {
-		return errors.New("error closing the temp key file")
+	// the volume may have been created while waiting for the lock
+	if _, err = os.Stat(deviceMapperLocation); !os.IsNotExist(err) {
+		return &VolumeError{Op: "create", Path: deviceMapperLocation, Kind: ErrAlreadyExists}
 	}
 
-	keyPath := tmpKeyFile.Name()
+	// the rollback runs before the locks are released
+	undo := &rollback{}
+	defer func() {
+		if err != nil {
+			err = undo.run(err)
+		}
+	}()
 
 	// get loop device associated to the sparse file and format it
-	deviceLoop, formatDevice, err := getLoopDevice(sparseFilePath, diskSize, keyPath)
+	deviceLoop, formatDevice, err := m.getLoopDevice(ctx, sparseFilePath, diskSize, key, opts, undo)
 	if err != nil {
-		return fmt.Errorf("error while trying to get the device loop: %s", err.Error())
+		return fmt.Errorf("error while trying to get the device loop: %w", err)
 	}
 
-	var deviceMapperString = strings.Split(deviceMapperLocation, "/")
-	var deviceMapperName = deviceMapperString[len(deviceMapperString)-1]
-
-	// check the status of the device device mapper
-	args = []string{"status", deviceMapperLocation}
-	cmdOutput, err = runCommand("cryptsetup", args)
-	if strings.Contains(cmdOutput, "inactive") {
-		args = []string{"-v", "luksOpen", deviceLoop, deviceMapperName, "--key-file", keyPath}
-		cmdOutput, err = runCommand("cryptsetup", args)
-		if err != nil {
-			return errors.New("error trying to open the luks volume")
-		}
-
-		//checking the status of the volume again
-		args = []string{"status", deviceMapperLocation}
-		cmdOutput, err = runCommand("cryptsetup", args)
-		if !strings.Contains(cmdOutput, "active") {
-			return errors.New("volume is not active for use")
-		}
+	if err = m.openVolume(ctx, deviceLoop, deviceMapperLocation, key, undo); err != nil {
+		return err
 	}
+
 	// 9. format the volume
-	if formatDevice {
-		args = []string{"-v", deviceMapperLocation}
-		cmdOutput, err = runCommand("mkfs.ext4", args)
+	if formatDevice && opts.filesystem() != FilesystemNone {
+		mkfsCmd, args := opts.Mkfs.mkfsCommand(opts.filesystem(), deviceMapperLocation)
+		_, err = m.runCommand(ctx, mkfsCmd, args)
 		if err != nil {
-			return errors.New("error trying to format the luks volume")
+			return &VolumeError{Op: "mkfs", Path: deviceMapperLocation, Err: err}
 		}
 	}
+
+	// the volume is complete once formatted, failing to record it does not undo it
+	undo.commit()
+	if err = m.recordVolume(ctx, sparseFilePath, deviceMapperLocation, deviceLoop, &opts); err != nil {
+		return &VolumeError{Op: "create", Path: deviceMapperLocation, Kind: ErrNotRecorded, Err: err}
+	}
 	return nil
 }
 
 // This function is used to create a sparse file is it doesn't exist,
-// find a loop device and associate the sparse file with it.
-func getLoopDevice(sparseFilePath string, diskSize int, keyPath string) (string, bool, error) {
+// find a loop device and associate the sparse file with it. The sparse file and the loop
+// device are registered with undo when this call creates them.
+func (m *Manager) getLoopDevice(ctx context.Context, sparseFilePath string, diskSize int, key []byte, opts VolumeOptions, undo *rollback) (string, bool, error) {
 	var err error
 	var args []string
 	var deviceLoop string
@@ -122,63 +163,109 @@ func getLoopDevice(sparseFilePath string, diskSize int, keyPath string) (string,
 
 	// check if the sparse file exists
 	fileInfo, err := os.Stat(sparseFilePath)
-	var fileSizeMatches = false
 
-	// if sparse file exists, check if the file size matches the given disk size
+	// if sparse file exists, check if the file size matches the given disk size. The volume is
+	// never reformatted on a mismatch, ResizeVolume is used to grow it.
 	if !os.IsNotExist(err) {
-		diskSizeInBytes := diskSize * 1000000000
-		if int64(diskSizeInBytes) == fileInfo.Size() {
-			fileSizeMatches = true
+		if err != nil {
+			return "", false, &VolumeError{Op: "create", Path: sparseFilePath, Err: err}
 		}
-	}
-
-	// sparse file does not exist, creating a new sparsefile
-	if (os.IsNotExist(err)) || !fileSizeMatches {
-		// create a sparse file
+		if sizeInBytes(diskSize) != fileInfo.Size() {
+			return "", false, &VolumeError{Op: "create", Path: sparseFilePath, Kind: ErrSizeMismatch,
+				Err: fmt.Errorf("sparse file size is %d bytes, expected %d bytes", fileInfo.Size(), sizeInBytes(diskSize))}
+		}
+	} else {
+		// sparse file does not exist, creating a new sparsefile
 		size := strconv.Itoa(diskSize) + "GB"
 		args = []string{"-s", size, sparseFilePath}
-		_, err = runCommand("truncate", args)
+		_, err = m.runCommand(ctx, "truncate", args)
 		if err != nil {
-			return "", false, fmt.Errorf("error creating a sparse file: ", err.Error())
+			return "", false, &VolumeError{Op: "truncate", Path: sparseFilePath, Err: err}
 		}
+		// removing the sparse file also discards a partially written LUKS header
+		undo.add(func() error {
+			return os.Remove(sparseFilePath)
+		})
 		formatDevice = true
 	}
 
-	// find the loop device associated to the sparse file
-	args = []string{"-j", sparseFilePath}
-	cmdOutput, err := runCommand("losetup", args)
+	deviceLoop, err = m.attachLoop(ctx, sparseFilePath, undo)
 	if err != nil {
-		return "", false, errors.New("error trying to find a loop device associated with the sparse file")
+		return "", false, err
 	}
-	// find the loop device and associate it with the sparse file
-	if (cmdOutput == "") || (len(cmdOutput) <= 0) {
-		// find the loop device
-		args = []string{"-f", sparseFilePath}
-		cmdOutput, err = runCommand("losetup", args)
+
+	// format loop device
+	if formatDevice {
+		args = opts.luksFormatArgs(deviceLoop)
+		_, err = m.runCommandWithStdin(ctx, "cryptsetup", args, key)
 		if err != nil {
-			return "", false, errors.New("error trying to accociate a loop device to the sparse file")
+			return "", false, cryptsetupError("luksFormat", deviceLoop, err)
 		}
 	}
+	return deviceLoop, formatDevice, nil
+}
 
-	// check if the loop device is associated to the sparse file
-	args = []string{"-j", sparseFilePath}
-	cmdOutput, err = runCommand("losetup", args)
-	if (cmdOutput == "") || (len(cmdOutput) <= 0) {
-		return "", false, errors.New("sparse file is not associated to the loop device")
-	} else {
-		var modifiedOutput = strings.Split(cmdOutput, ":")
-		deviceLoop = modifiedOutput[0]
+// attachLoop returns the loop device the sparse file is attached to, attaching it to a free
+// loop device if needed. A loop device attached by this call is registered with undo.
+func (m *Manager) attachLoop(ctx context.Context, sparseFilePath string, undo *rollback) (string, error) {
+	// loop devices are allocated under a host wide lock, so that two volumes never race for
+	// the same free loop device
+	unlockLoop, err := m.lock(ctx, loopLockName)
+	if err != nil {
+		return "", err
 	}
+	defer unlockLoop()
 
-	// format loop device
-	if formatDevice {
-		args = []string{"-v", "--batch-mode", "luksFormat", deviceLoop, "--key-file", keyPath}
-		cmdOutput, err = runCommand("cryptsetup", args)
-		if err != nil {
-			return "", false, fmt.Errorf("error trying to format the loop device: %s", err.Error())
+	// find the loop device associated to the sparse file
+	deviceLoop, err := m.loop().FindByBackingFile(sparseFilePath)
+	if err == nil {
+		return deviceLoop, nil
+	} else if !errors.Is(err, loop.ErrNotFound) {
+		return "", &VolumeError{Op: "attach", Path: sparseFilePath, Err: err}
+	}
+
+	// find a free loop device and associate it with the sparse file
+	deviceLoop, err = m.loop().Attach(sparseFilePath, loop.Options{})
+	if err != nil {
+		return "", &VolumeError{Op: "attach", Path: sparseFilePath, Err: err}
+	}
+	undo.add(func() error {
+		if err := m.loop().Detach(deviceLoop); err != nil {
+			return &VolumeError{Op: "detach", Path: deviceLoop, Err: err}
 		}
+		return nil
+	})
+	return deviceLoop, nil
+}
+
+// openVolume opens the LUKS volume on the loop device at the device mapper location, unless it
+// is already active. A volume opened by this call is registered with undo.
+func (m *Manager) openVolume(ctx context.Context, deviceLoop, deviceMapperLocation string, key []byte, undo *rollback) error {
+	// check the status of the device mapper
+	status, err := m.volumeStatus(ctx, deviceMapperLocation)
+	if err != nil {
+		return err
 	}
-	return deviceLoop, formatDevice, nil
+	if status.Active {
+		return nil
+	}
+
+	if err = m.luksOpen(ctx, deviceLoop, deviceMapperLocation, key); err != nil {
+		return err
+	}
+	undo.add(func() error {
+		return m.luksClose(context.Background(), deviceMapperLocation)
+	})
+
+	//checking the status of the volume again
+	status, err = m.volumeStatus(ctx, deviceMapperLocation)
+	if err != nil {
+		return err
+	}
+	if !status.Active {
+		return &VolumeError{Op: "status", Path: deviceMapperLocation, Kind: ErrNotFound, Err: errors.New("volume is not active for use")}
+	}
+	return nil
 }
 
 // DeleteVolume method is used to delete the given dm-crypt volume.
@@ -187,19 +274,26 @@ func getLoopDevice(sparseFilePath string, diskSize int, keyPath string) (string,
 //
 // deviceMapperLocation – Absolute path of the dm-crypt volume.
 func DeleteVolume(deviceMapperLocation string) error {
-	//validate input parameters
-	if len(strings.TrimSpace(deviceMapperLocation)) <= 0 {
-		return errors.New("device mapper location not given")
-	}
+	return DefaultManager.DeleteVolume(deviceMapperLocation)
+}
 
-	// build and excute the cryptsetup luksClose command to close and delete the volume
-	deleteVolumeCmd := "cryptsetup"
-	args := []string{"luksClose", deviceMapperLocation}
-	_, err := runCommand(deleteVolumeCmd, args)
-	if err != nil {
-		return fmt.Errorf("error trying to close the device mapper: %s", err.Error())
-	}
-	return nil
+// DeleteVolumeContext is used to delete the dm-crypt volume like DeleteVolume. When ctx is done
+// before the volume is deleted, the running command is killed and the error wraps ctx.Err().
+func DeleteVolumeContext(ctx context.Context, deviceMapperLocation string) error {
+	return DefaultManager.DeleteVolumeContext(ctx, deviceMapperLocation)
+}
+
+// DeleteVolume deletes the dm-crypt volume like the package level DeleteVolume, running the
+// commands with the manager's CommandRunner. The loop device backing the volume is detached,
+// the sparse file is kept.
+func (m *Manager) DeleteVolume(deviceMapperLocation string) error {
+	return m.DeleteVolumeContext(context.Background(), deviceMapperLocation)
+}
+
+// DeleteVolumeContext deletes the dm-crypt volume like the package level DeleteVolumeContext.
+func (m *Manager) DeleteVolumeContext(ctx context.Context, deviceMapperLocation string) error {
+	_, err := m.DeleteVolumeWithOptionsContext(ctx, deviceMapperLocation, DeleteOptions{})
+	return err
 }
 
 // CreateVMManifest is used to create a VM manifest and return a manifest.
@@ -226,6 +320,43 @@ func CreateVMManifest(vmID string, hostHardwareUUID string, imageID string, imag
 	return manifest, nil
 }
 
+// VMManifest is the manifest of a VM along with the dm-verity root hash of its image. It
+// serializes like instance.Manifest with an additional image_verity member, omitted when
+// ImageVerity is nil.
+//
+// instance.Manifest belongs to the common library and has no field for the root hash. Existing
+// consumers that parse the manifest into an instance.Manifest silently drop image_verity, they
+// must parse it into a VMManifest to read the root hash.
+type VMManifest struct {
+	instance.Manifest
+	ImageVerity *ImageVerity `json:"image_verity,omitempty"`
+}
+
+// ImageVerity records the dm-verity root hash the read-only image of an instance is opened with,
+// see OpenVerityVolume.
+type ImageVerity struct {
+	RootHash          string `json:"root_hash"`
+	RootHashSignature []byte `json:"root_hash_signature,omitempty"`
+}
+
+// CreateVMManifestWithVerity is used to create a VM manifest like CreateVMManifest, recording the
+// dm-verity root hash of the image in the image_verity member of the VMManifest. The root hash is
+// lost by consumers that parse the manifest as an instance.Manifest, see VMManifest.
+//
+// Input Parameters:
+//
+// 	imageVerity – Root hash of the image returned by CreateVerityVolume, and its signature if any.
+func CreateVMManifestWithVerity(vmID string, hostHardwareUUID string, imageID string, imageEncrypted bool, imageVerity ImageVerity) (VMManifest, error) {
+	if _, err := hex.DecodeString(imageVerity.RootHash); err != nil || imageVerity.RootHash == "" {
+		return VMManifest{}, errors.New("invalid format for the root hash")
+	}
+	manifest, err := CreateVMManifest(vmID, hostHardwareUUID, imageID, imageEncrypted)
+	if err != nil {
+		return VMManifest{}, err
+	}
+	return VMManifest{Manifest: manifest, ImageVerity: &imageVerity}, nil
+}
+
 // CreateContainerManifest is used to create a container manifest and return a manifest.
 //
 // Input Parameters:
@@ -253,6 +384,34 @@ func CreateContainerManifest(containerID, hostHardwareUUID, imageID string, imag
 	return manifest, nil
 }
 
+// Encrypt is used to encrypt data with the key in byte format using AES 256 GCM algorithm,
+// in the format read by Decrypt.
+//
+// Input Parameters:
+//
+// 	plaintext – The data to encrypt.
+//
+// 	key – The AES-256 key, 32 bytes.
+//
+// The data is prefixed with the crypt.EncryptionHeader, holding a fresh random IV and the
+// little endian offset of the encrypted data, right after the header. Use EncryptStream for
+// images that do not fit in memory.
+func Encrypt(plaintext, key []byte) ([]byte, error) {
+	gcm, err := newGCM256(key)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := crypt.GetRandomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, &VolumeError{Op: "encrypt", Err: err}
+	}
+
+	header := newEncryptionHeader(crypt.EncryptionHeaderVersion, encryptionHeaderSize)
+	copy(header.IV[:], iv)
+	rawHeader := marshalEncryptionHeader(header)
+	return gcm.Seal(rawHeader, header.IV[:], plaintext, nil), nil
+}
+
 // Decrypt is used to decrypt an encrypted file with the key in
 // byte format using AES 256 GCM algorithm.
 //
@@ -262,33 +421,42 @@ func CreateContainerManifest(containerID, hostHardwareUUID, imageID string, imag
 //
 // 	key – The key file used to decrypt the image/file.
 //
+// The header of the data is checked by ParseEncryptionHeader first, an error wrapping an
+// *EncryptionHeaderError is returned when it is truncated or invalid. An error of kind
+// ErrInvalidKey is returned for a key of the wrong size, ErrWrongKey when the data does not
+// decrypt with the key. Images in the V2 chunked format of EncryptStream are decrypted as well.
 func Decrypt(data, key []byte) ([]byte, error) {
-
-	var encryptionHeader crypt.EncryptionHeader
-	block, err := aes.NewCipher(key)
+	header, err := ParseEncryptionHeader(data)
 	if err != nil {
-		return nil, fmt.Errorf("error while creating the cipher: %s", err.Error())
+		return nil, &VolumeError{Op: "decrypt", Err: err}
+	}
+	if header.Version == EncryptionHeaderVersionV2 {
+		return DecryptContext(context.Background(), data, key)
 	}
 
+	block, err := newDecryptionBlock(header, key)
+	if err != nil {
+		return nil, err
+	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, fmt.Errorf("error while creating a cipher block: %s", err.Error())
 	}
-
-	iv := data[int(unsafe.Offsetof(encryptionHeader.IV)) : int(unsafe.Offsetof(encryptionHeader.IV))+int(unsafe.Sizeof(encryptionHeader.IV))]
-
-	offsetSlice := data[int(unsafe.Offsetof(encryptionHeader.OffsetInLittleEndian)) : int(unsafe.Offsetof(encryptionHeader.OffsetInLittleEndian))+int(unsafe.Sizeof(encryptionHeader.OffsetInLittleEndian))]
-	offsetValue := binary.LittleEndian.Uint32(offsetSlice)
-	encryptedData := data[offsetValue:]
-
-	plaintext, err := gcm.Open(nil, iv, encryptedData, nil)
+	plaintext, err := gcm.Open(nil, header.IV[:], data[header.DataOffset:], nil)
 	if err != nil {
-		return nil, fmt.Errorf("error while decrypting the file: %s", err.Error())
+		return nil, &VolumeError{Op: "decrypt", Kind: ErrWrongKey, Err: fmt.Errorf("error while decrypting the file: %w", err)}
 	}
 	return plaintext, nil
 }
 
-func runCommand(cmd string, args []string) (string, error) {
-	out, err := exec.Command(cmd, args...).Output()
-	return string(out), err
+// DecryptContext is used to decrypt the data like Decrypt, returning an error wrapping ctx.Err()
+// when ctx is done first. The data is decrypted by DecryptStreamContext, which checks ctx between
+// the chunks of the image and stops there.
+func DecryptContext(ctx context.Context, data, key []byte) ([]byte, error) {
+	var plaintext bytes.Buffer
+	plaintext.Grow(len(data))
+	if err := DecryptStreamContext(ctx, bytes.NewReader(data), &plaintext, key); err != nil {
+		return nil, err
+	}
+	return plaintext.Bytes(), nil
 }
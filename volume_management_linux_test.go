@@ -0,0 +1,286 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// truncateRunner creates the sparse files truncate is asked for and leaves the other commands
+// to the ScriptedRunner
+type truncateRunner struct {
+	*ScriptedRunner
+}
+
+func (r truncateRunner) RunContext(ctx context.Context, c Command) (CommandResult, error) {
+	result, err := r.ScriptedRunner.RunContext(ctx, c)
+	if err == nil && c.Name == "truncate" {
+		err = ioutil.WriteFile(c.Args[len(c.Args)-1], nil, 0600)
+	}
+	return result, err
+}
+
+func (r truncateRunner) Run(c Command) (CommandResult, error) {
+	return r.RunContext(context.Background(), c)
+}
+
+func TestCreateVolume(t *testing.T) {
+	key := []byte("volume key")
+	tests := []struct {
+		name         string
+		script       func(mapper, sparseFile string) []ScriptedResponse
+		wantErr      error
+		wantCommands []string
+		wantFile     bool
+		wantDetached []string
+	}{
+		{
+			name: "created",
+			script: func(mapper, sparseFile string) []ScriptedResponse {
+				return []ScriptedResponse{
+					{Name: "cryptsetup", Args: []string{"status"}, Times: 1, Result: cryptsetupStatus(mapper, false, "", "")},
+					{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, true, "/dev/loop0", sparseFile)},
+				}
+			},
+			wantCommands: []string{"truncate", "cryptsetup luksFormat", "cryptsetup status", "cryptsetup luksOpen", "cryptsetup status", "cryptsetup luksUUID", "mkfs.ext4"},
+			wantFile:     true,
+		},
+		{
+			name: "wrong key rolls back",
+			script: func(mapper, sparseFile string) []ScriptedResponse {
+				return []ScriptedResponse{
+					{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, false, "", "")},
+					{Name: "cryptsetup", Args: []string{"luksOpen"}, Result: CommandResult{ExitCode: cryptsetupExitWrongKey, Stderr: "No key available with this passphrase."}},
+				}
+			},
+			wantErr:      ErrWrongKey,
+			wantCommands: []string{"truncate", "cryptsetup luksFormat", "cryptsetup status", "cryptsetup luksOpen"},
+			wantDetached: []string{"/dev/loop0"},
+		},
+		{
+			name: "failed mkfs rolls back",
+			script: func(mapper, sparseFile string) []ScriptedResponse {
+				return []ScriptedResponse{
+					{Name: "cryptsetup", Args: []string{"status"}, Times: 1, Result: cryptsetupStatus(mapper, false, "", "")},
+					{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, true, "/dev/loop0", sparseFile)},
+					{Name: "mkfs.ext4", Result: CommandResult{ExitCode: 1, Stderr: "no space left"}},
+				}
+			},
+			wantErr:      ErrCommandFailed,
+			wantCommands: []string{"truncate", "cryptsetup luksFormat", "cryptsetup status", "cryptsetup luksOpen", "cryptsetup status", "cryptsetup luksUUID", "mkfs.ext4", "cryptsetup luksClose"},
+			wantDetached: []string{"/dev/loop0"},
+		},
+		{
+			name: "failed luksFormat rolls back",
+			script: func(mapper, sparseFile string) []ScriptedResponse {
+				return []ScriptedResponse{
+					{Name: "cryptsetup", Args: []string{"luksFormat"}, Result: CommandResult{ExitCode: 1}},
+				}
+			},
+			wantErr:      ErrCommandFailed,
+			wantCommands: []string{"truncate", "cryptsetup luksFormat"},
+			wantDetached: []string{"/dev/loop0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sparseFile := filepath.Join(dir, "vol.img")
+			mapper := filepath.Join(dir, "mapper", "vol")
+
+			scripted := &ScriptedRunner{}
+			for _, resp := range tt.script(mapper, sparseFile) {
+				scripted.Add(resp)
+			}
+			loops := newFakeLoop()
+			m := &Manager{Runner: truncateRunner{scripted}, Loop: loops, LockDir: filepath.Join(dir, "locks")}
+
+			err := m.CreateVolume(sparseFile, mapper, key, 1)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			var commands []string
+			for _, c := range scripted.Commands() {
+				commands = append(commands, commandVerb(c))
+				// the key is only ever handed over on stdin
+				for _, arg := range c.Args {
+					if strings.Contains(arg, string(key)) {
+						t.Errorf("key passed as an argument of %s", c)
+					}
+				}
+				if (commandVerb(c) == "cryptsetup luksFormat" || commandVerb(c) == "cryptsetup luksOpen") && !bytes.Equal(c.Stdin, key) {
+					t.Errorf("%s did not get the key on stdin", c)
+				}
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("ran %q, want %q", commands, tt.wantCommands)
+			}
+			if _, err := os.Stat(sparseFile); (err == nil) != tt.wantFile {
+				t.Errorf("sparse file exists: %v, want %v", err == nil, tt.wantFile)
+			}
+			if !reflect.DeepEqual(loops.detached, tt.wantDetached) {
+				t.Errorf("detached %q, want %q", loops.detached, tt.wantDetached)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeSizeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	sparseFile := filepath.Join(dir, "vol.img")
+	if err := ioutil.WriteFile(sparseFile, []byte("too small"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	scripted := &ScriptedRunner{}
+	m := &Manager{Runner: scripted, Loop: newFakeLoop(), LockDir: dir}
+
+	err := m.CreateVolume(sparseFile, filepath.Join(dir, "mapper", "vol"), []byte("key"), 1)
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrSizeMismatch)
+	}
+	if got := scripted.Commands(); len(got) != 0 {
+		t.Fatalf("ran %v on a mismatching sparse file", got)
+	}
+}
+
+func TestCreateVolumeNotRecorded(t *testing.T) {
+	dir := t.TempDir()
+	sparseFile := filepath.Join(dir, "vol.img")
+	mapper := filepath.Join(dir, "mapper", "vol")
+	// a file in place of the state directory makes the registry update fail
+	stateDir := filepath.Join(dir, "state")
+	if err := ioutil.WriteFile(stateDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	scripted := &ScriptedRunner{}
+	scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Times: 1, Result: cryptsetupStatus(mapper, false, "", "")})
+	scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, true, "/dev/loop0", sparseFile)})
+	loops := newFakeLoop()
+	m := &Manager{Runner: truncateRunner{scripted}, Loop: loops, LockDir: filepath.Join(dir, "locks"), StateDir: stateDir}
+
+	err := m.CreateVolume(sparseFile, mapper, []byte("key"), 1)
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("got error %v, want %v", err, ErrNotRecorded)
+	}
+
+	// the formatted volume is kept
+	for _, c := range scripted.Commands() {
+		if commandVerb(c) == "cryptsetup luksClose" {
+			t.Errorf("volume closed after the registry failed")
+		}
+	}
+	if len(loops.detached) != 0 {
+		t.Errorf("detached %q after the registry failed", loops.detached)
+	}
+	if _, err = os.Stat(sparseFile); err != nil {
+		t.Errorf("sparse file removed after the registry failed: %v", err)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		active       bool
+		loopFile     string
+		opts         func(sparseFile string) DeleteOptions
+		wantErr      error
+		wantCommands []string
+		wantDetached []string
+		wantRemoved  bool
+	}{
+		{
+			name:         "active volume",
+			active:       true,
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose"},
+			wantDetached: []string{"/dev/loop0"},
+		},
+		{
+			name:         "loop device of another file is kept",
+			active:       true,
+			loopFile:     "/var/lib/other.img",
+			wantCommands: []string{"cryptsetup status", "cryptsetup luksUUID", "cryptsetup luksClose"},
+		},
+		{
+			name:         "inactive volume without a sparse file",
+			wantErr:      ErrNotFound,
+			wantCommands: []string{"cryptsetup status"},
+		},
+		{
+			name: "inactive volume with its sparse file",
+			opts: func(sparseFile string) DeleteOptions {
+				return DeleteOptions{SparseFilePath: sparseFile, EraseKeyslots: true, RemoveSparseFile: true}
+			},
+			wantCommands: []string{"cryptsetup status", "cryptsetup erase"},
+			wantDetached: []string{"/dev/loop0"},
+			wantRemoved:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sparseFile := filepath.Join(dir, "vol.img")
+			if err := ioutil.WriteFile(sparseFile, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			mapper := filepath.Join(dir, "mapper", "vol")
+			loops := newFakeLoop()
+			loopFile := sparseFile
+			if tt.loopFile != "" {
+				loopFile = tt.loopFile
+			}
+			loops.devices["/dev/loop0"] = loopFile
+
+			scripted := &ScriptedRunner{}
+			scripted.Add(ScriptedResponse{Name: "cryptsetup", Args: []string{"status"}, Result: cryptsetupStatus(mapper, tt.active, "/dev/loop0", sparseFile)})
+			m := &Manager{Runner: scripted, Loop: loops, LockDir: filepath.Join(dir, "locks")}
+
+			opts := DeleteOptions{}
+			if tt.opts != nil {
+				opts = tt.opts(sparseFile)
+			}
+			report, err := m.DeleteVolumeWithOptions(mapper, opts)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("DeleteVolumeWithOptions failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			var commands []string
+			for _, c := range scripted.Commands() {
+				commands = append(commands, commandVerb(c))
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("ran %q, want %q", commands, tt.wantCommands)
+			}
+			if !reflect.DeepEqual(loops.detached, tt.wantDetached) {
+				t.Errorf("detached %q, want %q", loops.detached, tt.wantDetached)
+			}
+			if report.LoopDetached != (len(tt.wantDetached) > 0) {
+				t.Errorf("report.LoopDetached is %v", report.LoopDetached)
+			}
+			if _, err := os.Stat(sparseFile); os.IsNotExist(err) != tt.wantRemoved || report.SparseFileRemoved != tt.wantRemoved {
+				t.Errorf("sparse file removed: %v, reported %v, want %v", os.IsNotExist(err), report.SparseFileRemoved, tt.wantRemoved)
+			}
+		})
+	}
+}
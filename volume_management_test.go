@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2019 Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package vml
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"intel/isecl/lib/common/v4/crypt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	key := testKey(5)
+	for _, size := range []int{0, 1, 16, 1000, streamChunkSize + 1} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			image := testImage(size)
+			encrypted, err := Encrypt(image, key)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+			if len(encrypted) != encryptionHeaderSize+size+testTagSize {
+				t.Fatalf("encrypted to %d bytes, want %d", len(encrypted), encryptionHeaderSize+size+testTagSize)
+			}
+
+			// the header has the layout of crypt.EncryptionHeader
+			if got := string(encrypted[0:len(crypt.EncryptionHeaderMagicText)]); got != crypt.EncryptionHeaderMagicText {
+				t.Errorf("got magic text %q", got)
+			}
+			if offset := binary.LittleEndian.Uint32(encrypted[12:16]); offset != encryptionHeaderSize {
+				t.Errorf("got data offset %d, want %d", offset, encryptionHeaderSize)
+			}
+			header, err := ParseEncryptionHeader(encrypted)
+			if err != nil {
+				t.Fatalf("ParseEncryptionHeader failed: %v", err)
+			}
+			if header.Version != crypt.EncryptionHeaderVersion || header.Algorithm != crypt.GCMEncryptionAlgorithm || header.ChunkSize != 0 {
+				t.Errorf("got header %+v", header)
+			}
+
+			plaintext, err := Decrypt(encrypted, key)
+			if err != nil || !bytes.Equal(plaintext, image) {
+				t.Fatalf("Decrypt returned %d bytes, %v", len(plaintext), err)
+			}
+			var streamed bytes.Buffer
+			if err = DecryptStream(bytes.NewReader(encrypted), &streamed, key); err != nil || !bytes.Equal(streamed.Bytes(), image) {
+				t.Fatalf("DecryptStream returned %d bytes, %v", streamed.Len(), err)
+			}
+		})
+	}
+}
+
+func TestEncryptFreshIV(t *testing.T) {
+	key := testKey(5)
+	first, err := Encrypt([]byte("image"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Encrypt([]byte("image"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first[20:32], second[20:32]) || bytes.Equal(first, second) {
+		t.Fatal("the same IV was used twice")
+	}
+}
+
+func TestEncryptHeaderExists(t *testing.T) {
+	encrypted, err := Encrypt([]byte("image"), testKey(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "image.enc")
+	if err = ioutil.WriteFile(path, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := crypt.EncryptionHeaderExists(path); err != nil || !exists {
+		t.Fatalf("crypt.EncryptionHeaderExists returned %v, %v", exists, err)
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	image := []byte("image")
+	encrypted, err := Encrypt(image, testKey(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		wantErr error
+	}{
+		{name: "no key", key: nil, wantErr: ErrInvalidKey},
+		{name: "AES-128 key", key: testKey(5)[:16], wantErr: ErrInvalidKey},
+		{name: "short key", key: testKey(5)[:31], wantErr: ErrInvalidKey},
+		{name: "long key", key: append(testKey(5), 0), wantErr: ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Encrypt(image, tt.key); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Encrypt returned %v, want %v", err, tt.wantErr)
+			}
+			if err := EncryptStream(bytes.NewReader(image), &bytes.Buffer{}, tt.key); !errors.Is(err, tt.wantErr) {
+				t.Errorf("EncryptStream returned %v, want %v", err, tt.wantErr)
+			}
+			if _, err := Decrypt(encrypted, tt.key); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Decrypt returned %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Decrypt(encrypted, testKey(6)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Decrypt with another key returned %v, want %v", err, ErrWrongKey)
+	}
+}
@@ -1,19 +1,22 @@
+//go:build linux
+
 /*
  * Copyright (C) 2019 Intel Corporation
  * SPDX-License-Identifier: BSD-3-Clause
  */
-// +build linux
-
 package vml
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
-// Mount method is used to attach the filesystem on the device mapper of a specific type at the mount path.
+// Mount method is used to attach the filesystem on the device mapper at the mount path. The filesystem
+// type is detected from the superblock of the device.
 //
 // Input Parameters:
 //
@@ -21,6 +24,22 @@ import (
 //
 // 	mountLocation – Mount point location where the device will be mounted
 func Mount(deviceMapperLocation string, mountLocation string) error {
+	return DefaultManager.Mount(deviceMapperLocation, mountLocation)
+}
+
+// MountContext is used to attach the filesystem like Mount. ctx bounds the wait for the volume
+// lock, the mount system call itself cannot be interrupted.
+func MountContext(ctx context.Context, deviceMapperLocation string, mountLocation string) error {
+	return DefaultManager.MountContext(ctx, deviceMapperLocation, mountLocation)
+}
+
+// Mount attaches the filesystem like the package level Mount.
+func (m *Manager) Mount(deviceMapperLocation string, mountLocation string) error {
+	return m.MountContext(context.Background(), deviceMapperLocation, mountLocation)
+}
+
+// MountContext attaches the filesystem like the package level MountContext.
+func (m *Manager) MountContext(ctx context.Context, deviceMapperLocation string, mountLocation string) error {
 	//input parameters validation
 	if len(strings.TrimSpace(deviceMapperLocation)) <= 0 {
 		return fmt.Errorf("device mapper location not given")
@@ -28,14 +47,36 @@ func Mount(deviceMapperLocation string, mountLocation string) error {
 	if len(strings.TrimSpace(mountLocation)) <= 0 {
 		return fmt.Errorf("mount location not given")
 	}
+
+	unlock, err := m.lockVolume(ctx, "", deviceMapperLocation, mountLocation)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// read the filesystem type from the superblock of the device
+	fs, err := detectFilesystem(deviceMapperLocation)
+	if os.IsNotExist(err) {
+		return &VolumeError{Op: "mount", Path: deviceMapperLocation, Kind: ErrNotFound, Err: err}
+	} else if err != nil {
+		return &VolumeError{Op: "mount", Path: deviceMapperLocation, Err: err}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return &VolumeError{Op: "mount", Path: deviceMapperLocation, Err: err}
+	}
+
 	// call syscall to mount the file system
-	err := unix.Mount(deviceMapperLocation, mountLocation, "ext4", 0, "")
+	err = unix.Mount(deviceMapperLocation, mountLocation, string(fs), 0, "")
 	if err != nil {
-		if strings.Contains(string(err.Error()), "device or resource busy") {
-			return fmt.Errorf("device is already mounted")
-		} else {
-			return fmt.Errorf("attempt to mount returned error : %s ", err.Error())
-		}
+		return &VolumeError{Op: "mount", Path: deviceMapperLocation, Kind: syscallErrorKind(err), Err: err}
+	}
+
+	// the filesystem is already mounted, ctx no longer applies
+	if err = m.recordMount(context.Background(), deviceMapperLocation, mountLocation); err != nil {
+		// keep the registry in line with the mounts of the host
+		unix.Unmount(mountLocation, 0)
+		return err
 	}
 	return nil
 }
@@ -46,15 +87,80 @@ func Mount(deviceMapperLocation string, mountLocation string) error {
 //
 // mountLocation – Mount point location  where we want to unmount the device.
 func Unmount(mountLocation string) error {
+	return DefaultManager.Unmount(mountLocation)
+}
+
+// UnmountContext is used to detach the filesystem like Unmount. ctx bounds the wait for the
+// volume lock, the umount system call itself cannot be interrupted.
+func UnmountContext(ctx context.Context, mountLocation string) error {
+	return DefaultManager.UnmountContext(ctx, mountLocation)
+}
+
+// Unmount detaches the filesystem like the package level Unmount.
+func (m *Manager) Unmount(mountLocation string) error {
+	return m.UnmountContext(context.Background(), mountLocation)
+}
+
+// UnmountContext detaches the filesystem like the package level UnmountContext.
+func (m *Manager) UnmountContext(ctx context.Context, mountLocation string) error {
 	//input parameters validation
 	if len(strings.TrimSpace(mountLocation)) <= 0 {
 		return fmt.Errorf("unmount location not given")
 	}
 
+	unlock, err := m.lockVolume(ctx, "", "", mountLocation)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = ctx.Err(); err != nil {
+		return &VolumeError{Op: "unmount", Path: mountLocation, Err: err}
+	}
+
 	// call syscall to unmount the file system from the mount location
-	err := unix.Unmount(mountLocation, 0)
+	err = unix.Unmount(mountLocation, 0)
 	if err != nil {
-		return fmt.Errorf("attempt to unmount returned error : %s", err.Error())
+		kind := syscallErrorKind(err)
+		if err == unix.EINVAL {
+			// the mount location is not a mount point
+			kind = ErrNotFound
+		}
+		return &VolumeError{Op: "unmount", Path: mountLocation, Kind: kind, Err: err}
+	}
+
+	// the filesystem is already unmounted, ctx no longer applies
+	return m.recordUnmount(context.Background(), mountLocation)
+}
+
+// syscallErrorKind maps the errno returned by mount and umount to the matching sentinel error.
+func syscallErrorKind(err error) error {
+	switch err {
+	case unix.EBUSY:
+		return ErrBusy
+	case unix.ENOENT, unix.ENXIO, unix.ENODEV:
+		return ErrNotFound
 	}
 	return nil
 }
+
+// discardFile deallocates all the blocks of the file, keeping its size.
+func discardFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() == 0 {
+		return nil
+	}
+	if err = unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, fileInfo.Size()); err != nil {
+		return fmt.Errorf("error punching a hole in %s: %w", path, err)
+	}
+	return file.Sync()
+}
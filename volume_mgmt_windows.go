@@ -1,12 +1,15 @@
+//go:build windows
+
 /*
  * Copyright (C) 2019 Intel Corporation
  * SPDX-License-Identifier: BSD-3-Clause
  */
-// +build windows
-
 package vml
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 // WARNING : Product does not work on windows  - stub implementation only
 
@@ -26,6 +29,13 @@ func Mount(deviceMapperLocation string, mountLocation string) error {
 
 }
 
+// Mount attaches the filesystem like the package level Mount.
+func (m *Manager) Mount(deviceMapperLocation string, mountLocation string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}
+
 // Unmount method is used to detach the filesystem from the mount path.
 //
 // Input Parameter:
@@ -36,3 +46,44 @@ func Unmount(mountLocation string) error {
 	return fmt.Errorf("function not implemented on Windows")
 
 }
+
+// Unmount detaches the filesystem like the package level Unmount.
+func (m *Manager) Unmount(mountLocation string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}
+
+// MountContext is used to attach the filesystem like Mount.
+func MountContext(ctx context.Context, deviceMapperLocation string, mountLocation string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}
+
+// MountContext attaches the filesystem like the package level MountContext.
+func (m *Manager) MountContext(ctx context.Context, deviceMapperLocation string, mountLocation string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}
+
+// UnmountContext is used to detach the filesystem like Unmount.
+func UnmountContext(ctx context.Context, mountLocation string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}
+
+// UnmountContext detaches the filesystem like the package level UnmountContext.
+func (m *Manager) UnmountContext(ctx context.Context, mountLocation string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}
+
+func discardFile(path string) error {
+
+	return fmt.Errorf("function not implemented on Windows")
+
+}